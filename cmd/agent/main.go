@@ -7,10 +7,15 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/devize-ed/yapracproj-metrics.git/internal/agent"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/certs"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/config"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/diagnostics"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
 	"github.com/go-resty/resty/v2"
 )
 
@@ -48,13 +53,51 @@ func run() error {
 	// Log the agent start information.
 	logger.Infof("Agent config: %+v", cfg)
 
+	// Export the spans of the requests if an exporter is configured, flushing them on exit.
+	shutdownTracing, err := tracing.Setup(cfg.Trace, "metrics-agent")
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("failed to shut down tracing: %v", err)
+		}
+	}()
+
 	client := resty.New() // Initialize HTTP client.
+	// Use the CA bundle and the client certificate if TLS is configured.
+	tlsConfig, err := certs.ClientTLS(cfg.TLS)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %w", err)
+	}
+	if tlsConfig != nil {
+		client.SetTLSClientConfig(tlsConfig)
+	}
 
 	a := agent.NewAgent(client, cfg, logger) // Create a new agent instance.
+	// Sign the requests with the private key of the agent if it is set.
+	if cfg.Sign.PrivateKey != "" {
+		signer, err := sign.LoadSigner(cfg.Sign.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to load sign private key: %w", err)
+		}
+		a.WithSigner(signer)
+	}
 
 	// Create a context that listens for OS signals to shut down the agent.
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer stop()
+	// Serve the diagnostics endpoints to the debug token if they are enabled.
+	if cfg.Debug.Enabled {
+		handler := diagnostics.RequireToken(cfg.Debug.Token, diagnostics.NewHandler("metrics-agent"))
+		go func() {
+			if err := diagnostics.Serve(ctx, cfg.Debug.ListenAddress(), handler, logger); err != nil {
+				logger.Errorf("diagnostics server error: %v", err)
+			}
+		}()
+	}
 	// Start the agent to collect and report metrics.
 	if err := a.Run(ctx); err != nil {
 		return fmt.Errorf("failed to run agent: %w", err)
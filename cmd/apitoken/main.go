@@ -0,0 +1,158 @@
+// Command apitoken mints, revokes and lists the API tokens of the server.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	"github.com/spf13/pflag"
+)
+
+// Exit codes of the command.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// dbTimeout bounds the database operations of the command.
+const dbTimeout = 10 * time.Second
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// usage is printed for unknown commands.
+const usage = `usage: apitoken <command> [flags]
+
+commands:
+  mint    create a token; it is stored in the database with -d, otherwise its config entry is printed
+  revoke  revoke a token of the database
+  list    list the tokens of the database
+`
+
+// run executes the command of the arguments and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	fs := pflag.NewFlagSet("apitoken "+args[0], pflag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dsn := fs.StringP("dsn", "d", os.Getenv("DATABASE_DSN"), "database DSN (default: $DATABASE_DSN)")
+
+	switch args[0] {
+	case "mint":
+		id := fs.String("id", "", "name of the token")
+		scopes := fs.StringSlice("scope", nil, "granted scope: metrics:write, metrics:read or admin; repeat or separate with commas")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		return mint(*dsn, *id, *scopes, stdout, stderr)
+	case "revoke":
+		id := fs.String("id", "", "name of the token")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if *id == "" || *dsn == "" {
+			fmt.Fprintln(stderr, "--id and --dsn are required; tokens of the config are revoked by removing their entries")
+			return exitUsage
+		}
+		return withStore(*dsn, stderr, func(ctx context.Context, store *auth.DBStore) error {
+			if err := store.Revoke(ctx, *id); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "revoked %s\n", *id)
+			return nil
+		})
+	case "list":
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if *dsn == "" {
+			fmt.Fprintln(stderr, "--dsn is required")
+			return exitUsage
+		}
+		return withStore(*dsn, stderr, func(ctx context.Context, store *auth.DBStore) error {
+			tokens, err := store.List(ctx)
+			if err != nil {
+				return err
+			}
+			for _, t := range tokens {
+				status := "active"
+				if t.RevokedAt != nil {
+					status = "revoked " + t.RevokedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(stdout, "%s\t%s\tcreated %s\t%s\n",
+					t.ID, strings.Join(t.Scopes, ","), t.CreatedAt.Format(time.RFC3339), status)
+			}
+			return nil
+		})
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+}
+
+// mint generates a token and stores it in the database, or prints its entry for the JSON config.
+// The token itself is printed once and cannot be recovered from the stored hash.
+func mint(dsn, id string, scopes []string, stdout, stderr io.Writer) int {
+	if id == "" || len(scopes) == 0 {
+		fmt.Fprintln(stderr, "--id and at least one --scope are required")
+		return exitUsage
+	}
+	for _, scope := range scopes {
+		if !auth.ValidScope(scope) {
+			fmt.Fprintf(stderr, "unknown scope %q, use %s, %s or %s\n", scope, auth.ScopeWrite, auth.ScopeRead, auth.ScopeAdmin)
+			return exitUsage
+		}
+	}
+	token, hash, err := auth.Generate()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	if dsn == "" {
+		entry, err := json.Marshal(cfg.TokenConfig{ID: id, Hash: hash, Scopes: scopes})
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "token: %s\n", token)
+		fmt.Fprintf(stdout, "add to auth.tokens of the server config: %s\n", entry)
+		return exitOK
+	}
+	return withStore(dsn, stderr, func(ctx context.Context, store *auth.DBStore) error {
+		if _, err := store.Create(ctx, auth.Token{ID: id, Hash: hash, Scopes: scopes}); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "token: %s\n", token)
+		return nil
+	})
+}
+
+// withStore opens the token store of the database and runs f with it.
+func withStore(dsn string, stderr io.Writer, f func(ctx context.Context, store *auth.DBStore) error) int {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	store, err := auth.NewDBStore(ctx, dsn)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	defer store.Close()
+	if err := f(ctx, store); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	return exitOK
+}
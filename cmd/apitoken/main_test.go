@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	t.Setenv("DATABASE_DSN", "")
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantErr  string
+	}{
+		{name: "no_command", args: nil, wantCode: exitUsage, wantErr: "usage"},
+		{name: "unknown_command", args: []string{"rotate"}, wantCode: exitUsage, wantErr: `unknown command "rotate"`},
+		{name: "mint_without_scope", args: []string{"mint", "--id", "agent"}, wantCode: exitUsage, wantErr: "--scope"},
+		{name: "mint_unknown_scope", args: []string{"mint", "--id", "agent", "--scope", "metrics:delete"}, wantCode: exitUsage, wantErr: "unknown scope"},
+		{name: "revoke_without_dsn", args: []string{"revoke", "--id", "agent"}, wantCode: exitUsage, wantErr: "--dsn"},
+		{name: "list_without_dsn", args: []string{"list"}, wantCode: exitUsage, wantErr: "--dsn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, tt.wantCode, run(tt.args, &stdout, &stderr))
+			assert.Contains(t, stderr.String(), tt.wantErr)
+		})
+	}
+}
+
+func TestRun_MintConfigEntry(t *testing.T) {
+	t.Setenv("DATABASE_DSN", "")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"mint", "--id", "agent", "--scope", "metrics:write,metrics:read"}, &stdout, &stderr)
+	require.Equal(t, exitOK, code, stderr.String())
+
+	match := regexp.MustCompile(`(?m)^token: (\S+)\nadd to auth.tokens of the server config: (\{.*\})$`).FindStringSubmatch(stdout.String())
+	require.NotNil(t, match, stdout.String())
+	var entry cfg.TokenConfig
+	require.NoError(t, json.Unmarshal([]byte(match[2]), &entry))
+	assert.Equal(t, []string{auth.ScopeWrite, auth.ScopeRead}, entry.Scopes)
+
+	// The printed entry authenticates the printed token.
+	store, err := auth.NewStaticStore([]cfg.TokenConfig{entry})
+	require.NoError(t, err)
+	token, err := auth.NewAuthenticator(store).Authenticate(context.Background(), match[1])
+	require.NoError(t, err)
+	assert.Equal(t, "agent", token.ID)
+}
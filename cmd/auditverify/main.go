@@ -0,0 +1,86 @@
+// Command auditverify verifies the hash chain of an audit file written by the server.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/spf13/pflag"
+)
+
+// Exit codes of the command.
+const (
+	exitOK     = 0
+	exitBroken = 1
+	exitError  = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run verifies the audit files given by the arguments and returns the exit code.
+// Several files are verified as consecutive segments of one chain, gzipped segments are decompressed.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := pflag.NewFlagSet("auditverify", pflag.ContinueOnError)
+	fs.SetOutput(stderr)
+	paths := fs.StringArrayP("file", "f", nil, "path to the audit file or segment, repeat for consecutive segments")
+	key := fs.StringP("key", "k", os.Getenv("AUDIT_CHAIN_KEY"), "HMAC key of the hash chain (default: $AUDIT_CHAIN_KEY)")
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	files := append(*paths, fs.Args()...)
+	if len(files) == 0 {
+		fmt.Fprintln(stderr, "audit file is required")
+		fs.PrintDefaults()
+		return exitError
+	}
+
+	var prev *audit.ChainReport
+	for _, path := range files {
+		report, err := verifyFile(path, *key)
+		var chainErr *audit.ChainError
+		switch {
+		case errors.As(err, &chainErr):
+			fmt.Fprintf(stdout, "%s: %v\n", path, chainErr)
+			fmt.Fprintf(stdout, "%d entries before the broken link are valid\n", report.Entries)
+			return exitBroken
+		case err != nil:
+			fmt.Fprintf(stderr, "%s: %v\n", path, err)
+			return exitError
+		}
+
+		// A segment must continue the chain of the previous one.
+		first := prev == nil
+		if prev != nil && report.Entries > 0 && (report.FirstPrev != prev.Head || report.FirstSeq != prev.LastSeq+1) {
+			fmt.Fprintf(stdout, "%s: does not continue the chain of the previous file (seq %d, head %s)\n", path, prev.LastSeq, prev.Head)
+			return exitBroken
+		}
+		if report.Entries > 0 {
+			prev = &report
+		}
+
+		fmt.Fprintf(stdout, "%s: OK, %d records, %d checkpoints, seq %d-%d, head %s\n",
+			path, report.Records, report.Checkpoints, report.FirstSeq, report.LastSeq, report.Head)
+		if report.FirstPrev != "" && first {
+			fmt.Fprintf(stdout, "the chain continues from hash %s\n", report.FirstPrev)
+		}
+		if report.Unanchored > 0 {
+			fmt.Fprintf(stdout, "%d records after the last checkpoint\n", report.Unanchored)
+		}
+	}
+	return exitOK
+}
+
+// verifyFile verifies the chain of the audit file or segment.
+func verifyFile(path, key string) (audit.ChainReport, error) {
+	r, err := audit.OpenSegment(path)
+	if err != nil {
+		return audit.ChainReport{}, fmt.Errorf("open audit file: %w", err)
+	}
+	defer r.Close()
+	return audit.VerifyChain(r, key)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeAuditFile writes a chain of the records and a checkpoint, the tamper function may modify the lines.
+func writeAuditFile(t *testing.T, key string, tamper func(lines []string)) string {
+	t.Helper()
+	chain := audit.NewChain(key)
+	var lines []string
+	add := func(entry audit.ChainEntry, err error) {
+		require.NoError(t, err)
+		lines = append(lines, string(entry.Line))
+	}
+	for _, metric := range []string{"Alloc", "PollCount"} {
+		add(chain.Append(audit.AuditMsg{TimeStamp: time.Now(), Addr: "127.0.0.1", Metrics: []string{metric}}))
+	}
+	add(chain.Checkpoint(time.Now()))
+	add(chain.Append(audit.AuditMsg{TimeStamp: time.Now(), Addr: "127.0.0.1", Metrics: []string{"RandomValue"}}))
+	if tamper != nil {
+		tamper(lines)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.json")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+	return path
+}
+
+// writeSegments writes the records with the file auditor rotating after every record,
+// and returns the gzipped segments and the current file in the chain order.
+func writeSegments(t *testing.T, key string, metrics ...string) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan audit.AuditMsg, len(metrics))
+	for _, metric := range metrics {
+		ch <- audit.AuditMsg{Metrics: []string{metric}}
+	}
+	cancel()
+	audit.RunFileAudit(ctx, ch, path, audit.FileOptions{ChainKey: key, MaxSize: 1}, zap.NewNop().Sugar())
+
+	segments, err := filepath.Glob(path + ".*.gz")
+	require.NoError(t, err)
+	require.Len(t, segments, len(metrics))
+	return append(segments, path)
+}
+
+func TestRun(t *testing.T) {
+	key := "chain_key"
+	tests := []struct {
+		name     string
+		args     func(t *testing.T) []string
+		wantCode int
+		wantOut  []string
+	}{
+		{
+			name:     "valid_chain",
+			args:     func(t *testing.T) []string { return []string{"-f", writeAuditFile(t, key, nil), "-k", key} },
+			wantCode: exitOK,
+			wantOut:  []string{"OK, 3 records, 1 checkpoints, seq 1-4", "1 records after the last checkpoint"},
+		},
+		{
+			name: "modified_record",
+			args: func(t *testing.T) []string {
+				path := writeAuditFile(t, key, func(lines []string) {
+					lines[1] = strings.Replace(lines[1], "PollCount", "PollCounter", 1)
+				})
+				return []string{"-f", path, "-k", key}
+			},
+			wantCode: exitBroken,
+			wantOut:  []string{"broken audit chain at line 2 (seq 2): hash mismatch", "1 entries before the broken link are valid"},
+		},
+		{
+			name:     "wrong_key",
+			args:     func(t *testing.T) []string { return []string{"-f", writeAuditFile(t, key, nil), "-k", "other"} },
+			wantCode: exitBroken,
+			wantOut:  []string{"broken audit chain at line 1"},
+		},
+		{
+			name: "segments",
+			args: func(t *testing.T) []string {
+				return append([]string{"-k", key}, writeSegments(t, key, "m1", "m2", "m3")...)
+			},
+			wantCode: exitOK,
+			wantOut:  []string{".gz: OK, 1 records, 1 checkpoints, seq 5-6"},
+		},
+		{
+			name: "missing_segment",
+			args: func(t *testing.T) []string {
+				segments := writeSegments(t, key, "m1", "m2", "m3")
+				return append([]string{"-k", key, segments[0]}, segments[2:]...)
+			},
+			wantCode: exitBroken,
+			wantOut:  []string{"does not continue the chain of the previous file (seq 2"},
+		},
+		{
+			name:     "missing_file_flag",
+			args:     func(t *testing.T) []string { return nil },
+			wantCode: exitError,
+		},
+		{
+			name:     "missing_file",
+			args:     func(t *testing.T) []string { return []string{"-f", filepath.Join(t.TempDir(), "none.json")} },
+			wantCode: exitError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args(t), &stdout, &stderr)
+			assert.Equal(t, tt.wantCode, code, stderr.String()+stdout.String())
+			for _, want := range tt.wantOut {
+				assert.Contains(t, stdout.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+// Command keytool generates and inspects the keys of the server and the agent.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/encryption"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/sign/config"
+	"github.com/spf13/pflag"
+)
+
+// Exit codes of the command.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// defaultSecretSize is the size of the generated HMAC keys in bytes.
+const defaultSecretSize = 32
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// usage is printed for unknown commands.
+const usage = `usage: keytool <command> [flags]
+
+commands:
+  rsa      generate the RSA key pair of CRYPTO_KEY: <out>.key for the server, <out>.pem for the agent
+  ed25519  generate the key pair of an agent: <out>.key for SIGN_PRIVATE_KEY, <out>.pem for SIGN_AGENT_KEYS_DIR
+  hmac     generate an HMAC key for KEY, or an entry of sign.keys with --id
+  inspect  describe a key file and the settings accepting it; with --for check it the way the server and agent load it
+`
+
+// keyUse is a setting reading a key file.
+type keyUse struct {
+	setting string                  // setting and program reading the key
+	load    func(path string) error // loader of the program
+}
+
+// keyUses are the settings reading key files, by the names of the --for flag.
+var keyUses = map[string]keyUse{
+	"crypto-private": {setting: "CRYPTO_KEY of the server", load: func(path string) error {
+		_, err := encryption.NewDecryptor(path)
+		return err
+	}},
+	"crypto-public": {setting: "CRYPTO_KEY of the agent", load: func(path string) error {
+		_, err := encryption.NewEncryptor(path)
+		return err
+	}},
+	"sign-private": {setting: "SIGN_PRIVATE_KEY of the agent", load: func(path string) error {
+		_, err := sign.LoadSigner(path)
+		return err
+	}},
+	"sign-public": {setting: "SIGN_AGENT_KEYS_DIR/<agent ID>.pem of the server", load: func(path string) error {
+		_, err := sign.LoadAgentKey(path)
+		return err
+	}},
+}
+
+// run executes the command of the arguments and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	fs := pflag.NewFlagSet("keytool "+args[0], pflag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	switch args[0] {
+	case "rsa":
+		out := fs.StringP("out", "o", "", "base name of the key files, <out>.key and <out>.pem")
+		bits := fs.Int("bits", encryption.DefaultKeyBits, "size of the key in bits, at least 2048")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if *out == "" {
+			fmt.Fprintln(stderr, "--out is required")
+			return exitUsage
+		}
+		priv, pub, err := encryption.GenerateKeyPair(*bits)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		if err := writeKeyPair(*out, priv, pub); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "private key: %s.key, set as CRYPTO_KEY of the server\n", *out)
+		fmt.Fprintf(stdout, "public key: %s.pem, set as CRYPTO_KEY of the agents\n", *out)
+		fmt.Fprintf(stdout, "the agents encrypt request bodies up to %d bytes\n", encryption.MaxMessageSize(*bits))
+		return exitOK
+	case "ed25519":
+		out := fs.StringP("out", "o", "", "base name of the key files, the ID of the agent: <out>.key and <out>.pem")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if *out == "" {
+			fmt.Fprintln(stderr, "--out is required")
+			return exitUsage
+		}
+		priv, pub, err := sign.GenerateAgentKey()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if err := writeKeyPair(*out, priv, pub); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "private key: %s.key, set as SIGN_PRIVATE_KEY of the agent\n", *out)
+		fmt.Fprintf(stdout, "public key: %s.pem, copy to SIGN_AGENT_KEYS_DIR of the server; the file name is the AGENT_ID\n", *out)
+		return exitOK
+	case "hmac":
+		size := fs.Int("bytes", defaultSecretSize, "size of the key in bytes, at least 16")
+		id := fs.String("id", "", "ID of the key, prints its entry of sign.keys")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		secret, err := sign.NewSecret(*size)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		if *id == "" {
+			fmt.Fprintln(stdout, secret)
+			return exitOK
+		}
+		entry, err := json.Marshal(cfg.KeyConfig{ID: *id, Key: secret})
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "key: %s\n", secret)
+		fmt.Fprintf(stdout, "add to sign.keys of the server config: %s\n", entry)
+		fmt.Fprintf(stdout, "set on the agents: KEY=%s KEY_ID=%s\n", secret, *id)
+		return exitOK
+	case "inspect":
+		use := fs.String("for", "", "check the key for a setting: "+strings.Join(useNames(), ", "))
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprintln(stderr, "exactly one key file is required")
+			return exitUsage
+		}
+		if _, ok := keyUses[*use]; *use != "" && !ok {
+			fmt.Fprintf(stderr, "unknown --for %q, use %s\n", *use, strings.Join(useNames(), ", "))
+			return exitUsage
+		}
+		return inspect(fs.Arg(0), *use, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+}
+
+// inspect prints the format of the key file and the settings accepting it.
+// With a use it also loads the key the way the setting does, and fails if it is rejected.
+func inspect(path, use string, stdout, stderr io.Writer) int {
+	info, err := describe(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "format: %s\n", info.format)
+	fmt.Fprintf(stdout, "algorithm: %s\n", info.algorithm)
+	if info.note != "" {
+		fmt.Fprintf(stdout, "note: %s\n", info.note)
+	}
+	for _, u := range info.uses {
+		fmt.Fprintf(stdout, "accepted as: %s\n", keyUses[u].setting)
+	}
+	if use == "" {
+		return exitOK
+	}
+
+	if !slices.Contains(info.uses, use) {
+		fmt.Fprintf(stderr, "%s: %s (%s) is not accepted as %s\n", path, info.format, info.algorithm, keyUses[use].setting)
+		return exitError
+	}
+	if err := keyUses[use].load(path); err != nil {
+		fmt.Fprintf(stderr, "%s: rejected as %s: %v\n", path, keyUses[use].setting, err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "ok: valid %s\n", keyUses[use].setting)
+	return exitOK
+}
+
+// keyInfo describes a key file.
+type keyInfo struct {
+	format    string   // encoding of the key
+	algorithm string   // algorithm and size of the key
+	uses      []string // names of the settings accepting the key
+	note      string   // limits of the key, if any
+}
+
+// describe reads the first PEM block of the file and tells which settings accept it.
+// The errors of the formats produced by the usual openssl commands name the command converting them.
+func describe(path string) (keyInfo, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return keyInfo{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return keyInfo{}, errors.New("no PEM block, the keys are PEM files starting with -----BEGIN")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return keyInfo{}, fmt.Errorf("invalid PKCS#8 private key: %w", err)
+		}
+		info := keyInfo{format: "PKCS#8 private key"}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			info.algorithm, info.note = rsaAlgorithm(k.N.BitLen())
+			info.uses = []string{"crypto-private"}
+		case ed25519.PrivateKey:
+			info.algorithm = "Ed25519"
+			info.uses = []string{"sign-private"}
+		case *ecdsa.PrivateKey:
+			info.algorithm = "ECDSA " + k.Curve.Params().Name
+			info.uses = []string{"sign-private"}
+		default:
+			return keyInfo{}, fmt.Errorf("unsupported private key type %T, use RSA, Ed25519 or ECDSA", key)
+		}
+		return info, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return keyInfo{}, fmt.Errorf("invalid PKIX public key: %w", err)
+		}
+		info := keyInfo{format: "PKIX public key"}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			info.algorithm, info.note = rsaAlgorithm(k.N.BitLen())
+			info.uses = []string{"crypto-public"}
+		case ed25519.PublicKey:
+			info.algorithm = "Ed25519"
+			info.uses = []string{"sign-public"}
+		case *ecdsa.PublicKey:
+			info.algorithm = "ECDSA " + k.Curve.Params().Name
+			info.uses = []string{"sign-public"}
+		default:
+			return keyInfo{}, fmt.Errorf("unsupported public key type %T, use RSA, Ed25519 or ECDSA", key)
+		}
+		return info, nil
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY":
+		return keyInfo{}, fmt.Errorf("%s is a PKCS#1 or SEC 1 key, PKCS#8 is expected: convert it with "+
+			"openssl pkcs8 -topk8 -nocrypt -in %s -out key.pem", block.Type, path)
+	case "RSA PUBLIC KEY":
+		return keyInfo{}, fmt.Errorf("RSA PUBLIC KEY is a PKCS#1 key, PKIX is expected: convert it with "+
+			"openssl rsa -RSAPublicKey_in -pubout -in %s -out key.pem", path)
+	case "ENCRYPTED PRIVATE KEY":
+		return keyInfo{}, fmt.Errorf("the private key is encrypted, the server and the agent read unencrypted keys: decrypt it with "+
+			"openssl pkcs8 -in %s -out key.pem", path)
+	case "CERTIFICATE":
+		return keyInfo{}, errors.New("a certificate, not a key: it is set as TLS_CERT_FILE, TLS_CA_FILE or TLS_CLIENT_CA_FILE")
+	default:
+		return keyInfo{}, fmt.Errorf("unsupported PEM block %q, PRIVATE KEY or PUBLIC KEY is expected", block.Type)
+	}
+}
+
+// rsaAlgorithm describes an RSA key and the largest request body it encrypts.
+func rsaAlgorithm(bits int) (algorithm, note string) {
+	return fmt.Sprintf("RSA %d bits", bits), fmt.Sprintf("encrypts request bodies up to %d bytes", encryption.MaxMessageSize(bits))
+}
+
+// writeKeyPair writes the private key to <out>.key and the public key to <out>.pem, the existing files are kept.
+func writeKeyPair(out string, privatePEM, publicPEM []byte) error {
+	for _, path := range []string{out + ".key", out + ".pem"} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, remove it or choose another --out", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.WriteFile(out+".key", privatePEM, 0600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	if err := os.WriteFile(out+".pem", publicPEM, 0644); err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+	return nil
+}
+
+// useNames returns the sorted names of the --for flag.
+func useNames() []string {
+	return slices.Sorted(maps.Keys(keyUses))
+}
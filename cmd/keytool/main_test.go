@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/encryption"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/sign/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantErr  string
+	}{
+		{name: "no_command", args: nil, wantCode: exitUsage, wantErr: "usage"},
+		{name: "unknown_command", args: []string{"dsa"}, wantCode: exitUsage, wantErr: `unknown command "dsa"`},
+		{name: "rsa_without_out", args: []string{"rsa"}, wantCode: exitUsage, wantErr: "--out"},
+		{name: "rsa_too_small", args: []string{"rsa", "-o", "key", "--bits", "1024"}, wantCode: exitUsage, wantErr: "at least 2048 bits"},
+		{name: "ed25519_without_out", args: []string{"ed25519"}, wantCode: exitUsage, wantErr: "--out"},
+		{name: "hmac_too_small", args: []string{"hmac", "--bytes", "8"}, wantCode: exitUsage, wantErr: "at least 16 bytes"},
+		{name: "inspect_without_file", args: []string{"inspect"}, wantCode: exitUsage, wantErr: "one key file"},
+		{name: "inspect_unknown_use", args: []string{"inspect", "--for", "tls", "key.pem"}, wantCode: exitUsage, wantErr: `unknown --for "tls"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, tt.wantCode, run(tt.args, &stdout, &stderr))
+			assert.Contains(t, stderr.String(), tt.wantErr)
+		})
+	}
+}
+
+func TestRun_RSA(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "crypto")
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, exitOK, run([]string{"rsa", "-o", out, "--bits", "2048"}, &stdout, &stderr), stderr.String())
+	assert.Contains(t, stdout.String(), "up to 190 bytes")
+
+	// The generated pair is read by the encryption of the agent and the server.
+	encryptor, err := encryption.NewEncryptor(out + ".pem")
+	require.NoError(t, err)
+	decryptor, err := encryption.NewDecryptor(out + ".key")
+	require.NoError(t, err)
+	ciphertext, err := encryptor.Encrypt([]byte("metrics"))
+	require.NoError(t, err)
+	plaintext, err := decryptor.Decrypt(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "metrics", string(plaintext))
+
+	info, err := os.Stat(out + ".key")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The existing keys are not overwritten.
+	stderr.Reset()
+	assert.Equal(t, exitError, run([]string{"rsa", "-o", out, "--bits", "2048"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "already exists")
+}
+
+func TestRun_Ed25519(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, exitOK, run([]string{"ed25519", "-o", filepath.Join(dir, "host-01")}, &stdout, &stderr), stderr.String())
+
+	// The public key is registered by its file name, the private key signs the requests of the agent.
+	signer, err := sign.LoadSigner(filepath.Join(dir, "host-01.key"))
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(filepath.Join(dir, "host-01.key"), filepath.Join(t.TempDir(), "host-01.key")))
+	agents, err := sign.LoadAgentKeys(dir)
+	require.NoError(t, err)
+	signature, err := signer.Sign([]byte("request"))
+	require.NoError(t, err)
+	assert.NoError(t, agents.Verify("host-01", []byte("request"), signature))
+}
+
+func TestRun_HMAC(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, exitOK, run([]string{"hmac"}, &stdout, &stderr), stderr.String())
+	assert.Regexp(t, `^[0-9a-f]{64}\n$`, stdout.String())
+
+	stdout.Reset()
+	require.Equal(t, exitOK, run([]string{"hmac", "--id", "2026-11"}, &stdout, &stderr), stderr.String())
+	match := regexp.MustCompile(`(?m)^add to sign.keys of the server config: (\{.*\})$`).FindStringSubmatch(stdout.String())
+	require.NotNil(t, match, stdout.String())
+	var entry cfg.KeyConfig
+	require.NoError(t, json.Unmarshal([]byte(match[1]), &entry))
+	assert.Equal(t, "2026-11", entry.ID)
+	assert.Len(t, entry.Key, 64)
+}
+
+func TestRun_Inspect(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, exitOK, run([]string{"rsa", "-o", filepath.Join(dir, "crypto"), "--bits", "2048"}, &stdout, &stderr))
+	require.Equal(t, exitOK, run([]string{"ed25519", "-o", filepath.Join(dir, "agent")}, &stdout, &stderr))
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs1 := write("pkcs1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	cert := write("cert.pem", "CERTIFICATE", []byte("not parsed"))
+	garbage := filepath.Join(dir, "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("secret"), 0600))
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+		wantErr  string
+	}{
+		{name: "rsa_private", args: []string{filepath.Join(dir, "crypto.key")}, wantOut: "accepted as: CRYPTO_KEY of the server"},
+		{name: "rsa_public", args: []string{"--for", "crypto-public", filepath.Join(dir, "crypto.pem")}, wantOut: "ok: valid CRYPTO_KEY of the agent"},
+		{name: "agent_private", args: []string{"--for", "sign-private", filepath.Join(dir, "agent.key")}, wantOut: "algorithm: Ed25519"},
+		{name: "agent_public", args: []string{"--for", "sign-public", filepath.Join(dir, "agent.pem")}, wantOut: "ok: valid SIGN_AGENT_KEYS_DIR"},
+		{
+			name:     "wrong_use",
+			args:     []string{"--for", "crypto-private", filepath.Join(dir, "agent.key")},
+			wantCode: exitError,
+			wantErr:  "PKCS#8 private key (Ed25519) is not accepted as CRYPTO_KEY of the server",
+		},
+		{name: "pkcs1", args: []string{pkcs1}, wantCode: exitError, wantErr: "openssl pkcs8 -topk8 -nocrypt"},
+		{name: "certificate", args: []string{cert}, wantCode: exitError, wantErr: "a certificate, not a key"},
+		{name: "not_pem", args: []string{garbage}, wantCode: exitError, wantErr: "no PEM block"},
+		{name: "missing", args: []string{filepath.Join(dir, "missing.pem")}, wantCode: exitError, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, tt.wantCode, run(append([]string{"inspect"}, tt.args...), &stdout, &stderr), stderr.String())
+			assert.Contains(t, stdout.String(), tt.wantOut)
+			assert.Contains(t, stderr.String(), tt.wantErr)
+		})
+	}
+}
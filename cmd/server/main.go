@@ -6,14 +6,24 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/alert"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	auditcfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/config"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/diagnostics"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/handler"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/server"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/statsd"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
 )
 
 var (
@@ -47,6 +57,19 @@ func run() error {
 		}
 	}()
 
+	// Export the spans of the requests if an exporter is configured, flushing them on exit
+	shutdownTracing, err := tracing.Setup(cfg.Trace, "metrics-server")
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("failed to shut down tracing: %v", err)
+		}
+	}()
+
 	// Initialize the repository based on the configuration
 	repository, err := repository.NewRepository(context.Background(), cfg.Repository, logger)
 	if err != nil {
@@ -65,13 +88,139 @@ func run() error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer stop()
 
+	// the postgres audit sinks write to the metrics database unless another DSN is set
+	for i := range cfg.Audit.Sinks {
+		if cfg.Audit.Sinks[i].Type == auditcfg.SinkPostgres && cfg.Audit.Sinks[i].DSN == "" {
+			cfg.Audit.Sinks[i].DSN = cfg.Repository.DBConfig.DatabaseDSN
+		}
+	}
+	// load the public keys of the agents signing their requests
+	var agents *sign.AgentKeys
+	if cfg.Sign.AgentKeysDir != "" {
+		var err error
+		if agents, err = sign.LoadAgentKeys(cfg.Sign.AgentKeysDir); err != nil {
+			return fmt.Errorf("failed to load agent keys: %w", err)
+		}
+		logger.Infof("loaded the public keys of %d agents", agents.Len())
+	}
 	// create a new auditor with the logger
-	auditor := audit.NewAuditor(logger, cfg.Audit.AuditFile, cfg.Audit.AuditURL)
+	auditor := audit.NewAuditorWithConfig(logger, cfg.Audit)
 	// start the auditor
 	go auditor.Run(ctx)
+	// reopen the audit file on SIGHUP, after it was moved by logrotate, and reload the agent keys
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Info("reopening the audit file")
+				auditor.Reopen()
+				if agents != nil {
+					if err := agents.Reload(); err != nil {
+						logger.Errorf("failed to reload agent keys, keeping the loaded ones: %v", err)
+					} else {
+						logger.Infof("reloaded the public keys of %d agents", agents.Len())
+					}
+				}
+			}
+		}
+	}()
+
+	// start the StatsD listener if the address is set, wait for its final flush before closing the repository;
+	// the goroutines stop on the context, so it is cancelled first, otherwise an error return would wait forever
+	var wg sync.WaitGroup
+	defer func() {
+		stop()
+		wg.Wait()
+	}()
+	if cfg.StatsD.Address != "" {
+		listener := statsd.NewListener(cfg.StatsD, repository, auditor, logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := listener.Run(ctx); err != nil {
+				logger.Errorf("StatsD listener error: %v", err)
+			}
+		}()
+	}
+
+	// start the alerting engine if there are alert rules
+	if len(cfg.Alert.Rules) > 0 {
+		rules, err := alert.ParseRules(cfg.Alert.Rules)
+		if err != nil {
+			return fmt.Errorf("failed to parse alert rules: %w", err)
+		}
+		notifications := make(chan alert.Notification)
+		engine := alert.NewEngine(rules, repository, time.Duration(cfg.Alert.EvalInterval)*time.Second, logger)
+		go alert.NewDispatcher(cfg.Alert.Webhooks, logger).Run(ctx, notifications)
+		go engine.Run(ctx, notifications)
+	}
+
+	// load the API tokens of the config and of the database if auth is enabled
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled {
+		static, err := auth.NewStaticStore(cfg.Auth.Tokens)
+		if err != nil {
+			return fmt.Errorf("failed to load API tokens: %w", err)
+		}
+		stores := []auth.Store{static}
+		if cfg.Repository.DBConfig.DatabaseDSN != "" {
+			tokens, err := auth.NewDBStore(ctx, cfg.Repository.DBConfig.DatabaseDSN)
+			if err != nil {
+				return fmt.Errorf("failed to open API token store: %w", err)
+			}
+			defer tokens.Close()
+			stores = append(stores, tokens)
+		}
+		authenticator = auth.NewAuthenticator(stores...)
+	}
+
+	// load the sign keys, the key of KEY and the key ring of the config
+	keys, err := sign.KeyRingFromConfig(cfg.Sign)
+	if err != nil {
+		return fmt.Errorf("failed to load sign keys: %w", err)
+	}
+	if !cfg.Sign.Required && (!keys.Empty() || agents != nil) {
+		logger.Info("unsigned and legacy HMAC POST requests are accepted without replay protection and counted in the self-metrics, set SIGN_REQUIRED to reject them")
+	}
+
+	// collect the self-metrics of the requests, the repository and the auditor, and save them to the repository if the interval is set
+	collectors := []selfmetrics.Collector{auditor}
+	if c, ok := repository.(selfmetrics.Collector); ok {
+		collectors = append(collectors, c)
+	}
+	selfMetrics := selfmetrics.NewRegistry(collectors...)
+	if cfg.SelfMetrics.IngestInterval > 0 {
+		ingester := selfmetrics.NewIngester(selfMetrics, repository, time.Duration(cfg.SelfMetrics.IngestInterval)*time.Second, logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ingester.Run(ctx); err != nil {
+				logger.Errorf("self-metrics ingester error: %v", err)
+			}
+		}()
+	}
 
 	// create a new HTTP server with the configuration and handler
-	h := handler.NewHandler(repository, cfg.Sign.Key, auditor, logger)
+	h := handler.NewHandler(repository, cfg.Sign.Key, auditor, logger).
+		WithAuthenticator(authenticator).
+		WithKeyRing(keys).
+		WithReplayGuard(sign.NewReplayGuard(time.Duration(cfg.Sign.ReplayWindow)*time.Second, cfg.Sign.NonceCacheSize)).
+		WithAgentKeys(agents).
+		WithSignRequired(cfg.Sign.Required).
+		WithLimits(cfg.Limit).
+		WithSelfMetrics(selfMetrics).
+		WithAccessLogSampling(cfg.AccessLog.Sampling)
+	// serve the diagnostics endpoints to the admin API tokens if they are enabled
+	if cfg.Debug.Enabled {
+		h.WithDiagnostics(diagnostics.NewHandler("metrics-server"))
+	}
+	// start the background tasks of the handler
+	go h.Run(ctx)
 	srv := server.NewServer(cfg, h, logger)
 
 	if err = srv.Serve(ctx); err != nil {
@@ -9,25 +9,49 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/devize-ed/yapracproj-metrics.git/internal/config"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/encryption"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
 	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 const batchSize = 10
 
+var (
+	// ErrResponseSignature is returned when the hash of a response does not match its body.
+	ErrResponseSignature = errors.New("invalid response signature")
+	// ErrServerBusy is returned when the limits of the server still reject the request after the retries.
+	ErrServerBusy = errors.New("server is busy")
+	// ErrRequestRejected is returned when the server answers with another error status.
+	ErrRequestRejected = errors.New("request rejected")
+)
+
+// maxRetryWait bounds the wait before a retry, the Retry-After of the server included.
+const maxRetryWait = 30 * time.Second
+
 // Agent holds the HTTP client, metric storage, and configuration.
 type Agent struct {
 	client  *resty.Client
 	storage *AgentStorage
 	config  config.AgentConfig
+	signer  *sign.Signer // private key signing the requests, nil when disabled
 	logger  *zap.SugaredLogger
 }
 
@@ -53,6 +77,12 @@ func NewAgent(client *resty.Client, config config.AgentConfig, logger *zap.Sugar
 	}
 }
 
+// WithSigner makes the agent sign its requests with the private key of the signer.
+func (a *Agent) WithSigner(signer *sign.Signer) *Agent {
+	a.signer = signer
+	return a
+}
+
 // NewJobs creates a new jobs queue with the specified number of workers.
 func NewJobs(numWorkers int, logger *zap.SugaredLogger) *jobs {
 	return &jobs{
@@ -117,7 +147,7 @@ func (a *Agent) sendMetrics() error {
 
 		// Send metrics as a batch to the server.
 		metrics := a.loadMetrics()
-		if err := jobs.sendMetricsBatch(a.config.Connection.Host, metrics, a.logger); err != nil {
+		if err := jobs.sendMetricsBatch(a.serverURL(), metrics, a.logger); err != nil {
 			return fmt.Errorf("error sending batch metrics: %w", err)
 		}
 		// Close the jobs queue after pushing all metrics.
@@ -149,12 +179,12 @@ func (a *Agent) sendMetrics() error {
 		a.storage.mu.RUnlock()
 		// Get the metrics from the server.
 		for name, val := range tmpCounters {
-			if err := getMetric(a.request, a.config.Connection.Host, name, val); err != nil {
+			if err := getMetric(a.request, a.serverURL(), name, val); err != nil {
 				return fmt.Errorf("error getting %s: %w", name, err)
 			}
 		}
 		for name, val := range tmpGauges {
-			if err := getMetric(a.request, a.config.Connection.Host, name, val); err != nil {
+			if err := getMetric(a.request, a.serverURL(), name, val); err != nil {
 				return fmt.Errorf("error getting %s: %w", name, err)
 			}
 		}
@@ -190,15 +220,28 @@ func (a *Agent) loadMetrics() []models.Metrics {
 	return metrics
 }
 
+// serverURL returns the base URL of the server.
+// An address with a scheme is used as is, otherwise the scheme is https if TLS is configured and http if not.
+func (a *Agent) serverURL() string {
+	host := a.config.Connection.Host
+	if strings.Contains(host, "://") {
+		return strings.TrimSuffix(host, "/")
+	}
+	if a.config.TLS.Enabled() {
+		return "https://" + host
+	}
+	return "http://" + host
+}
+
 // SendMetricsBatch sends a batch of metrics to the server.
-func (j *jobs) sendMetricsBatch(host string, metrics []models.Metrics, logger *zap.SugaredLogger) error {
+func (j *jobs) sendMetricsBatch(baseURL string, metrics []models.Metrics, logger *zap.SugaredLogger) error {
 	// Нужно разделить metrics на батчи по N метрик (const) и отправить в jobsQueue
 	for i := 0; i < len(metrics); i += batchSize {
 		batch := metrics[i:min(i+batchSize, len(metrics))]
 
-		logger.Debugf("Sending metrics batch to %s", host)
+		logger.Debugf("Sending metrics batch to %s", baseURL)
 
-		endpoint := fmt.Sprintf("http://%s/updates/", host)
+		endpoint := baseURL + "/updates/"
 
 		// Marshal the body to JSON.
 		bodyBytes, err := json.Marshal(batch)
@@ -217,8 +260,8 @@ func (j *jobs) sendMetricsBatch(host string, metrics []models.Metrics, logger *z
 }
 
 // GetMetric requests a metric from the server for testing purposes.
-func getMetric[T MetricValue](request func(name string, endpoint string, bodyBytes []byte) error, host, metric string, value T) error {
-	endpoint := fmt.Sprintf("http://%s/value/", host)
+func getMetric[T MetricValue](request func(name string, endpoint string, bodyBytes []byte) error, baseURL, metric string, value T) error {
+	endpoint := baseURL + "/value/"
 
 	body := models.Metrics{
 		ID: metric,
@@ -247,12 +290,32 @@ func getMetric[T MetricValue](request func(name string, endpoint string, bodyByt
 }
 
 // request sends an HTTP request to the specified endpoint.
+// The request runs in a client span, its trace context is sent to the server in the traceparent header.
+// Every request gets its own ID, kept across the retries, so that the logs of the agent and the server can be matched.
 func (a *Agent) request(name string, endpoint string, bodyBytes []byte) error {
-	a.logger.Debugf("Request: %s %s", name, endpoint)
+	id := logger.NewRequestID()
+	ctx, span := tracing.Start(context.Background(), "agent.request", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("agent.request", name), attribute.String("url.full", endpoint),
+			attribute.String("http.request.id", id)))
+	err := a.post(logger.WithRequest(ctx, a.logger, id), name, endpoint, bodyBytes)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("request %s: %w", id, err)
+	}
+	return nil
+}
+
+// post builds, signs and sends the request, and verifies the response.
+func (a *Agent) post(ctx context.Context, name string, endpoint string, bodyBytes []byte) error {
+	log := logger.FromContext(ctx, a.logger)
+	log.Debugf("Request: %s %s", name, endpoint)
 
 	// Create a new request.
 	req := a.client.R().
-		SetHeader("Content-Type", "application/json")
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(logger.RequestIDHeader, logger.RequestID(ctx))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	var (
 		body []byte
@@ -262,11 +325,13 @@ func (a *Agent) request(name string, endpoint string, bodyBytes []byte) error {
 	if a.config.Agent.EnableGzip {
 		req.SetHeader("Content-Encoding", "gzip").
 			SetHeader("Accept-Encoding", "gzip")
-		body, err = compress(bodyBytes, a.logger)
+		body, err = compress(bodyBytes, log)
 		if err != nil {
 			return fmt.Errorf("failed to compress request body: %w", err)
 		}
 	} else {
+		// Ask for the response as is, so that the transport does not decompress it before its hash is checked.
+		req.SetHeader("Accept-Encoding", "identity")
 		body = bodyBytes
 	}
 
@@ -283,26 +348,84 @@ func (a *Agent) request(name string, endpoint string, bodyBytes []byte) error {
 		req.SetHeader("Content-Type", "application/octet-stream").SetHeader("X-Encryption", "rsa")
 	}
 
-	// Set the hash of the request body.
-	if a.config.Sign.Key != "" {
-		a.logger.Debugf("Setting hash header")
-		hash := sign.Hash(body, a.config.Sign.Key)
-		req.SetHeader(sign.HashHeader, hash)
+	// Sign the request with a timestamp and a nonce, so that the server can reject replays.
+	// The retries reuse the nonce: a request the server has already processed is not counted twice.
+	if a.config.Sign.Key != "" || a.signer != nil {
+		log.Debugf("Setting hash header")
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to parse endpoint: %w", err)
+		}
+		nonce, err := sign.NewNonce()
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		canonical := sign.CanonicalRequest(http.MethodPost, u.EscapedPath(), timestamp, nonce, body)
+		req.SetHeader(sign.TimestampHeader, timestamp).
+			SetHeader(sign.NonceHeader, nonce)
+		if a.config.Sign.Key != "" {
+			req.SetHeader(sign.HashHeader, sign.Hash(canonical, a.config.Sign.Key))
+			// Name the key, so that the server picks it from its key ring.
+			if a.config.Sign.KeyID != "" {
+				req.SetHeader(sign.KeyIDHeader, a.config.Sign.KeyID)
+			}
+		}
+		// Sign with the private key of the agent, the server verifies it with the registered public key.
+		if a.signer != nil {
+			signature, err := a.signer.Sign(canonical)
+			if err != nil {
+				return err
+			}
+			req.SetHeader(sign.SignatureHeader, signature).
+				SetHeader(sign.AgentIDHeader, a.config.Sign.AgentID)
+		}
+	}
+
+	// Authenticate the request with the API token.
+	if a.config.Agent.APIToken != "" {
+		req.SetAuthToken(a.config.Agent.APIToken)
 	}
 
 	// Set the request body.
 	req.SetBody(body)
 
-	a.logger.Debugf("Request body: %s", string(bodyBytes))
-	a.logger.Debugf("Request header: %v", req.Header)
+	log.Debugf("Request body: %s", string(bodyBytes))
+	log.Debugf("Request header: %v", req.Header)
 
+	// Read the response body as it was sent, the server signs it before the compression.
+	req.SetDoNotParseResponse(true)
 	resp, err := req.Post(endpoint)
 	if err != nil {
 		return fmt.Errorf("failed to POST request: %w", err)
 	}
+	defer resp.RawBody().Close()
+	respBody, err := io.ReadAll(resp.RawBody())
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	log.Debugf("Response status-code: %d", resp.StatusCode())
+	log.Debugf("Response header: %v", resp.Header())
 
-	a.logger.Debugf("Response status-code: %d", resp.StatusCode())
-	a.logger.Debugf("Response header: %v", resp.Header())
+	// The limits and the authentication of the server reject the requests before signing the responses.
+	if serverBusy(resp.StatusCode()) {
+		return fmt.Errorf("%w: %s answered %s", ErrServerBusy, endpoint, resp.Status())
+	}
+	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s answered %s: %s", ErrRequestRejected, endpoint, resp.Status(), bytes.TrimSpace(respBody))
+	}
+
+	// Verify the hash of the response body.
+	if a.config.Sign.Key != "" {
+		hash := resp.Header().Get(sign.HashHeader)
+		if hash == "" {
+			return fmt.Errorf("%w: response of %s has no %s header", ErrResponseSignature, endpoint, sign.HashHeader)
+		}
+		if _, err := sign.Verify(respBody, a.config.Sign.Key, hash); err != nil {
+			return fmt.Errorf("%w: response of %s: %v", ErrResponseSignature, endpoint, err)
+		}
+	}
 	return nil
 }
 
@@ -329,7 +452,15 @@ func clientWithRetries(client *resty.Client, logger *zap.SugaredLogger) *resty.C
 
 	// Set the retry count and backoff delay.
 	client.SetRetryCount(len(backoffs)).
+		SetRetryMaxWaitTime(maxRetryWait).
 		SetRetryAfter(func(c *resty.Client, r *resty.Response) (time.Duration, error) {
+			// Wait as long as the server asks, if it rejected the request because of its limits.
+			if r != nil && serverBusy(r.StatusCode()) {
+				if sec, err := strconv.Atoi(r.Header().Get("Retry-After")); err == nil && sec > 0 {
+					retryLogger(r, logger).Debugf("retry attempt %d, server asks to wait %ds", r.Request.Attempt, sec)
+					return time.Duration(sec) * time.Second, nil
+				}
+			}
 			// Get the retry count.
 			n := r.Request.Attempt - 1
 			if n >= len(backoffs) {
@@ -337,21 +468,50 @@ func clientWithRetries(client *resty.Client, logger *zap.SugaredLogger) *resty.C
 			}
 			// Get the backoff delay.
 			delay := backoffs[n]
-			logger.Debugf("retry attempt %d, waiting %s", r.Request.Attempt, delay)
+			retryLogger(r, logger).Debugf("retry attempt %d, waiting %s", r.Request.Attempt, delay)
 			return delay, nil
 		}).
 		AddRetryCondition(func(r *resty.Response, err error) bool {
 			// Check if the error is retryable.
 			if err != nil && isErrorRetryable(err) {
-				logger.Warnf("network error: %w — will retry", err)
+				retryLogger(r, logger).Warnf("network error: %w — will retry", err)
+				return true
+			}
+			// The limits and the authentication of the server refuse the request before its nonce is recorded,
+			// it can be sent again with the same nonce.
+			if r != nil && serverBusy(r.StatusCode()) {
+				retryLogger(r, logger).Warnf("server answered %s — will retry", r.Status())
 				return true
 			}
 
 			return false
+		}).
+		AddRetryHook(func(r *resty.Response, _ error) {
+			// The responses are not parsed, read and close the body of the retried one to release its connection.
+			// The body is kept in memory, the last attempt is returned to the caller.
+			if r == nil || r.RawResponse == nil {
+				return
+			}
+			body, _ := io.ReadAll(r.RawResponse.Body)
+			_ = r.RawResponse.Body.Close()
+			r.RawResponse.Body = io.NopCloser(bytes.NewReader(body))
 		})
 	return client
 }
 
+// retryLogger returns the logger of the retried request, which adds its ID to every entry.
+func retryLogger(r *resty.Response, fallback *zap.SugaredLogger) *zap.SugaredLogger {
+	if r == nil || r.Request == nil {
+		return fallback
+	}
+	return logger.FromContext(r.Request.Context(), fallback)
+}
+
+// serverBusy reports whether the status is a rejection by the rate or concurrency limits of the server.
+func serverBusy(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
 // isErrorRetryable checks if the error is retryable.
 func isErrorRetryable(err error) bool {
 	// Check if the error is a network error.
@@ -1,16 +1,37 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/certs"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/certs/certstest"
+	certcfg "github.com/devize-ed/yapracproj-metrics.git/internal/certs/config"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/config"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/handler"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign/signtest"
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
 )
 
@@ -60,7 +81,7 @@ func TestSendMetricsBatch_WithWorkerPool(t *testing.T) {
 	j := NewJobs(numWorkers, agent.logger)
 	errCh := j.createWorkerPool(agent.request, numWorkers, agent.logger)
 
-	if err := j.sendMetricsBatch(agent.config.Connection.Host, metrics, agent.logger); err != nil {
+	if err := j.sendMetricsBatch(agent.serverURL(), metrics, agent.logger); err != nil {
 		t.Fatalf("sendMetricsBatch() error = %v", err)
 	}
 	close(j.jobsQueue)
@@ -97,14 +118,14 @@ func TestGetMetric_GaugeAndCounter(t *testing.T) {
 	host := strings.TrimPrefix(srv.URL, "http://")
 	agent := newTestAgent(host)
 
-	if err := getMetric(agent.request, host, "testGauge", Gauge(0)); err != nil {
+	if err := getMetric(agent.request, agent.serverURL(), "testGauge", Gauge(0)); err != nil {
 		t.Fatalf("getMetric(gauge) error = %v", err)
 	}
 	assert.Equal(t, "/value/", gotPath, "path should be /value/")
 	assert.Equal(t, "POST", gotMethod, "method should be POST")
 	assert.Equal(t, http.StatusOK, gotStatus)
 
-	if err := getMetric(agent.request, host, "testCounter", Counter(1)); err != nil {
+	if err := getMetric(agent.request, agent.serverURL(), "testCounter", Counter(1)); err != nil {
 		t.Fatalf("getMetric(counter) error = %v", err)
 	}
 	assert.Equal(t, "/value/", gotPath, "path should be /value/")
@@ -145,3 +166,353 @@ func TestCreateWorkerPool(t *testing.T) {
 	}
 	assert.Equal(t, int32(N), atomic.LoadInt32(&processed), "not all jobs were processed")
 }
+
+func TestRequest_APIToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		wantHeader string
+	}{
+		{name: "with_token", token: "mt_token", wantHeader: "Bearer mt_token"},
+		{name: "without_token", token: "", wantHeader: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotHeader string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotHeader = r.Header.Get("Authorization")
+			}))
+			defer srv.Close()
+
+			agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+			agent.config.Agent.APIToken = tt.token
+			assert.NoError(t, agent.request("batch", srv.URL+"/updates/", []byte(`[]`)))
+			assert.Equal(t, tt.wantHeader, gotHeader)
+		})
+	}
+}
+
+func TestRequest_KeyID(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		keyID     string
+		wantKeyID string
+	}{
+		{name: "with_key_id", key: "secret", keyID: "k2", wantKeyID: "k2"},
+		{name: "without_key_id", key: "secret", wantKeyID: ""},
+		{name: "without_key", keyID: "k2", wantKeyID: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotKeyID string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotKeyID = r.Header.Get(sign.KeyIDHeader)
+				w.Header().Set(sign.HashHeader, sign.Hash(nil, tt.key))
+			}))
+			defer srv.Close()
+
+			agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+			agent.config.Sign.Key = tt.key
+			agent.config.Sign.KeyID = tt.keyID
+			assert.NoError(t, agent.request("batch", srv.URL+"/updates/", []byte(`[]`)))
+			assert.Equal(t, tt.wantKeyID, gotKeyID)
+		})
+	}
+}
+
+func TestRequest_SignedWithReplayProtection(t *testing.T) {
+	var got http.Header
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		gotBody, _ = io.ReadAll(r.Body)
+		w.Header().Set(sign.HashHeader, sign.Hash(nil, "secret"))
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+	agent.config.Sign.Key = "secret"
+	require.NoError(t, agent.request("batch", srv.URL+"/updates/", []byte(`[]`)))
+	first := got.Get(sign.NonceHeader)
+	require.NoError(t, agent.request("batch", srv.URL+"/updates/", []byte(`[]`)))
+
+	timestamp := got.Get(sign.TimestampHeader)
+	nonce := got.Get(sign.NonceHeader)
+	require.NotEmpty(t, nonce)
+	assert.NotEqual(t, first, nonce, "every request has its own nonce")
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), time.Unix(sec, 0), time.Minute)
+	want := sign.Hash(sign.CanonicalRequest(http.MethodPost, "/updates/", timestamp, nonce, gotBody), "secret")
+	assert.Equal(t, want, got.Get(sign.HashHeader))
+}
+
+func TestRequest_AgentSignature(t *testing.T) {
+	dir := t.TempDir()
+	signer, err := sign.LoadSigner(signtest.WriteAgentKey(t, dir, "agent-1", signtest.NewECDSA(t)))
+	require.NoError(t, err)
+	agents, err := sign.LoadAgentKeys(dir)
+	require.NoError(t, err)
+
+	var got http.Header
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://")).WithSigner(signer)
+	agent.config.Sign.AgentID = "agent-1"
+	require.NoError(t, agent.request("batch", srv.URL+"/updates/", []byte(`[]`)))
+
+	assert.Equal(t, "agent-1", got.Get(sign.AgentIDHeader))
+	assert.Empty(t, got.Get(sign.HashHeader), "no HMAC without a shared key")
+	canonical := sign.CanonicalRequest(http.MethodPost, "/updates/", got.Get(sign.TimestampHeader), got.Get(sign.NonceHeader), gotBody)
+	assert.NoError(t, agents.Verify("agent-1", canonical, got.Get(sign.SignatureHeader)))
+}
+
+func TestRequest_ServerBusy(t *testing.T) {
+	var calls atomic.Int32
+	var nonces []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, r.Header.Get(sign.NonceHeader))
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set(sign.HashHeader, sign.Hash(nil, "secret"))
+	}))
+	defer srv.Close()
+
+	// The rejected request is sent again after the wait asked by the server, with the same nonce.
+	agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+	agent.config.Sign.Key = "secret"
+	start := time.Now()
+	require.NoError(t, agent.request("batch", srv.URL+"/updates/", []byte(`[]`)))
+	assert.Equal(t, int32(2), calls.Load())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.NotEmpty(t, nonces[0])
+	assert.Equal(t, nonces[0], nonces[1])
+
+	// Without retries left the rejection is reported.
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Server is busy", http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	agent = newTestAgent(strings.TrimPrefix(busy.URL, "http://"))
+	agent.client.SetRetryCount(0)
+	assert.ErrorIs(t, agent.request("batch", busy.URL+"/updates/", []byte(`[]`)), ErrServerBusy)
+
+	// A signed rejection is reported too, the batch is not taken as delivered.
+	replayed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(sign.HashHeader, sign.Hash([]byte("Request replay rejected\n"), "secret"))
+		http.Error(w, "Request replay rejected", http.StatusBadRequest)
+	}))
+	defer replayed.Close()
+	agent = newTestAgent(strings.TrimPrefix(replayed.URL, "http://"))
+	agent.config.Sign.Key = "secret"
+	assert.ErrorIs(t, agent.request("batch", replayed.URL+"/updates/", []byte(`[]`)), ErrRequestRejected)
+}
+
+func TestRequest_TraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, agent.request("batch 0", srv.URL+"/updates/", []byte(`[]`)))
+
+	// The server receives the context of the client span of the request.
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "agent.request", spans[0].Name)
+	sc := spans[0].SpanContext
+	assert.Equal(t, "00-"+sc.TraceID().String()+"-"+sc.SpanID().String()+"-01", traceparent)
+}
+
+func TestRequest_ResponseSignature(t *testing.T) {
+	const key = "secret"
+	gzipped := func(data string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(data))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name    string
+		gzip    bool
+		body    []byte
+		hash    string
+		wantErr bool
+	}{
+		{name: "signed", body: []byte(`{"status":"ok"}`), hash: sign.Hash([]byte(`{"status":"ok"}`), key)},
+		{name: "signed_gzip", gzip: true, body: gzipped(`{"status":"ok"}`), hash: sign.Hash(gzipped(`{"status":"ok"}`), key)},
+		{name: "tampered_body", body: []byte(`{"status":"forged"}`), hash: sign.Hash([]byte(`{"status":"ok"}`), key), wantErr: true},
+		{name: "other_key", body: []byte(`{"status":"ok"}`), hash: sign.Hash([]byte(`{"status":"ok"}`), "other"), wantErr: true},
+		{name: "unsigned", body: []byte(`{"status":"ok"}`), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.gzip {
+					w.Header().Set("Content-Encoding", "gzip")
+				}
+				if tt.hash != "" {
+					w.Header().Set(sign.HashHeader, tt.hash)
+				}
+				_, _ = w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+			agent.config.Sign.Key = key
+			agent.config.Agent.EnableGzip = tt.gzip
+			err := agent.request("batch", srv.URL+"/updates/", []byte(`[]`))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrResponseSignature)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSendMetrics_SignedResponses(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	const key = "secret"
+
+	for _, enableGzip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("gzip_%t", enableGzip), func(t *testing.T) {
+			ms := mstorage.NewMemStorage()
+			h := handler.NewHandler(ms, key, audit.NewAuditor(logger, "", ""), logger)
+			srv := httptest.NewServer(h.NewRouter())
+			defer srv.Close()
+
+			agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+			agent.config.Sign.Key = key
+			agent.config.Agent.EnableGzip = enableGzip
+			agent.storage.collectMetrics()
+			require.NoError(t, agent.sendMetrics())
+			assert.NotEmpty(t, ms.Gauge)
+
+			// The /value responses of the test-get mode are verified too.
+			agent.config.Agent.EnableTestGet = true
+			require.NoError(t, agent.sendMetrics())
+		})
+	}
+
+	t.Run("forged_response", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(sign.HashHeader, sign.Hash([]byte("other"), key))
+			_, _ = w.Write([]byte(`{}`))
+		}))
+		defer srv.Close()
+
+		agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+		agent.config.Sign.Key = key
+		agent.storage.collectMetrics()
+		// The workers report the mismatch through the error channel.
+		assert.ErrorIs(t, agent.sendMetrics(), ErrResponseSignature)
+		agent.config.Agent.EnableTestGet = true
+		assert.ErrorIs(t, agent.sendMetrics(), ErrResponseSignature)
+	})
+}
+
+func TestServerURL(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		tls  certcfg.ClientTLSConfig
+		want string
+	}{
+		{name: "plain", host: "localhost:8080", want: "http://localhost:8080"},
+		{name: "tls", host: "localhost:8080", tls: certcfg.ClientTLSConfig{CAFile: "ca.pem"}, want: "https://localhost:8080"},
+		{name: "explicit_scheme", host: "https://metrics.example.com/", want: "https://metrics.example.com"},
+		{
+			name: "explicit_scheme_wins",
+			host: "http://localhost:8080",
+			tls:  certcfg.ClientTLSConfig{CAFile: "ca.pem"},
+			want: "http://localhost:8080",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(tt.host)
+			agent.config.TLS = tt.tls
+			assert.Equal(t, tt.want, agent.serverURL())
+		})
+	}
+}
+
+func TestSendMetrics_MutualTLS(t *testing.T) {
+	ca := certstest.NewCA(t)
+	serverCert, serverKey := ca.IssueServer("127.0.0.1")
+	serverTLS, err := certs.ServerTLS(certcfg.ServerTLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CertFile})
+	require.NoError(t, err)
+
+	var gotClient atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotClient.Store(r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientCert, clientKey := ca.IssueClient("agent")
+	agent := newTestAgent(strings.TrimPrefix(srv.URL, "https://"))
+	agent.config.TLS = certcfg.ClientTLSConfig{CAFile: ca.CertFile, CertFile: clientCert, KeyFile: clientKey}
+	clientTLS, err := certs.ClientTLS(agent.config.TLS)
+	require.NoError(t, err)
+	agent.client.SetTLSClientConfig(clientTLS)
+	agent.client.SetRetryCount(0)
+
+	agent.storage.collectMetrics()
+	require.NoError(t, agent.sendMetrics())
+	assert.Equal(t, "agent", gotClient.Load())
+}
+
+func TestRequest_RequestID(t *testing.T) {
+	var ids []string
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get(logger.RequestIDHeader))
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	// The retry keeps the ID of the request, the next request gets its own.
+	agent := newTestAgent(strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, agent.request("batch 0", srv.URL+"/updates/", []byte(`[]`)))
+	require.NoError(t, agent.request("batch 1", srv.URL+"/updates/", []byte(`[]`)))
+	require.Len(t, ids, 3)
+	assert.Len(t, ids[0], 32)
+	assert.Equal(t, ids[0], ids[1])
+	assert.NotEqual(t, ids[0], ids[2])
+
+	// The error of a request names its ID, to find the entries of the server.
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get(logger.RequestIDHeader))
+		http.Error(w, "Server is busy", http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	agent = newTestAgent(strings.TrimPrefix(busy.URL, "http://"))
+	agent.client.SetRetryCount(0)
+	err := agent.request("batch", busy.URL+"/updates/", []byte(`[]`))
+	assert.ErrorIs(t, err, ErrServerBusy)
+	assert.Contains(t, err.Error(), ids[len(ids)-1])
+}
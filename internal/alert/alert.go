@@ -0,0 +1,157 @@
+// Package alert provides threshold alerting on the stored metrics.
+// Rules are evaluated periodically against the repository and move through the pending, firing and resolved states,
+// the firing and resolved transitions are sent as notifications to the webhooks.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// defaultEvalInterval is used when the evaluation interval is not configured.
+const defaultEvalInterval = 15 * time.Second
+
+// States of the rules.
+const (
+	StateInactive = "inactive" // the condition does not hold
+	StatePending  = "pending"  // the condition holds for less than the rule duration
+	StateFiring   = "firing"   // the condition holds for the rule duration
+	StateResolved = "resolved" // the condition stopped holding after firing
+)
+
+// Notification is sent to the webhooks when a rule fires or resolves.
+type Notification struct {
+	Rule      string    `json:"rule"`      // expression of the rule
+	State     string    `json:"state"`     // firing or resolved
+	Metric    string    `json:"metric"`    // metric ID
+	Value     *float64  `json:"value"`     // metric value, nil when the metric is missing
+	Threshold float64   `json:"threshold"` // threshold of the rule
+	ActiveAt  time.Time `json:"active_at"` // time the condition started to hold
+	TimeStamp time.Time `json:"ts"`        // time of the transition
+}
+
+// ruleState is the evaluation state of a rule.
+type ruleState struct {
+	state    string
+	activeAt time.Time
+}
+
+// Engine evaluates the rules against the repository.
+type Engine struct {
+	rules    []Rule
+	states   []ruleState // states of the rules by index
+	storage  repository.Repository
+	interval time.Duration
+	logger   *zap.SugaredLogger
+}
+
+// NewEngine creates an alerting engine, the rules are evaluated every interval (15s if not positive).
+func NewEngine(rules []Rule, storage repository.Repository, interval time.Duration, logger *zap.SugaredLogger) *Engine {
+	if interval <= 0 {
+		interval = defaultEvalInterval
+	}
+	states := make([]ruleState, len(rules))
+	for i := range states {
+		states[i].state = StateInactive
+	}
+	return &Engine{
+		rules:    rules,
+		states:   states,
+		storage:  storage,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Run evaluates the rules every interval and sends the notifications to out until ctx is done.
+func (e *Engine) Run(ctx context.Context, out chan<- Notification) {
+	e.logger.Debugf("starting alerting engine with %d rules", len(e.rules))
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			notifications, err := e.Evaluate(ctx, now)
+			if err != nil {
+				e.logger.Errorf("failed to evaluate alert rules: %v", err)
+				continue
+			}
+			for _, n := range notifications {
+				select {
+				case out <- n:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// Evaluate evaluates the rules at the given time and returns the notifications of the firing and resolved transitions.
+// A missing metric does not satisfy the condition.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) ([]Notification, error) {
+	metrics, err := e.storage.ListMetrics(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metrics: %w", err)
+	}
+	gauges := make(map[string]float64)
+	counters := make(map[string]float64)
+	for _, m := range metrics {
+		switch {
+		case m.MType == models.Gauge && m.Value != nil:
+			gauges[m.ID] = *m.Value
+		case m.MType == models.Counter && m.Delta != nil:
+			counters[m.ID] = float64(*m.Delta)
+		}
+	}
+
+	var notifications []Notification
+	for i, rule := range e.rules {
+		var value *float64
+		if v, ok := gauges[rule.Metric]; ok {
+			value = &v
+		} else if v, ok := counters[rule.Metric]; ok {
+			value = &v
+		}
+		holds := value != nil && rule.Holds(*value)
+
+		s := &e.states[i]
+		prev := s.state
+		switch {
+		case holds && (s.state == StateInactive || s.state == StateResolved):
+			s.state, s.activeAt = StatePending, now
+			if rule.For == 0 {
+				s.state = StateFiring
+			}
+		case holds && s.state == StatePending && now.Sub(s.activeAt) >= rule.For:
+			s.state = StateFiring
+		case !holds && s.state == StatePending:
+			s.state = StateInactive
+		case !holds && s.state == StateFiring:
+			s.state = StateResolved
+		}
+		if s.state == prev {
+			continue
+		}
+		e.logger.Infof("alert rule %q: %s -> %s", rule.Expr, prev, s.state)
+		if s.state == StateFiring || s.state == StateResolved {
+			notifications = append(notifications, Notification{
+				Rule:      rule.Expr,
+				State:     s.state,
+				Metric:    rule.Metric,
+				Value:     value,
+				Threshold: rule.Threshold,
+				ActiveAt:  s.activeAt,
+				TimeStamp: now,
+			})
+		}
+	}
+	return notifications, nil
+}
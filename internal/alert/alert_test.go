@@ -0,0 +1,150 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    Rule
+		wantErr bool
+	}{
+		{
+			name: "unit_and_duration",
+			expr: "FreeMemory < 500MB for 2m",
+			want: Rule{Metric: "FreeMemory", Op: opLess, Threshold: 500 << 20, For: 2 * time.Minute},
+		},
+		{
+			name: "no_duration",
+			expr: "CPUutilization1 > 90",
+			want: Rule{Metric: "CPUutilization1", Op: opGreater, Threshold: 90},
+		},
+		{
+			name: "no_spaces",
+			expr: "PollCount>=1e3",
+			want: Rule{Metric: "PollCount", Op: opGreaterEqual, Threshold: 1000},
+		},
+		{
+			name: "percent",
+			expr: "CPUutilization1 != 100% for 30s",
+			want: Rule{Metric: "CPUutilization1", Op: opNotEqual, Threshold: 100, For: 30 * time.Second},
+		},
+		{name: "unknown_unit", expr: "FreeMemory < 5XB", wantErr: true},
+		{name: "invalid_duration", expr: "FreeMemory < 5 for ever", wantErr: true},
+		{name: "no_operator", expr: "FreeMemory 5", wantErr: true},
+		{name: "no_threshold", expr: "FreeMemory <", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRule(tt.expr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tt.want.Expr = tt.expr
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	setMemory := func(v float64) {
+		require.NoError(t, ms.SetGauge(ctx, "FreeMemory", &v))
+	}
+
+	rules, err := ParseRules([]string{"FreeMemory < 500MB for 2m", "PollCount > 5"})
+	require.NoError(t, err)
+	engine := NewEngine(rules, ms, 0, zap.NewNop().Sugar())
+
+	start := time.Unix(1000, 0)
+	steps := []struct {
+		name       string
+		at         time.Duration
+		setup      func()
+		wantStates []string
+		wantSent   []string // states of the notifications
+	}{
+		{
+			name:       "missing_metrics_are_inactive",
+			wantStates: []string{StateInactive, StateInactive},
+		},
+		{
+			name:       "condition_starts_holding",
+			at:         time.Minute,
+			setup:      func() { setMemory(100 << 20) },
+			wantStates: []string{StatePending, StateInactive},
+		},
+		{
+			name:       "pending_for_less_than_duration",
+			at:         2 * time.Minute,
+			wantStates: []string{StatePending, StateInactive},
+		},
+		{
+			name: "fires_after_duration_and_without_duration",
+			at:   3 * time.Minute,
+			setup: func() {
+				delta := int64(10)
+				require.NoError(t, ms.AddCounter(ctx, "PollCount", &delta))
+			},
+			wantStates: []string{StateFiring, StateFiring},
+			wantSent:   []string{StateFiring, StateFiring},
+		},
+		{
+			name:       "firing_is_not_repeated",
+			at:         4 * time.Minute,
+			wantStates: []string{StateFiring, StateFiring},
+		},
+		{
+			name:       "resolves",
+			at:         5 * time.Minute,
+			setup:      func() { setMemory(1 << 30) },
+			wantStates: []string{StateResolved, StateFiring},
+			wantSent:   []string{StateResolved},
+		},
+		{
+			name:       "pending_again_then_back_to_inactive",
+			at:         6 * time.Minute,
+			setup:      func() { setMemory(1 << 20) },
+			wantStates: []string{StatePending, StateFiring},
+		},
+		{
+			name:       "inactive",
+			at:         7 * time.Minute,
+			setup:      func() { setMemory(1 << 30) },
+			wantStates: []string{StateInactive, StateFiring},
+		},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if step.setup != nil {
+				step.setup()
+			}
+			now := start.Add(step.at)
+			notifications, err := engine.Evaluate(ctx, now)
+			require.NoError(t, err)
+
+			var sent []string
+			for _, n := range notifications {
+				sent = append(sent, n.State)
+				assert.Equal(t, now, n.TimeStamp)
+				require.NotNil(t, n.Value)
+			}
+			assert.Equal(t, step.wantSent, sent)
+			for i, want := range step.wantStates {
+				assert.Equal(t, want, engine.states[i].state, rules[i].Expr)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+// Package config provides configuration structures for the alerting component.
+package config
+
+// AlertConfig holds the alert rules and the webhooks receiving the notifications.
+type AlertConfig struct {
+	Rules        []string `json:"rules"`                                   // Alert rules, e.g. "FreeMemory < 500MB for 2m"
+	Webhooks     []string `json:"webhooks"`                                // URLs receiving the notifications
+	EvalInterval int      `env:"ALERT_EVAL_INTERVAL" json:"eval_interval"` // Rule evaluation interval, s
+}
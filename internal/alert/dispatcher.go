@@ -0,0 +1,144 @@
+package alert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+// webhookQueueSize is the number of notifications buffered per webhook.
+const webhookQueueSize = 64
+
+// IdempotencyKeyHeader carries the key of the notification, the same on every attempt to deliver it,
+// so that a webhook can drop the duplicates of a retry after a timeout.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Key identifies the transition of the notification: its rule, state and activation time.
+func (n Notification) Key() string {
+	sum := sha256.Sum256([]byte(n.Rule + "\x00" + n.State + "\x00" + n.ActiveAt.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Dispatcher fans the notifications out to the webhooks.
+type Dispatcher struct {
+	urls     []string
+	backoffs []time.Duration // delays between the delivery attempts
+	logger   *zap.SugaredLogger
+}
+
+// NewDispatcher creates a dispatcher for the webhook URLs.
+func NewDispatcher(urls []string, logger *zap.SugaredLogger) *Dispatcher {
+	return &Dispatcher{
+		urls:     urls,
+		backoffs: []time.Duration{time.Second, 3 * time.Second, 5 * time.Second},
+		logger:   logger,
+	}
+}
+
+// Run sends the notifications from ch to every webhook until ctx is done or ch is closed.
+// Every webhook has its own queue, so a slow webhook does not delay the others.
+func (d *Dispatcher) Run(ctx context.Context, ch <-chan Notification) {
+	queues := make([]chan Notification, 0, len(d.urls))
+	for _, url := range d.urls {
+		q := make(chan Notification, webhookQueueSize)
+		queues = append(queues, q)
+		go RunWebhook(ctx, q, url, d.backoffs, d.logger)
+	}
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
+
+	for {
+		select {
+		// If the context is done, exit
+		case <-ctx.Done():
+			return
+		// If a new notification is received, queue it for every webhook.
+		case n, ok := <-ch:
+			if !ok {
+				return
+			}
+			if len(queues) == 0 {
+				d.logger.Warnf("no webhooks configured, alert %q is %s", n.Rule, n.State)
+			}
+			for i, q := range queues {
+				select {
+				case q <- n:
+				default:
+					d.logger.Warnf("webhook %s queue is full; dropping alert %q", d.urls[i], n.Rule)
+				}
+			}
+		}
+	}
+}
+
+// RunWebhook delivers the notifications to the webhook URL, retrying with the backoffs on network and server errors.
+// Every attempt carries the key of the notification in the Idempotency-Key header, and a transition already
+// delivered to the webhook is not sent again.
+func RunWebhook(ctx context.Context, ch <-chan Notification, url string, backoffs []time.Duration, logger *zap.SugaredLogger) {
+	// Create a new resty client with retries.
+	client := resty.New().SetTimeout(10 * time.Second)
+	client.SetRetryCount(len(backoffs)).
+		SetRetryAfter(func(c *resty.Client, r *resty.Response) (time.Duration, error) {
+			// Get the backoff delay for the attempt.
+			n := r.Request.Attempt - 1
+			if n >= len(backoffs) {
+				n = len(backoffs) - 1
+			}
+			logger.Debugf("webhook %s retry attempt %d, waiting %s", url, r.Request.Attempt, backoffs[n])
+			return backoffs[n], nil
+		}).
+		AddRetryCondition(func(r *resty.Response, err error) bool {
+			var ne net.Error
+			if err != nil {
+				return errors.As(err, &ne)
+			}
+			return r.StatusCode() >= http.StatusInternalServerError || r.StatusCode() == http.StatusTooManyRequests
+		})
+
+	// Keys of the delivered transitions of every rule, the older ones are dropped when the rule changes its state.
+	delivered := make(map[string]string)
+	for {
+		select {
+		// If the context is done, exit
+		case <-ctx.Done():
+			logger.Debugf("context done, exiting")
+			return
+		// If a new notification is received, send it to the URL.
+		case n, ok := <-ch:
+			// If the channel is closed, exit
+			if !ok {
+				return
+			}
+			key := n.Key()
+			if delivered[n.Rule] == key {
+				logger.Debugf("alert %q is already %s at %s, skipping", n.Rule, n.State, url)
+				continue
+			}
+			resp, err := client.R().
+				SetHeader("Content-Type", "application/json").
+				SetHeader(IdempotencyKeyHeader, key).
+				SetBody(n).
+				SetContext(ctx).
+				Post(url)
+			if err != nil {
+				logger.Errorf("send alert to %s: %v", url, err)
+				continue
+			}
+			if resp.IsError() {
+				logger.Errorf("send alert to %s: unexpected status %s", url, resp.Status())
+				continue
+			}
+			delivered[n.Rule] = key
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// webhookRecorder is a webhook failing the first attempts of every notification.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	failures int // attempts to fail before accepting a notification
+	attempts int
+	keys     []string // idempotency keys of every attempt
+	received []Notification
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.attempts++
+	w.keys = append(w.keys, r.Header.Get(IdempotencyKeyHeader))
+	if w.attempts <= w.failures {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n Notification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.received = append(w.received, n)
+	w.attempts = 0
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (w *webhookRecorder) states() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var states []string
+	for _, n := range w.received {
+		states = append(states, n.Rule+" "+n.State)
+	}
+	return states
+}
+
+func TestDispatcher_Run(t *testing.T) {
+	flaky := &webhookRecorder{failures: 2}
+	stable := &webhookRecorder{}
+	flakySrv := httptest.NewServer(flaky)
+	defer flakySrv.Close()
+	stableSrv := httptest.NewServer(stable)
+	defer stableSrv.Close()
+
+	d := NewDispatcher([]string{flakySrv.URL, stableSrv.URL}, zap.NewNop().Sugar())
+	d.backoffs = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Notification)
+	go d.Run(ctx, ch)
+
+	activeAt := time.Unix(1000, 0)
+	firing := Notification{Rule: "FreeMemory < 500MB", State: StateFiring, ActiveAt: activeAt}
+	resolved := Notification{Rule: "FreeMemory < 500MB", State: StateResolved, ActiveAt: activeAt}
+	refiring := Notification{Rule: "FreeMemory < 500MB", State: StateFiring, ActiveAt: activeAt.Add(time.Minute)}
+	// The repeated firing notification is delivered once.
+	for _, n := range []Notification{firing, firing, resolved, refiring} {
+		ch <- n
+	}
+
+	// Every transition is delivered, in order.
+	want := []string{"FreeMemory < 500MB firing", "FreeMemory < 500MB resolved", "FreeMemory < 500MB firing"}
+	require.Eventually(t, func() bool {
+		return len(flaky.states()) == 3 && len(stable.states()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, want, flaky.states(), "failed attempts should be retried")
+	assert.Equal(t, want, stable.states())
+
+	// The retries carry the key of their notification, every transition has its own key.
+	flaky.mu.Lock()
+	defer flaky.mu.Unlock()
+	require.Len(t, flaky.keys, 9)
+	for i, n := range []Notification{firing, resolved, refiring} {
+		assert.Equal(t, []string{n.Key(), n.Key(), n.Key()}, flaky.keys[3*i:3*i+3])
+	}
+	assert.NotEqual(t, firing.Key(), refiring.Key())
+}
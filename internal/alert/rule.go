@@ -0,0 +1,104 @@
+package alert
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Comparison operators of the rules.
+const (
+	opLess         = "<"
+	opLessEqual    = "<="
+	opGreater      = ">"
+	opGreaterEqual = ">="
+	opEqual        = "=="
+	opNotEqual     = "!="
+)
+
+// ruleRe matches "<metric> <op> <threshold>[unit] [for <duration>]".
+var ruleRe = regexp.MustCompile(`^\s*(\S+?)\s*(<=|>=|==|!=|<|>)\s*([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*([A-Za-z%]*)\s*(?:\sfor\s+(\S+))?\s*$`)
+
+// units are the threshold suffixes, sizes are binary.
+var units = map[string]float64{
+	"":   1,
+	"%":  1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// Rule is a threshold condition on a metric.
+type Rule struct {
+	Expr      string        // source expression of the rule
+	Metric    string        // metric ID, gauges are looked up before counters
+	Op        string        // comparison operator
+	Threshold float64       // threshold with the unit applied
+	For       time.Duration // time the condition must hold before the rule fires
+}
+
+// ParseRule parses a rule like "FreeMemory < 500MB for 2m" or "CPUutilization1 > 90".
+func ParseRule(expr string) (Rule, error) {
+	m := ruleRe.FindStringSubmatch(expr)
+	if m == nil {
+		return Rule{}, fmt.Errorf("invalid rule %q: expected \"<metric> <op> <threshold> [for <duration>]\"", expr)
+	}
+	threshold, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid threshold in rule %q: %w", expr, err)
+	}
+	unit, ok := units[m[4]]
+	if !ok {
+		return Rule{}, fmt.Errorf("unknown unit %q in rule %q", m[4], expr)
+	}
+	rule := Rule{
+		Expr:      expr,
+		Metric:    m[1],
+		Op:        m[2],
+		Threshold: threshold * unit,
+	}
+	if m[5] != "" {
+		if rule.For, err = time.ParseDuration(m[5]); err != nil {
+			return Rule{}, fmt.Errorf("invalid duration in rule %q: %w", expr, err)
+		}
+		if rule.For < 0 {
+			return Rule{}, fmt.Errorf("negative duration in rule %q", expr)
+		}
+	}
+	return rule, nil
+}
+
+// ParseRules parses the rules of the configuration.
+func ParseRules(exprs []string) ([]Rule, error) {
+	rules := make([]Rule, 0, len(exprs))
+	for _, expr := range exprs {
+		rule, err := ParseRule(expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Holds reports whether the value satisfies the condition of the rule.
+func (r Rule) Holds(value float64) bool {
+	switch r.Op {
+	case opLess:
+		return value < r.Threshold
+	case opLessEqual:
+		return value <= r.Threshold
+	case opGreater:
+		return value > r.Threshold
+	case opGreaterEqual:
+		return value >= r.Threshold
+	case opEqual:
+		return value == r.Threshold
+	case opNotEqual:
+		return value != r.Threshold
+	}
+	return false
+}
@@ -1,64 +1,138 @@
 // Package audit provides audit logging functionality.
-// It handles audit message collection, distribution, and persistence to files or URLs.
+// It handles audit message collection, distribution, and delivery to the sinks: files, URLs, syslog and Postgres.
 package audit
 
 import (
 	"context"
-	"encoding/json"
-	"os"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
 )
 
 // AuditMsg is a struct that contains the audit message.
 type AuditMsg struct {
-	TimeStamp time.Time `json:"ts"`         // timestamp of the audit message
-	Addr      string    `json:"ip_address"` // source address of the request
-	Metrics   []string  `json:"metrics"`    // list of metrics that were updated
+	TimeStamp time.Time      `json:"ts"`                   // timestamp of the audit message
+	Addr      string         `json:"ip_address"`           // source address of the request
+	Metrics   []string       `json:"metrics"`              // list of metrics that were updated
+	Changes   []MetricChange `json:"changes,omitempty"`    // type, old and new value of every updated metric
+	Endpoint  string         `json:"endpoint,omitempty"`   // method and route of the request, e.g. "POST /update"
+	UserAgent string         `json:"user_agent,omitempty"` // user agent of the client
+	HMAC      string         `json:"hmac,omitempty"`       // result of the HMAC verification of the request body
+	Encrypted bool           `json:"encrypted,omitempty"`  // whether the request body was encrypted
+	RequestID string         `json:"request_id,omitempty"` // ID of the request from the X-Request-ID header
+	TokenID   string         `json:"token_id,omitempty"`   // ID of the API token of the request
+	AgentID   string         `json:"agent_id,omitempty"`   // ID of the agent whose signature was verified
+}
+
+// MetricChange describes the update of a single metric, the values are reported by the repository.
+type MetricChange = models.MetricChange
+
+// ErrAuditorStopped is returned when subscribing to an auditor that is not running anymore.
+var ErrAuditorStopped = errors.New("auditor is stopped")
+
+// defaultBufferSize is used when the buffer size is not configured.
+const defaultBufferSize = 100
+
+// Intervals between the attempts to deliver the spooled records: the interval doubles after every failed attempt
+// up to the maximum and is reset once the spool is delivered. Variables for the tests.
+var (
+	spoolRetryInterval    = 10 * time.Second
+	spoolMaxRetryInterval = 5 * time.Minute
+)
+
+// Stats holds the counters of the audit records lost by the pipeline.
+type Stats struct {
+	Dropped     int64            `json:"dropped"`      // records dropped by Send because the queue was full
+	Subscribers map[string]int64 `json:"subscribers"`  // records dropped by the overflow policy or by the sink per subscriber
+	LiveDropped int64            `json:"live_dropped"` // live subscriptions closed because they could not keep up
+	Spooled     int64            `json:"spooled"`      // records waiting for delivery in the spool of the URL sinks and in the batches
+}
+
+// subscriber is a registered subscription with its drop counter.
+type subscriber struct {
+	name    string
+	ch      chan AuditMsg
+	dropped atomic.Int64
 }
 
 // Auditor is a struct that contains channels for events and registrations.
 type Auditor struct {
-	eventChan    chan AuditMsg      // channel for sending audit messages
-	registerChan chan chan AuditMsg // channel for registering new subscriptions
-	auditFile    string             // file path for storing audit data
-	auditURL     string             // URL for sending audit data to the remote server
-	logger       *zap.SugaredLogger
+	eventChan       chan AuditMsg          // channel for sending audit messages
+	registerChan    chan *subscriber       // channel for registering new subscriptions
+	subscribeChan   chan chan AuditMsg     // channel for registering new live subscriptions
+	unsubscribeChan chan (<-chan AuditMsg) // channel for removing live subscriptions
+	done            chan struct{}          // closed when the auditor stops
+	sinks           []Sink                 // destinations of the records
+	bufferSize      int                    // size of the queue and of every subscriber buffer
+	policy          string                 // overflow policy of the queue and of the subscriber buffers
+	dropped         atomic.Int64           // records dropped by Send
+	liveDropped     atomic.Int64           // live subscriptions dropped as too slow
+	mu              sync.Mutex
+	subscribers     []*subscriber // registered subscriptions, for the stats
+	logger          *zap.SugaredLogger
 }
 
-// NewAuditor creates a new auditor.
+// NewAuditor creates a new auditor with the default buffer size and the drop_newest overflow policy.
 func NewAuditor(logger *zap.SugaredLogger, auditFile string, auditURL string) *Auditor {
+	return NewAuditorWithConfig(logger, cfg.AuditConfig{AuditFile: auditFile, AuditURL: auditURL})
+}
 
+// NewAuditorWithConfig creates a new auditor with the sinks, buffering and spooling settings of the configuration.
+func NewAuditorWithConfig(logger *zap.SugaredLogger, config cfg.AuditConfig) *Auditor {
+	size := config.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	policy := config.OverflowPolicy
+	if policy == "" {
+		policy = cfg.PolicyDropNewest
+	}
+	fileOpts := FileOptions{
+		ChainKey:           config.ChainKey,
+		CheckpointInterval: time.Duration(config.CheckpointInterval) * time.Second,
+		MaxSize:            int64(config.MaxSize) << 20,
+		RotateInterval:     time.Duration(config.RotateInterval) * time.Second,
+		MaxBackups:         config.MaxBackups,
+		MaxAge:             time.Duration(config.MaxAge) * time.Hour,
+	}
 	return &Auditor{
-		eventChan:    make(chan AuditMsg),
-		auditFile:    auditFile,
-		auditURL:     auditURL,
-		registerChan: make(chan chan AuditMsg, 2),
-		logger:       logger,
+		eventChan:       make(chan AuditMsg, size),
+		sinks:           newSinks(config, fileOpts, logger),
+		bufferSize:      size,
+		policy:          policy,
+		registerChan:    make(chan *subscriber, 2),
+		subscribeChan:   make(chan chan AuditMsg),
+		unsubscribeChan: make(chan (<-chan AuditMsg)),
+		done:            make(chan struct{}),
+		logger:          logger,
 	}
 }
 
 // Run starts the auditor.
 func (a *Auditor) Run(ctx context.Context) {
 	a.logger.Debugf("starting auditor")
-	// Create a map of subscriptions.
-	subs := make(map[chan AuditMsg]struct{})
-	// if audit file is set, start the file auditor
-	if a.auditFile != "" {
-		ch := a.Register()
-		go RunFileAudit(ctx, ch, a.auditFile, a.logger)
-	}
-	// if audit URL is set, start the URL auditor
-	if a.auditURL != "" {
-		ch := a.Register()
-		go RunURLAudit(ctx, ch, a.auditURL, a.logger)
-	}
-	// if audit file and URL are not set, skip the auditors
-	if a.auditFile == "" && a.auditURL == "" {
-		a.logger.Debugf("audit file and URL are not set, skipping auditors")
-		return
+	defer close(a.done)
+	// Create a list of subscriptions.
+	var subs []*subscriber
+	// Create a map of live subscriptions by their receiving ends, they are dropped when they cannot keep up.
+	live := make(map[<-chan AuditMsg]chan AuditMsg)
+	// start a sink per configured destination, every sink has its own subscription
+	for _, sink := range a.sinks {
+		ch := a.Register(sink.Name())
+		go sink.Run(ctx, ch)
+	}
+	// if no sinks are configured, only the live subscriptions receive the messages
+	if len(a.sinks) == 0 {
+		a.logger.Debugf("audit sinks are not configured, skipping auditors")
 	}
 	// start the auditors
 	for {
@@ -66,112 +140,434 @@ func (a *Auditor) Run(ctx context.Context) {
 		// If the context is done, close all subscriptions.
 		case <-ctx.Done():
 			// Close all subscriptions.
-			for sub := range subs {
+			for _, sub := range subs {
+				close(sub.ch)
+			}
+			for _, sub := range live {
 				close(sub)
 			}
 			return
-		// If a new subscription is registered, add it to the map.
+		// If a new subscription is registered, add it to the list.
 		case sub := <-a.registerChan:
-			subs[sub] = struct{}{}
-			a.logger.Debugf("new subscription for auditor: %v", sub)
+			subs = append(subs, sub)
+			a.mu.Lock()
+			a.subscribers = append(a.subscribers, sub)
+			a.mu.Unlock()
+			a.logger.Debugf("new subscription for auditor: %s", sub.name)
+		// If a new live subscription is registered, add it to the map.
+		case sub := <-a.subscribeChan:
+			live[sub] = sub
+			a.logger.Debugf("new live subscription for auditor: %v", sub)
+		// If a live subscription is cancelled, remove it and close its channel.
+		case sub := <-a.unsubscribeChan:
+			if ch, ok := live[sub]; ok {
+				delete(live, sub)
+				close(ch)
+			}
 		// If a new message is received, send it to all subscriptions.
 		case msg := <-a.eventChan:
-			a.logger.Debugf("received message from event channel: %v", msg)
-			for sub := range subs {
-				a.logger.Debugf("sending message to subscription: %v", sub)
-				sub <- msg
+			// The message is boxed into the arguments even when the entry is not logged, the level is checked first.
+			if a.logger.Level().Enabled(zap.DebugLevel) {
+				a.logger.Debugf("received message from event channel: %v", msg)
+			}
+			for _, sub := range subs {
+				// Every subscription has its own buffer, a full buffer is handled by the overflow policy.
+				if offer(sub.ch, msg, a.policy, ctx.Done()) {
+					sub.dropped.Add(1)
+					a.logger.Warnf("audit subscription %s is full; dropping message", sub.name)
+				}
+			}
+			// Live subscriptions never block the fan-out, a full buffer drops the subscription.
+			for key, sub := range live {
+				select {
+				case sub <- msg:
+				default:
+					a.logger.Warnf("live subscription %v is too slow; dropping it", sub)
+					a.liveDropped.Add(1)
+					delete(live, key)
+					close(sub)
+				}
 			}
 		}
 	}
 }
 
+// offer puts the message into the channel according to the overflow policy and reports whether a message was dropped.
+// With the block policy it waits for free space until done is closed.
+func offer(ch chan AuditMsg, msg AuditMsg, policy string, done <-chan struct{}) bool {
+	switch policy {
+	case cfg.PolicyBlock:
+		select {
+		case ch <- msg:
+			return false
+		case <-done:
+			return true
+		}
+	case cfg.PolicyDropOldest:
+		select {
+		case ch <- msg:
+			return false
+		default:
+		}
+		// Discard the oldest message, the consumer may have freed the space meanwhile.
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- msg:
+		default:
+		}
+		return true
+	default:
+		select {
+		case ch <- msg:
+			return false
+		default:
+			return true
+		}
+	}
+}
+
 // Send sends a message to the auditor.
+// Send is called by the handlers and never waits: a full queue is handled by the overflow policy,
+// the block policy applies to the subscriber buffers only and a full queue drops the incoming message.
 func (a *Auditor) Send(addr string, metrics []string) {
-	msg := AuditMsg{
-		TimeStamp: time.Now(),
-		Addr:      addr,
-		Metrics:   metrics,
+	a.Record(AuditMsg{Addr: addr, Metrics: metrics})
+}
+
+// Record sends a full audit record to the auditor, it is handled like the messages of Send.
+// The timestamp is set when it is zero and the metric names are taken from the changes when they are not set.
+func (a *Auditor) Record(msg AuditMsg) {
+	if msg.TimeStamp.IsZero() {
+		msg.TimeStamp = time.Now()
 	}
-	select {
-	case a.eventChan <- msg:
-		a.logger.Debugf("sent message to auditor: %v", msg)
-	default:
+	if msg.Metrics == nil {
+		msg.Metrics = make([]string, 0, len(msg.Changes))
+		for _, c := range msg.Changes {
+			msg.Metrics = append(msg.Metrics, c.ID)
+		}
+	}
+	if offer(a.eventChan, msg, a.queuePolicy(), a.done) {
+		a.dropped.Add(1)
 		a.logger.Warn("audit queue is full; dropping message")
+		return
+	}
+	if a.logger.Level().Enabled(zap.DebugLevel) {
+		a.logger.Debugf("sent message to auditor: %v", msg)
+	}
+}
+
+// queuePolicy returns the overflow policy of the queue: the policy of the configuration, except block,
+// which would stall the handlers behind a slow sink and is replaced with drop_newest.
+func (a *Auditor) queuePolicy() string {
+	if a.policy == cfg.PolicyBlock {
+		return cfg.PolicyDropNewest
+	}
+	return a.policy
+}
+
+// Reopen makes the file sinks close their audit files and open them again, e.g. after they were moved by logrotate.
+func (a *Auditor) Reopen() {
+	for _, sink := range a.sinks {
+		if r, ok := sink.(reopener); ok {
+			r.Reopen()
+		}
+	}
+}
+
+// Stats returns the counters of the dropped and pending records.
+func (a *Auditor) Stats() Stats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := Stats{
+		Dropped:     a.dropped.Load(),
+		Subscribers: make(map[string]int64, len(a.subscribers)),
+		LiveDropped: a.liveDropped.Load(),
+	}
+	for _, sub := range a.subscribers {
+		stats.Subscribers[sub.name] += sub.dropped.Load()
+	}
+	for _, sink := range a.sinks {
+		if d, ok := sink.(dropCounter); ok {
+			stats.Subscribers[sink.Name()] += d.Dropped()
+		}
+		if p, ok := sink.(pendingCounter); ok {
+			stats.Spooled += int64(p.Pending())
+		}
 	}
+	return stats
 }
 
-// Register registers a new subscription to the auditor.
-func (a *Auditor) Register() chan AuditMsg {
-	sub := make(chan AuditMsg)
+// Collect returns the counters of the dropped and pending records, for the self-metrics of the server.
+func (a *Auditor) Collect() []models.Metrics {
+	stats := a.Stats()
+	metrics := []models.Metrics{
+		selfmetrics.Counter("audit.dropped", stats.Dropped),
+		selfmetrics.Counter("audit.live_dropped", stats.LiveDropped),
+		selfmetrics.Gauge("audit.spooled", float64(stats.Spooled)),
+	}
+	for name, dropped := range stats.Subscribers {
+		metrics = append(metrics, selfmetrics.Counter("audit.subscriber_dropped."+name, dropped))
+	}
+	return metrics
+}
+
+// Register registers a new named subscription to the auditor.
+// The subscription is buffered, a full buffer is handled by the overflow policy of the auditor.
+func (a *Auditor) Register(name string) chan AuditMsg {
+	sub := &subscriber{name: name, ch: make(chan AuditMsg, a.bufferSize)}
 	a.registerChan <- sub
-	return sub
+	return sub.ch
+}
+
+// Subscribe registers a live subscription buffering up to size messages.
+// The channel is closed when the subscriber falls behind by more than size messages, when cancel is called
+// or when the auditor stops. It fails if ctx is done or the auditor is stopped before the subscription is registered.
+func (a *Auditor) Subscribe(ctx context.Context, size int) (<-chan AuditMsg, func(), error) {
+	sub := make(chan AuditMsg, size)
+	select {
+	case a.subscribeChan <- sub:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-a.done:
+		return nil, nil, ErrAuditorStopped
+	}
+	cancel := func() {
+		select {
+		case a.unsubscribeChan <- sub:
+		case <-a.done:
+		}
+	}
+	return sub, cancel, nil
 }
 
 // RunFileAudit runs the file auditor.
-func RunFileAudit(ctx context.Context, ch <-chan AuditMsg, fname string, logger *zap.SugaredLogger) {
+// The records are appended to the hash chain of the file, with a checkpoint every checkpoint interval
+// if records were written, before every rotation and on shutdown.
+// The records wait in the channel while the file is rotated or reopened, so none of them are lost.
+func RunFileAudit(ctx context.Context, ch <-chan AuditMsg, fname string, opts FileOptions, logger *zap.SugaredLogger) {
 	// Open the audit file.
-	f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	f, err := openRotatingFile(fname, opts, logger)
 	if err != nil {
 		logger.Errorf("open audit file: %v", err)
 		return
 	}
 	// Close the audit file.
-	defer func() {
-		if err := f.Sync(); err != nil {
-			logger.Errorf("sync audit file: %v", err)
+	defer f.Close()
+	// Continue the chain of the existing records, or of the last rotated segment if the file is empty.
+	chain := NewChain(opts.ChainKey)
+	if err := resumeChain(chain, f); err != nil {
+		logger.Errorf("read audit file: %v", err)
+		return
+	}
+	checkpointInterval := opts.CheckpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = defaultCheckpointInterval
+	}
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	// The age of the file is checked at least every second when the time rotation is enabled.
+	var rotateCheck <-chan time.Time
+	if opts.RotateInterval > 0 {
+		t := time.NewTicker(min(time.Second, opts.RotateInterval))
+		defer t.Stop()
+		rotateCheck = t.C
+	}
+
+	// write appends the entry to the file.
+	write := func(entry ChainEntry, err error) {
+		if err != nil {
+			logger.Errorf("chain audit entry: %v", err)
+			return
+		}
+		if _, err := f.Write(append(entry.Line, '\n')); err != nil {
+			logger.Errorf("write audit json: %v", err)
+		}
+	}
+	// checkpoint appends a checkpoint if records were written since the previous one.
+	checkpoint := func() {
+		if chain.Pending() == 0 {
+			return
 		}
-		if err := f.Close(); err != nil {
-			logger.Errorf("close audit file: %v", err)
+		write(chain.Checkpoint(time.Now()))
+		seq, head := chain.Head()
+		logger.Infow("audit checkpoint", "file", fname, "seq", seq, "hash", head)
+	}
+	// rotate closes the segment with a checkpoint and rotates the file if it reached the maximum size or age.
+	rotate := func() {
+		now := time.Now()
+		if !f.NeedsRotation(now) {
+			return
 		}
-	}()
-	// Create a new JSON encoder.
-	enc := json.NewEncoder(f)
+		checkpoint()
+		if err := f.Rotate(now); err != nil {
+			logger.Errorf("rotate audit file: %v", err)
+		}
+	}
+	// record appends the record to the chain and rotates the file if it is full.
+	record := func(msg AuditMsg) {
+		write(chain.Append(msg))
+		rotate()
+	}
+
 	// Wait for messages from the channel and send them to the file.
 	for {
 		select {
-		// If the context is done, exit
+		// If the context is done, write the buffered records and the final checkpoint and exit
 		case <-ctx.Done():
-			logger.Debugf("context done, exiting")
-			return
-		// If a new message is received, send it to the file.
+			for {
+				select {
+				case msg, ok := <-ch:
+					if !ok {
+						checkpoint()
+						return
+					}
+					record(msg)
+				default:
+					logger.Debugf("context done, exiting")
+					checkpoint()
+					return
+				}
+			}
+		case <-ticker.C:
+			checkpoint()
+		case <-rotateCheck:
+			rotate()
+		// The file was moved away, close the old file with a checkpoint and continue the chain in a new one.
+		case <-opts.Reopen:
+			checkpoint()
+			if err := f.Reopen(); err != nil {
+				logger.Errorf("reopen audit file: %v", err)
+			}
+		// If a new message is received, append it to the chain.
 		case msg, ok := <-ch:
 			// If the channel is closed, exit
 			if !ok {
+				checkpoint()
 				return
 			}
-			// If the message is not encoded, exit
-			if err := enc.Encode(msg); err != nil {
-				logger.Errorf("write audit json: %v", err)
-			}
+			record(msg)
 		}
 	}
 }
 
+// resumeChain continues the chain from the audit file, or from its last rotated segment if the file is empty.
+func resumeChain(chain *Chain, f *rotatingFile) error {
+	if f.Size() > 0 {
+		return chain.Resume(f.f)
+	}
+	segments, err := f.Segments()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	r, err := OpenSegment(segments[len(segments)-1])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return chain.Resume(r)
+}
+
 // RunURLAudit runs the URL auditor.
-func RunURLAudit(ctx context.Context, ch <-chan AuditMsg, url string, logger *zap.SugaredLogger) {
+// Records that cannot be delivered are appended to the spool (when not nil), records rejected by the server
+// with a 4xx status are not retried. While the spool holds records the new ones are appended behind them without
+// a delivery attempt, the spool is delivered in order by the retries, which back off while the server is down.
+func RunURLAudit(ctx context.Context, ch <-chan AuditMsg, url string, spool *Spool, logger *zap.SugaredLogger) {
 	// Create a new resty client.
 	client := resty.New().SetTimeout(10 * time.Second)
+	// Send the audit message to the remote server
+	deliver := func(msg AuditMsg) error {
+		resp, err := client.R().
+			SetHeader("Content-Type", "application/json").
+			SetBody(msg).
+			SetContext(ctx).
+			Post(url)
+		if err != nil {
+			return err
+		}
+		if resp.IsError() {
+			if resp.StatusCode() < http.StatusInternalServerError &&
+				resp.StatusCode() != http.StatusRequestTimeout && resp.StatusCode() != http.StatusTooManyRequests {
+				return fmt.Errorf("%w: status %s", errRejected, resp.Status())
+			}
+			return fmt.Errorf("unexpected status %s", resp.Status())
+		}
+		return nil
+	}
+	// Deliver the spooled records, it reports whether the spool is empty.
+	drain := func() bool {
+		if spool == nil || spool.Len() == 0 {
+			return true
+		}
+		if err := spool.Drain(deliver); err != nil {
+			logger.Debugf("deliver spooled audit records to %s: %v", url, err)
+			return false
+		}
+		return true
+	}
+	// Keep the record in the spool if it is set.
+	keep := func(msg AuditMsg) {
+		if spool == nil {
+			return
+		}
+		if err := spool.Append(msg); err != nil {
+			logger.Warnf("spool audit record: %v", err)
+		}
+	}
+	// Spooled reports whether records wait for delivery in the spool.
+	spooled := func() bool {
+		return spool != nil && spool.Len() > 0
+	}
+
+	delay := spoolRetryInterval
+	retry := time.NewTimer(delay)
+	defer retry.Stop()
 	// Wait for messages from the channel and send them to the URL.
 	for {
 		select {
-		// If the context is done, exit
+		// If the context is done, spool the buffered records and exit
 		case <-ctx.Done():
-			logger.Debugf("context done, exiting")
-			return
+			for {
+				select {
+				case msg, ok := <-ch:
+					if !ok {
+						return
+					}
+					keep(msg)
+				default:
+					logger.Debugf("context done, exiting")
+					return
+				}
+			}
+		// Retry the spooled records, backing off while they cannot be delivered.
+		case <-retry.C:
+			if drain() {
+				delay = spoolRetryInterval
+			} else {
+				delay = min(2*delay, spoolMaxRetryInterval)
+			}
+			retry.Reset(delay)
 		// If a new message is received, send it to the URL.
 		case msg, ok := <-ch:
 			// If the channel is closed, exit
 			if !ok {
 				return
 			}
-			// Send the audit message to the remote server
-			req := client.R().
-				SetHeader("Content-Type", "application/json").
-				SetBody(msg).
-				SetContext(ctx)
-			if _, err := req.Post(url); err != nil {
-				logger.Errorf("send audit to %s: %v", url, err)
+			// The spooled records go first to keep the order, the record waits behind them for the next retry.
+			if spooled() {
+				keep(msg)
+				continue
 			}
+			err := deliver(msg)
+			if err == nil {
+				continue
+			}
+			logger.Errorf("send audit to %s: %v", url, err)
+			if errors.Is(err, errRejected) {
+				continue
+			}
+			keep(msg)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -1,14 +1,21 @@
 package audit
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
@@ -18,21 +25,25 @@ func TestNewAuditor(t *testing.T) {
 		name      string
 		auditFile string
 		auditURL  string
+		wantSinks []string
 	}{
 		{
 			name:      "with_file_and_url",
 			auditFile: "/tmp/test-audit.json",
 			auditURL:  "http://192.168.1.1:8080",
+			wantSinks: []string{"file", "url"},
 		},
 		{
 			name:      "with_file_only",
 			auditFile: "/tmp/test-audit.json",
 			auditURL:  "",
+			wantSinks: []string{"file"},
 		},
 		{
 			name:      "with_url_only",
 			auditFile: "",
 			auditURL:  "http://192.168.1.1:8080",
+			wantSinks: []string{"url"},
 		},
 		{
 			name:      "no_config",
@@ -47,8 +58,7 @@ func TestNewAuditor(t *testing.T) {
 			auditor := NewAuditor(logger, tt.auditFile, tt.auditURL)
 
 			assert.NotNil(t, auditor, "NewAuditor should not return nil")
-			assert.Equal(t, tt.auditFile, auditor.auditFile, "auditFile should match")
-			assert.Equal(t, tt.auditURL, auditor.auditURL, "auditURL should match")
+			assert.Equal(t, tt.wantSinks, sinkNames(auditor.sinks), "sinks should match")
 			assert.NotNil(t, auditor.eventChan, "eventChan should not be nil")
 			assert.NotNil(t, auditor.registerChan, "registerChan should not be nil")
 			assert.NotNil(t, auditor.logger, "logger should not be nil")
@@ -99,7 +109,7 @@ func TestAuditor_Register(t *testing.T) {
 	logger := zaptest.NewLogger(t).Sugar()
 	auditor := NewAuditor(logger, "", "")
 
-	sub := auditor.Register()
+	sub := auditor.Register("test")
 	assert.NotNil(t, sub, "Register returned nil channel")
 
 	select {
@@ -184,8 +194,9 @@ func TestAuditor_Run(t *testing.T) {
 				assert.NoError(t, err, "Failed to read audit file")
 				assert.NotEmpty(t, content, "Audit file is empty")
 
+				// The first line is the record, it may be followed by the checkpoint written on shutdown.
 				var auditMsg AuditMsg
-				err = json.Unmarshal(content, &auditMsg)
+				err = json.NewDecoder(bytes.NewReader(content)).Decode(&auditMsg)
 				assert.NoError(t, err, "Failed to unmarshal audit message")
 				assert.Equal(t, tt.addr, auditMsg.Addr, "Address does not match")
 				assert.Len(t, auditMsg.Metrics, len(tt.metrics), "Metrics length does not match")
@@ -253,11 +264,15 @@ func TestRunFileAudit(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 			defer cancel()
 
-			go RunFileAudit(ctx, msgChan, auditFile, logger)
+			done := make(chan struct{})
+			go func() {
+				RunFileAudit(ctx, msgChan, auditFile, FileOptions{}, logger)
+				close(done)
+			}()
 
 			msgChan <- tt.msg
 
-			<-ctx.Done()
+			<-done
 
 			if tt.wantFile && !tt.wantError {
 				assert.FileExists(t, auditFile, "Audit file should be created")
@@ -266,10 +281,18 @@ func TestRunFileAudit(t *testing.T) {
 				assert.NoError(t, err, "Failed to read audit file")
 				assert.NotEmpty(t, content, "Audit file should contain data")
 
+				// The record is followed by the checkpoint written on shutdown.
+				lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+				assert.Len(t, lines, 2)
 				var auditMsg AuditMsg
-				err = json.Unmarshal(content, &auditMsg)
+				err = json.Unmarshal(lines[0], &auditMsg)
 				assert.NoError(t, err, "Failed to unmarshal audit message")
 				assert.Equal(t, tt.msg.Addr, auditMsg.Addr, "Address should match")
+
+				report, err := VerifyChain(bytes.NewReader(content), "")
+				assert.NoError(t, err)
+				assert.Equal(t, 1, report.Records)
+				assert.Equal(t, 1, report.Checkpoints)
 			}
 		})
 	}
@@ -311,7 +334,7 @@ func TestRunURLAudit(t *testing.T) {
 
 			done := make(chan struct{})
 			go func() {
-				RunURLAudit(ctx, msgChan, tt.url, logger)
+				RunURLAudit(ctx, msgChan, tt.url, nil, logger)
 				close(done)
 			}()
 
@@ -328,6 +351,426 @@ func TestRunURLAudit(t *testing.T) {
 	}
 }
 
+func TestAuditor_Subscribe(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	auditor := NewAuditor(logger, "", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go auditor.Run(ctx)
+
+	fast, cancelFast, err := auditor.Subscribe(ctx, 4)
+	assert.NoError(t, err)
+	slow, _, err := auditor.Subscribe(ctx, 1)
+	assert.NoError(t, err)
+
+	auditor.Send("", []string{"m1"})
+	auditor.Send("", []string{"m2"})
+	auditor.Send("", []string{"m3"})
+	assert.Eventually(t, func() bool {
+		return auditor.Stats().LiveDropped == 1
+	}, time.Second, time.Millisecond)
+
+	// The slow subscription is dropped after its buffer is full and does not block the fast one.
+	msg, ok := <-slow
+	assert.True(t, ok)
+	assert.Equal(t, []string{"m1"}, msg.Metrics)
+	_, ok = <-slow
+	assert.False(t, ok, "slow subscription should be closed")
+
+	for _, want := range []string{"m1", "m2", "m3"} {
+		msg, ok := <-fast
+		assert.True(t, ok)
+		assert.Equal(t, []string{want}, msg.Metrics)
+	}
+
+	// A cancelled subscription is closed.
+	cancelFast()
+	_, ok = <-fast
+	assert.False(t, ok)
+
+	// Subscribing to a stopped auditor fails.
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, _, err := auditor.Subscribe(context.Background(), 1)
+		return errors.Is(err, ErrAuditorStopped)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestOffer(t *testing.T) {
+	msg := func(metric string) AuditMsg { return AuditMsg{Metrics: []string{metric}} }
+	tests := []struct {
+		name        string
+		policy      string
+		wantDropped bool
+		want        []string
+	}{
+		{name: "drop_newest", policy: cfg.PolicyDropNewest, wantDropped: true, want: []string{"m1", "m2"}},
+		{name: "drop_oldest", policy: cfg.PolicyDropOldest, wantDropped: true, want: []string{"m2", "m3"}},
+		{name: "block_until_done", policy: cfg.PolicyBlock, wantDropped: true, want: []string{"m1", "m2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan AuditMsg, 2)
+			done := make(chan struct{})
+			assert.False(t, offer(ch, msg("m1"), tt.policy, done))
+			assert.False(t, offer(ch, msg("m2"), tt.policy, done))
+
+			// The blocking offer gives up only when done is closed.
+			time.AfterFunc(10*time.Millisecond, func() { close(done) })
+			assert.Equal(t, tt.wantDropped, offer(ch, msg("m3"), tt.policy, done))
+
+			close(ch)
+			var got []string
+			for m := range ch {
+				got = append(got, m.Metrics[0])
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("block_waits_for_space", func(t *testing.T) {
+		ch := make(chan AuditMsg, 1)
+		ch <- msg("m1")
+		time.AfterFunc(10*time.Millisecond, func() { <-ch })
+		assert.False(t, offer(ch, msg("m2"), cfg.PolicyBlock, make(chan struct{})))
+		assert.Equal(t, msg("m2"), <-ch)
+	})
+}
+
+func TestAuditor_Stats(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	auditor := NewAuditorWithConfig(logger, cfg.AuditConfig{BufferSize: 1, OverflowPolicy: cfg.PolicyDropNewest})
+
+	// The queue holds one message while the auditor is not running.
+	auditor.Send("", []string{"m1"})
+	auditor.Send("", []string{"m2"})
+	assert.Equal(t, int64(1), auditor.Stats().Dropped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go auditor.Run(ctx)
+
+	// Nobody reads the subscription, so its buffer overflows and the drops are counted per subscriber.
+	sub := auditor.Register("slow")
+	assert.Eventually(t, func() bool {
+		auditor.Send("", []string{"m"})
+		return auditor.Stats().Subscribers["slow"] > 0
+	}, time.Second, time.Millisecond)
+	assert.Len(t, sub, 1)
+}
+
+func TestAuditor_SendNeverBlocks(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	for _, policy := range []string{"", cfg.PolicyBlock, cfg.PolicyDropOldest, cfg.PolicyDropNewest} {
+		t.Run("policy_"+policy, func(t *testing.T) {
+			// The auditor is not running, the queue of one message is full after the first Send.
+			auditor := NewAuditorWithConfig(logger, cfg.AuditConfig{BufferSize: 1, OverflowPolicy: policy})
+			sent := make(chan struct{})
+			go func() {
+				defer close(sent)
+				for i := 0; i < 3; i++ {
+					auditor.Send("", []string{"m"})
+				}
+			}()
+			select {
+			case <-sent:
+			case <-time.After(time.Second):
+				t.Fatal("Send blocked on a full queue")
+			}
+			assert.Equal(t, int64(2), auditor.Stats().Dropped)
+		})
+	}
+}
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.spool")
+	spool, err := NewSpool(path, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, spool.Len())
+
+	for _, metric := range []string{"m1", "m2", "m3", "m4"} {
+		assert.NoError(t, spool.Append(AuditMsg{Metrics: []string{metric}}))
+	}
+
+	// The records survive a restart.
+	spool, err = NewSpool(path, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, spool.Len())
+
+	// Delivery stops at the first failure, rejected records are discarded.
+	var delivered []string
+	err = spool.Drain(func(msg AuditMsg) error {
+		switch msg.Metrics[0] {
+		case "m2":
+			return errRejected
+		case "m3":
+			return errors.New("connection refused")
+		}
+		delivered = append(delivered, msg.Metrics[0])
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"m1"}, delivered)
+	assert.Equal(t, 2, spool.Len())
+
+	delivered = nil
+	assert.NoError(t, spool.Drain(func(msg AuditMsg) error {
+		delivered = append(delivered, msg.Metrics[0])
+		return nil
+	}))
+	assert.Equal(t, []string{"m3", "m4"}, delivered)
+	assert.Equal(t, 0, spool.Len())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "empty spool file should be removed")
+}
+
+func TestSpool_MaxRecords(t *testing.T) {
+	spool, err := NewSpool(filepath.Join(t.TempDir(), "audit.spool"), 2)
+	require.NoError(t, err)
+
+	// The records above the maximum are dropped and counted.
+	for _, metric := range []string{"m1", "m2", "m3", "m4"} {
+		err := spool.Append(AuditMsg{Metrics: []string{metric}})
+		if spool.Dropped() > 0 {
+			assert.ErrorIs(t, err, ErrSpoolFull)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, 2, spool.Len())
+	assert.Equal(t, int64(2), spool.Dropped())
+
+	// The delivered records free the space.
+	var delivered []string
+	require.NoError(t, spool.Drain(func(msg AuditMsg) error {
+		delivered = append(delivered, msg.Metrics[0])
+		return nil
+	}))
+	assert.Equal(t, []string{"m1", "m2"}, delivered)
+	assert.NoError(t, spool.Append(AuditMsg{Metrics: []string{"m5"}}))
+}
+
+func TestRunURLAudit_Spool(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	retryInterval, maxRetryInterval := spoolRetryInterval, spoolMaxRetryInterval
+	spoolRetryInterval, spoolMaxRetryInterval = 20*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() { spoolRetryInterval, spoolMaxRetryInterval = retryInterval, maxRetryInterval })
+
+	var (
+		mu       sync.Mutex
+		down     = true
+		attempts int
+		received []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var msg AuditMsg
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, msg.Metrics[0])
+	}))
+	defer srv.Close()
+
+	spool, err := NewSpool(filepath.Join(t.TempDir(), "audit.spool"), 0)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan AuditMsg)
+	go RunURLAudit(ctx, ch, srv.URL, spool, logger)
+
+	// While the server is down the records are spooled.
+	ch <- AuditMsg{Metrics: []string{"m1"}}
+	assert.Eventually(t, func() bool { return spool.Len() == 1 }, time.Second, time.Millisecond)
+
+	// The records arriving while the spool is not empty are appended without a delivery attempt.
+	mu.Lock()
+	down = false
+	before := attempts
+	mu.Unlock()
+	ch <- AuditMsg{Metrics: []string{"m2"}}
+	ch <- AuditMsg{Metrics: []string{"m3"}}
+
+	// The retry delivers the spool in order.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"m1", "m2", "m3"}, received)
+	assert.Equal(t, before+3, attempts, "every record is sent once, by the retry")
+	mu.Unlock()
+	assert.Equal(t, 0, spool.Len())
+}
+
+func TestVerifyChain(t *testing.T) {
+	key := "chain_key"
+
+	// writeChain returns the lines of a chain of three records and a checkpoint.
+	writeChain := func(t *testing.T) [][]byte {
+		chain := NewChain(key)
+		var lines [][]byte
+		add := func(entry ChainEntry, err error) {
+			require.NoError(t, err)
+			lines = append(lines, entry.Line)
+		}
+		for _, metric := range []string{"m1", "m2", "m3"} {
+			add(chain.Append(AuditMsg{TimeStamp: time.Unix(1760800000, 0).UTC(), Addr: "127.0.0.1", Metrics: []string{metric}}))
+		}
+		add(chain.Checkpoint(time.Unix(1760800060, 0).UTC()))
+		return lines
+	}
+	join := func(lines [][]byte) []byte {
+		return append(bytes.Join(lines, []byte("\n")), '\n')
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		tamper   func(lines [][]byte) [][]byte
+		wantLine int
+	}{
+		{name: "valid", key: key, tamper: func(lines [][]byte) [][]byte { return lines }},
+		{
+			name: "modified_record",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"m2"`), []byte(`"m9"`), 1)
+				return lines
+			},
+			wantLine: 2,
+		},
+		{
+			name:     "deleted_record",
+			key:      key,
+			tamper:   func(lines [][]byte) [][]byte { return append(lines[:1], lines[2:]...) },
+			wantLine: 2,
+		},
+		{
+			name: "reordered_records",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			wantLine: 2,
+		},
+		{
+			name: "inserted_plain_record",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:3:3], append([][]byte{[]byte(`{"metrics":["x"]}`)}, lines[3:]...)...)
+			},
+			wantLine: 4,
+		},
+		{
+			// The decoded entry is the same, the bytes of the line are not.
+			name: "added_field",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`{`), []byte(`{"extra":1,`), 1)
+				return lines
+			},
+			wantLine: 2,
+		},
+		{
+			name: "duplicated_key",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`{`), []byte(`{"addr":"10.0.0.1",`), 1)
+				return lines
+			},
+			wantLine: 2,
+		},
+		{
+			name: "reordered_keys",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`{"seq":2,`), []byte(`{`), 1)
+				lines[1] = bytes.Replace(lines[1], []byte(`"prev_hash"`), []byte(`"seq":2,"prev_hash"`), 1)
+				return lines
+			},
+			wantLine: 2,
+		},
+		{
+			name: "hash_not_last",
+			key:  key,
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = append(bytes.TrimSuffix(lines[1], []byte(`}`)), []byte(`,"extra":1}`)...)
+				return lines
+			},
+			wantLine: 2,
+		},
+		{name: "wrong_key", key: "other_key", tamper: func(lines [][]byte) [][]byte { return lines }, wantLine: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := VerifyChain(bytes.NewReader(join(tt.tamper(writeChain(t)))), tt.key)
+			if tt.wantLine == 0 {
+				require.NoError(t, err)
+				assert.Equal(t, ChainReport{
+					Entries:     4,
+					Records:     3,
+					Checkpoints: 1,
+					FirstSeq:    1,
+					LastSeq:     4,
+					Head:        report.Head,
+				}, report)
+				return
+			}
+			var chainErr *ChainError
+			require.ErrorAs(t, err, &chainErr)
+			assert.Equal(t, tt.wantLine, chainErr.Line)
+			assert.Equal(t, tt.wantLine-1, report.Entries, "entries before the broken link are reported")
+		})
+	}
+}
+
+func TestRunFileAudit_ResumeChain(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	key := "chain_key"
+	path := filepath.Join(t.TempDir(), "audit.json")
+
+	// run writes the records to the file and waits for the final checkpoint.
+	run := func(metrics ...string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan AuditMsg)
+		done := make(chan struct{})
+		go func() {
+			RunFileAudit(ctx, ch, path, FileOptions{ChainKey: key, CheckpointInterval: time.Hour}, logger)
+			close(done)
+		}()
+		for _, metric := range metrics {
+			ch <- AuditMsg{Metrics: []string{metric}}
+		}
+		cancel()
+		<-done
+	}
+	run("m1", "m2")
+	run("m3")
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	report, err := VerifyChain(f, key)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Records)
+	assert.Equal(t, 2, report.Checkpoints)
+	assert.Equal(t, uint64(5), report.LastSeq)
+	assert.Zero(t, report.Unanchored)
+}
+
 // Benchmark tests
 func BenchmarkAuditor_Send(b *testing.B) {
 	logger := zap.NewNop().Sugar()
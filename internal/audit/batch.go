@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of the batching sinks.
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 5 * time.Second
+	// maxPendingBatches bounds the records kept while the destination is down, in batches.
+	maxPendingBatches = 10
+	// shutdownFlushTimeout bounds the final flush after the context is done.
+	shutdownFlushTimeout = 5 * time.Second
+)
+
+// batchOptions holds the batching settings of the postgres and http_batch sinks.
+type batchOptions struct {
+	Size          int           // maximum number of records in a batch, defaultBatchSize if not set
+	FlushInterval time.Duration // maximum delay of a record in a batch, defaultFlushInterval if not set
+}
+
+// flushFunc delivers a batch of records. Errors wrapping errRejected discard the batch, other errors retry it.
+type flushFunc func(ctx context.Context, batch []AuditMsg) error
+
+// batcher collects the records of a sink into batches.
+// A batch is flushed when it is full and every flush interval. The records of a failed flush are kept and
+// retried on the next interval; while the destination is down at most maxPendingBatches batches are kept
+// and the oldest records are dropped.
+type batcher struct {
+	name    string
+	opts    batchOptions
+	flush   flushFunc
+	pending []AuditMsg
+	failed  bool // the last flush failed, the next one waits for the interval
+	count   atomic.Int64
+	dropped atomic.Int64
+	logger  *zap.SugaredLogger
+}
+
+// newBatcher creates a batcher with the defaults applied to the options.
+func newBatcher(name string, opts batchOptions, flush flushFunc, logger *zap.SugaredLogger) *batcher {
+	if opts.Size <= 0 {
+		opts.Size = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	return &batcher{name: name, opts: opts, flush: flush, logger: logger}
+}
+
+// Pending returns the number of records waiting for a flush.
+func (b *batcher) Pending() int {
+	return int(b.count.Load())
+}
+
+// Dropped returns the number of records dropped because the destination was down or rejected them.
+func (b *batcher) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Run collects the records of the channel until the context is done or the channel is closed,
+// then flushes the buffered records once more.
+func (b *batcher) Run(ctx context.Context, ch <-chan AuditMsg) {
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		// If the context is done, flush the buffered records and exit.
+		case <-ctx.Done():
+			for {
+				select {
+				case msg, ok := <-ch:
+					if !ok {
+						b.shutdown(ctx)
+						return
+					}
+					b.add(msg)
+				default:
+					b.shutdown(ctx)
+					return
+				}
+			}
+		// Flush the pending records periodically, it also retries the failed batches.
+		case <-ticker.C:
+			b.failed = false
+			b.flushAll(ctx)
+		case msg, ok := <-ch:
+			if !ok {
+				b.shutdown(ctx)
+				return
+			}
+			b.add(msg)
+			if len(b.pending) >= b.opts.Size && !b.failed {
+				b.flushAll(ctx)
+			}
+		}
+	}
+}
+
+// add appends the record to the pending ones, dropping the oldest when too many are kept.
+func (b *batcher) add(msg AuditMsg) {
+	b.pending = append(b.pending, msg)
+	if limit := maxPendingBatches * b.opts.Size; len(b.pending) > limit {
+		n := len(b.pending) - limit
+		b.pending = b.pending[n:]
+		b.dropped.Add(int64(n))
+		b.logger.Warnf("audit sink %s keeps too many undelivered records; dropping the oldest %d", b.name, n)
+	}
+	b.count.Store(int64(len(b.pending)))
+}
+
+// flushAll delivers the pending records in batches until they are all delivered or a flush fails.
+func (b *batcher) flushAll(ctx context.Context) {
+	defer func() { b.count.Store(int64(len(b.pending))) }()
+	for len(b.pending) > 0 {
+		n := min(len(b.pending), b.opts.Size)
+		err := b.flush(ctx, b.pending[:n])
+		switch {
+		case err == nil:
+		case errors.Is(err, errRejected):
+			b.dropped.Add(int64(n))
+			b.logger.Errorf("audit sink %s: %v; dropping %d records", b.name, err, n)
+		default:
+			b.failed = true
+			b.logger.Errorf("audit sink %s: %v", b.name, err)
+			return
+		}
+		// Release the delivered records, the pending slice is reused.
+		b.pending = append(b.pending[:0], b.pending[n:]...)
+	}
+}
+
+// shutdown flushes the pending records with a fresh deadline, the context of the sink is already done.
+func (b *batcher) shutdown(ctx context.Context) {
+	if len(b.pending) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownFlushTimeout)
+	defer cancel()
+	b.flushAll(ctx)
+	if len(b.pending) > 0 {
+		b.logger.Errorf("audit sink %s: %d records were not delivered on shutdown", b.name, len(b.pending))
+	}
+}
@@ -0,0 +1,214 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+)
+
+// defaultCheckpointInterval is used when the checkpoint interval is not configured.
+const defaultCheckpointInterval = time.Minute
+
+// maxEntrySize is the maximum size of a line of the audit file.
+const maxEntrySize = 1 << 20
+
+// ChainEntry is a line of the hash-chained audit file.
+// It is either an audit record, whose fields are kept at the top level, or a checkpoint.
+// The hash is the HMAC-SHA256 of the line as written with an empty hash, the previous hash links the entries.
+type ChainEntry struct {
+	Seq uint64 `json:"seq"` // position of the entry in the chain, starting from 1
+	*AuditMsg
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+	PrevHash   string      `json:"prev_hash"` // hash of the previous entry, empty for the first entry of the chain
+	Hash       string      `json:"hash"`      // HMAC-SHA256 of the entry, always the last field of the line
+
+	Line []byte `json:"-"` // encoded line of the entry as it is written to the file, without the newline
+}
+
+// hashSuffix ends every encoded entry, the hash is written between its quotes.
+const hashSuffix = `"hash":""}`
+
+// Checkpoint is a signed entry marking the state of the chain.
+// Checkpoints are written periodically and on shutdown, and are logged so that they can be kept outside of the file.
+type Checkpoint struct {
+	TimeStamp time.Time `json:"ts"`      // time of the checkpoint
+	Records   uint64    `json:"records"` // number of records written since the previous checkpoint
+}
+
+// Chain links the audit entries with HMAC-SHA256 hashes.
+type Chain struct {
+	key     string
+	seq     uint64
+	head    string
+	pending uint64
+}
+
+// NewChain creates an empty chain signed with the key.
+func NewChain(key string) *Chain {
+	return &Chain{key: key}
+}
+
+// Resume continues the chain after the last entry read from r.
+// Lines that are not chain entries are skipped, they are reported by VerifyChain.
+func (c *Chain) Resume(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEntrySize)
+	for scanner.Scan() {
+		var entry ChainEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Hash == "" {
+			continue
+		}
+		c.seq, c.head = entry.Seq, entry.Hash
+	}
+	return scanner.Err()
+}
+
+// Head returns the sequence number and the hash of the last entry.
+func (c *Chain) Head() (uint64, string) {
+	return c.seq, c.head
+}
+
+// Pending returns the number of records appended since the last checkpoint.
+func (c *Chain) Pending() uint64 {
+	return c.pending
+}
+
+// Append links the record to the chain.
+func (c *Chain) Append(msg AuditMsg) (ChainEntry, error) {
+	c.pending++
+	return c.link(ChainEntry{AuditMsg: &msg})
+}
+
+// Checkpoint links a checkpoint covering the records appended since the previous one.
+func (c *Chain) Checkpoint(now time.Time) (ChainEntry, error) {
+	entry, err := c.link(ChainEntry{Checkpoint: &Checkpoint{TimeStamp: now, Records: c.pending}})
+	if err == nil {
+		c.pending = 0
+	}
+	return entry, err
+}
+
+// link sets the sequence number and the hashes of the entry, encodes its line and moves the head of the chain.
+func (c *Chain) link(entry ChainEntry) (ChainEntry, error) {
+	entry.Seq = c.seq + 1
+	entry.PrevHash = c.head
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return entry, fmt.Errorf("encode audit entry: %w", err)
+	}
+	if !bytes.HasSuffix(data, []byte(hashSuffix)) {
+		return entry, fmt.Errorf("encode audit entry: the hash is not the last field")
+	}
+	entry.Hash = sign.Hash(data, c.key)
+	// The hash is inserted between the quotes of the empty hash, the rest of the hashed bytes is written as is.
+	cut := len(data) - len(`"}`)
+	entry.Line = slices.Concat(data[:cut], []byte(entry.Hash), data[cut:])
+	c.seq, c.head = entry.Seq, entry.Hash
+	return entry, nil
+}
+
+// unsignedLine returns the line with the value of its last field, the hash, emptied.
+// It reports false if the line does not end with the hash.
+func unsignedLine(line []byte, hash string) ([]byte, bool) {
+	suffix := []byte(hashSuffix[:len(hashSuffix)-len(`"}`)] + hash + `"}`)
+	if !bytes.HasSuffix(line, suffix) {
+		return nil, false
+	}
+	return slices.Concat(line[:len(line)-len(suffix)], []byte(hashSuffix)), true
+}
+
+// ChainReport is the summary of a verified chain.
+type ChainReport struct {
+	Entries     int    // number of entries
+	Records     int    // number of audit records
+	Checkpoints int    // number of checkpoints
+	Unanchored  int    // number of records after the last checkpoint
+	FirstSeq    uint64 // sequence number of the first entry
+	FirstPrev   string // hash the first entry links to, empty when the file starts the chain
+	LastSeq     uint64 // sequence number of the last entry
+	Head        string // hash of the last entry
+}
+
+// ChainError describes the first broken link of a chain.
+type ChainError struct {
+	Line   int    // line of the file, starting from 1
+	Seq    uint64 // sequence number of the entry, 0 if the line could not be decoded
+	Reason string // what is wrong with the entry
+}
+
+// Error implements the error interface.
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("broken audit chain at line %d (seq %d): %s", e.Line, e.Seq, e.Reason)
+}
+
+// VerifyChain walks the entries read from r and verifies their hashes and links.
+// The first entry may link to an entry of another file, its previous hash is reported in FirstPrev.
+// A broken link is returned as *ChainError together with the report of the entries before it.
+func VerifyChain(r io.Reader, key string) (ChainReport, error) {
+	var report ChainReport
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEntrySize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry ChainEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return report, &ChainError{Line: line, Reason: fmt.Sprintf("cannot decode entry: %v", err)}
+		}
+		if entry.Hash == "" {
+			return report, &ChainError{Line: line, Seq: entry.Seq, Reason: "entry is not chained"}
+		}
+		if (entry.AuditMsg == nil) == (entry.Checkpoint == nil) {
+			return report, &ChainError{Line: line, Seq: entry.Seq, Reason: "entry must be either a record or a checkpoint"}
+		}
+
+		// Check the link to the previous entry.
+		if report.Entries == 0 {
+			if entry.PrevHash == "" && entry.Seq != 1 {
+				return report, &ChainError{Line: line, Seq: entry.Seq, Reason: "chain does not start with seq 1"}
+			}
+			report.FirstSeq, report.FirstPrev = entry.Seq, entry.PrevHash
+		} else {
+			if entry.Seq != report.LastSeq+1 {
+				return report, &ChainError{Line: line, Seq: entry.Seq, Reason: fmt.Sprintf("expected seq %d", report.LastSeq+1)}
+			}
+			if entry.PrevHash != report.Head {
+				return report, &ChainError{Line: line, Seq: entry.Seq, Reason: "previous hash does not match the previous entry"}
+			}
+		}
+
+		// Check the hash of the line as read, so that any change of its bytes breaks the chain.
+		unsigned, ok := unsignedLine(scanner.Bytes(), entry.Hash)
+		if !ok {
+			return report, &ChainError{Line: line, Seq: entry.Seq, Reason: "hash is not the last field of the entry"}
+		}
+		if hash := sign.Hash(unsigned, key); !hmac.Equal([]byte(hash), []byte(entry.Hash)) {
+			return report, &ChainError{Line: line, Seq: entry.Seq, Reason: "hash mismatch, the entry was modified or the key is wrong"}
+		}
+
+		report.Entries++
+		report.LastSeq, report.Head = entry.Seq, entry.Hash
+		if entry.Checkpoint != nil {
+			report.Checkpoints++
+			report.Unanchored = 0
+		} else {
+			report.Records++
+			report.Unanchored++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("read audit file: %w", err)
+	}
+	return report, nil
+}
@@ -1,7 +1,48 @@
 // Package audit provides configuration structures for the audit component.
 package audit
 
+// Overflow policies of the audit buffers.
+const (
+	PolicyBlock      = "block"       // wait for free space in the subscriber buffers, the queue of Send drops the incoming record
+	PolicyDropOldest = "drop_oldest" // discard the oldest buffered record
+	PolicyDropNewest = "drop_newest" // discard the incoming record
+)
+
+// Types of the audit sinks.
+const (
+	SinkFile      = "file"       // hash-chained JSON lines file
+	SinkURL       = "url"        // HTTP POST of every record
+	SinkSyslog    = "syslog"     // RFC 5424 syslog over UDP, TCP or a unix socket
+	SinkPostgres  = "postgres"   // audit table of a Postgres database
+	SinkHTTPBatch = "http_batch" // HTTP POST of batches of records
+)
+
+// SinkConfig configures an audit sink of the Sinks list.
+type SinkConfig struct {
+	Type            string `json:"type"`              // Type of the sink: file, url, syslog, postgres or http_batch
+	Name            string `json:"name"`              // Name of the sink in the stats and logs, the type by default
+	Path            string `json:"path"`              // file: path of the audit file
+	URL             string `json:"url"`               // url, http_batch: endpoint; syslog: udp://host:port, tcp://host:port, unix:///dev/log or unixgram:///dev/log
+	DSN             string `json:"dsn"`               // postgres: DSN of the database, the repository DSN by default
+	SpoolFile       string `json:"spool_file"`        // url: file spooling the undelivered records
+	SpoolMaxRecords int    `json:"spool_max_records"` // url: maximum number of spooled records, 10000 by default
+	Tag             string `json:"tag"`               // syslog: APP-NAME of the messages
+	BatchSize       int    `json:"batch_size"`        // postgres, http_batch: maximum number of records in a batch
+	FlushInterval   int    `json:"flush_interval"`    // postgres, http_batch: maximum delay of a record in a batch, s
+}
+
 type AuditConfig struct {
-	AuditFile string `env:"AUDIT_FILE" json:"audit_file"` // File path for storing audit data
-	AuditURL  string `env:"AUDIT_URL" json:"audit_url"`   // URL for sending audit data to the remote server
+	AuditFile          string       `env:"AUDIT_FILE" json:"audit_file"`                         // File path for storing audit data
+	AuditURL           string       `env:"AUDIT_URL" json:"audit_url"`                           // URL for sending audit data to the remote server
+	BufferSize         int          `env:"AUDIT_BUFFER_SIZE" json:"buffer_size"`                 // Size of the audit queue and of every subscriber buffer
+	OverflowPolicy     string       `env:"AUDIT_OVERFLOW_POLICY" json:"overflow_policy"`         // Policy for full buffers: drop_newest (default), drop_oldest or block
+	SpoolFile          string       `env:"AUDIT_SPOOL_FILE" json:"spool_file"`                   // File spooling the records the URL auditor could not deliver
+	SpoolMaxRecords    int          `env:"AUDIT_SPOOL_MAX_RECORDS" json:"spool_max_records"`     // Maximum number of spooled records, the new ones are dropped above it; 10000 by default
+	ChainKey           string       `env:"AUDIT_CHAIN_KEY" json:"chain_key"`                     // HMAC key of the hash chain of the audit file
+	CheckpointInterval int          `env:"AUDIT_CHECKPOINT_INTERVAL" json:"checkpoint_interval"` // Interval of the signed checkpoints of the audit file, s
+	MaxSize            int          `env:"AUDIT_MAX_SIZE" json:"max_size"`                       // Size of the audit file triggering the rotation, MB; 0 disables size rotation
+	RotateInterval     int          `env:"AUDIT_ROTATE_INTERVAL" json:"rotate_interval"`         // Age of the audit file triggering the rotation, s; 0 disables time rotation
+	MaxBackups         int          `env:"AUDIT_MAX_BACKUPS" json:"max_backups"`                 // Number of rotated audit segments to keep; 0 keeps all
+	MaxAge             int          `env:"AUDIT_MAX_AGE" json:"max_age"`                         // Age of the rotated audit segments to keep, h; 0 keeps all
+	Sinks              []SinkConfig `json:"sinks"`                                               // Additional sinks, set in the JSON config
 }
@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+// HTTPBatchSink posts the records to the URL in batches, as a JSON array per request.
+type HTTPBatchSink struct {
+	*batcher
+	name   string
+	url    string
+	client *resty.Client
+}
+
+// NewHTTPBatchSink creates a batched HTTP sink.
+func NewHTTPBatchSink(name, url string, opts batchOptions, logger *zap.SugaredLogger) *HTTPBatchSink {
+	s := &HTTPBatchSink{
+		name:   name,
+		url:    url,
+		client: resty.New().SetTimeout(10 * time.Second),
+	}
+	s.batcher = newBatcher(name, opts, s.post, logger)
+	return s
+}
+
+// Name returns the name of the sink.
+func (s *HTTPBatchSink) Name() string {
+	return s.name
+}
+
+// post sends the batch, a 4xx status other than 408 and 429 rejects it.
+func (s *HTTPBatchSink) post(ctx context.Context, batch []AuditMsg) error {
+	resp, err := s.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(batch).
+		SetContext(ctx).
+		Post(s.url)
+	if err != nil {
+		return fmt.Errorf("send audit batch to %s: %w", s.url, err)
+	}
+	if resp.IsError() {
+		if resp.StatusCode() < http.StatusInternalServerError &&
+			resp.StatusCode() != http.StatusRequestTimeout && resp.StatusCode() != http.StatusTooManyRequests {
+			return fmt.Errorf("%w by %s: status %s", errRejected, s.url, resp.Status())
+		}
+		return fmt.Errorf("send audit batch to %s: unexpected status %s", s.url, resp.Status())
+	}
+	return nil
+}
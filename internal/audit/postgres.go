@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/db/migrations"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// insertAuditQuery inserts a record into the audit table created by the migrations.
+const insertAuditQuery = `INSERT INTO audit (ts, ip_address, endpoint, request_id, metrics, record)
+VALUES ($1, $2, $3, $4, $5, $6)`
+
+// PostgresSink inserts the records into the audit table of a Postgres database in batches.
+// The database is connected and migrated on the first flush, a failed connection is retried with the batch.
+type PostgresSink struct {
+	*batcher
+	name   string
+	dsn    string
+	pool   *pgxpool.Pool
+	logger *zap.SugaredLogger
+}
+
+// NewPostgresSink creates a Postgres sink.
+func NewPostgresSink(name, dsn string, opts batchOptions, logger *zap.SugaredLogger) *PostgresSink {
+	s := &PostgresSink{name: name, dsn: dsn, logger: logger}
+	s.batcher = newBatcher(name, opts, s.insert, logger)
+	return s
+}
+
+// Name returns the name of the sink.
+func (s *PostgresSink) Name() string {
+	return s.name
+}
+
+// Run inserts the records until the context is done and closes the connection pool.
+func (s *PostgresSink) Run(ctx context.Context, ch <-chan AuditMsg) {
+	s.batcher.Run(ctx, ch)
+	if s.pool != nil {
+		s.pool.Close()
+	}
+}
+
+// connect migrates the database and opens the connection pool.
+func (s *PostgresSink) connect(ctx context.Context) error {
+	if err := migrations.RunMigrations(s.dsn, true); err != nil {
+		return fmt.Errorf("failed to run DB migrations: %w", err)
+	}
+	pool, err := pgxpool.New(ctx, s.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to initialize a connection pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return fmt.Errorf("failed to ping the DB: %w", err)
+	}
+	s.pool = pool
+	return nil
+}
+
+// insert inserts the batch in a transaction, records the database refuses as invalid reject the batch.
+func (s *PostgresSink) insert(ctx context.Context, batch []AuditMsg) error {
+	if s.pool == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	b := &pgx.Batch{}
+	for _, msg := range batch {
+		record, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("%w: encode audit record: %v", errRejected, err)
+		}
+		metrics := msg.Metrics
+		if metrics == nil {
+			metrics = []string{}
+		}
+		b.Queue(insertAuditQuery, msg.TimeStamp, msg.Addr, msg.Endpoint, msg.RequestID, metrics, string(record))
+	}
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, b).Close()
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgerrcode.IsDataException(pgErr.Code) {
+			return fmt.Errorf("%w: insert audit records: %v", errRejected, err)
+		}
+		return fmt.Errorf("insert audit records: %w", err)
+	}
+	return nil
+}
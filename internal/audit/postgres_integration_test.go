@@ -0,0 +1,108 @@
+//go:build integration_tests
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// runPostgres starts a postgres container and returns its DSN.
+func runPostgres(t *testing.T) string {
+	pool, err := dockertest.NewPool("")
+	require.NoError(t, err, "failed to initialize a pool")
+
+	pg, err := pool.RunWithOptions(
+		&dockertest.RunOptions{
+			Repository: "postgres",
+			Tag:        "17.2",
+			Name:       "audit-integration-tests",
+			Env: []string{
+				"POSTGRES_USER=postgres",
+				"POSTGRES_PASSWORD=postgres",
+			},
+			ExposedPorts: []string{"5432/tcp"},
+		},
+		func(config *docker.HostConfig) {
+			config.AutoRemove = true
+			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		},
+	)
+	require.NoError(t, err, "failed to run the postgres container")
+	t.Cleanup(func() {
+		if err := pool.Purge(pg); err != nil {
+			t.Logf("failed to purge the postgres container: %v", err)
+		}
+	})
+
+	dsn := fmt.Sprintf("postgres://postgres:postgres@%s/postgres?sslmode=disable", pg.GetHostPort("5432/tcp"))
+	pool.MaxWait = 10 * time.Second
+	require.NoError(t, pool.Retry(func() error {
+		conn, err := pgx.Connect(context.Background(), dsn)
+		if err != nil {
+			return err
+		}
+		return conn.Close(context.Background())
+	}), "failed to connect to the DB")
+	return dsn
+}
+
+func TestPostgresSink(t *testing.T) {
+	dsn := runPostgres(t)
+	logger := zaptest.NewLogger(t).Sugar()
+
+	sink := NewPostgresSink("postgres", dsn, batchOptions{Size: 2, FlushInterval: time.Hour}, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan AuditMsg)
+	done := make(chan struct{})
+	go func() {
+		sink.Run(ctx, ch)
+		close(done)
+	}()
+
+	// The full batch is inserted at once, the rest on shutdown.
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	ch <- AuditMsg{TimeStamp: ts, Addr: "127.0.0.1", Metrics: []string{"m1"}, Endpoint: "POST /update", RequestID: "r1"}
+	ch <- AuditMsg{TimeStamp: ts, Addr: "127.0.0.1", Metrics: []string{"m2", "m3"}}
+	ch <- AuditMsg{TimeStamp: ts, Addr: "127.0.0.1"}
+	cancel()
+	<-done
+	assert.Zero(t, sink.Pending())
+
+	conn, err := pgx.Connect(context.Background(), dsn)
+	require.NoError(t, err)
+	defer conn.Close(context.Background())
+
+	rows, err := conn.Query(context.Background(),
+		`SELECT ts, endpoint, request_id, metrics, record->>'ip_address' FROM audit ORDER BY id`)
+	require.NoError(t, err)
+	type row struct {
+		ts        time.Time
+		endpoint  string
+		requestID string
+		metrics   []string
+		addr      string
+	}
+	got, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (row, error) {
+		var res row
+		err := r.Scan(&res.ts, &res.endpoint, &res.requestID, &res.metrics, &res.addr)
+		return res, err
+	})
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.True(t, ts.Equal(got[0].ts))
+	assert.Equal(t, "POST /update", got[0].endpoint)
+	assert.Equal(t, "r1", got[0].requestID)
+	assert.Equal(t, []string{"m2", "m3"}, got[1].metrics)
+	assert.Equal(t, []string{}, got[2].metrics)
+	assert.Equal(t, "127.0.0.1", got[2].addr)
+}
@@ -0,0 +1,319 @@
+package audit
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// segmentTimeFormat is the format of the rotation time appended to the names of the rotated segments.
+const segmentTimeFormat = "20060102T150405.000"
+
+// gzipExt is the extension of the compressed segments.
+const gzipExt = ".gz"
+
+// FileOptions holds the chaining and rotation settings of the file auditor.
+type FileOptions struct {
+	ChainKey           string          // key of the hash chain
+	CheckpointInterval time.Duration   // interval of the checkpoints, defaultCheckpointInterval if not set
+	MaxSize            int64           // size of the file triggering the rotation, bytes; 0 disables size rotation
+	RotateInterval     time.Duration   // age of the file triggering the rotation; 0 disables time rotation
+	MaxBackups         int             // number of rotated segments to keep; 0 keeps all
+	MaxAge             time.Duration   // age of the rotated segments to keep; 0 keeps all
+	Reopen             <-chan struct{} // reopens the file after it was moved by an external tool
+}
+
+// rotatingFile is the audit file with its rotated segments.
+// The rotated segments are named <path>.<rotation time> and are gzipped in the background.
+type rotatingFile struct {
+	path    string
+	opts    FileOptions
+	f       *os.File
+	size    int64
+	opened  time.Time
+	rotated time.Time // rotation time of the last segment
+	wg      sync.WaitGroup
+	mu      sync.Mutex // serializes the compression and cleanup of the segments
+	logger  *zap.SugaredLogger
+}
+
+// openRotatingFile opens the audit file for appending.
+func openRotatingFile(path string, opts FileOptions, logger *zap.SugaredLogger) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, opts: opts, logger: logger}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file at the path, creating it if needed.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("open audit file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat audit file: %w", err)
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends the data to the file.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Size returns the size of the file.
+func (r *rotatingFile) Size() int64 {
+	return r.size
+}
+
+// NeedsRotation reports whether the file reached the maximum size or age.
+// An empty file is never rotated.
+func (r *rotatingFile) NeedsRotation(now time.Time) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.opts.MaxSize > 0 && r.size >= r.opts.MaxSize {
+		return true
+	}
+	return r.opts.RotateInterval > 0 && now.Sub(r.opened) >= r.opts.RotateInterval
+}
+
+// Rotate moves the file aside and opens a new one, the old segment is compressed in the background.
+// If the new file cannot be opened, the old one is moved back and the writes continue to it.
+func (r *rotatingFile) Rotate(now time.Time) error {
+	segment := r.segmentName(now)
+	if err := os.Rename(r.path, segment); err != nil {
+		return fmt.Errorf("rotate audit file: %w", err)
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		if renameErr := os.Rename(segment, r.path); renameErr != nil {
+			r.logger.Errorf("restore audit file: %v", renameErr)
+		}
+		return err
+	}
+	r.closeFile(old)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err := compressSegment(segment); err != nil {
+			r.logger.Errorf("compress audit segment: %v", err)
+		}
+		r.cleanup(time.Now())
+	}()
+	return nil
+}
+
+// segmentName returns an unused name for the segment rotated at now.
+// The rotation times in the names are strictly increasing, so that the names sort in the rotation order.
+func (r *rotatingFile) segmentName(now time.Time) string {
+	stamp := now.UTC().Truncate(time.Millisecond)
+	if !stamp.After(r.rotated) {
+		stamp = r.rotated.Add(time.Millisecond)
+	}
+	for {
+		segment := r.path + "." + stamp.Format(segmentTimeFormat)
+		_, err := os.Stat(segment)
+		_, errGz := os.Stat(segment + gzipExt)
+		if os.IsNotExist(err) && os.IsNotExist(errGz) {
+			r.rotated = stamp
+			return segment
+		}
+		stamp = stamp.Add(time.Millisecond)
+	}
+}
+
+// Reopen closes the file and opens the path again, after the file was moved by an external tool.
+// If the path cannot be opened, the writes continue to the old file.
+func (r *rotatingFile) Reopen() error {
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.closeFile(old)
+	return nil
+}
+
+// Close closes the file and waits for the compression of the rotated segments.
+func (r *rotatingFile) Close() {
+	r.closeFile(r.f)
+	r.wg.Wait()
+}
+
+// closeFile syncs and closes the file.
+func (r *rotatingFile) closeFile(f *os.File) {
+	if err := f.Sync(); err != nil {
+		r.logger.Errorf("sync audit file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		r.logger.Errorf("close audit file: %v", err)
+	}
+}
+
+// Segments returns the paths of the rotated segments, oldest first.
+func (r *rotatingFile) Segments() ([]string, error) {
+	return listSegments(r.path)
+}
+
+// cleanup removes the segments exceeding the maximum count or age.
+func (r *rotatingFile) cleanup(now time.Time) {
+	if r.opts.MaxBackups <= 0 && r.opts.MaxAge <= 0 {
+		return
+	}
+	segments, err := listSegments(r.path)
+	if err != nil {
+		r.logger.Errorf("list audit segments: %v", err)
+		return
+	}
+	for i, segment := range segments {
+		expired := r.opts.MaxBackups > 0 && len(segments)-i > r.opts.MaxBackups
+		if r.opts.MaxAge > 0 {
+			if rotated, ok := segmentTime(r.path, segment); ok && now.Sub(rotated) > r.opts.MaxAge {
+				expired = true
+			}
+		}
+		if !expired {
+			continue
+		}
+		if err := os.Remove(segment); err != nil {
+			r.logger.Errorf("remove audit segment: %v", err)
+			continue
+		}
+		r.logger.Infof("removed audit segment %s", segment)
+	}
+}
+
+// listSegments returns the rotated segments of the file, oldest first.
+// A segment is listed once, compressed or not.
+func listSegments(path string) ([]string, error) {
+	matches, err := filepath.Glob(globEscape(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+	byTime := make(map[string]string)
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, path+".")
+		stamp := strings.TrimSuffix(suffix, gzipExt)
+		if _, err := time.Parse(segmentTimeFormat, stamp); err != nil {
+			continue
+		}
+		// Prefer the uncompressed segment while it is being compressed.
+		if prev, ok := byTime[stamp]; ok && !strings.HasSuffix(prev, gzipExt) {
+			continue
+		}
+		byTime[stamp] = match
+	}
+	stamps := make([]string, 0, len(byTime))
+	for stamp := range byTime {
+		stamps = append(stamps, stamp)
+	}
+	sort.Strings(stamps)
+	segments := make([]string, 0, len(stamps))
+	for _, stamp := range stamps {
+		segments = append(segments, byTime[stamp])
+	}
+	return segments, nil
+}
+
+// segmentTime returns the rotation time of the segment.
+func segmentTime(path, segment string) (time.Time, bool) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(segment, path+"."), gzipExt)
+	t, err := time.Parse(segmentTimeFormat, stamp)
+	return t, err == nil
+}
+
+// globEscape escapes the meta characters of filepath.Match in the path.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// compressSegment gzips the segment and removes the uncompressed file.
+func compressSegment(segment string) error {
+	src, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := segment + gzipExt + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, segment+gzipExt); err != nil {
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// OpenSegment opens an audit file or segment for reading, gzipped segments are decompressed.
+func OpenSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, gzipExt) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("open gzipped audit segment: %w", err)
+	}
+	return &gzipFile{Reader: zr, f: f}, nil
+}
+
+// gzipFile closes both the gzip reader and the file.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+// Close closes the gzip reader and the file.
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
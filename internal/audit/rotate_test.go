@@ -0,0 +1,175 @@
+package audit
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// runFileAudit runs the file auditor until all the metrics are written.
+func runFileAudit(t *testing.T, path string, opts FileOptions, metrics ...string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan AuditMsg, len(metrics))
+	done := make(chan struct{})
+	go func() {
+		RunFileAudit(ctx, ch, path, opts, zaptest.NewLogger(t).Sugar())
+		close(done)
+	}()
+	for _, metric := range metrics {
+		ch <- AuditMsg{Metrics: []string{metric}}
+	}
+	// The records buffered in the channel are written before the auditor exits.
+	cancel()
+	<-done
+}
+
+// verifySegments verifies the chain of the segments and the file, and returns the reports.
+func verifySegments(t *testing.T, key string, paths []string) []ChainReport {
+	t.Helper()
+	var reports []ChainReport
+	for i, path := range paths {
+		r, err := OpenSegment(path)
+		require.NoError(t, err)
+		report, err := VerifyChain(r, key)
+		require.NoError(t, r.Close())
+		require.NoError(t, err, path)
+		if i > 0 {
+			assert.Equal(t, reports[i-1].Head, report.FirstPrev, "%s should continue the chain of the previous segment", path)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func TestRunFileAudit_Rotation(t *testing.T) {
+	key := "chain_key"
+	metrics := make([]string, 10)
+	for i := range metrics {
+		metrics[i] = "metric_" + strings.Repeat("x", i)
+	}
+
+	t.Run("keep_all", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.json")
+		runFileAudit(t, path, FileOptions{ChainKey: key, MaxSize: 400}, metrics...)
+
+		segments, err := listSegments(path)
+		require.NoError(t, err)
+		require.Greater(t, len(segments), 1)
+		for _, segment := range segments {
+			assert.True(t, strings.HasSuffix(segment, gzipExt), "%s should be compressed", segment)
+		}
+
+		// No record is lost and every segment ends with a checkpoint.
+		records := 0
+		for _, report := range verifySegments(t, key, append(segments, path)) {
+			records += report.Records
+			assert.Zero(t, report.Unanchored)
+		}
+		assert.Equal(t, len(metrics), records)
+	})
+
+	t.Run("max_backups", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.json")
+		runFileAudit(t, path, FileOptions{ChainKey: key, MaxSize: 400, MaxBackups: 2}, metrics...)
+
+		segments, err := listSegments(path)
+		require.NoError(t, err)
+		assert.Len(t, segments, 2)
+		verifySegments(t, key, append(segments, path))
+	})
+
+	t.Run("resume_after_rotation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.json")
+		runFileAudit(t, path, FileOptions{ChainKey: key, MaxSize: 1}, "m1")
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Zero(t, info.Size(), "the file should be rotated after the record")
+
+		// The new file continues the chain of the last segment.
+		runFileAudit(t, path, FileOptions{ChainKey: key}, "m2")
+		segments, err := listSegments(path)
+		require.NoError(t, err)
+		verifySegments(t, key, append(segments, path))
+	})
+}
+
+func TestRunFileAudit_Reopen(t *testing.T) {
+	key := "chain_key"
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.json")
+	moved := filepath.Join(dir, "audit.json.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan AuditMsg)
+	reopen := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		RunFileAudit(ctx, ch, path, FileOptions{ChainKey: key, Reopen: reopen}, zaptest.NewLogger(t).Sugar())
+		close(done)
+	}()
+
+	ch <- AuditMsg{Metrics: []string{"m1"}}
+	// Move the file like logrotate does and signal the auditor.
+	require.NoError(t, os.Rename(path, moved))
+	reopen <- struct{}{}
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	ch <- AuditMsg{Metrics: []string{"m2"}}
+	cancel()
+	<-done
+
+	reports := verifySegments(t, key, []string{moved, path})
+	assert.Equal(t, 1, reports[0].Records)
+	assert.Equal(t, 1, reports[0].Checkpoints, "the moved file should end with a checkpoint")
+	assert.Equal(t, 1, reports[1].Records)
+}
+
+func TestRotatingFile_Cleanup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.json")
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	var segments []string
+	for _, age := range []time.Duration{72 * time.Hour, 30 * time.Hour, 2 * time.Hour, time.Hour} {
+		segment := path + "." + now.Add(-age).Format(segmentTimeFormat) + gzipExt
+		require.NoError(t, os.WriteFile(segment, nil, 0o600))
+		segments = append(segments, segment)
+	}
+	// Files that are not segments are kept.
+	other := path + ".bak"
+	require.NoError(t, os.WriteFile(other, nil, 0o600))
+
+	r := &rotatingFile{path: path, opts: FileOptions{MaxBackups: 3, MaxAge: 24 * time.Hour}, logger: zaptest.NewLogger(t).Sugar()}
+	r.cleanup(now)
+
+	got, err := listSegments(path)
+	require.NoError(t, err)
+	assert.Equal(t, segments[2:], got)
+	assert.FileExists(t, other)
+}
+
+func TestOpenSegment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json.20261018T120000.000")
+	require.NoError(t, os.WriteFile(path, []byte("line\n"), 0o600))
+	require.NoError(t, compressSegment(path))
+	assert.NoFileExists(t, path)
+
+	r, err := OpenSegment(path + gzipExt)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "line\n", string(data))
+}
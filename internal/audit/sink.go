@@ -0,0 +1,172 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	"go.uber.org/zap"
+)
+
+// Sink is a destination of the audit records.
+// The auditor registers a subscription per sink and runs the sink with it until the context is done.
+// On shutdown the sink should deliver or keep the records left in the channel.
+type Sink interface {
+	Name() string                                // unique name of the sink, used in the stats and logs
+	Run(ctx context.Context, ch <-chan AuditMsg) // consumes the records of the channel
+}
+
+// reopener is implemented by the sinks that can reopen their files.
+type reopener interface {
+	Reopen()
+}
+
+// pendingCounter is implemented by the sinks that keep undelivered records.
+type pendingCounter interface {
+	Pending() int
+}
+
+// dropCounter is implemented by the sinks that drop records they could not deliver.
+type dropCounter interface {
+	Dropped() int64
+}
+
+// FileSink writes the records to the hash-chained, rotated audit file.
+type FileSink struct {
+	name   string
+	path   string
+	opts   FileOptions
+	reopen chan struct{}
+	logger *zap.SugaredLogger
+}
+
+// NewFileSink creates a file sink. The Reopen channel of the options is replaced by the one of the sink.
+func NewFileSink(name, path string, opts FileOptions, logger *zap.SugaredLogger) *FileSink {
+	reopen := make(chan struct{}, 1)
+	opts.Reopen = reopen
+	return &FileSink{name: name, path: path, opts: opts, reopen: reopen, logger: logger}
+}
+
+// Name returns the name of the sink.
+func (s *FileSink) Name() string {
+	return s.name
+}
+
+// Run writes the records to the file, see RunFileAudit.
+func (s *FileSink) Run(ctx context.Context, ch <-chan AuditMsg) {
+	RunFileAudit(ctx, ch, s.path, s.opts, s.logger)
+}
+
+// Reopen makes the sink close the file and open it again.
+func (s *FileSink) Reopen() {
+	select {
+	case s.reopen <- struct{}{}:
+	default:
+		// A reopen is already pending.
+	}
+}
+
+// URLSink posts every record to the URL, see RunURLAudit.
+type URLSink struct {
+	name   string
+	url    string
+	spool  *Spool
+	logger *zap.SugaredLogger
+}
+
+// NewURLSink creates a URL sink, the records that cannot be delivered are kept in the spool when it is not nil.
+func NewURLSink(name, url string, spool *Spool, logger *zap.SugaredLogger) *URLSink {
+	return &URLSink{name: name, url: url, spool: spool, logger: logger}
+}
+
+// Name returns the name of the sink.
+func (s *URLSink) Name() string {
+	return s.name
+}
+
+// Run posts the records to the URL.
+func (s *URLSink) Run(ctx context.Context, ch <-chan AuditMsg) {
+	RunURLAudit(ctx, ch, s.url, s.spool, s.logger)
+}
+
+// Pending returns the number of spooled records.
+func (s *URLSink) Pending() int {
+	if s.spool == nil {
+		return 0
+	}
+	return s.spool.Len()
+}
+
+// Dropped returns the number of records dropped because the spool was full.
+func (s *URLSink) Dropped() int64 {
+	if s.spool == nil {
+		return 0
+	}
+	return s.spool.Dropped()
+}
+
+// newSinks creates the sinks of the configuration: the file and URL sinks of AuditFile and AuditURL
+// followed by the sinks of the Sinks list. Sinks without a name are named after their type,
+// a name that is already taken gets a numeric suffix.
+func newSinks(config cfg.AuditConfig, fileOpts FileOptions, logger *zap.SugaredLogger) []Sink {
+	configs := make([]cfg.SinkConfig, 0, len(config.Sinks)+2)
+	if config.AuditFile != "" {
+		configs = append(configs, cfg.SinkConfig{Type: cfg.SinkFile, Path: config.AuditFile})
+	}
+	if config.AuditURL != "" {
+		configs = append(configs, cfg.SinkConfig{Type: cfg.SinkURL, URL: config.AuditURL, SpoolFile: config.SpoolFile, SpoolMaxRecords: config.SpoolMaxRecords})
+	}
+	configs = append(configs, config.Sinks...)
+
+	var sinks []Sink
+	names := make(map[string]bool)
+	for _, sc := range configs {
+		base := sc.Name
+		if base == "" {
+			base = sc.Type
+		}
+		name := base
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		sink, err := newSink(name, sc, fileOpts, logger)
+		if err != nil {
+			logger.Errorf("create audit sink %s: %v", name, err)
+			continue
+		}
+		names[name] = true
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// newSink creates a sink of the configured type.
+func newSink(name string, sc cfg.SinkConfig, fileOpts FileOptions, logger *zap.SugaredLogger) (Sink, error) {
+	batch := batchOptions{
+		Size:          sc.BatchSize,
+		FlushInterval: time.Duration(sc.FlushInterval) * time.Second,
+	}
+	switch sc.Type {
+	case cfg.SinkFile:
+		return NewFileSink(name, sc.Path, fileOpts, logger), nil
+	case cfg.SinkURL:
+		var spool *Spool
+		if sc.SpoolFile != "" {
+			var err error
+			if spool, err = NewSpool(sc.SpoolFile, sc.SpoolMaxRecords); err != nil {
+				// The records are still delivered, only the failed ones are lost.
+				logger.Errorf("open audit spool: %v", err)
+			}
+		}
+		return NewURLSink(name, sc.URL, spool, logger), nil
+	case cfg.SinkSyslog:
+		return NewSyslogSink(name, sc.URL, sc.Tag, logger)
+	case cfg.SinkPostgres:
+		return NewPostgresSink(name, sc.DSN, batch, logger), nil
+	case cfg.SinkHTTPBatch:
+		return NewHTTPBatchSink(name, sc.URL, batch, logger), nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink type %q", sc.Type)
+	}
+}
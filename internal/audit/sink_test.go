@@ -0,0 +1,274 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// sinkNames returns the names of the sinks.
+func sinkNames(sinks []Sink) []string {
+	var names []string
+	for _, s := range sinks {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+func TestNewSinks(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	config := cfg.AuditConfig{
+		AuditFile: "/tmp/audit.json",
+		Sinks: []cfg.SinkConfig{
+			{Type: cfg.SinkFile, Path: "/tmp/audit2.json"},
+			{Type: cfg.SinkSyslog, Name: "siem", URL: "udp://127.0.0.1:514"},
+			{Type: cfg.SinkSyslog, Name: "siem", URL: "tcp://127.0.0.1"},
+			{Type: cfg.SinkSyslog, URL: "http://127.0.0.1"},
+			{Type: cfg.SinkPostgres, DSN: "postgres://localhost/metrics"},
+			{Type: cfg.SinkHTTPBatch, URL: "http://127.0.0.1/audit"},
+			{Type: "kafka"},
+		},
+	}
+	sinks := newSinks(config, FileOptions{}, logger)
+
+	// Invalid sinks are skipped, taken names get a suffix.
+	assert.Equal(t, []string{"file", "file-2", "siem", "siem-2", "postgres", "http_batch"}, sinkNames(sinks))
+	assert.IsType(t, &FileSink{}, sinks[1])
+	assert.IsType(t, &SyslogSink{}, sinks[3])
+	assert.Equal(t, "127.0.0.1:514", sinks[3].(*SyslogSink).addr)
+	assert.IsType(t, &PostgresSink{}, sinks[4])
+	assert.IsType(t, &HTTPBatchSink{}, sinks[5])
+	assert.Equal(t, defaultBatchSize, sinks[5].(*HTTPBatchSink).opts.Size)
+}
+
+// syslogRE matches the RFC 5424 messages of the syslog sink.
+var syslogRE = regexp.MustCompile(`^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z \S+ test \d+ audit - (\{.*\})$`)
+
+func TestSyslogSink(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+
+	// listen returns the address of a syslog listener and a channel of the received messages.
+	listeners := map[string]func(t *testing.T) (string, <-chan string){
+		"udp": func(t *testing.T) (string, <-chan string) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(t, err)
+			t.Cleanup(func() { conn.Close() })
+			out := make(chan string, 10)
+			go func() {
+				buf := make([]byte, 64*1024)
+				for {
+					n, _, err := conn.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					out <- string(buf[:n])
+				}
+			}()
+			return "udp://" + conn.LocalAddr().String(), out
+		},
+		"tcp": func(t *testing.T) (string, <-chan string) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			t.Cleanup(func() { ln.Close() })
+			out := make(chan string, 10)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				// Octet-counting framing: MSG-LEN SP SYSLOG-MSG.
+				for {
+					length, err := r.ReadString(' ')
+					if err != nil {
+						return
+					}
+					n, err := strconv.Atoi(strings.TrimSpace(length))
+					if err != nil {
+						return
+					}
+					msg := make([]byte, n)
+					if _, err := io.ReadFull(r, msg); err != nil {
+						return
+					}
+					out <- string(msg)
+				}
+			}()
+			return "tcp://" + ln.Addr().String(), out
+		},
+	}
+
+	for network, listen := range listeners {
+		t.Run(network, func(t *testing.T) {
+			addr, received := listen(t)
+			sink, err := NewSyslogSink("syslog", addr, "test", logger)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan AuditMsg)
+			go sink.Run(ctx, ch)
+
+			for _, metric := range []string{"m1", "m2"} {
+				ch <- AuditMsg{TimeStamp: time.Now(), Addr: "127.0.0.1", Metrics: []string{metric}}
+			}
+			for _, metric := range []string{"m1", "m2"} {
+				select {
+				case msg := <-received:
+					match := syslogRE.FindStringSubmatch(msg)
+					require.NotNil(t, match, "not an RFC 5424 message: %s", msg)
+					var record AuditMsg
+					require.NoError(t, json.Unmarshal([]byte(match[1]), &record))
+					assert.Equal(t, []string{metric}, record.Metrics)
+				case <-time.After(time.Second):
+					t.Fatal("syslog message was not received")
+				}
+			}
+			assert.Zero(t, sink.Dropped())
+		})
+	}
+}
+
+func TestParseSyslogAddr(t *testing.T) {
+	tests := []struct {
+		addr        string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{addr: "udp://syslog.local:5514", wantNetwork: "udp", wantAddr: "syslog.local:5514"},
+		{addr: "tcp://syslog.local", wantNetwork: "tcp", wantAddr: "syslog.local:514"},
+		{addr: "unixgram:///dev/log", wantNetwork: "unixgram", wantAddr: "/dev/log"},
+		{addr: "unix:///run/syslog.sock", wantNetwork: "unix", wantAddr: "/run/syslog.sock"},
+		{addr: "udp://", wantErr: true},
+		{addr: "unix://", wantErr: true},
+		{addr: "https://syslog.local", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, addr, err := parseSyslogAddr(tt.addr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantNetwork, network)
+			assert.Equal(t, tt.wantAddr, addr)
+		})
+	}
+}
+
+func TestHTTPBatchSink(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+
+	var (
+		mu      sync.Mutex
+		status  = http.StatusServiceUnavailable
+		batches [][]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		var batch []AuditMsg
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var metrics []string
+		for _, msg := range batch {
+			metrics = append(metrics, msg.Metrics[0])
+		}
+		batches = append(batches, metrics)
+	}))
+	defer srv.Close()
+	setStatus := func(code int) {
+		mu.Lock()
+		defer mu.Unlock()
+		status = code
+	}
+	received := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), batches...)
+	}
+
+	sink := NewHTTPBatchSink("http_batch", srv.URL, batchOptions{Size: 2, FlushInterval: 50 * time.Millisecond}, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan AuditMsg)
+	done := make(chan struct{})
+	go func() {
+		sink.Run(ctx, ch)
+		close(done)
+	}()
+
+	// While the endpoint is down the records are kept.
+	for _, metric := range []string{"m1", "m2", "m3"} {
+		ch <- AuditMsg{Metrics: []string{metric}}
+	}
+	assert.Eventually(t, func() bool { return sink.Pending() == 3 }, time.Second, time.Millisecond)
+
+	// The kept records are delivered on the next flush, in batches of the configured size.
+	setStatus(http.StatusOK)
+	assert.Eventually(t, func() bool { return sink.Pending() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"m1", "m2"}, {"m3"}}, received())
+
+	// A rejected batch is dropped.
+	setStatus(http.StatusBadRequest)
+	ch <- AuditMsg{Metrics: []string{"m4"}}
+	assert.Eventually(t, func() bool { return sink.Dropped() == 1 }, time.Second, time.Millisecond)
+	assert.Zero(t, sink.Pending())
+
+	// The buffered records are flushed on shutdown.
+	setStatus(http.StatusOK)
+	ch <- AuditMsg{Metrics: []string{"m5"}}
+	cancel()
+	<-done
+	assert.Equal(t, []string{"m5"}, received()[len(received())-1])
+}
+
+func TestBatcher_Bounded(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	down := errors.New("connection refused")
+	b := newBatcher("test", batchOptions{Size: 2, FlushInterval: time.Hour}, func(context.Context, []AuditMsg) error {
+		return down
+	}, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan AuditMsg)
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx, ch)
+		close(done)
+	}()
+
+	// At most maxPendingBatches batches are kept, the oldest records are dropped.
+	for i := 0; i < maxPendingBatches*2+5; i++ {
+		ch <- AuditMsg{Metrics: []string{strconv.Itoa(i)}}
+	}
+	cancel()
+	<-done
+	assert.Equal(t, maxPendingBatches*2, b.Pending())
+	assert.Equal(t, int64(5), b.Dropped())
+	assert.Equal(t, "5", b.pending[0].Metrics[0])
+}
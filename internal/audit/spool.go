@@ -0,0 +1,171 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// errRejected marks a record the receiver refused, such records are not retried.
+var errRejected = errors.New("audit record rejected")
+
+// ErrSpoolFull is returned by Append when the spool holds the maximum number of records.
+var ErrSpoolFull = errors.New("audit spool is full")
+
+// defaultSpoolMaxRecords is used when the maximum number of spooled records is not configured.
+const defaultSpoolMaxRecords = 10000
+
+// Spool is a file-backed queue of the audit records that could not be delivered.
+// Records are kept as JSON lines in the order they were spooled.
+type Spool struct {
+	path    string
+	limit   int // maximum number of spooled records
+	mu      sync.Mutex
+	size    int          // number of spooled records
+	dropped atomic.Int64 // records dropped because the spool was full
+}
+
+// NewSpool opens the spool file holding at most maxRecords records, the default if it is not positive.
+// Records left by a previous run are kept.
+func NewSpool(path string, maxRecords int) (*Spool, error) {
+	if maxRecords <= 0 {
+		maxRecords = defaultSpoolMaxRecords
+	}
+	s := &Spool{path: path, limit: maxRecords}
+	msgs, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.size = len(msgs)
+	return s, nil
+}
+
+// Len returns the number of spooled records.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Dropped returns the number of records dropped because the spool was full.
+func (s *Spool) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Append adds the record to the end of the spool.
+// A full spool drops the record, counts it and returns ErrSpoolFull.
+func (s *Spool) Append(msg AuditMsg) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size >= s.limit {
+		s.dropped.Add(1)
+		return ErrSpoolFull
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open spool file: %w", err)
+	}
+	if err := json.NewEncoder(f).Encode(msg); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write spool record: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close spool file: %w", err)
+	}
+	s.size++
+	return nil
+}
+
+// Drain delivers the spooled records in order and removes the delivered ones.
+// It stops at the first failed delivery, records rejected by the receiver are discarded.
+func (s *Spool) Drain(deliver func(AuditMsg) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs, err := s.load()
+	if err != nil {
+		return err
+	}
+	var deliverErr error
+	sent := 0
+	for _, msg := range msgs {
+		if err := deliver(msg); err != nil && !errors.Is(err, errRejected) {
+			deliverErr = err
+			break
+		}
+		sent++
+	}
+	if sent == 0 && deliverErr != nil {
+		return deliverErr
+	}
+	if err := s.rewrite(msgs[sent:]); err != nil {
+		return err
+	}
+	s.size = len(msgs) - sent
+	return deliverErr
+}
+
+// load reads the spooled records.
+func (s *Spool) load() ([]AuditMsg, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open spool file: %w", err)
+	}
+	defer f.Close()
+
+	var msgs []AuditMsg
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg AuditMsg
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// A partially written line is left by a crash during Append, skip it.
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read spool file: %w", err)
+	}
+	return msgs, nil
+}
+
+// rewrite atomically replaces the spool content with the records.
+func (s *Spool) rewrite(msgs []AuditMsg) error {
+	if len(msgs) == 0 {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove spool file: %w", err)
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create spool file: %w", err)
+	}
+	enc := json.NewEncoder(tmp)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+			return fmt.Errorf("write spool record: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("close spool file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("replace spool file: %w", err)
+	}
+	return nil
+}
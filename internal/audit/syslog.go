@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Syslog settings of the audit records.
+const (
+	syslogPriority    = 16*8 + 6 // facility local0, severity informational
+	syslogMsgID       = "audit"
+	defaultSyslogTag  = "metrics-server"
+	defaultSyslogPort = "514"
+	syslogTimeFormat  = "2006-01-02T15:04:05.000000Z07:00"
+	syslogTimeout     = 5 * time.Second
+)
+
+// SyslogSink sends the records as RFC 5424 syslog messages with the JSON record as the message.
+// Datagram networks (udp, unixgram) carry a message per datagram, stream networks (tcp, unix)
+// use the octet-counting framing of RFC 6587. The connection is dialed on the first record and
+// redialed once when a write fails; a record that still cannot be sent is dropped.
+type SyslogSink struct {
+	name     string
+	network  string
+	addr     string
+	tag      string
+	hostname string
+	pid      int
+	conn     net.Conn
+	dropped  atomic.Int64
+	logger   *zap.SugaredLogger
+}
+
+// NewSyslogSink creates a syslog sink for an address like udp://host:514, tcp://host:514,
+// unix:///dev/log or unixgram:///dev/log. The tag is the APP-NAME of the messages.
+func NewSyslogSink(name, addr, tag string, logger *zap.SugaredLogger) (*SyslogSink, error) {
+	network, address, err := parseSyslogAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{
+		name:     name,
+		network:  network,
+		addr:     address,
+		tag:      tag,
+		hostname: hostname,
+		pid:      os.Getpid(),
+		logger:   logger,
+	}, nil
+}
+
+// parseSyslogAddr returns the network and the address of the syslog URL.
+func parseSyslogAddr(addr string) (string, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("parse syslog address: %w", err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("syslog address %q has no host", addr)
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), defaultSyslogPort)
+		}
+		return u.Scheme, host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("syslog address %q has no socket path", addr)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("unsupported syslog network %q, use udp, tcp, unix or unixgram", u.Scheme)
+	}
+}
+
+// Name returns the name of the sink.
+func (s *SyslogSink) Name() string {
+	return s.name
+}
+
+// Dropped returns the number of records that could not be sent.
+func (s *SyslogSink) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Run sends the records until the context is done, the buffered records are sent before it exits.
+func (s *SyslogSink) Run(ctx context.Context, ch <-chan AuditMsg) {
+	defer s.close()
+	for {
+		select {
+		// If the context is done, send the buffered records and exit
+		case <-ctx.Done():
+			for {
+				select {
+				case msg, ok := <-ch:
+					if !ok {
+						return
+					}
+					s.send(msg)
+				default:
+					return
+				}
+			}
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			s.send(msg)
+		}
+	}
+}
+
+// send writes the record, redialing the connection once if the write fails.
+func (s *SyslogSink) send(msg AuditMsg) {
+	data, err := s.format(msg)
+	if err != nil {
+		s.dropped.Add(1)
+		s.logger.Errorf("format syslog audit record: %v", err)
+		return
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.write(data); err == nil {
+			return
+		}
+		s.close()
+	}
+	s.dropped.Add(1)
+	s.logger.Errorf("send audit to syslog %s://%s: %v", s.network, s.addr, err)
+}
+
+// write dials the connection if needed and writes the framed message.
+func (s *SyslogSink) write(data []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, syslogTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if s.network == "tcp" || s.network == "unix" {
+		data = append([]byte(strconv.Itoa(len(data))+" "), data...)
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout)); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(data)
+	return err
+}
+
+// close closes the connection, the next write dials a new one.
+func (s *SyslogSink) close() {
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.Close(); err != nil {
+		s.logger.Debugf("close syslog connection: %v", err)
+	}
+	s.conn = nil
+}
+
+// format builds the RFC 5424 message of the record:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG.
+func (s *SyslogSink) format(msg AuditMsg) ([]byte, error) {
+	record, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	ts := msg.TimeStamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ",
+		syslogPriority, ts.UTC().Format(syslogTimeFormat), s.hostname, s.tag, s.pid, syslogMsgID)
+	return append([]byte(header), record...), nil
+}
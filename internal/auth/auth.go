@@ -0,0 +1,150 @@
+// Package auth provides bearer API tokens with scopes.
+// Tokens are random strings given to the clients once; the server keeps only their SHA-256 hashes,
+// in the JSON config or in the api_tokens table of the database.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+)
+
+// Scopes of the API tokens.
+const (
+	ScopeWrite = "metrics:write" // update the metrics
+	ScopeRead  = "metrics:read"  // read, query and stream the metrics
+	ScopeAdmin = "admin"         // admin endpoints, implies all other scopes
+)
+
+// tokenPrefix marks the API tokens, so that they are easy to spot in secret scanners.
+const tokenPrefix = "mt_"
+
+// ErrInvalidToken is returned for unknown and revoked tokens.
+var ErrInvalidToken = errors.New("invalid API token")
+
+// Token is an API token as it is stored, without the secret.
+type Token struct {
+	ID        string     // name of the token
+	Hash      string     // hex SHA-256 of the token
+	Scopes    []string   // granted scopes
+	CreatedAt time.Time  // creation time, zero for the tokens of the config
+	RevokedAt *time.Time // revocation time, nil while the token is valid
+}
+
+// Allows reports whether the token grants the scope, admin grants every scope.
+func (t Token) Allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// ValidScope reports whether the scope is known.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeWrite, ScopeRead, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// Generate returns a new random token and its hash.
+func Generate() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("generate API token: %w", err)
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex SHA-256 of the token, the form in which tokens are stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store looks up the tokens by their hashes.
+type Store interface {
+	// Lookup returns the valid token with the hash, ErrInvalidToken if there is none.
+	Lookup(ctx context.Context, hash string) (Token, error)
+}
+
+// StaticStore holds the tokens of the JSON config.
+type StaticStore struct {
+	tokens map[string]Token
+}
+
+// NewStaticStore creates a store of the configured tokens, it fails on unknown scopes and malformed hashes.
+func NewStaticStore(tokens []cfg.TokenConfig) (*StaticStore, error) {
+	s := &StaticStore{tokens: make(map[string]Token, len(tokens))}
+	for _, t := range tokens {
+		if err := validateToken(t.ID, t.Hash, t.Scopes); err != nil {
+			return nil, err
+		}
+		s.tokens[t.Hash] = Token{ID: t.ID, Hash: t.Hash, Scopes: t.Scopes}
+	}
+	return s, nil
+}
+
+// Lookup returns the configured token with the hash.
+func (s *StaticStore) Lookup(_ context.Context, hash string) (Token, error) {
+	t, ok := s.tokens[hash]
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// validateToken checks the ID, the hash and the scopes of a token.
+func validateToken(id, hash string, scopes []string) error {
+	if id == "" {
+		return errors.New("API token id is required")
+	}
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("API token %s: hash must be a hex SHA-256", id)
+	}
+	if len(scopes) == 0 {
+		return fmt.Errorf("API token %s: at least one scope is required", id)
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return fmt.Errorf("API token %s: unknown scope %q", id, scope)
+		}
+	}
+	return nil
+}
+
+// Authenticator checks the API tokens against the stores, in order.
+type Authenticator struct {
+	stores []Store
+}
+
+// NewAuthenticator creates an authenticator with the stores.
+func NewAuthenticator(stores ...Store) *Authenticator {
+	return &Authenticator{stores: stores}
+}
+
+// Authenticate returns the stored token of the request token.
+// It returns ErrInvalidToken if no store knows the token, and the store error if a store cannot be read.
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (Token, error) {
+	if token == "" {
+		return Token{}, ErrInvalidToken
+	}
+	hash := HashToken(token)
+	for _, s := range a.stores {
+		t, err := s.Lookup(ctx, hash)
+		if err == nil {
+			return t, nil
+		}
+		if !errors.Is(err, ErrInvalidToken) {
+			return Token{}, fmt.Errorf("look up API token: %w", err)
+		}
+	}
+	return Token{}, ErrInvalidToken
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	token, hash, err := Generate()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, tokenPrefix))
+	assert.Equal(t, HashToken(token), hash)
+	assert.Len(t, hash, 64)
+
+	other, _, err := Generate()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestToken_Allows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{name: "granted", scopes: []string{ScopeWrite}, scope: ScopeWrite, want: true},
+		{name: "other_scope", scopes: []string{ScopeWrite}, scope: ScopeRead, want: false},
+		{name: "admin_grants_all", scopes: []string{ScopeAdmin}, scope: ScopeRead, want: true},
+		{name: "no_scopes", scope: ScopeRead, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Token{Scopes: tt.scopes}.Allows(tt.scope))
+		})
+	}
+}
+
+func TestNewStaticStore(t *testing.T) {
+	hash := HashToken("secret")
+	tests := []struct {
+		name    string
+		token   cfg.TokenConfig
+		wantErr bool
+	}{
+		{name: "valid", token: cfg.TokenConfig{ID: "agent", Hash: hash, Scopes: []string{ScopeWrite}}},
+		{name: "no_id", token: cfg.TokenConfig{Hash: hash, Scopes: []string{ScopeWrite}}, wantErr: true},
+		{name: "plain_token", token: cfg.TokenConfig{ID: "agent", Hash: "secret", Scopes: []string{ScopeWrite}}, wantErr: true},
+		{name: "no_scopes", token: cfg.TokenConfig{ID: "agent", Hash: hash}, wantErr: true},
+		{name: "unknown_scope", token: cfg.TokenConfig{ID: "agent", Hash: hash, Scopes: []string{"metrics:delete"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewStaticStore([]cfg.TokenConfig{tt.token})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// storeFunc adapts a function to the Store interface.
+type storeFunc func(ctx context.Context, hash string) (Token, error)
+
+func (f storeFunc) Lookup(ctx context.Context, hash string) (Token, error) {
+	return f(ctx, hash)
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	static, err := NewStaticStore([]cfg.TokenConfig{{ID: "agent", Hash: HashToken("agent-token"), Scopes: []string{ScopeWrite}}})
+	require.NoError(t, err)
+	db := storeFunc(func(_ context.Context, hash string) (Token, error) {
+		switch hash {
+		case HashToken("db-token"):
+			return Token{ID: "grafana", Scopes: []string{ScopeRead}}, nil
+		case HashToken("broken"):
+			return Token{}, errors.New("connection refused")
+		}
+		return Token{}, ErrInvalidToken
+	})
+	a := NewAuthenticator(static, db)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantID  string
+		wantErr error
+	}{
+		{name: "config_token", token: "agent-token", wantID: "agent"},
+		{name: "db_token", token: "db-token", wantID: "grafana"},
+		{name: "unknown_token", token: "guess", wantErr: ErrInvalidToken},
+		{name: "empty_token", token: "", wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := a.Authenticate(context.Background(), tt.token)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantID, token.ID)
+		})
+	}
+
+	// A store that cannot be read is not mistaken for an unknown token.
+	_, err = a.Authenticate(context.Background(), "broken")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidToken)
+}
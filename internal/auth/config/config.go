@@ -0,0 +1,15 @@
+// Package config provides configuration structures for the auth component.
+package config
+
+// AuthConfig holds the API token settings of the server.
+type AuthConfig struct {
+	Enabled bool          `env:"AUTH_ENABLED" json:"enabled"` // Require API tokens on the metric and admin routes.
+	Tokens  []TokenConfig `json:"tokens"`                     // Tokens set in the JSON config, in addition to the tokens of the database.
+}
+
+// TokenConfig is an API token of the JSON config. Only the SHA-256 hash of the token is kept.
+type TokenConfig struct {
+	ID     string   `json:"id"`     // Name of the token, shown in the logs and audit records.
+	Hash   string   `json:"hash"`   // Hex SHA-256 of the token, printed by cmd/apitoken.
+	Scopes []string `json:"scopes"` // Granted scopes: metrics:write, metrics:read or admin.
+}
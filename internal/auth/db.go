@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/db/migrations"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrTokenExists is returned when a token with the same ID is already stored.
+var ErrTokenExists = errors.New("API token already exists")
+
+// ErrTokenNotFound is returned when revoking a token that is not stored or already revoked.
+var ErrTokenNotFound = errors.New("API token not found")
+
+// DBStore keeps the tokens in the api_tokens table of the database.
+type DBStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewDBStore migrates the database and connects to it.
+func NewDBStore(ctx context.Context, dsn string) (*DBStore, error) {
+	if err := migrations.RunMigrations(dsn, true); err != nil {
+		return nil, fmt.Errorf("failed to run DB migrations: %w", err)
+	}
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize a connection pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping the DB: %w", err)
+	}
+	return &DBStore{pool: pool}, nil
+}
+
+// Close closes the connection pool.
+func (s *DBStore) Close() {
+	s.pool.Close()
+}
+
+// Lookup returns the token with the hash unless it is revoked.
+func (s *DBStore) Lookup(ctx context.Context, hash string) (Token, error) {
+	row := s.pool.QueryRow(ctx,
+		`SELECT id, hash, scopes, created_at, revoked_at FROM api_tokens WHERE hash = $1 AND revoked_at IS NULL`, hash)
+	t, err := scanToken(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Token{}, ErrInvalidToken
+	}
+	return t, err
+}
+
+// Create stores the token, the ID must be unique.
+func (s *DBStore) Create(ctx context.Context, t Token) (Token, error) {
+	if err := validateToken(t.ID, t.Hash, t.Scopes); err != nil {
+		return Token{}, err
+	}
+	row := s.pool.QueryRow(ctx,
+		`INSERT INTO api_tokens (id, hash, scopes) VALUES ($1, $2, $3)
+		RETURNING id, hash, scopes, created_at, revoked_at`, t.ID, t.Hash, t.Scopes)
+	created, err := scanToken(row)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return Token{}, fmt.Errorf("%w: %s", ErrTokenExists, t.ID)
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to store API token: %w", err)
+	}
+	return created, nil
+}
+
+// Revoke marks the token with the ID as revoked, it is rejected from then on.
+func (s *DBStore) Revoke(ctx context.Context, id string) error {
+	tag, err := s.pool.Exec(ctx,
+		`UPDATE api_tokens SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke API token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, id)
+	}
+	return nil
+}
+
+// List returns all stored tokens, revoked ones included, oldest first.
+func (s *DBStore) List(ctx context.Context) ([]Token, error) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT id, hash, scopes, created_at, revoked_at FROM api_tokens ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	tokens, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Token, error) {
+		return scanToken(row)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// scanToken reads a token row.
+func scanToken(row pgx.Row) (Token, error) {
+	var t Token
+	err := row.Scan(&t.ID, &t.Hash, &t.Scopes, &t.CreatedAt, &t.RevokedAt)
+	return t, err
+}
@@ -0,0 +1,89 @@
+//go:build integration_tests
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runPostgres starts a postgres container and returns its DSN.
+func runPostgres(t *testing.T) string {
+	pool, err := dockertest.NewPool("")
+	require.NoError(t, err, "failed to initialize a pool")
+
+	pg, err := pool.RunWithOptions(
+		&dockertest.RunOptions{
+			Repository: "postgres",
+			Tag:        "17.2",
+			Name:       "auth-integration-tests",
+			Env: []string{
+				"POSTGRES_USER=postgres",
+				"POSTGRES_PASSWORD=postgres",
+			},
+			ExposedPorts: []string{"5432/tcp"},
+		},
+		func(config *docker.HostConfig) {
+			config.AutoRemove = true
+			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		},
+	)
+	require.NoError(t, err, "failed to run the postgres container")
+	t.Cleanup(func() {
+		if err := pool.Purge(pg); err != nil {
+			t.Logf("failed to purge the postgres container: %v", err)
+		}
+	})
+
+	dsn := fmt.Sprintf("postgres://postgres:postgres@%s/postgres?sslmode=disable", pg.GetHostPort("5432/tcp"))
+	pool.MaxWait = 10 * time.Second
+	require.NoError(t, pool.Retry(func() error {
+		conn, err := pgx.Connect(context.Background(), dsn)
+		if err != nil {
+			return err
+		}
+		return conn.Close(context.Background())
+	}), "failed to connect to the DB")
+	return dsn
+}
+
+func TestDBStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewDBStore(ctx, runPostgres(t))
+	require.NoError(t, err)
+	defer store.Close()
+
+	token, hash, err := Generate()
+	require.NoError(t, err)
+	created, err := store.Create(ctx, Token{ID: "agent", Hash: hash, Scopes: []string{ScopeWrite}})
+	require.NoError(t, err)
+	assert.False(t, created.CreatedAt.IsZero())
+
+	_, err = store.Create(ctx, Token{ID: "agent", Hash: HashToken("other"), Scopes: []string{ScopeRead}})
+	assert.ErrorIs(t, err, ErrTokenExists)
+
+	// The stored token authenticates until it is revoked.
+	a := NewAuthenticator(store)
+	got, err := a.Authenticate(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "agent", got.ID)
+	assert.Equal(t, []string{ScopeWrite}, got.Scopes)
+
+	require.NoError(t, store.Revoke(ctx, "agent"))
+	_, err = a.Authenticate(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	assert.ErrorIs(t, store.Revoke(ctx, "agent"), ErrTokenNotFound)
+
+	tokens, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].RevokedAt)
+}
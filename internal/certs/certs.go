@@ -0,0 +1,78 @@
+// Package certs builds the TLS configurations of the server and the agent from PEM files.
+// The server verifies the client certificates against a CA bundle when one is configured (mutual TLS).
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/certs/config"
+)
+
+// ErrNoCertificates is returned when a CA bundle holds no PEM certificates.
+var ErrNoCertificates = errors.New("no certificates found")
+
+// ServerTLS returns the TLS config of the server, nil if TLS is not configured.
+func ServerTLS(c cfg.ServerTLSConfig) (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCAFile != "" {
+		pool, err := LoadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %w", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// ClientTLS returns the TLS config of the agent, nil if TLS is not configured.
+func ClientTLS(c cfg.ClientTLSConfig) (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		pool, err := LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA: %w", err)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w in %s", ErrNoCertificates, path)
+	}
+	return pool, nil
+}
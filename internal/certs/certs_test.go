@@ -0,0 +1,129 @@
+package certs_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/certs"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/certs/certstest"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/certs/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTLS(t *testing.T) {
+	ca := certstest.NewCA(t)
+	cert, key := ca.IssueServer("127.0.0.1")
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a certificate"), 0600))
+
+	tests := []struct {
+		name       string
+		config     cfg.ServerTLSConfig
+		wantNil    bool
+		wantClient tls.ClientAuthType
+		wantErr    bool
+	}{
+		{name: "disabled", config: cfg.ServerTLSConfig{}, wantNil: true},
+		{name: "tls", config: cfg.ServerTLSConfig{CertFile: cert, KeyFile: key}, wantClient: tls.NoClientCert},
+		{
+			name:       "mtls",
+			config:     cfg.ServerTLSConfig{CertFile: cert, KeyFile: key, ClientCAFile: ca.CertFile},
+			wantClient: tls.RequireAndVerifyClientCert,
+		},
+		{name: "missing key", config: cfg.ServerTLSConfig{CertFile: cert, KeyFile: "missing.pem"}, wantErr: true},
+		{name: "key mismatch", config: cfg.ServerTLSConfig{CertFile: cert, KeyFile: ca.CertFile}, wantErr: true},
+		{
+			name:    "invalid client CA",
+			config:  cfg.ServerTLSConfig{CertFile: cert, KeyFile: key, ClientCAFile: garbage},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := certs.ServerTLS(tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantNil {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Len(t, got.Certificates, 1)
+			assert.Equal(t, tt.wantClient, got.ClientAuth)
+			assert.Equal(t, uint16(tls.VersionTLS12), got.MinVersion)
+		})
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a certificate"), 0600))
+
+	_, err := certs.LoadCertPool(garbage)
+	assert.True(t, errors.Is(err, certs.ErrNoCertificates))
+	_, err = certs.LoadCertPool(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+	pool, err := certs.LoadCertPool(certstest.NewCA(t).CertFile)
+	require.NoError(t, err)
+	assert.NotNil(t, pool)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := certstest.NewCA(t)
+	otherCA := certstest.NewCA(t)
+	serverCert, serverKey := ca.IssueServer("127.0.0.1")
+
+	serverTLS, err := certs.ServerTLS(cfg.ServerTLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CertFile})
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	goodCert, goodKey := ca.IssueClient("agent")
+	strangerCert, strangerKey := otherCA.IssueClient("stranger")
+	tests := []struct {
+		name    string
+		config  cfg.ClientTLSConfig
+		wantErr bool
+	}{
+		{name: "trusted client", config: cfg.ClientTLSConfig{CAFile: ca.CertFile, CertFile: goodCert, KeyFile: goodKey}},
+		{name: "no client certificate", config: cfg.ClientTLSConfig{CAFile: ca.CertFile}, wantErr: true},
+		{
+			name:    "client of another CA",
+			config:  cfg.ClientTLSConfig{CAFile: ca.CertFile, CertFile: strangerCert, KeyFile: strangerKey},
+			wantErr: true,
+		},
+		{
+			name:    "server of another CA",
+			config:  cfg.ClientTLSConfig{CAFile: otherCA.CertFile, CertFile: goodCert, KeyFile: goodKey},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS, err := certs.ClientTLS(tt.config)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			resp, err := client.Get(srv.URL)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
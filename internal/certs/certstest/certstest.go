@@ -0,0 +1,138 @@
+// Package certstest generates throwaway certificates for the tests, so that TLS can be tested offline.
+package certstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// certLifetime is the validity of the generated certificates.
+const certLifetime = time.Hour
+
+// CA is a certificate authority living in a temporary directory of the test.
+type CA struct {
+	// CertFile is the PEM certificate of the CA, to be used as the CA bundle.
+	CertFile string
+
+	t    testing.TB
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// NewCA creates a self-signed CA, its files are removed with the temporary directory of the test.
+func NewCA(t testing.TB) *CA {
+	t.Helper()
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(t),
+		Subject:               pkix.Name{CommonName: "certstest CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(certLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA certificate: %v", err)
+	}
+	ca := &CA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.CertFile = ca.writePEM("ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+// IssueServer issues a server certificate for the hosts, IP addresses or DNS names.
+// It returns the paths of the certificate and key files.
+func (ca *CA) IssueServer(hosts ...string) (string, string) {
+	ca.t.Helper()
+	tmpl := ca.template("server")
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return ca.issue("server", tmpl)
+}
+
+// IssueClient issues a client certificate with the common name.
+// It returns the paths of the certificate and key files.
+func (ca *CA) IssueClient(name string) (string, string) {
+	ca.t.Helper()
+	tmpl := ca.template(name)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue("client-"+name, tmpl)
+}
+
+// template returns a leaf certificate template with the common name.
+func (ca *CA) template(name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: newSerial(ca.t),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// issue signs the template with the CA and writes the certificate and key files named after the base.
+func (ca *CA) issue(base string, tmpl *x509.Certificate) (string, string) {
+	ca.t.Helper()
+	key := newKey(ca.t)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatalf("create %s certificate: %v", base, err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		ca.t.Fatalf("marshal %s key: %v", base, err)
+	}
+	return ca.writePEM(base+".pem", "CERTIFICATE", der), ca.writePEM(base+"-key.pem", "PRIVATE KEY", keyDER)
+}
+
+// writePEM writes the PEM block to the file of the CA directory and returns its path.
+func (ca *CA) writePEM(name, typ string, der []byte) string {
+	ca.t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		ca.t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+// newKey generates an ECDSA P-256 key.
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// newSerial returns a random certificate serial number.
+func newSerial(t testing.TB) *big.Int {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatalf("generate serial: %v", err)
+	}
+	return serial
+}
@@ -0,0 +1,26 @@
+// Package config provides configuration structures for the TLS certificates.
+package config
+
+// ServerTLSConfig holds the TLS settings of the server.
+type ServerTLSConfig struct {
+	CertFile     string `env:"TLS_CERT_FILE" json:"cert_file"`           // PEM certificate (chain) of the server; enables HTTPS.
+	KeyFile      string `env:"TLS_KEY_FILE" json:"key_file"`             // PEM private key of the server certificate.
+	ClientCAFile string `env:"TLS_CLIENT_CA_FILE" json:"client_ca_file"` // PEM CA bundle verifying the client certificates; enables mTLS.
+}
+
+// Enabled reports whether the server serves HTTPS.
+func (c ServerTLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// ClientTLSConfig holds the TLS settings of the agent.
+type ClientTLSConfig struct {
+	CAFile   string `env:"TLS_CA_FILE" json:"ca_file"`     // PEM CA bundle verifying the server, the system roots if empty.
+	CertFile string `env:"TLS_CERT_FILE" json:"cert_file"` // PEM client certificate for mTLS.
+	KeyFile  string `env:"TLS_KEY_FILE" json:"key_file"`   // PEM private key of the client certificate.
+}
+
+// Enabled reports whether the agent connects over HTTPS.
+func (c ClientTLSConfig) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != ""
+}
@@ -4,30 +4,50 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	agent "github.com/devize-ed/yapracproj-metrics.git/internal/agent/config"
+	alert "github.com/devize-ed/yapracproj-metrics.git/internal/alert/config"
 	audit "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	auth "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	certs "github.com/devize-ed/yapracproj-metrics.git/internal/certs/config"
+	debug "github.com/devize-ed/yapracproj-metrics.git/internal/diagnostics/config"
 	encryption "github.com/devize-ed/yapracproj-metrics.git/internal/encryption/config"
+	limit "github.com/devize-ed/yapracproj-metrics.git/internal/limit/config"
+	accesslog "github.com/devize-ed/yapracproj-metrics.git/internal/logger/config"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
 	db "github.com/devize-ed/yapracproj-metrics.git/internal/repository/db/config"
 	fs "github.com/devize-ed/yapracproj-metrics.git/internal/repository/fstorage/config"
+	selfmetrics "github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics/config"
 	sign "github.com/devize-ed/yapracproj-metrics.git/internal/sign/config"
+	statsd "github.com/devize-ed/yapracproj-metrics.git/internal/statsd/config"
+	trace "github.com/devize-ed/yapracproj-metrics.git/internal/tracing/config"
 )
 
 // ServerConfig holds the configuration for the server.
 type ServerConfig struct {
-	Connection ServerConn                  `json:"connection"`
-	Repository repository.RepositoryConfig `json:"repository"`
-	Sign       sign.SignConfig             `json:"sign"`
-	Audit      audit.AuditConfig           `json:"audit"`
-	Encryption encryption.EncryptionConfig `json:"encryption"`
-	LogLevel   string                      `json:"log_level"` // Log level for the server.
+	Connection  ServerConn                    `json:"connection"`
+	Repository  repository.RepositoryConfig   `json:"repository"`
+	Sign        sign.SignConfig               `json:"sign"`
+	Audit       audit.AuditConfig             `json:"audit"`
+	Encryption  encryption.EncryptionConfig   `json:"encryption"`
+	StatsD      statsd.StatsDConfig           `json:"statsd"`
+	Alert       alert.AlertConfig             `json:"alert"`
+	Auth        auth.AuthConfig               `json:"auth"`
+	TLS         certs.ServerTLSConfig         `json:"tls"`
+	Limit       limit.LimitConfig             `json:"limit"`
+	Trace       trace.TraceConfig             `json:"trace"`
+	SelfMetrics selfmetrics.SelfMetricsConfig `json:"self_metrics"`
+	Debug       debug.ServerDebugConfig       `json:"debug"`
+	AccessLog   accesslog.AccessLogConfig     `json:"access_log"`
+	LogLevel    string                        `json:"log_level"` // Log level for the server.
 }
 
 // ServerConn holds server address configuration.
@@ -41,6 +61,9 @@ type AgentConfig struct {
 	Agent           agent.AgentConfig           `json:"agent"`
 	Sign            sign.SignConfig             `json:"sign"`
 	Encryption      encryption.EncryptionConfig `json:"encryption"`
+	TLS             certs.ClientTLSConfig       `json:"tls"`
+	Trace           trace.TraceConfig           `json:"trace"`
+	Debug           debug.AgentDebugConfig      `json:"debug"`
 	LogLevel        string                      `json:"log_level"`        // Log level for the agent.
 	ShutdownTimeout int                         `json:"shutdown_timeout"` // Shutdown timeout for the agent.
 }
@@ -69,6 +92,10 @@ func defaultServerConfig() ServerConfig {
 		Sign:       sign.SignConfig{},
 		Audit:      audit.AuditConfig{},
 		Encryption: encryption.EncryptionConfig{},
+		StatsD:     statsd.StatsDConfig{},
+		Alert:      alert.AlertConfig{},
+		Auth:       auth.AuthConfig{},
+		TLS:        certs.ServerTLSConfig{},
 		LogLevel:   "",
 	}
 }
@@ -88,6 +115,7 @@ func defaultAgentConfig() AgentConfig {
 		},
 		Sign:            sign.SignConfig{},
 		Encryption:      encryption.EncryptionConfig{},
+		TLS:             certs.ClientTLSConfig{},
 		ShutdownTimeout: 5,
 		LogLevel:        "",
 	}
@@ -108,9 +136,43 @@ var serverEnv = []envBinding{
 	{"repository.fs.restore", "RESTORE", "bool"},
 	{"repository.db.database_dsn", "DATABASE_DSN", "string"},
 	{"sign.key", "KEY", "string"},
+	{"sign.key_id", "KEY_ID", "string"},
+	{"sign.replay_window", "SIGN_REPLAY_WINDOW", "int"},
+	{"sign.nonce_cache_size", "SIGN_NONCE_CACHE_SIZE", "int"},
+	{"sign.required", "SIGN_REQUIRED", "bool"},
+	{"sign.agent_keys_dir", "SIGN_AGENT_KEYS_DIR", "string"},
 	{"encryption.crypto_key", "CRYPTO_KEY", "string"},
 	{"audit.audit_file", "AUDIT_FILE", "string"},
 	{"audit.audit_url", "AUDIT_URL", "string"},
+	{"audit.buffer_size", "AUDIT_BUFFER_SIZE", "int"},
+	{"audit.overflow_policy", "AUDIT_OVERFLOW_POLICY", "string"},
+	{"audit.spool_file", "AUDIT_SPOOL_FILE", "string"},
+	{"audit.spool_max_records", "AUDIT_SPOOL_MAX_RECORDS", "int"},
+	{"audit.chain_key", "AUDIT_CHAIN_KEY", "string"},
+	{"audit.checkpoint_interval", "AUDIT_CHECKPOINT_INTERVAL", "int"},
+	{"audit.max_size", "AUDIT_MAX_SIZE", "int"},
+	{"audit.rotate_interval", "AUDIT_ROTATE_INTERVAL", "int"},
+	{"audit.max_backups", "AUDIT_MAX_BACKUPS", "int"},
+	{"audit.max_age", "AUDIT_MAX_AGE", "int"},
+	{"statsd.address", "STATSD_ADDRESS", "string"},
+	{"statsd.flush_interval", "STATSD_FLUSH_INTERVAL", "int"},
+	{"alert.eval_interval", "ALERT_EVAL_INTERVAL", "int"},
+	{"auth.enabled", "AUTH_ENABLED", "bool"},
+	{"tls.cert_file", "TLS_CERT_FILE", "string"},
+	{"tls.key_file", "TLS_KEY_FILE", "string"},
+	{"tls.client_ca_file", "TLS_CLIENT_CA_FILE", "string"},
+	{"limit.max_body_size", "LIMIT_BODY_SIZE", "int"},
+	{"limit.max_decompressed_size", "LIMIT_DECOMPRESSED_SIZE", "int"},
+	{"limit.ip_rate", "LIMIT_IP_RATE", "int"},
+	{"limit.ip_burst", "LIMIT_IP_BURST", "int"},
+	{"limit.token_rate", "LIMIT_TOKEN_RATE", "int"},
+	{"limit.token_burst", "LIMIT_TOKEN_BURST", "int"},
+	{"limit.concurrency", "LIMIT_CONCURRENCY", "int"},
+	{"trace.exporter", "TRACE_EXPORTER", "string"},
+	{"trace.file", "TRACE_FILE", "string"},
+	{"self_metrics.ingest_interval", "SELF_METRICS_INTERVAL", "int"},
+	{"debug.enabled", "DEBUG_ENABLED", "bool"},
+	{"access_log.sampling", "ACCESS_LOG_SAMPLING", "int"},
 	{"log_level", "LOG_LEVEL", "string"},
 }
 
@@ -122,8 +184,20 @@ var agentEnv = []envBinding{
 	{"agent.enable_gzip", "ENABLE_GZIP", "bool"},
 	{"agent.enable_get_metrics", "ENABLE_TEST_GET", "bool"},
 	{"agent.rate_limit", "RATE_LIMIT", "int"},
+	{"agent.api_token", "API_TOKEN", "string"},
 	{"sign.key", "KEY", "string"},
+	{"sign.key_id", "KEY_ID", "string"},
+	{"sign.private_key", "SIGN_PRIVATE_KEY", "string"},
+	{"sign.agent_id", "AGENT_ID", "string"},
 	{"encryption.crypto_key", "CRYPTO_KEY", "string"},
+	{"tls.ca_file", "TLS_CA_FILE", "string"},
+	{"tls.cert_file", "TLS_CERT_FILE", "string"},
+	{"tls.key_file", "TLS_KEY_FILE", "string"},
+	{"trace.exporter", "TRACE_EXPORTER", "string"},
+	{"trace.file", "TRACE_FILE", "string"},
+	{"debug.enabled", "DEBUG_ENABLED", "bool"},
+	{"debug.address", "DEBUG_ADDRESS", "string"},
+	{"debug.token", "DEBUG_TOKEN", "string"},
 	{"log_level", "LOG_LEVEL", "string"},
 	{"shutdown_timeout", "SHUTDOWN_TIMEOUT", "int"},
 }
@@ -157,15 +231,49 @@ func bindEnvAndElevate(v *viper.Viper, bindings []envBinding) error {
 // mapServerFlagToKey maps server flag names to viper configuration keys.
 func mapServerFlagToKey(flagName string) string {
 	flagMap := map[string]string{
-		"a":          "connection.host",
-		"i":          "repository.fs.store_interval",
-		"f":          "repository.fs.file_storage_path",
-		"d":          "repository.db.database_dsn",
-		"r":          "repository.fs.restore",
-		"k":          "sign.key",
-		"crypto-key": "encryption.crypto_key",
-		"audit-file": "audit.audit_file",
-		"audit-url":  "audit.audit_url",
+		"a":                         "connection.host",
+		"i":                         "repository.fs.store_interval",
+		"f":                         "repository.fs.file_storage_path",
+		"d":                         "repository.db.database_dsn",
+		"r":                         "repository.fs.restore",
+		"k":                         "sign.key",
+		"key-id":                    "sign.key_id",
+		"sign-replay-window":        "sign.replay_window",
+		"sign-nonce-cache-size":     "sign.nonce_cache_size",
+		"sign-required":             "sign.required",
+		"sign-agent-keys-dir":       "sign.agent_keys_dir",
+		"crypto-key":                "encryption.crypto_key",
+		"audit-file":                "audit.audit_file",
+		"audit-url":                 "audit.audit_url",
+		"audit-buffer-size":         "audit.buffer_size",
+		"audit-overflow-policy":     "audit.overflow_policy",
+		"audit-spool-file":          "audit.spool_file",
+		"audit-spool-max-records":   "audit.spool_max_records",
+		"audit-chain-key":           "audit.chain_key",
+		"audit-checkpoint-interval": "audit.checkpoint_interval",
+		"audit-max-size":            "audit.max_size",
+		"audit-rotate-interval":     "audit.rotate_interval",
+		"audit-max-backups":         "audit.max_backups",
+		"audit-max-age":             "audit.max_age",
+		"statsd-address":            "statsd.address",
+		"statsd-flush-interval":     "statsd.flush_interval",
+		"alert-eval-interval":       "alert.eval_interval",
+		"auth-enabled":              "auth.enabled",
+		"tls-cert":                  "tls.cert_file",
+		"tls-key":                   "tls.key_file",
+		"tls-client-ca":             "tls.client_ca_file",
+		"limit-body-size":           "limit.max_body_size",
+		"limit-decompressed-size":   "limit.max_decompressed_size",
+		"limit-ip-rate":             "limit.ip_rate",
+		"limit-ip-burst":            "limit.ip_burst",
+		"limit-token-rate":          "limit.token_rate",
+		"limit-token-burst":         "limit.token_burst",
+		"limit-concurrency":         "limit.concurrency",
+		"trace-exporter":            "trace.exporter",
+		"trace-file":                "trace.file",
+		"self-metrics-interval":     "self_metrics.ingest_interval",
+		"debug-enabled":             "debug.enabled",
+		"access-log-sampling":       "access_log.sampling",
 	}
 	if key, ok := flagMap[flagName]; ok {
 		return key
@@ -176,14 +284,26 @@ func mapServerFlagToKey(flagName string) string {
 // mapAgentFlagToKey maps agent flag names to viper configuration keys.
 func mapAgentFlagToKey(flagName string) string {
 	flagMap := map[string]string{
-		"a":          "connection.host",
-		"r":          "agent.report_interval",
-		"p":          "agent.poll_interval",
-		"gzip":       "agent.enable_gzip",
-		"g":          "agent.enable_get_metrics",
-		"l":          "agent.rate_limit",
-		"k":          "sign.key",
-		"crypto-key": "encryption.crypto_key",
+		"a":                "connection.host",
+		"r":                "agent.report_interval",
+		"p":                "agent.poll_interval",
+		"gzip":             "agent.enable_gzip",
+		"g":                "agent.enable_get_metrics",
+		"l":                "agent.rate_limit",
+		"api-token":        "agent.api_token",
+		"k":                "sign.key",
+		"key-id":           "sign.key_id",
+		"sign-private-key": "sign.private_key",
+		"agent-id":         "sign.agent_id",
+		"crypto-key":       "encryption.crypto_key",
+		"tls-ca":           "tls.ca_file",
+		"tls-cert":         "tls.cert_file",
+		"tls-key":          "tls.key_file",
+		"trace-exporter":   "trace.exporter",
+		"trace-file":       "trace.file",
+		"debug-enabled":    "debug.enabled",
+		"debug-address":    "debug.address",
+		"debug-token":      "debug.token",
 	}
 	if key, ok := flagMap[flagName]; ok {
 		return key
@@ -231,9 +351,48 @@ func setServerDefaults(v *viper.Viper) {
 	v.SetDefault("repository.fs.restore", d.Repository.FSConfig.Restore)
 	v.SetDefault("repository.db.database_dsn", d.Repository.DBConfig.DatabaseDSN)
 	v.SetDefault("sign.key", d.Sign.Key)
+	v.SetDefault("sign.key_id", d.Sign.KeyID)
+	v.SetDefault("sign.keys", d.Sign.Keys)
+	v.SetDefault("sign.replay_window", d.Sign.ReplayWindow)
+	v.SetDefault("sign.nonce_cache_size", d.Sign.NonceCacheSize)
+	v.SetDefault("sign.required", d.Sign.Required)
+	v.SetDefault("sign.agent_keys_dir", d.Sign.AgentKeysDir)
 	v.SetDefault("encryption.crypto_key", d.Encryption.CryptoKey)
 	v.SetDefault("audit.audit_file", d.Audit.AuditFile)
 	v.SetDefault("audit.audit_url", d.Audit.AuditURL)
+	v.SetDefault("audit.buffer_size", d.Audit.BufferSize)
+	v.SetDefault("audit.overflow_policy", d.Audit.OverflowPolicy)
+	v.SetDefault("audit.spool_file", d.Audit.SpoolFile)
+	v.SetDefault("audit.spool_max_records", d.Audit.SpoolMaxRecords)
+	v.SetDefault("audit.chain_key", d.Audit.ChainKey)
+	v.SetDefault("audit.checkpoint_interval", d.Audit.CheckpointInterval)
+	v.SetDefault("audit.max_size", d.Audit.MaxSize)
+	v.SetDefault("audit.rotate_interval", d.Audit.RotateInterval)
+	v.SetDefault("audit.max_backups", d.Audit.MaxBackups)
+	v.SetDefault("audit.max_age", d.Audit.MaxAge)
+	v.SetDefault("audit.sinks", d.Audit.Sinks)
+	v.SetDefault("statsd.address", d.StatsD.Address)
+	v.SetDefault("statsd.flush_interval", d.StatsD.FlushInterval)
+	v.SetDefault("alert.rules", d.Alert.Rules)
+	v.SetDefault("alert.webhooks", d.Alert.Webhooks)
+	v.SetDefault("alert.eval_interval", d.Alert.EvalInterval)
+	v.SetDefault("auth.enabled", d.Auth.Enabled)
+	v.SetDefault("auth.tokens", d.Auth.Tokens)
+	v.SetDefault("tls.cert_file", d.TLS.CertFile)
+	v.SetDefault("tls.key_file", d.TLS.KeyFile)
+	v.SetDefault("tls.client_ca_file", d.TLS.ClientCAFile)
+	v.SetDefault("limit.max_body_size", d.Limit.MaxBodySize)
+	v.SetDefault("limit.max_decompressed_size", d.Limit.MaxDecompressedSize)
+	v.SetDefault("limit.ip_rate", d.Limit.IPRate)
+	v.SetDefault("limit.ip_burst", d.Limit.IPBurst)
+	v.SetDefault("limit.token_rate", d.Limit.TokenRate)
+	v.SetDefault("limit.token_burst", d.Limit.TokenBurst)
+	v.SetDefault("limit.concurrency", d.Limit.Concurrency)
+	v.SetDefault("trace.exporter", d.Trace.Exporter)
+	v.SetDefault("trace.file", d.Trace.File)
+	v.SetDefault("self_metrics.ingest_interval", d.SelfMetrics.IngestInterval)
+	v.SetDefault("debug.enabled", d.Debug.Enabled)
+	v.SetDefault("access_log.sampling", d.AccessLog.Sampling)
 	v.SetDefault("log_level", d.LogLevel)
 }
 
@@ -248,8 +407,20 @@ func setAgentDefaults(v *viper.Viper) {
 	v.SetDefault("agent.enable_gzip", d.Agent.EnableGzip)
 	v.SetDefault("agent.enable_get_metrics", d.Agent.EnableTestGet)
 	v.SetDefault("agent.rate_limit", d.Agent.RateLimit)
+	v.SetDefault("agent.api_token", d.Agent.APIToken)
 	v.SetDefault("sign.key", d.Sign.Key)
+	v.SetDefault("sign.key_id", d.Sign.KeyID)
+	v.SetDefault("sign.private_key", d.Sign.PrivateKey)
+	v.SetDefault("sign.agent_id", d.Sign.AgentID)
 	v.SetDefault("encryption.crypto_key", d.Encryption.CryptoKey)
+	v.SetDefault("tls.ca_file", d.TLS.CAFile)
+	v.SetDefault("tls.cert_file", d.TLS.CertFile)
+	v.SetDefault("tls.key_file", d.TLS.KeyFile)
+	v.SetDefault("trace.exporter", d.Trace.Exporter)
+	v.SetDefault("trace.file", d.Trace.File)
+	v.SetDefault("debug.enabled", d.Debug.Enabled)
+	v.SetDefault("debug.address", d.Debug.Address)
+	v.SetDefault("debug.token", d.Debug.Token)
 	v.SetDefault("log_level", d.LogLevel)
 	v.SetDefault("shutdown_timeout", d.ShutdownTimeout)
 }
@@ -284,9 +455,43 @@ func GetServerConfig() (ServerConfig, error) {
 	fs.StringP("d", "d", v.GetString("repository.db.database_dsn"), "database DSN")
 	fs.BoolP("r", "r", v.GetBool("repository.fs.restore"), "restore on start")
 	fs.StringP("k", "k", v.GetString("sign.key"), "sign key")
+	fs.String("key-id", v.GetString("sign.key_id"), "ID of the sign key in the key ring")
+	fs.Int("sign-replay-window", v.GetInt("sign.replay_window"), "accepted clock skew of the signed requests, s")
+	fs.Int("sign-nonce-cache-size", v.GetInt("sign.nonce_cache_size"), "nonces of the signed requests remembered to reject replays")
+	fs.Bool("sign-required", v.GetBool("sign.required"), "reject the POST requests not signed with replay protection")
+	fs.String("sign-agent-keys-dir", v.GetString("sign.agent_keys_dir"), "directory of the <agent ID>.pem public keys of the agents")
 	fs.String("crypto-key", v.GetString("encryption.crypto_key"), "path to crypto key")
 	fs.String("audit-file", v.GetString("audit.audit_file"), "audit file path")
 	fs.String("audit-url", v.GetString("audit.audit_url"), "audit URL")
+	fs.Int("audit-buffer-size", v.GetInt("audit.buffer_size"), "audit buffer size")
+	fs.String("audit-overflow-policy", v.GetString("audit.overflow_policy"), "audit overflow policy: drop_newest, drop_oldest or block")
+	fs.String("audit-spool-file", v.GetString("audit.spool_file"), "audit spool file path")
+	fs.Int("audit-spool-max-records", v.GetInt("audit.spool_max_records"), "maximum number of spooled audit records")
+	fs.String("audit-chain-key", v.GetString("audit.chain_key"), "HMAC key of the audit file hash chain")
+	fs.Int("audit-checkpoint-interval", v.GetInt("audit.checkpoint_interval"), "audit file checkpoint interval, s")
+	fs.Int("audit-max-size", v.GetInt("audit.max_size"), "audit file size triggering the rotation, MB")
+	fs.Int("audit-rotate-interval", v.GetInt("audit.rotate_interval"), "audit file age triggering the rotation, s")
+	fs.Int("audit-max-backups", v.GetInt("audit.max_backups"), "number of rotated audit files to keep")
+	fs.Int("audit-max-age", v.GetInt("audit.max_age"), "age of the rotated audit files to keep, h")
+	fs.String("statsd-address", v.GetString("statsd.address"), "StatsD UDP listen address")
+	fs.Int("statsd-flush-interval", v.GetInt("statsd.flush_interval"), "StatsD flush interval, s")
+	fs.Int("alert-eval-interval", v.GetInt("alert.eval_interval"), "alert rules evaluation interval, s")
+	fs.Bool("auth-enabled", v.GetBool("auth.enabled"), "require API tokens")
+	fs.String("tls-cert", v.GetString("tls.cert_file"), "path to the PEM server certificate, enables HTTPS")
+	fs.String("tls-key", v.GetString("tls.key_file"), "path to the PEM server key")
+	fs.String("tls-client-ca", v.GetString("tls.client_ca_file"), "path to the PEM CA bundle verifying client certificates, enables mTLS")
+	fs.Int("limit-body-size", v.GetInt("limit.max_body_size"), "maximum request body size in bytes as received, 8 MiB if zero")
+	fs.Int("limit-decompressed-size", v.GetInt("limit.max_decompressed_size"), "maximum request body size in bytes after decompression, 32 MiB if zero")
+	fs.Int("limit-ip-rate", v.GetInt("limit.ip_rate"), "requests per second of a client IP address, unlimited if zero")
+	fs.Int("limit-ip-burst", v.GetInt("limit.ip_burst"), "requests of a client IP address above the rate, the rate if zero")
+	fs.Int("limit-token-rate", v.GetInt("limit.token_rate"), "requests per second of an API token, unlimited if zero")
+	fs.Int("limit-token-burst", v.GetInt("limit.token_burst"), "requests of an API token above the rate, the rate if zero")
+	fs.Int("limit-concurrency", v.GetInt("limit.concurrency"), "requests served at once by the storage-bound handlers, unlimited if zero")
+	fs.String("trace-exporter", v.GetString("trace.exporter"), "span exporter: none, stdout or file")
+	fs.String("trace-file", v.GetString("trace.file"), "file the spans are appended to by the file exporter")
+	fs.Int("self-metrics-interval", v.GetInt("self_metrics.ingest_interval"), "interval for saving the self-metrics to the repository, s; disabled if zero")
+	fs.Bool("debug-enabled", v.GetBool("debug.enabled"), "serve the pprof and runtime diagnostics endpoints to the admin API tokens")
+	fs.Int("access-log-sampling", v.GetInt("access_log.sampling"), "log one of every N successful requests per route, every request if 0 or 1")
 
 	// Parse flags
 	if err := fs.Parse(os.Args[1:]); err != nil && err != pflag.ErrHelp {
@@ -341,6 +546,133 @@ func validateServerConfig(cfg *ServerConfig) error {
 	if cfg.Repository.FSConfig.StoreInterval < 0 {
 		return fmt.Errorf("STORE_INTERVAL must be non-negative (got %d)", cfg.Repository.FSConfig.StoreInterval)
 	}
+	if cfg.StatsD.FlushInterval < 0 {
+		return fmt.Errorf("STATSD_FLUSH_INTERVAL must be non-negative (got %d)", cfg.StatsD.FlushInterval)
+	}
+	if cfg.Alert.EvalInterval < 0 {
+		return fmt.Errorf("ALERT_EVAL_INTERVAL must be non-negative (got %d)", cfg.Alert.EvalInterval)
+	}
+	if cfg.SelfMetrics.IngestInterval < 0 {
+		return fmt.Errorf("SELF_METRICS_INTERVAL must be non-negative (got %d)", cfg.SelfMetrics.IngestInterval)
+	}
+	if cfg.AccessLog.Sampling < 0 {
+		return fmt.Errorf("ACCESS_LOG_SAMPLING must be non-negative (got %d)", cfg.AccessLog.Sampling)
+	}
+	// The diagnostics endpoints are served to the admin API tokens only.
+	if cfg.Debug.Enabled && !cfg.Auth.Enabled {
+		return fmt.Errorf("DEBUG_ENABLED requires AUTH_ENABLED")
+	}
+	if cfg.Audit.BufferSize < 0 {
+		return fmt.Errorf("AUDIT_BUFFER_SIZE must be non-negative (got %d)", cfg.Audit.BufferSize)
+	}
+	if cfg.Audit.SpoolMaxRecords < 0 {
+		return fmt.Errorf("AUDIT_SPOOL_MAX_RECORDS must be non-negative (got %d)", cfg.Audit.SpoolMaxRecords)
+	}
+	if cfg.Audit.CheckpointInterval < 0 {
+		return fmt.Errorf("AUDIT_CHECKPOINT_INTERVAL must be non-negative (got %d)", cfg.Audit.CheckpointInterval)
+	}
+	if cfg.Audit.MaxSize < 0 {
+		return fmt.Errorf("AUDIT_MAX_SIZE must be non-negative (got %d)", cfg.Audit.MaxSize)
+	}
+	if cfg.Audit.RotateInterval < 0 {
+		return fmt.Errorf("AUDIT_ROTATE_INTERVAL must be non-negative (got %d)", cfg.Audit.RotateInterval)
+	}
+	if cfg.Audit.MaxBackups < 0 {
+		return fmt.Errorf("AUDIT_MAX_BACKUPS must be non-negative (got %d)", cfg.Audit.MaxBackups)
+	}
+	if cfg.Audit.MaxAge < 0 {
+		return fmt.Errorf("AUDIT_MAX_AGE must be non-negative (got %d)", cfg.Audit.MaxAge)
+	}
+	switch cfg.Audit.OverflowPolicy {
+	case "", audit.PolicyBlock, audit.PolicyDropOldest, audit.PolicyDropNewest:
+	default:
+		return fmt.Errorf("AUDIT_OVERFLOW_POLICY must be one of %s, %s or %s (got %q)",
+			audit.PolicyBlock, audit.PolicyDropOldest, audit.PolicyDropNewest, cfg.Audit.OverflowPolicy)
+	}
+	if cfg.Audit.ChainKey == "" && (cfg.Audit.AuditFile != "" || slices.ContainsFunc(cfg.Audit.Sinks, func(sink audit.SinkConfig) bool {
+		return sink.Type == audit.SinkFile
+	})) {
+		// Without a key anyone can recompute the hashes, the file would not be tamper-evident.
+		return fmt.Errorf("the audit file sink requires AUDIT_CHAIN_KEY")
+	}
+	if cfg.Auth.Enabled && len(cfg.Auth.Tokens) == 0 && cfg.Repository.DBConfig.DatabaseDSN == "" {
+		return fmt.Errorf("AUTH_ENABLED requires API tokens in the config or DATABASE_DSN")
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.Sign.KeyID != "" && cfg.Sign.Key == "" {
+		return fmt.Errorf("KEY_ID requires KEY")
+	}
+	if cfg.Sign.ReplayWindow < 0 {
+		return fmt.Errorf("SIGN_REPLAY_WINDOW must be non-negative (got %d)", cfg.Sign.ReplayWindow)
+	}
+	if cfg.Sign.NonceCacheSize < 0 {
+		return fmt.Errorf("SIGN_NONCE_CACHE_SIZE must be non-negative (got %d)", cfg.Sign.NonceCacheSize)
+	}
+	if cfg.Sign.Required && cfg.Sign.Key == "" && len(cfg.Sign.Keys) == 0 && cfg.Sign.AgentKeysDir == "" {
+		return fmt.Errorf("SIGN_REQUIRED requires KEY, sign keys in the config or SIGN_AGENT_KEYS_DIR")
+	}
+	for i, key := range cfg.Sign.Keys {
+		if key.ID == "" || key.Key == "" {
+			return fmt.Errorf("sign key %d: id and key are required", i)
+		}
+		for _, t := range []string{key.NotBefore, key.NotAfter} {
+			if _, err := time.Parse(time.RFC3339, t); t != "" && err != nil {
+				return fmt.Errorf("sign key %s: not_before and not_after must be RFC 3339 times: %w", key.ID, err)
+			}
+		}
+	}
+	if cfg.TLS.ClientCAFile != "" && cfg.TLS.CertFile == "" {
+		return fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	for _, l := range []struct {
+		env   string
+		value int
+	}{
+		{"LIMIT_BODY_SIZE", cfg.Limit.MaxBodySize},
+		{"LIMIT_DECOMPRESSED_SIZE", cfg.Limit.MaxDecompressedSize},
+		{"LIMIT_IP_RATE", cfg.Limit.IPRate},
+		{"LIMIT_IP_BURST", cfg.Limit.IPBurst},
+		{"LIMIT_TOKEN_RATE", cfg.Limit.TokenRate},
+		{"LIMIT_TOKEN_BURST", cfg.Limit.TokenBurst},
+		{"LIMIT_CONCURRENCY", cfg.Limit.Concurrency},
+	} {
+		if l.value < 0 {
+			return fmt.Errorf("%s must be non-negative (got %d)", l.env, l.value)
+		}
+	}
+	if err := validateTraceConfig(cfg.Trace); err != nil {
+		return err
+	}
+	for i, sink := range cfg.Audit.Sinks {
+		switch sink.Type {
+		case audit.SinkFile:
+			if sink.Path == "" {
+				return fmt.Errorf("audit sink %d: path is required for the %s sink", i, sink.Type)
+			}
+		case audit.SinkURL, audit.SinkSyslog, audit.SinkHTTPBatch:
+			if sink.URL == "" {
+				return fmt.Errorf("audit sink %d: url is required for the %s sink", i, sink.Type)
+			}
+		case audit.SinkPostgres:
+			if sink.DSN == "" && cfg.Repository.DBConfig.DatabaseDSN == "" {
+				return fmt.Errorf("audit sink %d: dsn is required for the %s sink without DATABASE_DSN", i, sink.Type)
+			}
+		default:
+			return fmt.Errorf("audit sink %d: type must be one of %s, %s, %s, %s or %s (got %q)", i,
+				audit.SinkFile, audit.SinkURL, audit.SinkSyslog, audit.SinkPostgres, audit.SinkHTTPBatch, sink.Type)
+		}
+		if sink.SpoolMaxRecords < 0 {
+			return fmt.Errorf("audit sink %d: spool_max_records must be non-negative (got %d)", i, sink.SpoolMaxRecords)
+		}
+		if sink.BatchSize < 0 {
+			return fmt.Errorf("audit sink %d: batch_size must be non-negative (got %d)", i, sink.BatchSize)
+		}
+		if sink.FlushInterval < 0 {
+			return fmt.Errorf("audit sink %d: flush_interval must be non-negative (got %d)", i, sink.FlushInterval)
+		}
+	}
 	return nil
 }
 
@@ -374,8 +706,20 @@ func GetAgentConfig() (AgentConfig, error) {
 	fs.Bool("gzip", v.GetBool("agent.enable_gzip"), "enable gzip")
 	fs.BoolP("g", "g", v.GetBool("agent.enable_get_metrics"), "enable GET /metrics")
 	fs.IntP("l", "l", v.GetInt("agent.rate_limit"), "rate limit")
+	fs.String("api-token", v.GetString("agent.api_token"), "API token with the metrics:write scope")
 	fs.StringP("k", "k", v.GetString("sign.key"), "sign key")
+	fs.String("key-id", v.GetString("sign.key_id"), "ID of the sign key, sent to the server")
+	fs.String("sign-private-key", v.GetString("sign.private_key"), "path to the PEM Ed25519 or ECDSA private key signing the requests")
+	fs.String("agent-id", v.GetString("sign.agent_id"), "ID of the agent, the name of its public key on the server")
 	fs.String("crypto-key", v.GetString("encryption.crypto_key"), "path to crypto key")
+	fs.String("tls-ca", v.GetString("tls.ca_file"), "path to the PEM CA bundle verifying the server, enables HTTPS")
+	fs.String("tls-cert", v.GetString("tls.cert_file"), "path to the PEM client certificate, enables HTTPS")
+	fs.String("tls-key", v.GetString("tls.key_file"), "path to the PEM client key")
+	fs.String("trace-exporter", v.GetString("trace.exporter"), "span exporter: none, stdout or file")
+	fs.String("trace-file", v.GetString("trace.file"), "file the spans are appended to by the file exporter")
+	fs.Bool("debug-enabled", v.GetBool("debug.enabled"), "serve the pprof and runtime diagnostics endpoints")
+	fs.String("debug-address", v.GetString("debug.address"), "listen address of the diagnostics endpoints, localhost:6060 if empty")
+	fs.String("debug-token", v.GetString("debug.token"), "bearer token required by the diagnostics endpoints")
 
 	// Parse flags
 	if err := fs.Parse(os.Args[1:]); err != nil && err != pflag.ErrHelp {
@@ -432,6 +776,33 @@ func validateAgentConfig(cfg *AgentConfig) error {
 	if cfg.ShutdownTimeout < 0 {
 		return fmt.Errorf("SHUTDOWN_TIMEOUT must be non-negative (got %d)", cfg.ShutdownTimeout)
 	}
+	if cfg.Sign.KeyID != "" && cfg.Sign.Key == "" {
+		return fmt.Errorf("KEY_ID requires KEY")
+	}
+	if (cfg.Sign.PrivateKey == "") != (cfg.Sign.AgentID == "") {
+		return fmt.Errorf("SIGN_PRIVATE_KEY and AGENT_ID must be set together")
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.Debug.Enabled && cfg.Debug.Token == "" {
+		return fmt.Errorf("DEBUG_ENABLED requires DEBUG_TOKEN")
+	}
+	return validateTraceConfig(cfg.Trace)
+}
+
+// validateTraceConfig validates the tracing config shared by the server and the agent.
+func validateTraceConfig(cfg trace.TraceConfig) error {
+	switch cfg.Exporter {
+	case "", trace.ExporterNone, trace.ExporterStdout:
+	case trace.ExporterFile:
+		if cfg.File == "" {
+			return fmt.Errorf("TRACE_EXPORTER %s requires TRACE_FILE", trace.ExporterFile)
+		}
+	default:
+		return fmt.Errorf("TRACE_EXPORTER must be one of %s, %s or %s (got %q)",
+			trace.ExporterNone, trace.ExporterStdout, trace.ExporterFile, cfg.Exporter)
+	}
 	return nil
 }
 
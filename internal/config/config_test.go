@@ -8,10 +8,19 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	agentcfg "github.com/devize-ed/yapracproj-metrics.git/internal/agent/config"
+	alertcfg "github.com/devize-ed/yapracproj-metrics.git/internal/alert/config"
+	auditcfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	authcfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	certcfg "github.com/devize-ed/yapracproj-metrics.git/internal/certs/config"
+	debugcfg "github.com/devize-ed/yapracproj-metrics.git/internal/diagnostics/config"
+	limit "github.com/devize-ed/yapracproj-metrics.git/internal/limit/config"
+	logcfg "github.com/devize-ed/yapracproj-metrics.git/internal/logger/config"
 	repo "github.com/devize-ed/yapracproj-metrics.git/internal/repository"
 	db "github.com/devize-ed/yapracproj-metrics.git/internal/repository/db/config"
 	fs "github.com/devize-ed/yapracproj-metrics.git/internal/repository/fstorage/config"
+	selfmetrics "github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics/config"
 	sign "github.com/devize-ed/yapracproj-metrics.git/internal/sign/config"
+	tracecfg "github.com/devize-ed/yapracproj-metrics.git/internal/tracing/config"
 )
 
 func writeTempJSON(t *testing.T, content string) string {
@@ -188,6 +197,7 @@ func TestGetServerConfig(t *testing.T) {
 					"db": {"database_dsn": ""}
 				},
 				"sign": {"key": "test_key"},
+				"alert": {"rules": ["FreeMemory < 500MB for 2m"], "webhooks": ["http://localhost:9000/hook"], "eval_interval": 30},
 				"log_level": "debug"
 			}`,
 			envVars: map[string]string{
@@ -209,10 +219,349 @@ func TestGetServerConfig(t *testing.T) {
 				Sign: sign.SignConfig{
 					Key: "test_key",
 				},
+				Alert: alertcfg.AlertConfig{
+					Rules:        []string{"FreeMemory < 500MB for 2m"},
+					Webhooks:     []string{"http://localhost:9000/hook"},
+					EvalInterval: 30,
+				},
 				LogLevel: "debug",
 			},
 			wantErr: false,
 		},
+		{
+			name: "Audit pipeline",
+			envVars: map[string]string{
+				"AUDIT_URL":             "http://localhost:9000/audit",
+				"AUDIT_OVERFLOW_POLICY": "drop_oldest",
+			},
+			args: []string{"--audit-buffer-size=500", "--audit-spool-file=audit.spool", "--audit-spool-max-records=1000", "--audit-chain-key=chain", "--audit-checkpoint-interval=30",
+				"--audit-max-size=100", "--audit-max-backups=7"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Audit: auditcfg.AuditConfig{
+					AuditURL:           "http://localhost:9000/audit",
+					BufferSize:         500,
+					OverflowPolicy:     auditcfg.PolicyDropOldest,
+					SpoolFile:          "audit.spool",
+					SpoolMaxRecords:    1000,
+					ChainKey:           "chain",
+					CheckpointInterval: 30,
+					MaxSize:            100,
+					MaxBackups:         7,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative audit max age",
+			envVars: map[string]string{
+				"AUDIT_MAX_AGE": "-1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative audit spool max records",
+			envVars: map[string]string{
+				"AUDIT_SPOOL_MAX_RECORDS": "-1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "audit file without chain key",
+			envVars: map[string]string{
+				"AUDIT_FILE": "audit.json",
+			},
+			wantErr: true,
+		},
+		{
+			name: "audit file sink without chain key",
+			setupFileJSON: `{
+				"audit": {"sinks": [{"type": "file", "path": "audit.json"}]}
+			}`,
+			args:    []string{"-c", "configpath.json"},
+			wantErr: true,
+		},
+		{
+			name: "unknown audit overflow policy",
+			envVars: map[string]string{
+				"AUDIT_OVERFLOW_POLICY": "drop_all",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Audit sinks from config file",
+			setupFileJSON: `{
+				"audit": {"sinks": [
+					{"type": "syslog", "name": "siem", "url": "tcp://siem.local:514", "tag": "metrics"},
+					{"type": "postgres", "dsn": "postgres://localhost/audit", "batch_size": 50},
+					{"type": "http_batch", "url": "http://localhost:9000/audit", "flush_interval": 2}
+				]}
+			}`,
+			args: []string{"-c", "configpath.json"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Audit: auditcfg.AuditConfig{
+					Sinks: []auditcfg.SinkConfig{
+						{Type: auditcfg.SinkSyslog, Name: "siem", URL: "tcp://siem.local:514", Tag: "metrics"},
+						{Type: auditcfg.SinkPostgres, DSN: "postgres://localhost/audit", BatchSize: 50},
+						{Type: auditcfg.SinkHTTPBatch, URL: "http://localhost:9000/audit", FlushInterval: 2},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "API tokens from config file",
+			setupFileJSON: `{
+				"auth": {"enabled": true, "tokens": [
+					{"id": "agent", "hash": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "scopes": ["metrics:write"]}
+				]}
+			}`,
+			args: []string{"-c", "configpath.json"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Auth: authcfg.AuthConfig{
+					Enabled: true,
+					Tokens: []authcfg.TokenConfig{
+						{ID: "agent", Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", Scopes: []string{"metrics:write"}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "auth enabled without tokens",
+			envVars: map[string]string{
+				"AUTH_ENABLED": "true",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown audit sink type",
+			setupFileJSON: `{
+				"audit": {"sinks": [{"type": "kafka", "url": "kafka://localhost:9092"}]}
+			}`,
+			args:    []string{"-c", "configpath.json"},
+			wantErr: true,
+		},
+		{
+			name: "audit sink without url",
+			setupFileJSON: `{
+				"audit": {"sinks": [{"type": "http_batch"}]}
+			}`,
+			args:    []string{"-c", "configpath.json"},
+			wantErr: true,
+		},
+		{
+			name: "Mutual TLS",
+			envVars: map[string]string{
+				"TLS_CLIENT_CA_FILE": "ca.pem",
+			},
+			args: []string{"--tls-cert=server.pem", "--tls-key=server-key.pem"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				TLS: certcfg.ServerTLSConfig{
+					CertFile:     "server.pem",
+					KeyFile:      "server-key.pem",
+					ClientCAFile: "ca.pem",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "TLS certificate without key",
+			envVars: map[string]string{
+				"TLS_CERT_FILE": "server.pem",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Sign key ring from config file",
+			setupFileJSON: `{
+				"sign": {"key": "k1-secret", "key_id": "k1", "keys": [
+					{"id": "k2", "key": "k2-secret", "not_before": "2026-10-01T00:00:00Z", "not_after": "2027-01-01T00:00:00Z"}
+				]}
+			}`,
+			args: []string{"-c", "configpath.json"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Sign: sign.SignConfig{
+					Key:   "k1-secret",
+					KeyID: "k1",
+					Keys: []sign.KeyConfig{
+						{ID: "k2", Key: "k2-secret", NotBefore: "2026-10-01T00:00:00Z", NotAfter: "2027-01-01T00:00:00Z"},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "sign key with bad time",
+			setupFileJSON: `{
+				"sign": {"keys": [{"id": "k2", "key": "k2-secret", "not_after": "next year"}]}
+			}`,
+			args:    []string{"-c", "configpath.json"},
+			wantErr: true,
+		},
+		{
+			name: "key ID without key",
+			envVars: map[string]string{
+				"KEY_ID": "k1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Sign replay protection",
+			envVars: map[string]string{
+				"SIGN_REPLAY_WINDOW": "60",
+			},
+			args: []string{"--sign-nonce-cache-size=5000"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Sign:       sign.SignConfig{ReplayWindow: 60, NonceCacheSize: 5000},
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative replay window",
+			envVars: map[string]string{
+				"SIGN_REPLAY_WINDOW": "-1",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "client CA without certificate",
+			args:    []string{"--tls-client-ca=ca.pem"},
+			wantErr: true,
+		},
+		{
+			name: "Agent keys required",
+			envVars: map[string]string{
+				"SIGN_AGENT_KEYS_DIR": "/etc/metrics/agents",
+			},
+			args: []string{"--sign-required"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Sign:       sign.SignConfig{Required: true, AgentKeysDir: "/etc/metrics/agents"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "signature required without keys",
+			envVars: map[string]string{
+				"SIGN_REQUIRED": "true",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Request limits",
+			envVars: map[string]string{
+				"LIMIT_BODY_SIZE":   "1048576",
+				"LIMIT_IP_RATE":     "50",
+				"LIMIT_CONCURRENCY": "8",
+			},
+			args: []string{"--limit-ip-burst=100", "--limit-token-rate=20"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Limit:      limit.LimitConfig{MaxBodySize: 1048576, IPRate: 50, IPBurst: 100, TokenRate: 20, Concurrency: 8},
+			},
+			wantErr: false,
+		},
+		{
+			name:          "Request limits from JSON",
+			setupFileJSON: `{"limit": {"max_decompressed_size": 4194304, "token_rate": 10, "token_burst": 30}}`,
+			args:          []string{"-c", "configpath.json"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Limit:      limit.LimitConfig{MaxDecompressedSize: 4194304, TokenRate: 10, TokenBurst: 30},
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative rate limit",
+			envVars: map[string]string{
+				"LIMIT_IP_RATE": "-5",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Trace file exporter",
+			envVars: map[string]string{
+				"TRACE_EXPORTER": "file",
+			},
+			args: []string{"--trace-file=/var/log/metrics/spans.json"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Trace:      tracecfg.TraceConfig{Exporter: "file", File: "/var/log/metrics/spans.json"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "trace file exporter without file",
+			envVars: map[string]string{
+				"TRACE_EXPORTER": "file",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown trace exporter",
+			args:    []string{"--trace-exporter=jaeger"},
+			wantErr: true,
+		},
+		{
+			name: "Self-metrics ingestion",
+			envVars: map[string]string{
+				"SELF_METRICS_INTERVAL": "15",
+			},
+			expectedConfig: ServerConfig{
+				Connection:  ServerConn{Host: "localhost:8080"},
+				SelfMetrics: selfmetrics.SelfMetricsConfig{IngestInterval: 15},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative self-metrics interval",
+			args:    []string{"--self-metrics-interval=-1"},
+			wantErr: true,
+		},
+		{
+			name: "Diagnostics endpoints",
+			envVars: map[string]string{
+				"AUTH_ENABLED": "true",
+				"DATABASE_DSN": "postgres://metrics@localhost/metrics",
+			},
+			args: []string{"--debug-enabled"},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				Repository: repo.RepositoryConfig{DBConfig: db.DBConfig{DatabaseDSN: "postgres://metrics@localhost/metrics"}},
+				Auth:       authcfg.AuthConfig{Enabled: true},
+				Debug:      debugcfg.ServerDebugConfig{Enabled: true},
+			},
+			wantErr: false,
+		},
+		{
+			name: "diagnostics endpoints without auth",
+			envVars: map[string]string{
+				"DEBUG_ENABLED": "true",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Access log sampling",
+			envVars: map[string]string{
+				"ACCESS_LOG_SAMPLING": "100",
+			},
+			expectedConfig: ServerConfig{
+				Connection: ServerConn{Host: "localhost:8080"},
+				AccessLog:  logcfg.AccessLogConfig{Sampling: 100},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative access log sampling",
+			args:    []string{"--access-log-sampling=-1"},
+			wantErr: true,
+		},
 	}
 
 	for _, tc := range tests {
@@ -220,6 +569,14 @@ func TestGetServerConfig(t *testing.T) {
 			for _, k := range []string{
 				"ADDRESS", "STORE_INTERVAL", "FILE_STORAGE_PATH", "RESTORE", "DATABASE_DSN",
 				"LOG_LEVEL", "KEY", "CONFIG", "CRYPTO_KEY", "AUDIT_FILE", "AUDIT_URL",
+				"AUDIT_BUFFER_SIZE", "AUDIT_OVERFLOW_POLICY", "AUDIT_SPOOL_FILE", "AUDIT_SPOOL_MAX_RECORDS",
+				"AUDIT_CHAIN_KEY", "AUDIT_CHECKPOINT_INTERVAL",
+				"AUDIT_MAX_SIZE", "AUDIT_ROTATE_INTERVAL", "AUDIT_MAX_BACKUPS", "AUDIT_MAX_AGE", "AUTH_ENABLED",
+				"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "KEY_ID",
+				"SIGN_REPLAY_WINDOW", "SIGN_NONCE_CACHE_SIZE", "SIGN_REQUIRED", "SIGN_AGENT_KEYS_DIR",
+				"LIMIT_BODY_SIZE", "LIMIT_DECOMPRESSED_SIZE", "LIMIT_IP_RATE", "LIMIT_IP_BURST",
+				"LIMIT_TOKEN_RATE", "LIMIT_TOKEN_BURST", "LIMIT_CONCURRENCY", "TRACE_EXPORTER", "TRACE_FILE",
+				"SELF_METRICS_INTERVAL", "DEBUG_ENABLED", "ACCESS_LOG_SAMPLING",
 			} {
 				t.Setenv(k, "")
 			}
@@ -296,7 +653,7 @@ func TestGetAgentConfig(t *testing.T) {
 		{
 			name:    "CLI flags",
 			envVars: map[string]string{},
-			args:    []string{"-a=:7070", "-r=5", "-p=1", "--gzip=false", "-g=false", "-k=test_key", "-l=5"},
+			args:    []string{"-a=:7070", "-r=5", "-p=1", "--gzip=false", "-g=false", "-k=test_key", "-l=5", "--api-token=mt_token"},
 			expectedConfig: AgentConfig{
 				Connection: AgentConn{Host: ":7070"},
 				Agent: agentcfg.AgentConfig{
@@ -305,6 +662,7 @@ func TestGetAgentConfig(t *testing.T) {
 					EnableGzip:     false,
 					EnableTestGet:  false,
 					RateLimit:      5,
+					APIToken:       "mt_token",
 				},
 				Sign: sign.SignConfig{
 					Key: "test_key",
@@ -439,6 +797,130 @@ func TestGetAgentConfig(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Mutual TLS from config file",
+			setupFileJSON: `{
+				"tls": {"ca_file": "ca.pem", "cert_file": "agent.pem"}
+			}`,
+			envVars: map[string]string{
+				"TLS_KEY_FILE": "agent-key.pem",
+			},
+			args: []string{"-c", "WILL_BE_REPLACED"},
+			expectedConfig: AgentConfig{
+				Connection: AgentConn{Host: "localhost:8080"},
+				Agent: agentcfg.AgentConfig{
+					ReportInterval: 10,
+					PollInterval:   2,
+					EnableGzip:     true,
+					RateLimit:      10,
+				},
+				TLS: certcfg.ClientTLSConfig{
+					CAFile:   "ca.pem",
+					CertFile: "agent.pem",
+					KeyFile:  "agent-key.pem",
+				},
+				ShutdownTimeout: 5,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Sign key ID",
+			envVars: map[string]string{
+				"KEY_ID": "k2",
+			},
+			args: []string{"-k=secret"},
+			expectedConfig: AgentConfig{
+				Connection: AgentConn{Host: "localhost:8080"},
+				Agent: agentcfg.AgentConfig{
+					ReportInterval: 10,
+					PollInterval:   2,
+					EnableGzip:     true,
+					RateLimit:      10,
+				},
+				Sign:            sign.SignConfig{Key: "secret", KeyID: "k2"},
+				ShutdownTimeout: 5,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "client certificate without key",
+			args:    []string{"--tls-cert=agent.pem"},
+			wantErr: true,
+		},
+		{
+			name: "Sign private key",
+			envVars: map[string]string{
+				"AGENT_ID": "agent-1",
+			},
+			args: []string{"--sign-private-key=agent-1.key"},
+			expectedConfig: AgentConfig{
+				Connection: AgentConn{Host: "localhost:8080"},
+				Agent: agentcfg.AgentConfig{
+					ReportInterval: 10,
+					PollInterval:   2,
+					EnableGzip:     true,
+					RateLimit:      10,
+				},
+				Sign:            sign.SignConfig{PrivateKey: "agent-1.key", AgentID: "agent-1"},
+				ShutdownTimeout: 5,
+			},
+			wantErr: false,
+		},
+		{
+			name: "private key without agent ID",
+			envVars: map[string]string{
+				"SIGN_PRIVATE_KEY": "agent-1.key",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Trace stdout exporter",
+			envVars: map[string]string{
+				"TRACE_EXPORTER": "stdout",
+			},
+			expectedConfig: AgentConfig{
+				Connection: AgentConn{Host: "localhost:8080"},
+				Agent: agentcfg.AgentConfig{
+					ReportInterval: 10,
+					PollInterval:   2,
+					EnableGzip:     true,
+					RateLimit:      10,
+				},
+				Trace:           tracecfg.TraceConfig{Exporter: "stdout"},
+				ShutdownTimeout: 5,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "unknown agent trace exporter",
+			args:    []string{"--trace-exporter=otlp"},
+			wantErr: true,
+		},
+		{
+			name: "Diagnostics endpoints",
+			envVars: map[string]string{
+				"DEBUG_ENABLED": "true",
+				"DEBUG_TOKEN":   "debug-token",
+			},
+			args: []string{"--debug-address=localhost:6061"},
+			expectedConfig: AgentConfig{
+				Connection: AgentConn{Host: "localhost:8080"},
+				Agent: agentcfg.AgentConfig{
+					ReportInterval: 10,
+					PollInterval:   2,
+					EnableGzip:     true,
+					RateLimit:      10,
+				},
+				Debug:           debugcfg.AgentDebugConfig{Enabled: true, Address: "localhost:6061", Token: "debug-token"},
+				ShutdownTimeout: 5,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "diagnostics endpoints without token",
+			args:    []string{"--debug-enabled"},
+			wantErr: true,
+		},
 	}
 
 	for _, tc := range tests {
@@ -446,7 +928,9 @@ func TestGetAgentConfig(t *testing.T) {
 			for _, k := range []string{
 				"ADDRESS", "REPORT_INTERVAL", "POLL_INTERVAL", "LOG_LEVEL",
 				"ENABLE_GZIP", "ENABLE_TEST_GET",
-				"KEY", "RATE_LIMIT", "CONFIG", "CRYPTO_KEY", "SHUTDOWN_TIMEOUT",
+				"KEY", "RATE_LIMIT", "CONFIG", "CRYPTO_KEY", "SHUTDOWN_TIMEOUT", "API_TOKEN",
+				"TLS_CA_FILE", "TLS_CERT_FILE", "TLS_KEY_FILE", "KEY_ID", "SIGN_PRIVATE_KEY", "AGENT_ID",
+				"TRACE_EXPORTER", "TRACE_FILE", "DEBUG_ENABLED", "DEBUG_ADDRESS", "DEBUG_TOKEN",
 			} {
 				t.Setenv(k, "")
 			}
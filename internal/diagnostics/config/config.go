@@ -0,0 +1,25 @@
+// Package config provides configuration structures for the diagnostics endpoints.
+package config
+
+// DefaultAgentAddress is the listen address of the diagnostics endpoints of the agent when none is set.
+const DefaultAgentAddress = "localhost:6060"
+
+// ServerDebugConfig holds the diagnostics endpoints of the server, served on its address to the admin API tokens.
+type ServerDebugConfig struct {
+	Enabled bool `env:"DEBUG_ENABLED" json:"enabled"` // Serve /debug/pprof, /debug/vars and /debug/profile; requires AUTH_ENABLED.
+}
+
+// AgentDebugConfig holds the diagnostics endpoints of the agent, served on their own address to the bearer token.
+type AgentDebugConfig struct {
+	Enabled bool   `env:"DEBUG_ENABLED" json:"enabled"` // Serve /debug/pprof, /debug/vars and /debug/profile.
+	Address string `env:"DEBUG_ADDRESS" json:"address"` // Listen address of the endpoints, localhost:6060 if empty.
+	Token   string `env:"DEBUG_TOKEN" json:"token"`     // Bearer token required by the endpoints.
+}
+
+// ListenAddress returns the listen address of the endpoints, the default one if none is set.
+func (c AgentDebugConfig) ListenAddress() string {
+	if c.Address == "" {
+		return DefaultAgentAddress
+	}
+	return c.Address
+}
@@ -0,0 +1,172 @@
+// Package diagnostics serves the profiling and runtime diagnostics endpoints of the server and the agent.
+package diagnostics
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Duration limits of the profiles captured by /debug/profile, s.
+const (
+	defaultProfileSeconds = 30
+	maxProfileSeconds     = 300
+)
+
+// Profile kinds captured by /debug/profile.
+const (
+	ProfileCPU  = "cpu"  // CPU profile over the duration
+	ProfileHeap = "heap" // allocations made over the duration
+)
+
+var (
+	// startTime is the start of the process, for its uptime.
+	startTime = time.Now()
+	// publishOnce publishes the runtime variable once, expvar panics on a second one.
+	publishOnce sync.Once
+)
+
+// NewHandler returns the handler of the diagnostics endpoints of the service:
+//   - /debug/pprof/ and its profiles, from net/http/pprof;
+//   - /debug/vars, the expvar variables with the runtime information of the service;
+//   - /debug/profile, a CPU or heap profile over a duration, as a file.
+//
+// /debug/pprof is redirected to /debug/pprof/. The handler does not check the caller, it is to be served behind authentication.
+func NewHandler(service string) http.Handler {
+	publishOnce.Do(func() {
+		expvar.Publish("runtime", expvar.Func(func() any { return runtimeInfo(service) }))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/profile", profileHandler(service))
+	return mux
+}
+
+// Serve serves the handler on the address until ctx is cancelled.
+func Serve(ctx context.Context, addr string, handler http.Handler, logger *zap.SugaredLogger) error {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutCtx); err != nil {
+			logger.Debugf("shut down diagnostics server: %v", err)
+		}
+	}()
+
+	logger.Infof("diagnostics endpoints listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve diagnostics: %w", err)
+	}
+	return nil
+}
+
+// RequireToken wraps the handler so that it serves only the requests with the bearer token.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="diagnostics"`)
+			http.Error(w, "Debug token is required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// profileHandler captures the profile of the kind parameter, cpu by default, over the seconds parameter, 30 by default.
+// The profile is sent as a file named after the service, the kind and the time, to be read with go tool pprof.
+func profileHandler(service string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		kind := query.Get("kind")
+		if kind == "" {
+			kind = ProfileCPU
+		}
+		seconds := defaultProfileSeconds
+		if s := query.Get("seconds"); s != "" {
+			var err error
+			if seconds, err = strconv.Atoi(s); err != nil || seconds <= 0 || seconds > maxProfileSeconds {
+				http.Error(w, fmt.Sprintf("seconds must be an integer from 1 to %d", maxProfileSeconds), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var capture http.Handler
+		switch kind {
+		case ProfileCPU:
+			capture = http.HandlerFunc(pprof.Profile)
+		case ProfileHeap:
+			// The heap profile over seconds is the delta of the allocations.
+			capture = pprof.Handler("heap")
+		default:
+			http.Error(w, "kind must be cpu or heap", http.StatusBadRequest)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		query.Set("seconds", strconv.Itoa(seconds))
+		r.URL.RawQuery = query.Encode()
+		r.Form = nil
+		capture.ServeHTTP(&fileWriter{
+			ResponseWriter: w,
+			name:           fmt.Sprintf("%s-%s-%s.pprof", service, kind, time.Now().UTC().Format("20060102T150405")),
+		}, r)
+	}
+}
+
+// fileWriter names the file of a captured profile, net/http/pprof names the delta profiles after the profile only.
+type fileWriter struct {
+	http.ResponseWriter
+	name        string
+	wroteHeader bool
+}
+
+func (f *fileWriter) WriteHeader(status int) {
+	if !f.wroteHeader {
+		f.wroteHeader = true
+		if status == http.StatusOK {
+			f.Header().Set("Content-Disposition", `attachment; filename="`+f.name+`"`)
+		}
+	}
+	f.ResponseWriter.WriteHeader(status)
+}
+
+func (f *fileWriter) Write(b []byte) (int, error) {
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+	return f.ResponseWriter.Write(b)
+}
+
+// runtimeInfo returns the runtime information of the service published in /debug/vars.
+func runtimeInfo(service string) map[string]any {
+	return map[string]any{
+		"service":        service,
+		"go_version":     runtime.Version(),
+		"os":             runtime.GOOS,
+		"arch":           runtime.GOARCH,
+		"num_cpu":        runtime.NumCPU(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"goroutines":     runtime.NumGoroutine(),
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	}
+}
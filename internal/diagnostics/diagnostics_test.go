@@ -0,0 +1,125 @@
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRequireToken(t *testing.T) {
+	srv := httptest.NewServer(RequireToken("debug-token", NewHandler("metrics-test")))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{name: "without_token", wantStatus: http.StatusUnauthorized},
+		{name: "other_token", header: "Bearer other-token", wantStatus: http.StatusUnauthorized},
+		{name: "basic_scheme", header: "Basic debug-token", wantStatus: http.StatusUnauthorized},
+		{name: "token", header: "Bearer debug-token", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R()
+			if tt.header != "" {
+				req.SetHeader("Authorization", tt.header)
+			}
+			resp, err := req.Get(srv.URL + "/debug/vars")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+		})
+	}
+}
+
+func TestHandler_Vars(t *testing.T) {
+	srv := httptest.NewServer(NewHandler("metrics-test"))
+	defer srv.Close()
+
+	var vars struct {
+		Runtime  map[string]any `json:"runtime"`
+		MemStats map[string]any `json:"memstats"`
+	}
+	resp, err := resty.New().R().Get(srv.URL + "/debug/vars")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.NoError(t, json.Unmarshal(resp.Body(), &vars))
+	assert.Equal(t, "metrics-test", vars.Runtime["service"])
+	assert.NotZero(t, vars.Runtime["goroutines"])
+	assert.NotEmpty(t, vars.MemStats)
+
+	// The index of the profiles is under /debug/pprof/.
+	resp, err = resty.New().R().Get(srv.URL + "/debug/pprof")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "goroutine")
+}
+
+func TestHandler_Profile(t *testing.T) {
+	srv := httptest.NewServer(NewHandler("metrics-test"))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantFile   string
+	}{
+		{name: "cpu", query: "?kind=cpu&seconds=1", wantStatus: http.StatusOK, wantFile: "metrics-test-cpu-"},
+		{name: "heap", query: "?kind=heap&seconds=1", wantStatus: http.StatusOK, wantFile: "metrics-test-heap-"},
+		{name: "unknown_kind", query: "?kind=trace", wantStatus: http.StatusBadRequest},
+		{name: "zero_seconds", query: "?seconds=0", wantStatus: http.StatusBadRequest},
+		{name: "too_long", query: "?kind=heap&seconds=301", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			resp, err := resty.New().R().Get(srv.URL + "/debug/profile" + tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+			if tt.wantFile == "" {
+				assert.Empty(t, resp.Header().Get("Content-Disposition"))
+				return
+			}
+			// The profile covers the duration and is sent as a file.
+			assert.GreaterOrEqual(t, time.Since(start), time.Second)
+			assert.Contains(t, resp.Header().Get("Content-Disposition"), `filename="`+tt.wantFile)
+			assert.NotEmpty(t, resp.Body())
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, addr, NewHandler("metrics-test"), zap.NewNop().Sugar()) }()
+
+	require.Eventually(t, func() bool {
+		resp, err := resty.New().R().Get("http://" + addr + "/debug/vars")
+		return err == nil && resp.StatusCode() == http.StatusOK
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// The server stops with the context.
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("diagnostics server did not stop")
+	}
+}
@@ -15,6 +15,36 @@ import (
 // ErrEmptyCryptoKey is returned when a crypto key path is empty.
 var ErrEmptyCryptoKey = errors.New("crypto key is empty")
 
+// DefaultKeyBits is the size of the generated RSA keys.
+const DefaultKeyBits = 4096
+
+// GenerateKeyPair generates an RSA key pair in the formats read by NewDecryptor and NewEncryptor:
+// the PEM PKCS#8 private key and the PEM PKIX public key.
+func GenerateKeyPair(bits int) (privatePEM, publicPEM []byte, err error) {
+	if bits < 2048 {
+		return nil, nil, fmt.Errorf("RSA key size must be at least 2048 bits (got %d)", bits)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate RSA key: %w", err)
+	}
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal private key: %w", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), nil
+}
+
+// MaxMessageSize returns the largest message RSA-OAEP with SHA-256 encrypts with a key of the size in bits.
+func MaxMessageSize(bits int) int {
+	return bits/8 - 2*sha256.Size - 2
+}
+
 // Encryptor is a struct that contains the public key for encryption.
 type Encryptor struct {
 	publicKey *rsa.PublicKey
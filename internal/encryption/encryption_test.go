@@ -240,3 +240,28 @@ func TestDecryptor(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateKeyPair(t *testing.T) {
+	_, _, err := encryption.GenerateKeyPair(1024)
+	assert.Error(t, err)
+
+	priv, pub, err := encryption.GenerateKeyPair(2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), priv, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pub.pem"), pub, 0644))
+	encryptor, err := encryption.NewEncryptor(filepath.Join(dir, "pub.pem"))
+	require.NoError(t, err)
+	decryptor, err := encryption.NewDecryptor(filepath.Join(dir, "key.pem"))
+	require.NoError(t, err)
+
+	// The largest message fits, a larger one does not.
+	msg := make([]byte, encryption.MaxMessageSize(2048))
+	encrypted, err := encryptor.Encrypt(msg)
+	require.NoError(t, err)
+	got, err := decryptor.Decrypt(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+	_, err = encryptor.Encrypt(append(msg, 0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AuditStatsHandler returns the delivery counters of the audit pipeline as JSON.
+func (h *Handler) AuditStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := json.Marshal(h.auditor.Stats())
+		if err != nil {
+			h.log(r).Debug("Cannot encode response JSON:", err)
+			http.Error(w, "Cannot encode response JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(resp); err != nil {
+			h.log(r).Debug("Failed to write response body:", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	auditcfg "github.com/devize-ed/yapracproj-metrics.git/internal/audit/config"
+	mw "github.com/devize-ed/yapracproj-metrics.git/internal/handler/middleware"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuditStatsHandler(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	// The auditor is not running, so the second record overflows the queue.
+	auditor := audit.NewAuditorWithConfig(logger, auditcfg.AuditConfig{BufferSize: 1, OverflowPolicy: auditcfg.PolicyDropNewest})
+	auditor.Send("", []string{"m1"})
+	auditor.Send("", []string{"m2"})
+
+	h := NewHandler(mstorage.NewMemStorage(), "", auditor, logger)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	resp, err := resty.New().R().Get(srv.URL + "/audit/stats")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+
+	var stats audit.Stats
+	require.NoError(t, json.Unmarshal(resp.Body(), &stats))
+	assert.Equal(t, int64(1), stats.Dropped)
+	assert.Zero(t, stats.Spooled)
+}
+
+func TestAuditRecords(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := "test_key"
+
+	auditor := audit.NewAuditor(log, "", "")
+	go auditor.Run(ctx)
+	records, unsubscribe, err := auditor.Subscribe(ctx, 8)
+	require.NoError(t, err)
+	defer unsubscribe()
+
+	ms := mstorage.NewMemStorage()
+	ms.Counter["PollCount"] = 5
+	h := NewHandler(ms, key, auditor, log)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	next := func(t *testing.T) audit.AuditMsg {
+		t.Helper()
+		select {
+		case msg := <-records:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no audit record received")
+			return audit.AuditMsg{}
+		}
+	}
+	int64Ptr := func(v int64) *int64 { return &v }
+	float64Ptr := func(v float64) *float64 { return &v }
+
+	t.Run("text_update", func(t *testing.T) {
+		resp, err := resty.New().R().
+			SetHeader("User-Agent", "test-agent").
+			SetHeader(logger.RequestIDHeader, "req-1").
+			Post(srv.URL + "/update/counter/PollCount/3")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+
+		msg := next(t)
+		assert.Equal(t, []string{"PollCount"}, msg.Metrics)
+		assert.Equal(t, []audit.MetricChange{
+			{ID: "PollCount", MType: models.Counter, OldDelta: int64Ptr(5), NewDelta: int64Ptr(8)},
+		}, msg.Changes)
+		assert.Equal(t, "POST /update/{metricType}/{metricName}/{metricValue}", msg.Endpoint)
+		assert.Equal(t, "test-agent", msg.UserAgent)
+		assert.Equal(t, mw.HMACUnsigned, msg.HMAC)
+		assert.Equal(t, "req-1", msg.RequestID)
+		assert.Equal(t, "req-1", resp.Header().Get(logger.RequestIDHeader))
+		assert.False(t, msg.Encrypted)
+	})
+
+	t.Run("signed_batch", func(t *testing.T) {
+		body := `[
+			{"id":"Alloc","type":"gauge","value":1.5},
+			{"id":"Alloc","type":"gauge","value":2.5},
+			{"id":"PollCount","type":"counter","delta":2}
+		]`
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		resp, err := resty.New().R().
+			SetHeader("Content-Type", "application/json").
+			SetHeader(sign.HashHeader, sign.Hash(sign.CanonicalRequest(http.MethodPost, "/updates", timestamp, "n1", []byte(body)), key)).
+			SetHeader(sign.TimestampHeader, timestamp).
+			SetHeader(sign.NonceHeader, "n1").
+			SetBody(body).
+			Post(srv.URL + "/updates")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+
+		// A metric updated several times in a batch is recorded once.
+		msg := next(t)
+		assert.Equal(t, []string{"Alloc", "PollCount"}, msg.Metrics)
+		assert.Equal(t, []audit.MetricChange{
+			{ID: "Alloc", MType: models.Gauge, NewValue: float64Ptr(2.5)},
+			{ID: "PollCount", MType: models.Counter, OldDelta: int64Ptr(8), NewDelta: int64Ptr(10)},
+		}, msg.Changes)
+		assert.Equal(t, "POST /updates", msg.Endpoint)
+		assert.Equal(t, mw.HMACVerified, msg.HMAC)
+		// The request without an ID gets one, echoed in the response.
+		assert.Len(t, msg.RequestID, 32)
+		assert.Equal(t, msg.RequestID, resp.Header().Get(logger.RequestIDHeader))
+	})
+
+	t.Run("failed_update_is_not_audited", func(t *testing.T) {
+		resp, err := resty.New().R().Post(srv.URL + "/update/counter/PollCount/x")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+		select {
+		case msg := <-records:
+			t.Fatalf("unexpected audit record: %+v", msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	mw "github.com/devize-ed/yapracproj-metrics.git/internal/handler/middleware"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/go-chi/chi"
+)
+
+// metricKey identifies a metric in the storage.
+type metricKey struct {
+	id    string
+	mType string
+}
+
+// changeRecorder wraps the storage and records the values of the updated metrics before and after the updates.
+// The updates go through UpdateBatch, which reports the values, so the metrics are not read again.
+// It is created per request, the changes are recorded in the order the metrics were first updated.
+type changeRecorder struct {
+	repository.Repository
+	index   map[metricKey]int
+	changes []audit.MetricChange
+}
+
+// newChangeRecorder creates a recorder of the updates of the storage.
+func newChangeRecorder(storage repository.Repository) *changeRecorder {
+	return &changeRecorder{
+		Repository: storage,
+		index:      make(map[metricKey]int),
+	}
+}
+
+// SetGauge sets the gauge and records its change.
+func (c *changeRecorder) SetGauge(ctx context.Context, name string, value *float64) error {
+	return c.SaveBatch(ctx, []models.Metrics{{ID: name, MType: models.Gauge, Value: value}})
+}
+
+// AddCounter increments the counter and records its change.
+func (c *changeRecorder) AddCounter(ctx context.Context, name string, delta *int64) error {
+	return c.SaveBatch(ctx, []models.Metrics{{ID: name, MType: models.Counter, Delta: delta}})
+}
+
+// SaveBatch saves the batch and records the changes of its metrics.
+func (c *changeRecorder) SaveBatch(ctx context.Context, batch []models.Metrics) error {
+	changes, err := c.Repository.UpdateBatch(ctx, batch)
+	if err != nil {
+		return err
+	}
+	c.record(changes)
+	return nil
+}
+
+// Changes returns the recorded changes.
+func (c *changeRecorder) Changes() []audit.MetricChange {
+	return c.changes
+}
+
+// record merges the changes into the recorded ones: a metric updated again keeps its first old value and gets the last new one.
+func (c *changeRecorder) record(changes []audit.MetricChange) {
+	for _, change := range changes {
+		k := metricKey{change.ID, change.MType}
+		i, ok := c.index[k]
+		if !ok {
+			c.index[k] = len(c.changes)
+			c.changes = append(c.changes, change)
+			continue
+		}
+		c.changes[i].NewDelta, c.changes[i].NewValue = change.NewDelta, change.NewValue
+	}
+}
+
+// sendAudit sends the audit record of the request with the recorded changes.
+func (h *Handler) sendAudit(r *http.Request, changes []audit.MetricChange) {
+	if len(changes) == 0 {
+		return
+	}
+	endpoint := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		endpoint = rctx.RoutePattern()
+	}
+	h.auditor.Record(audit.AuditMsg{
+		Addr:      r.RemoteAddr,
+		Changes:   changes,
+		Endpoint:  r.Method + " " + endpoint,
+		UserAgent: r.UserAgent(),
+		HMAC:      mw.HMACResult(r.Context()),
+		Encrypted: mw.Decrypted(r.Context()),
+		RequestID: logger.RequestID(r.Context()),
+		TokenID:   mw.TokenID(r.Context()),
+		AgentID:   mw.AgentID(r.Context()),
+	})
+}
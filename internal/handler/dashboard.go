@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"embed"
+	"html/template"
+	"mime"
+	"strconv"
+	"strings"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+)
+
+// dashboardRefreshSeconds is the auto-refresh interval of the dashboard.
+const dashboardRefreshSeconds = 5
+
+// Media types served by the root listing.
+const (
+	mediaHTML  = "text/html"
+	mediaJSON  = "application/json"
+	mediaPlain = "text/plain"
+)
+
+//go:embed templates/dashboard.html
+var templatesFS embed.FS
+
+// dashboardTemplate renders the HTML dashboard.
+var dashboardTemplate = template.Must(template.ParseFS(templatesFS, "templates/dashboard.html"))
+
+// dashboardMetric is a metric row of the dashboard.
+type dashboardMetric struct {
+	ID    string
+	Value string
+}
+
+// dashboardGroup is a table of the metrics of one type.
+type dashboardGroup struct {
+	Type    string
+	Title   string
+	Metrics []dashboardMetric
+}
+
+// dashboardData is the data of the dashboard template.
+type dashboardData struct {
+	Groups         []dashboardGroup
+	RefreshSeconds int
+	AuthRequired   bool // the page asks for an API token and sends it with the refreshes
+}
+
+// newDashboardData groups the sorted metrics by type.
+func newDashboardData(metrics []models.Metrics) dashboardData {
+	gauges := dashboardGroup{Type: models.Gauge, Title: "Gauges"}
+	counters := dashboardGroup{Type: models.Counter, Title: "Counters"}
+	for _, m := range metrics {
+		switch {
+		case m.MType == models.Gauge && m.Value != nil:
+			gauges.Metrics = append(gauges.Metrics, dashboardMetric{ID: m.ID, Value: strconv.FormatFloat(*m.Value, 'f', -1, 64)})
+		case m.MType == models.Counter && m.Delta != nil:
+			counters.Metrics = append(counters.Metrics, dashboardMetric{ID: m.ID, Value: strconv.FormatInt(*m.Delta, 10)})
+		}
+	}
+	return dashboardData{
+		Groups:         []dashboardGroup{gauges, counters},
+		RefreshSeconds: dashboardRefreshSeconds,
+	}
+}
+
+// negotiate returns the offer preferred by the Accept header, the first offer is the default.
+// Media ranges are weighted by their q parameter, more specific ranges take precedence over wildcards.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			s := -1
+			switch {
+			case mediaType == offer:
+				s = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				s = 1
+			case mediaType == "*/*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, 1.0
+			if v, ok := params["q"]; ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
@@ -3,14 +3,25 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 
 	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	mw "github.com/devize-ed/yapracproj-metrics.git/internal/handler/middleware"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/ingest"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/limit"
+	limitcfg "github.com/devize-ed/yapracproj-metrics.git/internal/limit/config"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/query"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
 	"github.com/go-chi/chi"
 	"go.uber.org/zap"
 )
@@ -18,21 +29,144 @@ import (
 // Handler wraps the storage.
 type Handler struct {
 	storage repository.Repository // storage for metrics
-	hashKey string                // key for hashing requests
+	keys    *sign.KeyRing         // keys for hashing requests, nil when hashing is disabled
+	replay  *sign.ReplayGuard     // guard rejecting replayed signed requests
+	agents  *sign.AgentKeys       // public keys of the agents signing their requests, nil when disabled
+	signReq bool                  // whether the POST requests must be signed with replay protection
+	signs   *mw.SignStats         // POST requests accepted without replay protection
+	limits  requestLimits         // limits protecting the server from misbehaving clients
 	auditor *audit.Auditor        // audito servic for logging changes of metrics
+	otlp    *ingest.OTLPReceiver  // receiver keeping the state of OTLP cumulative sums
+	query   *query.Engine         // engine for the aggregation queries
+	auth    *auth.Authenticator   // API token authenticator, nil when auth is disabled
+	self    *selfmetrics.Registry // self-metrics of the server
+	debug   http.Handler          // diagnostics endpoints, nil when they are disabled
+	access  *mw.AccessLogSampler  // sampler of the access log entries per route
 	logger  *zap.SugaredLogger
+	plain   *zap.Logger // non-sugared logger of the hot paths
 }
 
 // NewHandler constructs a new Handler with the provided storage.
 func NewHandler(r repository.Repository, key string, auditor *audit.Auditor, logger *zap.SugaredLogger) *Handler {
+	signs := new(mw.SignStats)
 	return &Handler{
 		storage: r,
-		hashKey: key,
+		keys:    sign.NewSingleKeyRing(key),
+		replay:  sign.NewReplayGuard(0, 0),
 		auditor: auditor, //
+		otlp:    ingest.NewOTLPReceiver(),
+		query:   query.NewEngine(r, 0, logger),
+		limits:  newRequestLimits(limitcfg.LimitConfig{}),
+		signs:   signs,
+		self:    selfmetrics.NewRegistry(signs),
+		access:  mw.NewAccessLogSampler(1),
 		logger:  logger,
+		plain:   logger.Desugar(),
 	}
 }
 
+// WithAuthenticator makes the router require API tokens checked by the authenticator.
+func (h *Handler) WithAuthenticator(a *auth.Authenticator) *Handler {
+	h.auth = a
+	return h
+}
+
+// WithKeyRing makes the router verify the request hashes with the keys of the ring instead of the single key.
+func (h *Handler) WithKeyRing(keys *sign.KeyRing) *Handler {
+	h.keys = keys
+	return h
+}
+
+// WithReplayGuard replaces the replay guard of the signed requests, to change its window and nonce cache size.
+func (h *Handler) WithReplayGuard(g *sign.ReplayGuard) *Handler {
+	h.replay = g
+	return h
+}
+
+// WithAgentKeys makes the router accept the requests signed with the private keys of the registered agents.
+func (h *Handler) WithAgentKeys(agents *sign.AgentKeys) *Handler {
+	h.agents = agents
+	return h
+}
+
+// WithSignRequired makes the router reject the POST requests that are not signed with replay protection.
+func (h *Handler) WithSignRequired(required bool) *Handler {
+	h.signReq = required
+	return h
+}
+
+// WithLimits sets the request size limits, the rate limits and the concurrency limit of the router.
+func (h *Handler) WithLimits(c limitcfg.LimitConfig) *Handler {
+	h.limits = newRequestLimits(c)
+	return h
+}
+
+// WithSelfMetrics makes the router count its requests in the registry, which also collects the metrics of the other components.
+// The counters of the requests accepted without replay protection are registered in it.
+func (h *Handler) WithSelfMetrics(reg *selfmetrics.Registry) *Handler {
+	reg.Register(h.signs)
+	h.self = reg
+	return h
+}
+
+// WithDiagnostics serves the diagnostics endpoints of the handler, /debug/pprof, /debug/vars and /debug/profile, to the admin API tokens.
+func (h *Handler) WithDiagnostics(d http.Handler) *Handler {
+	h.debug = d
+	return h
+}
+
+// WithAccessLogSampling makes the router log one of every n successful requests of a route, and every failed one.
+func (h *Handler) WithAccessLogSampling(n int) *Handler {
+	h.access = mw.NewAccessLogSampler(n)
+	return h
+}
+
+// requestLimits are the limits of the router built from the config.
+type requestLimits struct {
+	maxBody         int64              // bytes of the request body as received
+	maxDecompressed int64              // bytes of the request body after the decompression
+	perIP           *limit.RateLimiter // rate limit of the client IP addresses, nil without limit
+	perToken        *limit.RateLimiter // rate limit of the API tokens, nil without limit
+	storage         limit.Semaphore    // concurrency limit of the storage-bound handlers, nil without limit
+}
+
+// newRequestLimits builds the limits of the config, with the default sizes for the zero ones.
+func newRequestLimits(c limitcfg.LimitConfig) requestLimits {
+	l := requestLimits{
+		maxBody:         int64(c.MaxBodySize),
+		maxDecompressed: int64(c.MaxDecompressedSize),
+		perIP:           limit.NewRateLimiter(c.IPRate, c.IPBurst),
+		perToken:        limit.NewRateLimiter(c.TokenRate, c.TokenBurst),
+		storage:         limit.NewSemaphore(c.Concurrency),
+	}
+	if l.maxBody <= 0 {
+		l.maxBody = limit.DefaultMaxBodySize
+	}
+	if l.maxDecompressed <= 0 {
+		l.maxDecompressed = limit.DefaultMaxDecompressedSize
+	}
+	return l
+}
+
+// bodyTooLarge answers 413 if reading the request body failed because of a size limit.
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	if !mw.BodyTooLarge(err) {
+		return false
+	}
+	http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// reservedName answers 400 if the metric is named under the namespace of the self-metrics.
+func reservedName(w http.ResponseWriter, id string) bool {
+	err := selfmetrics.CheckName(id)
+	if err == nil {
+		return false
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+	return true
+}
+
 // UpdateMetricHandler handles the update of a metric based on URL parameters.
 func (h *Handler) UpdateMetricHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -40,46 +174,57 @@ func (h *Handler) UpdateMetricHandler() http.HandlerFunc {
 		metricName := chi.URLParam(r, "metricName")
 		metricValue := chi.URLParam(r, "metricValue")
 		metricType := chi.URLParam(r, "metricType")
+		if reservedName(w, metricName) {
+			return
+		}
+		// Record the changes for the auditor.
+		storage := newChangeRecorder(h.storage)
 
 		// Handle different metric types, if unknown -> response as http.StatusBadRequest.
 		switch chi.URLParam(r, "metricType") {
 		case models.Counter:
-			h.logger.Debug("Counter:", metricName, metricValue)
 			// Convert string value from url and save in the storage.
 			val, err := strconv.ParseInt(metricValue, 10, 64)
 			if err != nil {
 				http.Error(w, "Incorrect counter value", http.StatusBadRequest)
 				return
 			}
-			if err := h.storage.AddCounter(r.Context(), metricName, &val); err != nil {
-				h.logger.Error("Failed to add counter:", err)
+			if err := storage.AddCounter(r.Context(), metricName, &val); err != nil {
+				h.plainLog(r).Error("Failed to add counter", zap.String("name", metricName), zap.Error(err))
 				http.Error(w, "Failed to add counter", http.StatusInternalServerError)
 				return
 			}
-			h.logger.Debugf("Counter %s increased by %d\n", metricName, val)
+			if h.debugEnabled() {
+				h.plainLog(r).Debug("Counter increased", zap.String("name", metricName), zap.Int64("delta", val))
+			}
 
 		case models.Gauge:
-			h.logger.Debug("Gauge", metricName, metricValue)
 			// Convert string value from url and save in the storage.
 			val, err := strconv.ParseFloat(metricValue, 64)
 			if err != nil {
 				http.Error(w, "Incorrect gauge value", http.StatusBadRequest)
 				return
 			}
-			if err := h.storage.SetGauge(r.Context(), metricName, &val); err != nil {
-				h.logger.Error("Failed to set gauge:", err)
+			if err := storage.SetGauge(r.Context(), metricName, &val); err != nil {
+				h.plainLog(r).Error("Failed to set gauge", zap.String("name", metricName), zap.Error(err))
 				http.Error(w, "Failed to set gauge", http.StatusInternalServerError)
 				return
 			}
-			h.logger.Debugf("Gauge %s updated to %f\n", metricName, val)
+			if h.debugEnabled() {
+				h.plainLog(r).Debug("Gauge updated", zap.String("name", metricName), zap.Float64("value", val))
+			}
 
 		default:
 			// If metric type is unknown, return http.StatusBadRequest.
-			h.logger.Debug("Request invalid metric type: ", metricType)
+			if h.debugEnabled() {
+				h.plainLog(r).Debug("Request invalid metric type", zap.String("type", metricType))
+			}
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
 			return
 		}
 
+		// Send the changes to the auditor.
+		h.sendAudit(r, storage.Changes())
 		// Write response.
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	}
@@ -104,7 +249,7 @@ func (h *Handler) GetMetricHandler() http.HandlerFunc {
 			if err == nil {
 				val = []byte(strconv.FormatInt(*got, 10))
 			} else {
-				h.logger.Error("Requested metric not found: ", r.URL.Path)
+				h.log(r).Error("Requested metric not found: ", r.URL.Path)
 				http.Error(w, "metric not found", http.StatusNotFound)
 				return
 			}
@@ -114,14 +259,14 @@ func (h *Handler) GetMetricHandler() http.HandlerFunc {
 			if err == nil {
 				val = []byte(strconv.FormatFloat(*got, 'f', -1, 64))
 			} else {
-				h.logger.Error("Requested metric not found: ", r.URL.Path)
+				h.log(r).Error("Requested metric not found: ", r.URL.Path)
 				http.Error(w, "metric not found", http.StatusNotFound)
 				return
 			}
 
 		default:
 			// If metric type is unknown, return http.StatusBadRequest.
-			h.logger.Error("Request invalid metric type: ", metricType)
+			h.log(r).Error("Request invalid metric type: ", metricType)
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
 			return
 		}
@@ -129,34 +274,120 @@ func (h *Handler) GetMetricHandler() http.HandlerFunc {
 		// Write response
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if _, err := w.Write(val); err != nil {
-			h.logger.Debug("Failed to write response:", err)
+			h.log(r).Debug("Failed to write response:", err)
 		}
 	}
 }
 
 // ListMetricsHandler handles the listing of all metrics in the storage.
+// It serves the HTML dashboard by default, the JSON list of metrics for "Accept: application/json"
+// and the "name = value" lines for "Accept: text/plain".
 func (h *Handler) ListMetricsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get the map with all the metrics from the storage.
-		metrics, err := h.storage.GetAll(r.Context())
-		if err != nil {
-			h.logger.Error("Failed to get all metrics:", err)
-			http.Error(w, "Failed to get all metrics", http.StatusInternalServerError)
+		switch negotiate(r.Header.Get("Accept"), mediaHTML, mediaJSON, mediaPlain) {
+		case mediaPlain:
+			h.listMetricsText(w, r)
+			return
+		case mediaJSON:
+			h.listMetricsJSON(w, r)
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		// Sort the keys to ensure consistent order.
-		keys := make([]string, 0, len(metrics))
-		for k := range metrics {
-			keys = append(keys, k)
+		// Get the typed metrics from the storage and render the dashboard.
+		metrics, err := h.storage.ListMetrics(r.Context())
+		if err != nil {
+			h.log(r).Error("Failed to list metrics:", err)
+			http.Error(w, "Failed to list metrics", http.StatusInternalServerError)
+			return
 		}
-		sort.Strings(keys)
-		// Write the metrics to the response.
-		for _, k := range keys {
-			if _, err := fmt.Fprintf(w, "%s = %s\n", k, metrics[k]); err != nil {
-				h.logger.Debug("Failed to write metric:", err)
-			}
+		h.writeDashboard(w, r, newDashboardData(metrics))
+	}
+}
+
+// DashboardHandler serves the dashboard without the metrics, the page loads them from the JSON listing.
+// It does not read the storage and is served without a token, the page sends the API token entered by the user.
+func (h *Handler) DashboardHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := newDashboardData(nil)
+		data.AuthRequired = h.auth != nil
+		h.writeDashboard(w, r, data)
+	}
+}
+
+// writeDashboard renders the dashboard page.
+func (h *Handler) writeDashboard(w http.ResponseWriter, r *http.Request, data dashboardData) {
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, data); err != nil {
+		h.log(r).Error("Failed to render dashboard:", err)
+		http.Error(w, "Failed to render dashboard", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		h.log(r).Debug("Failed to write dashboard:", err)
+	}
+}
+
+// listMetricsJSON writes the typed metrics as a JSON array.
+func (h *Handler) listMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.storage.ListMetrics(r.Context())
+	if err != nil {
+		h.log(r).Error("Failed to list metrics:", err)
+		http.Error(w, "Failed to list metrics", http.StatusInternalServerError)
+		return
+	}
+	if metrics == nil {
+		metrics = []models.Metrics{}
+	}
+	resp, err := json.Marshal(metrics)
+	if err != nil {
+		h.log(r).Debug("Cannot encode response JSON:", err)
+		http.Error(w, "Cannot encode response JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		h.log(r).Debug("Failed to write response body:", err)
+	}
+}
+
+// listMetricsText writes the metrics as "name = value" lines sorted by name.
+func (h *Handler) listMetricsText(w http.ResponseWriter, r *http.Request) {
+	// Get the map with all the metrics from the storage.
+	metrics, err := h.storage.GetAll(r.Context())
+	if err != nil {
+		h.log(r).Error("Failed to get all metrics:", err)
+		http.Error(w, "Failed to get all metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// Sort the keys to ensure consistent order.
+	keys := make([]string, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// Write the metrics to the response.
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s = %s\n", k, metrics[k]); err != nil {
+			h.log(r).Debug("Failed to write metric:", err)
 		}
 	}
 }
+
+// log returns the logger of the request, which adds the request ID to every entry.
+func (h *Handler) log(r *http.Request) *zap.SugaredLogger {
+	return logger.FromContext(r.Context(), h.logger)
+}
+
+// plainLog returns the non-sugared logger of the request, for the typed entries of the update handlers.
+func (h *Handler) plainLog(r *http.Request) *zap.Logger {
+	return logger.PlainFromContext(r.Context(), h.plain)
+}
+
+// debugEnabled reports whether the debug entries are logged. The update handlers check it first,
+// so that they build neither their entries nor the logger of the request when they are not.
+func (h *Handler) debugEnabled() bool {
+	return h.plain.Core().Enabled(zap.DebugLevel)
+}
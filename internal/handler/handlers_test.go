@@ -106,18 +106,88 @@ func TestListAllHandler(t *testing.T) {
 	defer srv.Close()
 
 	var tests = []struct {
-		url          string
-		expectedCode int
-		expectedBody string
+		name                string
+		accept              string
+		expectedCode        int
+		expectedContentType string
+		expectedBody        []string
 	}{
-		{"/", http.StatusOK, "testCounter = 5\ntestGauge1 = 10.5\ntestGauge2 = 1.5"},
+		{
+			name:                "plain_text",
+			accept:              "text/plain",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "text/plain; charset=utf-8",
+			expectedBody:        []string{"testCounter = 5\ntestGauge1 = 10.5\ntestGauge2 = 1.5"},
+		},
+		{
+			name:                "json",
+			accept:              "application/json",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/json",
+			expectedBody: []string{
+				`[{"id":"testCounter","type":"counter","delta":5},` +
+					`{"id":"testGauge1","type":"gauge","value":10.5},` +
+					`{"id":"testGauge2","type":"gauge","value":1.5}]`,
+			},
+		},
+		{
+			name:                "dashboard_for_browsers",
+			accept:              "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody: []string{
+				"<title>Metrics</title>",
+				`<tr data-id="testGauge1"><td>testGauge1</td><td class="value">10.5</td>`,
+				`<tr data-id="testCounter"><td>testCounter</td><td class="value">5</td>`,
+			},
+		},
+		{
+			name:                "dashboard_by_default",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        []string{"<title>Metrics</title>"},
+		},
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.url, func(t *testing.T) {
-			resp := testRequest(t, srv, http.MethodGet, tt.url)
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R()
+			if tt.accept != "" {
+				req.SetHeader("Accept", tt.accept)
+			}
+			resp, err := req.Get(srv.URL + "/")
+			assert.NoError(t, err, "error making HTTP request")
 			assert.Equal(t, tt.expectedCode, resp.StatusCode(), "Response code didn't match expected")
-			assert.Equal(t, tt.expectedBody, resp.String(), "Response body didn't match expected")
+			assert.Equal(t, tt.expectedContentType, resp.Header().Get("Content-Type"))
+			if tt.expectedContentType == "text/html; charset=utf-8" {
+				for _, want := range tt.expectedBody {
+					assert.Contains(t, resp.String(), want)
+				}
+				return
+			}
+			assert.Equal(t, tt.expectedBody[0], resp.String(), "Response body didn't match expected")
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{mediaHTML, mediaJSON, mediaPlain}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", mediaHTML},
+		{"*/*", mediaHTML},
+		{"text/plain", mediaPlain},
+		{"text/*", mediaHTML},
+		{"text/*;q=0.5, text/plain", mediaPlain},
+		{"application/json, text/plain;q=0.5", mediaJSON},
+		{"text/html;q=0.1, */*;q=0.8", mediaJSON},
+		{"image/png", mediaHTML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, negotiate(tt.accept, offers...))
 		})
 	}
 }
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/ingest"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"github.com/golang/snappy"
+	"go.uber.org/zap"
+)
+
+// RemoteWriteHandler handles Prometheus remote-write requests (snappy-compressed protobuf WriteRequest).
+func (h *Handler) RemoteWriteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Read the compressed request body.
+		body, err := io.ReadAll(r.Body)
+		if bodyTooLarge(w, err) {
+			return
+		}
+		if err != nil {
+			h.log(r).Debug("Cannot read remote-write body", zap.Error(err))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		// Check the decompressed size before the decoding, as the gzip middleware does for the other bodies.
+		if n, err := snappy.DecodedLen(body); err == nil && int64(n) > h.limits.maxDecompressed {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Decode the samples, a malformed payload is not retried by Prometheus on 4xx.
+		metrics, err := ingest.DecodeRemoteWrite(body)
+		if err != nil {
+			h.log(r).Debug("Cannot decode remote-write body", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, m := range metrics {
+			if reservedName(w, m.ID) {
+				return
+			}
+		}
+
+		if len(metrics) > 0 {
+			storage := newChangeRecorder(h.storage)
+			if err := storage.SaveBatch(r.Context(), metrics); err != nil {
+				h.log(r).Error("failed to save remote-write batch", zap.Error(err))
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			// Send the changes to the auditor
+			h.sendAudit(r, storage.Changes())
+		}
+		h.log(r).Debugf("Saved %d remote-write series", len(metrics))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// OTLPMetricsHandler handles OTLP/HTTP metric exports in the protobuf and JSON encodings.
+func (h *Handler) OTLPMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if bodyTooLarge(w, err) {
+			return
+		}
+		if err != nil {
+			h.log(r).Debug("Cannot read OTLP body", zap.Error(err))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		// Decode the request according to its content type.
+		contentType := r.Header.Get("Content-Type")
+		var otlpMetrics []ingest.OTLPMetric
+		switch {
+		case strings.HasPrefix(contentType, "application/x-protobuf"):
+			otlpMetrics, err = ingest.DecodeOTLPProto(body)
+		case strings.HasPrefix(contentType, "application/json"):
+			otlpMetrics, err = ingest.DecodeOTLPJSON(body)
+		default:
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			h.log(r).Debug("Cannot decode OTLP body", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		storage := newChangeRecorder(h.storage)
+		metrics, rejected, err := h.otlp.Store(r.Context(), storage, otlpMetrics)
+		if err != nil {
+			h.log(r).Error("failed to save OTLP metrics", zap.Error(err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		// Send the changes to the auditor
+		h.sendAudit(r, storage.Changes())
+		h.log(r).Debugf("Saved %d OTLP series", len(metrics))
+
+		// Respond with an ExportMetricsServiceResponse in the request encoding, reporting the rejected points.
+		var message string
+		if rejected > 0 {
+			message = fmt.Sprintf("%d data points of monotonic sums without an aggregation temporality or of metrics named under the reserved %s namespace were rejected",
+				rejected, selfmetrics.Namespace)
+			h.log(r).Warnw("Rejected OTLP data points", "rejected", rejected, "user_agent", r.UserAgent())
+		}
+		if strings.HasPrefix(contentType, "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(ingest.EncodeOTLPResponseJSON(rejected, message))
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(ingest.EncodeOTLPResponseProto(rejected, message))
+	}
+}
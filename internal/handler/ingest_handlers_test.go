@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/go-resty/resty/v2"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteBody encodes a compressed WriteRequest with a sample of value 1 for every series name.
+func remoteWriteBody(names ...string) []byte {
+	var req []byte
+	for _, name := range names {
+		var label, sample, series []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, "__name__")
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(1))
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return snappy.Encode(nil, req)
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	// The payload is a recorded Prometheus WriteRequest with several series,
+	// repeated samples, a staleness marker and metadata.
+	recorded, err := os.ReadFile(filepath.Join("testdata", "remote_write.snappy"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantStatus int
+		wantGauges map[string]float64
+	}{
+		{
+			name:       "recorded_payload",
+			body:       recorded,
+			wantStatus: http.StatusNoContent,
+			wantGauges: map[string]float64{
+				`up{instance="localhost:9100",job="node"}`:                        1,
+				`node_memory_MemFree_bytes{instance="localhost:9100",job="node"}`: 4.98e8,
+				`http_requests_total{code="200",method="GET"}`:                    1043,
+				`go_goroutines`: 42,
+			},
+		},
+		{
+			name:       "reserved_name",
+			body:       remoteWriteBody("go_goroutines", "_server.http.requests.get.ping.2xx"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not_snappy",
+			body:       []byte("plain text"),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := mstorage.NewMemStorage()
+			h := NewHandler(ms, "", audit.NewAuditor(logger, "", ""), logger)
+			srv := httptest.NewServer(h.NewRouter())
+			defer srv.Close()
+
+			resp, err := resty.New().R().
+				SetHeader("Content-Type", "application/x-protobuf").
+				SetHeader("Content-Encoding", "snappy").
+				SetHeader("X-Prometheus-Remote-Write-Version", "0.1.0").
+				SetBody(tt.body).
+				Post(srv.URL + "/api/v1/write")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+
+			assert.Len(t, ms.Gauge, len(tt.wantGauges), "staleness markers should be skipped")
+			for name, want := range tt.wantGauges {
+				got, err := ms.GetGauge(context.Background(), name)
+				require.NoError(t, err, name)
+				assert.Equal(t, want, *got, name)
+			}
+		})
+	}
+}
+
+func TestOTLPMetricsHandler(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	key := "test_key"
+
+	// The payload is a recorded ExportMetricsServiceRequest with a gauge, a cumulative sum and a histogram.
+	recorded, err := os.ReadFile(filepath.Join("testdata", "otlp_metrics.pb"))
+	require.NoError(t, err)
+
+	jsonPayload := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+		{"name":"queue.size","gauge":{"dataPoints":[{"timeUnixNano":"1760800015000000000","asInt":"7"}]}},
+		{"name":"jobs.done","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asInt":"3"}]}}
+	]}]}]}`
+
+	tests := []struct {
+		name         string
+		contentType  string
+		body         []byte
+		gzip         bool
+		wantStatus   int
+		wantBody     string
+		wantGauges   map[string]float64
+		wantCounters map[string]int64
+	}{
+		{
+			name:        "protobuf",
+			contentType: "application/x-protobuf",
+			body:        recorded,
+			wantStatus:  http.StatusOK,
+			wantGauges:  map[string]float64{`system.memory.usage{state="free"}`: 4.98e8},
+			wantCounters: map[string]int64{
+				`http.server.requests{http.method="GET"}`: 120,
+			},
+		},
+		{
+			name:         "gzipped_json",
+			contentType:  "application/json",
+			body:         []byte(jsonPayload),
+			gzip:         true,
+			wantStatus:   http.StatusOK,
+			wantBody:     `{}`,
+			wantGauges:   map[string]float64{"queue.size": 7},
+			wantCounters: map[string]int64{"jobs.done": 3},
+		},
+		{
+			name:        "unspecified_temporality",
+			contentType: "application/json",
+			body: []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+				{"name":"queue.size","gauge":{"dataPoints":[{"asInt":"7"}]}},
+				{"name":"jobs.done","sum":{"isMonotonic":true,"dataPoints":[{"asInt":"3"}]}}
+			]}]}]}`),
+			wantStatus: http.StatusOK,
+			wantBody: `{"partialSuccess":{"errorMessage":"1 data points of monotonic sums without an aggregation temporality ` +
+				`or of metrics named under the reserved _server. namespace were rejected","rejectedDataPoints":"1"}}`,
+			wantGauges: map[string]float64{"queue.size": 7},
+		},
+		{
+			name:        "reserved_name",
+			contentType: "application/json",
+			body: []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+				{"name":"queue.size","gauge":{"dataPoints":[{"asInt":"7"}]}},
+				{"name":"_server.audit.dropped","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asInt":"3"}]}}
+			]}]}]}`),
+			wantStatus: http.StatusOK,
+			wantBody: `{"partialSuccess":{"errorMessage":"1 data points of monotonic sums without an aggregation temporality ` +
+				`or of metrics named under the reserved _server. namespace were rejected","rejectedDataPoints":"1"}}`,
+			wantGauges: map[string]float64{"queue.size": 7},
+		},
+		{
+			name:        "invalid_json",
+			contentType: "application/json",
+			body:        []byte(`{"resourceMetrics":`),
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported_content_type",
+			contentType: "text/plain",
+			body:        []byte("metric 1"),
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := mstorage.NewMemStorage()
+			h := NewHandler(ms, key, audit.NewAuditor(logger, "", ""), logger)
+			srv := httptest.NewServer(h.NewRouter())
+			defer srv.Close()
+
+			body := tt.body
+			req := resty.New().R().SetHeader("Content-Type", tt.contentType)
+			if tt.gzip {
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				_, err := zw.Write(body)
+				require.NoError(t, err)
+				require.NoError(t, zw.Close())
+				body = buf.Bytes()
+				req.SetHeader("Content-Encoding", "gzip")
+			}
+			// The request goes through the same hash verification as the JSON API.
+			resp, err := req.
+				SetHeader(sign.HashHeader, sign.Hash(body, key)).
+				SetBody(body).
+				Post(srv.URL + "/v1/metrics")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, resp.String())
+			}
+
+			assert.Len(t, ms.Gauge, len(tt.wantGauges))
+			for name, want := range tt.wantGauges {
+				got, err := ms.GetGauge(context.Background(), name)
+				require.NoError(t, err, name)
+				assert.Equal(t, want, *got, name)
+			}
+			assert.Len(t, ms.Counter, len(tt.wantCounters))
+			for name, want := range tt.wantCounters {
+				got, err := ms.GetCounter(context.Background(), name)
+				require.NoError(t, err, name)
+				assert.Equal(t, want, *got, name)
+			}
+		})
+	}
+}
@@ -14,18 +14,24 @@ func (h *Handler) UpdateMetricJSONHandler() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Decode request body into model struct.
-		h.logger.Debug("Decoding request JSON body")
 		body := &models.Metrics{}
 		dec := json.NewDecoder(r.Body)
 		if err := dec.Decode(body); err != nil {
-			h.logger.Debug("Cannot decode request JSON body", zap.Error(err))
+			if bodyTooLarge(w, err) {
+				return
+			}
+			h.plainLog(r).Debug("Cannot decode request JSON body", zap.Error(err))
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		h.logger.Debugf("req body: ID = %s, MType = %s, Delta = %v, Value = %v", body.ID, body.MType, body.Delta, body.Value)
 		// Get parameters.
 		metricName := body.ID
 		metricType := body.MType
+		if reservedName(w, metricName) {
+			return
+		}
+		// Record the changes for the auditor.
+		storage := newChangeRecorder(h.storage)
 		// Handle different metric types, if unknown -> response as http.StatusBadRequest.
 		switch metricType {
 		case models.Counter:
@@ -37,12 +43,14 @@ func (h *Handler) UpdateMetricJSONHandler() http.HandlerFunc {
 				return
 			}
 
-			if err := h.storage.AddCounter(r.Context(), metricName, &metricValue); err != nil {
-				h.logger.Error("Failed to add counter:", err)
+			if err := storage.AddCounter(r.Context(), metricName, &metricValue); err != nil {
+				h.plainLog(r).Error("Failed to add counter", zap.String("name", metricName), zap.Error(err))
 				http.Error(w, "Failed to add counter", http.StatusInternalServerError)
 				return
 			}
-			h.logger.Debugf("Counter %s increased by %d\n", metricName, metricValue)
+			if h.debugEnabled() {
+				h.plainLog(r).Debug("Counter increased", zap.String("name", metricName), zap.Int64("delta", metricValue))
+			}
 
 		case models.Gauge:
 			var metricValue float64
@@ -52,22 +60,26 @@ func (h *Handler) UpdateMetricJSONHandler() http.HandlerFunc {
 				http.Error(w, "empty gauge value", http.StatusNotFound)
 				return
 			}
-			if err := h.storage.SetGauge(r.Context(), metricName, &metricValue); err != nil {
-				h.logger.Error("Failed to set gauge:", err)
+			if err := storage.SetGauge(r.Context(), metricName, &metricValue); err != nil {
+				h.plainLog(r).Error("Failed to set gauge", zap.String("name", metricName), zap.Error(err))
 				http.Error(w, "Failed to set gauge", http.StatusInternalServerError)
 				return
 			}
-			h.logger.Debugf("Gauge %s updated to %f\n", metricName, metricValue)
+			if h.debugEnabled() {
+				h.plainLog(r).Debug("Gauge updated", zap.String("name", metricName), zap.Float64("value", metricValue))
+			}
 
 		default:
 			// If metric type is unknown, return http.StatusBadRequest.
-			h.logger.Debug("Request invalid metric type: ", metricType)
+			if h.debugEnabled() {
+				h.plainLog(r).Debug("Request invalid metric type", zap.String("type", metricType))
+			}
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
 			return
 		}
 
-		// Send metric to auditor
-		h.auditor.Send(r.RemoteAddr, []string{metricName})
+		// Send the change to the auditor
+		h.sendAudit(r, storage.Changes())
 		// Write response
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -81,15 +93,18 @@ func (h *Handler) GetMetricJSONHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// Decode request body into model struct.
-		h.logger.Debug("Decoding request JSON body")
+		h.log(r).Debug("Decoding request JSON body")
 		body := &models.Metrics{}
 		dec := json.NewDecoder(r.Body)
 		if err := dec.Decode(body); err != nil {
-			h.logger.Debug("Cannot decode request JSON body:", zap.Error(err))
+			if bodyTooLarge(w, err) {
+				return
+			}
+			h.log(r).Debug("Cannot decode request JSON body:", zap.Error(err))
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		h.logger.Debugf("req body: ID = %s, MType = %s, Delta = %v, Value = %v", body.ID, body.MType, body.Delta, body.Value)
+		h.log(r).Debugf("req body: ID = %s, MType = %s, Delta = %v, Value = %v", body.ID, body.MType, body.Delta, body.Value)
 
 		// Get parameters.
 		metricName := body.ID
@@ -103,10 +118,10 @@ func (h *Handler) GetMetricJSONHandler() http.HandlerFunc {
 			if err == nil {
 				body.Delta = got
 			} else {
-				h.logger.Error("Requested metric not found: ", metricName)
+				h.log(r).Error("Requested metric not found: ", metricName)
 				metrics, err := h.storage.GetAll(r.Context())
 				if err == nil {
-					h.logger.Debugln("Available metrics: ", metrics)
+					h.log(r).Debugln("Available metrics: ", metrics)
 				}
 				http.Error(w, "metric not found", http.StatusNotFound)
 				return
@@ -117,10 +132,10 @@ func (h *Handler) GetMetricJSONHandler() http.HandlerFunc {
 			if err == nil {
 				body.Value = got
 			} else {
-				h.logger.Error("Requested metric not found: ", metricName)
+				h.log(r).Error("Requested metric not found: ", metricName)
 				metrics, err := h.storage.GetAll(r.Context())
 				if err == nil {
-					h.logger.Debugln("Available metrics: ", metrics)
+					h.log(r).Debugln("Available metrics: ", metrics)
 				}
 				http.Error(w, "metric not found", http.StatusNotFound)
 				return
@@ -128,7 +143,7 @@ func (h *Handler) GetMetricJSONHandler() http.HandlerFunc {
 
 		default:
 			// If metric type is unknown, return http.StatusBadRequest.
-			h.logger.Error("Request invalid metric type: ", metricType)
+			h.log(r).Error("Request invalid metric type: ", metricType)
 			http.Error(w, "Invalid metric type", http.StatusBadRequest)
 			return
 		}
@@ -136,7 +151,7 @@ func (h *Handler) GetMetricJSONHandler() http.HandlerFunc {
 		// Write response.
 		resp, err := json.Marshal(body)
 		if err != nil {
-			h.logger.Debug("Cannot encode response JSON:", err)
+			h.log(r).Debug("Cannot encode response JSON:", err)
 			http.Error(w, "Cannot encode response JSON", http.StatusInternalServerError)
 			return
 		}
@@ -144,7 +159,7 @@ func (h *Handler) GetMetricJSONHandler() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write(resp); err != nil {
-			h.logger.Debug("Failed to write response body:", err)
+			h.log(r).Debug("Failed to write response body:", err)
 		}
 	}
 }
@@ -156,30 +171,33 @@ func (h *Handler) UpdateBatchHandler() http.HandlerFunc {
 
 		var metrics []models.Metrics
 		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
-			h.logger.Debug("Cannot decode request JSON body", zap.Error(err))
+			if bodyTooLarge(w, err) {
+				return
+			}
+			h.plainLog(r).Debug("Cannot decode request JSON body", zap.Error(err))
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		for _, m := range metrics {
+			if reservedName(w, m.ID) {
+				return
+			}
+		}
 
-		if err := h.storage.SaveBatch(r.Context(), metrics); err != nil {
-			h.logger.Error("failed to save batch", zap.Error(err))
+		storage := newChangeRecorder(h.storage)
+		if err := storage.SaveBatch(r.Context(), metrics); err != nil {
+			h.plainLog(r).Error("failed to save batch", zap.Error(err))
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
 
-		h.logger.Debug("Saved batch of metrics", zap.Any("batch", metrics))
+		if h.debugEnabled() {
+			h.plainLog(r).Debug("Saved batch of metrics", zap.Any("batch", metrics))
+		}
 
-		// Send metrics to auditor
-		h.auditor.Send(r.RemoteAddr, metricsToStrings(metrics))
+		// Send the changes to the auditor
+		h.sendAudit(r, storage.Changes())
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(`{"status":"ok"}`))
 	}
 }
-
-func metricsToStrings(metrics []models.Metrics) []string {
-	metricsStrings := []string{}
-	for _, metric := range metrics {
-		metricsStrings = append(metricsStrings, metric.ID)
-	}
-	return metricsStrings
-}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
@@ -160,19 +161,29 @@ func BenchmarkUpdateBatchHandler(b *testing.B) {
 	})
 }
 
-func BenchmarkMetricsToStrings(b *testing.B) {
+// BenchmarkChangeRecorder_SaveBatch measures the recording of the changes of a batch of 100 metrics,
+// the payload of the audit record of /updates.
+func BenchmarkChangeRecorder_SaveBatch(b *testing.B) {
 	metrics := make([]models.Metrics, 100)
 	for i := 0; i < 100; i++ {
-		metrics[i] = models.Metrics{
-			ID:    "metric_" + string(rune(i)),
-			MType: models.Gauge,
+		if i%2 == 0 {
+			value := float64(i)
+			metrics[i] = models.Metrics{ID: "gauge_" + strconv.Itoa(i), MType: models.Gauge, Value: &value}
+		} else {
+			delta := int64(i)
+			metrics[i] = models.Metrics{ID: "counter_" + strconv.Itoa(i), MType: models.Counter, Delta: &delta}
 		}
 	}
+	storage := mstorage.NewMemStorage()
+	ctx := context.Background()
 
+	b.ReportAllocs()
 	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			_ = metricsToStrings(metrics)
+	for i := 0; i < b.N; i++ {
+		recorder := newChangeRecorder(storage)
+		if err := recorder.SaveBatch(ctx, metrics); err != nil {
+			b.Fatal(err)
 		}
-	})
+		_ = recorder.Changes()
+	}
 }
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	"go.uber.org/zap"
+)
+
+// AuthMiddleware is a middleware that requires a bearer API token granting the scope.
+// A missing or unknown token is answered with 401, a token without the scope with 403.
+// With a nil authenticator the requests are passed through, so the routes stay open when auth is disabled.
+func AuthMiddleware(authenticator *auth.Authenticator, scope string, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if authenticator == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Get the token from the Authorization header.
+			token, ok := bearerToken(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "API token is required", http.StatusUnauthorized)
+				return
+			}
+			t, err := authenticator.Authenticate(r.Context(), token)
+			if errors.Is(err, auth.ErrInvalidToken) {
+				requestLogger(r, logger).Debugf("invalid API token from %s", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics", error="invalid_token"`)
+				http.Error(w, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				// The token store cannot be read, the request is refused rather than let through.
+				requestLogger(r, logger).Errorf("authenticate request: %v", err)
+				http.Error(w, "Authentication is unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if !t.Allows(scope) {
+				requestLogger(r, logger).Debugf("API token %s lacks the %s scope", t.ID, scope)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics", error="insufficient_scope", scope="`+scope+`"`)
+				http.Error(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenIDKey, t.ID)))
+		})
+	}
+}
+
+// bearerToken returns the token of the "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// failingStore is a token store that cannot be read.
+type failingStore struct{}
+
+func (failingStore) Lookup(context.Context, string) (auth.Token, error) {
+	return auth.Token{}, errors.New("connection refused")
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	store, err := auth.NewStaticStore([]cfg.TokenConfig{
+		{ID: "agent", Hash: auth.HashToken("write-token"), Scopes: []string{auth.ScopeWrite}},
+		{ID: "ops", Hash: auth.HashToken("admin-token"), Scopes: []string{auth.ScopeAdmin}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		authenticator *auth.Authenticator
+		header        string
+		wantStatus    int
+		wantTokenID   string
+	}{
+		{name: "auth_disabled", authenticator: nil, wantStatus: http.StatusOK},
+		{name: "no_token", authenticator: auth.NewAuthenticator(store), wantStatus: http.StatusUnauthorized},
+		{name: "basic_auth", authenticator: auth.NewAuthenticator(store), header: "Basic d3JpdGUtdG9rZW4=", wantStatus: http.StatusUnauthorized},
+		{name: "unknown_token", authenticator: auth.NewAuthenticator(store), header: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "scope_granted", authenticator: auth.NewAuthenticator(store), header: "Bearer write-token", wantStatus: http.StatusOK, wantTokenID: "agent"},
+		{name: "admin_token", authenticator: auth.NewAuthenticator(store), header: "bearer admin-token", wantStatus: http.StatusOK, wantTokenID: "ops"},
+		{name: "store_unavailable", authenticator: auth.NewAuthenticator(failingStore{}), header: "Bearer write-token", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokenID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokenID = TokenID(r.Context())
+			})
+			h := AuthMiddleware(tt.authenticator, auth.ScopeWrite, logger)(next)
+
+			req := httptest.NewRequest(http.MethodPost, "/update", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantTokenID, tokenID)
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+
+	// A token without the scope is forbidden.
+	readStore, err := auth.NewStaticStore([]cfg.TokenConfig{{ID: "grafana", Hash: auth.HashToken("read-token"), Scopes: []string{auth.ScopeRead}}})
+	require.NoError(t, err)
+	h := AuthMiddleware(auth.NewAuthenticator(readStore), auth.ScopeWrite, logger)(http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodPost, "/update", nil)
+	req.Header.Set("Authorization", "Bearer read-token")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `scope="metrics:write"`)
+}
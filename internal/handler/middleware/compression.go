@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -67,6 +69,16 @@ func (c *compressWriter) Write(b []byte) (int, error) {
 	return c.zw.Write(b)
 }
 
+// Flush flushes the compressed data and sends it to the client, required by streaming handlers.
+func (c *compressWriter) Flush() {
+	if c.zw != nil {
+		_ = c.zw.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (c *compressWriter) Close() error {
 	if c.zw != nil {
 		return c.zw.Close()
@@ -105,27 +117,36 @@ func (c *compressReader) Close() error {
 }
 
 // MiddlewareGzip is a middleware that handles gzip compression and decompression.
-func MiddlewareGzip(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+// The decompressed request body is limited to maxSize bytes, so that a small gzip bomb cannot exhaust the memory.
+// Its span covers the next handlers, which read the decompressed body and write the compressed response.
+func MiddlewareGzip(maxSize int64, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		logFn := func(w http.ResponseWriter, r *http.Request) {
 			ow := w // Set original http.ResponseWriter.
-			logger.Debug("req header", r.Header)
+			ctx, span := tracing.Start(r.Context(), "middleware.gzip")
+			defer span.End()
+			r = r.WithContext(ctx)
 			// check if request is compressed, decompress it and remove Content-Encoding header.
 			contentEncoding := r.Header.Get("Content-Encoding")
 			sendsGzip := strings.Contains(contentEncoding, "gzip")
-			logger.Debugf("Content-Encoding: %s, sendsGzip: %t", contentEncoding, sendsGzip)
+			// Check if agent is accepting gzip and compress it.
+			acceptEncoding := r.Header.Get("Accept-Encoding")
+			supportsGzip := strings.Contains(acceptEncoding, "gzip")
+			if debugEnabled(logger) {
+				requestLogger(r, logger).Debugf("req header: %v, Content-Encoding: %s, Accept-Encoding: %s", r.Header, contentEncoding, acceptEncoding)
+			}
 			if sendsGzip {
-				logger.Debugf("Received data is compressed,")
 				cr, err := NewCompressReader(r.Body)
 				if err != nil {
-					logger.Debugf("error decompressing request: ", err)
+					requestLogger(r, logger).Debugf("error decompressing request: ", err)
+					tracing.End(span, err)
 					http.Error(w, "error decompressing request", http.StatusInternalServerError)
 					return
 				}
-				r.Body = cr
+				r.Body = http.MaxBytesReader(w, cr, maxSize)
 				defer func() {
 					if err := cr.Close(); err != nil {
-						logger.Debugf("error closing request body: ", err)
+						requestLogger(r, logger).Debugf("error closing request body: ", err)
 					}
 				}()
 
@@ -133,20 +154,17 @@ func MiddlewareGzip(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
 				r.Header.Del("Content-Length")
 			}
 
-			// Check if agent is accepting gzip and compress it.
-			acceptEncoding := r.Header.Get("Accept-Encoding")
-			supportsGzip := strings.Contains(acceptEncoding, "gzip")
-			logger.Debugf("Accept-Encoding: %s, gzip: %t", acceptEncoding, supportsGzip)
 			if supportsGzip {
 				cw := newCompressWriter(w, true)
 				w.Header().Set("Content-Encoding", "gzip")
 				defer func() {
 					if err := cw.Close(); err != nil {
-						logger.Debugf("error closing response body: ", err)
+						requestLogger(r, logger).Debugf("error closing response body: ", err)
 					}
 				}()
 				ow = cw
 			}
+			span.SetAttributes(attribute.Bool("gzip.request", sendsGzip), attribute.Bool("gzip.response", supportsGzip))
 			h.ServeHTTP(ow, r)
 		}
 
@@ -39,7 +39,7 @@ func TestMiddlewareGzip(t *testing.T) {
 	})
 
 	router := chi.NewRouter()
-	router.Use(MiddlewareGzip(logger))
+	router.Use(MiddlewareGzip(1<<20, logger))
 	router.Post("/", successHandler)
 
 	srv := httptest.NewServer(router)
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"go.uber.org/zap"
+)
+
+// HMAC verification results stored in the request context by HashMiddleware.
+const (
+	HMACDisabled  = "disabled"  // no key is configured
+	HMACUnsigned  = "unsigned"  // the request has no hash header
+	HMACVerified  = "verified"  // the hash of the canonical request matches and the request is not a replay
+	HMACLegacy    = "legacy"    // the hash of the request body matches, the request has no replay protection
+	HMACSignature = "signature" // the canonical request is signed by the private key of a registered agent
+)
+
+// ctxKey is the type of the request context keys set by the middlewares.
+type ctxKey int
+
+const (
+	hmacResultKey ctxKey = iota
+	decryptedKey
+	tokenIDKey
+	agentIDKey
+)
+
+// HMACResult returns the HMAC verification result of the request, empty if HashMiddleware was not used.
+func HMACResult(ctx context.Context) string {
+	result, _ := ctx.Value(hmacResultKey).(string)
+	return result
+}
+
+// Decrypted reports whether the request body was decrypted by DecryptionMiddleware.
+func Decrypted(ctx context.Context) bool {
+	decrypted, _ := ctx.Value(decryptedKey).(bool)
+	return decrypted
+}
+
+// TokenID returns the ID of the API token of the request, empty if AuthMiddleware did not authenticate it.
+func TokenID(ctx context.Context) string {
+	id, _ := ctx.Value(tokenIDKey).(string)
+	return id
+}
+
+// AgentID returns the ID of the agent whose signature HashMiddleware verified, empty for other requests.
+func AgentID(ctx context.Context) string {
+	id, _ := ctx.Value(agentIDKey).(string)
+	return id
+}
+
+// requestLogger returns the logger of the request set by RequestIDMiddleware, or fallback without it.
+func requestLogger(r *http.Request, fallback *zap.SugaredLogger) *zap.SugaredLogger {
+	return logger.FromContext(r.Context(), fallback)
+}
+
+// debugEnabled reports whether the logger logs the debug entries. The middlewares check it before the debug entries
+// of the requests passing through, so that they build neither the entries nor the logger of the request otherwise.
+func debugEnabled(l *zap.SugaredLogger) bool {
+	return l.Level().Enabled(zap.DebugLevel)
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -24,6 +25,10 @@ func DecryptionMiddleware(privKeyPath string, logger *zap.SugaredLogger) (func(h
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Every return before the next handler rejects the request.
+			st := startStage(r, "middleware.decrypt")
+			defer st.end(http.StatusBadRequest)
+
 			// Get the encryption type from the header.
 			encType := r.Header.Get("X-Encryption")
 			if encType != "rsa" {
@@ -40,7 +45,7 @@ func DecryptionMiddleware(privKeyPath string, logger *zap.SugaredLogger) (func(h
 			// Read the body of the request.
 			cipherBody, err := io.ReadAll(r.Body)
 			if err != nil {
-				logger.Debugf("Error reading request body: %w", err)
+				requestLogger(r, logger).Debugf("Error reading request body: %w", err)
 				http.Error(w, "bad request", http.StatusBadRequest)
 				return
 			}
@@ -49,7 +54,7 @@ func DecryptionMiddleware(privKeyPath string, logger *zap.SugaredLogger) (func(h
 			// Decrypt the request body.
 			plain, err := decryptor.Decrypt(cipherBody)
 			if err != nil {
-				logger.Debugf("Error decrypting request body: %w", err)
+				requestLogger(r, logger).Debugf("Error decrypting request body: %w", err)
 				http.Error(w, "Error decrypting request body", http.StatusBadRequest)
 				return
 			}
@@ -59,7 +64,8 @@ func DecryptionMiddleware(privKeyPath string, logger *zap.SugaredLogger) (func(h
 			r.ContentLength = int64(len(plain))
 
 			// Serve the request.
-			next.ServeHTTP(w, r)
+			st.end(0)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), decryptedKey, true)))
 		})
 	}, nil
 }
@@ -2,30 +2,47 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
+	"sync/atomic"
 
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
+// hashResponseWriter buffers the response to sign its body.
+// A handler that flushes streams the response, which cannot be signed: the buffer is written unsigned
+// and the rest of the response goes straight to the client.
 type hashResponseWriter struct {
-	header http.Header
-	buf    bytes.Buffer
-	code   int
+	w         http.ResponseWriter
+	header    http.Header
+	buf       bytes.Buffer
+	code      int
+	streaming bool
 }
 
-func newHashResponseWriter() *hashResponseWriter {
+func newHashResponseWriter(w http.ResponseWriter) *hashResponseWriter {
 	return &hashResponseWriter{
+		w:      w,
 		header: make(http.Header),
 	}
 }
 
 func (h *hashResponseWriter) Header() http.Header {
+	if h.streaming {
+		return h.w.Header()
+	}
 	return h.header
 }
 
 func (h *hashResponseWriter) Write(b []byte) (int, error) {
+	if h.streaming {
+		return h.w.Write(b)
+	}
 	return h.buf.Write(b)
 }
 
@@ -35,30 +52,105 @@ func (h *hashResponseWriter) WriteHeader(status int) {
 	}
 }
 
-// HashMiddleware is a middleware that verifies the hash of the request body.
-func HashMiddleware(key string, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+// Flush switches to streaming and sends the buffered data to the client, required by streaming handlers.
+func (h *hashResponseWriter) Flush() {
+	if !h.streaming {
+		h.writeBuffered()
+		h.streaming = true
+	}
+	if f, ok := h.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// SignStats counts the POST requests HashMiddleware accepts without replay protection, because the signatures
+// are not required. They are reported in the self-metrics of the server, a nil SignStats counts nothing.
+type SignStats struct {
+	unsigned atomic.Int64 // unsigned POST requests
+	legacy   atomic.Int64 // POST requests signed with HMAC over the body only
+}
+
+// Collect returns the counters of the accepted requests.
+func (s *SignStats) Collect() []models.Metrics {
+	return []models.Metrics{
+		selfmetrics.Counter("sign.unsigned_posts", s.unsigned.Load()),
+		selfmetrics.Counter("sign.legacy_posts", s.legacy.Load()),
+	}
+}
+
+// count counts the accepted POST request without replay protection.
+func (s *SignStats) count(r *http.Request, result string) {
+	if s == nil || r.Method != http.MethodPost {
+		return
+	}
+	if result == HMACLegacy {
+		s.legacy.Add(1)
+	} else {
+		s.unsigned.Add(1)
+	}
+}
+
+// HashMiddleware is a middleware that verifies the signature of the request.
+// A request with a Signature header is verified against the public key of its agent, other requests against
+// the HMAC keys of the key ring. Requests with a timestamp and a nonce are signed over their canonical form
+// and checked by the replay guard; HMAC requests without them are signed over the body only and are accepted as legacy.
+// With required set, the POST requests that are not signed with replay protection are rejected,
+// otherwise they are accepted and counted in stats.
+// Every response is signed with an HMAC key: the key that verified the request, or the key named by the request,
+// or the signing key of the ring.
+func HashMiddleware(keys *sign.KeyRing, agents *sign.AgentKeys, replay *sign.ReplayGuard, required bool, stats *SignStats, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			logger.Debugf("Hash middleware with key %s", key)
-			// If the key is empty, skip the hash verification.
-			if key == "" {
-				logger.Debugf("key is empty")
-				next.ServeHTTP(w, r)
+			// If there are no keys, skip the hash verification.
+			if keys.Empty() && agents == nil {
+				if debugEnabled(logger) {
+					requestLogger(r, logger).Debugf("key is empty")
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hmacResultKey, HMACDisabled)))
 				return
 			}
-			// Get the hash from the header.
+			// Sign the rejections with the key the client expects, if it is in the ring.
+			keyID := r.Header.Get(sign.KeyIDHeader)
+			key, ok := keys.Key(keyID)
+			if !ok {
+				key, _ = keys.SigningKey()
+			}
+			hw := newHashResponseWriter(w)
+			defer func() {
+				hw.writeSigned(key)
+			}()
+			st := startStage(r, "middleware.hash")
+			defer func() {
+				st.end(hw.code)
+			}()
+
 			hash := r.Header.Get(sign.HashHeader)
-			if hash == "" {
-				// If the hash header is empty, skip the hash verification.
-				next.ServeHTTP(w, r)
+			signature := r.Header.Get(sign.SignatureHeader)
+			if agents == nil {
+				signature = ""
+			}
+			if hash == "" && signature == "" {
+				if required && r.Method == http.MethodPost {
+					http.Error(hw, "Request signature required", http.StatusBadRequest)
+					return
+				}
+				// If the request is not signed, skip the verification.
+				stats.count(r, HMACUnsigned)
+				st.span.SetAttributes(attribute.String("sign.result", HMACUnsigned))
+				st.end(0)
+				next.ServeHTTP(hw, r.WithContext(context.WithValue(r.Context(), hmacResultKey, HMACUnsigned)))
 				return
 			}
 
 			// Read the body of the request.
 			body, err := io.ReadAll(r.Body)
+			if BodyTooLarge(err) {
+				http.Error(hw, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
-				logger.Debugf("Error reading request body: %w", err)
-				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				requestLogger(r, logger).Debugf("Error reading request body: %w", err)
+				http.Error(hw, "Error reading request body", http.StatusBadRequest)
 				return
 			}
 			// Close the original body to release the underlying reader before replacing it.
@@ -66,41 +158,101 @@ func HashMiddleware(key string, logger *zap.SugaredLogger) func(http.Handler) ht
 			// Restore the body so other handlers can read it.
 			r.Body = io.NopCloser(bytes.NewReader(body))
 
-			// Verify the hash of the request body.
-			ok, err := sign.Verify(body, key, hash)
-			if err != nil || !ok {
-				http.Error(w, "Hash verification failed", http.StatusBadRequest)
-				return
+			// Build the signed material, the canonical request if it has a timestamp or a nonce.
+			timestamp, nonce := r.Header.Get(sign.TimestampHeader), r.Header.Get(sign.NonceHeader)
+			protected := timestamp != "" || nonce != ""
+			signed := body
+			if protected {
+				signed = sign.CanonicalRequest(r.Method, r.URL.EscapedPath(), timestamp, nonce, body)
+			}
+
+			ctx := r.Context()
+			var result string
+			if signature != "" {
+				// The agent signatures always cover the canonical request.
+				agentID := r.Header.Get(sign.AgentIDHeader)
+				if !protected {
+					http.Error(hw, "Signature verification failed", http.StatusBadRequest)
+					return
+				}
+				if err := agents.Verify(agentID, signed, signature); err != nil {
+					requestLogger(r, logger).Debugf("Signature verification failed: %v", err)
+					http.Error(hw, "Signature verification failed", http.StatusBadRequest)
+					return
+				}
+				if debugEnabled(logger) {
+					requestLogger(r, logger).Debugf("Signature verification passed for agent %q", agentID)
+				}
+				ctx = context.WithValue(ctx, agentIDKey, agentID)
+				result = HMACSignature
+			} else {
+				// Verify the hash of the request.
+				verified, err := keys.Verify(signed, keyID, hash)
+				if err != nil {
+					requestLogger(r, logger).Debugf("Hash verification failed: %v", err)
+					http.Error(hw, "Hash verification failed", http.StatusBadRequest)
+					return
+				}
+				if debugEnabled(logger) {
+					requestLogger(r, logger).Debugf("Hash verification passed with key %q", verified.ID)
+				}
+				key = verified
+				result = HMACVerified
+				if !protected {
+					if required && r.Method == http.MethodPost {
+						http.Error(hw, "Request signature required", http.StatusBadRequest)
+						return
+					}
+					result = HMACLegacy
+					stats.count(r, result)
+				}
+			}
+			// Check the replay only after the signature, so that forged requests cannot fill the nonce cache.
+			if protected && replay != nil {
+				if err := replay.Check(timestamp, nonce); err != nil {
+					requestLogger(r, logger).Debugf("Replay check failed: %v", err)
+					http.Error(hw, "Request replay rejected", http.StatusBadRequest)
+					return
+				}
 			}
 
-			logger.Debugf("Hash verification passed")
-			// Hash the response body.
-			hw := newHashResponseWriter()
-			next.ServeHTTP(hw, r)
-			hw.WriteTo(w, key)
-			logger.Debugf("Hash response written")
+			st.span.SetAttributes(attribute.String("sign.result", result))
+			st.end(0)
+			next.ServeHTTP(hw, r.WithContext(context.WithValue(ctx, hmacResultKey, result)))
 		})
 	}
 }
 
-func (h *hashResponseWriter) WriteTo(w http.ResponseWriter, key string) {
+// writeSigned signs the buffered response with the key and writes it, a streamed response is already written.
+func (h *hashResponseWriter) writeSigned(key sign.Key) {
+	if h.streaming {
+		return
+	}
+	// Set the hash of the response body.
+	if key.Secret != "" {
+		h.header.Set(sign.HashHeader, sign.Hash(h.buf.Bytes(), key.Secret))
+		if key.ID != "" {
+			h.header.Set(sign.KeyIDHeader, key.ID)
+		}
+	}
+	h.writeBuffered()
+}
+
+// writeBuffered writes the headers, the status code and the buffered body to the client.
+func (h *hashResponseWriter) writeBuffered() {
 	// Copy the headers from the response writer.
 	for k, vv := range h.header {
 		for _, v := range vv {
-			w.Header().Add(k, v)
+			h.w.Header().Add(k, v)
 		}
 	}
 	// Remove the Content-Length header.
-	w.Header().Del("Content-Length")
-	// Set the hash of the response body.
-	if key != "" {
-		w.Header().Set(sign.HashHeader, sign.Hash(h.buf.Bytes(), key))
-	}
+	h.w.Header().Del("Content-Length")
 	// Set the status code.
 	if h.code == 0 {
 		h.code = http.StatusOK
 	}
 	// Write the response body.
-	w.WriteHeader(h.code)
-	_, _ = w.Write(h.buf.Bytes())
+	h.w.WriteHeader(h.code)
+	_, _ = h.w.Write(h.buf.Bytes())
 }
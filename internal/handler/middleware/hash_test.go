@@ -3,13 +3,17 @@ package handler
 import (
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign/signtest"
 	"github.com/go-chi/chi"
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestHashMiddleware(t *testing.T) {
@@ -29,13 +33,14 @@ func TestHashMiddleware(t *testing.T) {
 	key := "test_key"
 
 	successHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-HMAC-Result", HMACResult(r.Context()))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("success"))
 	})
 
 	router := chi.NewRouter()
-	router.Use(HashMiddleware(key, logger))
+	router.Use(HashMiddleware(sign.NewSingleKeyRing(key), nil, sign.NewReplayGuard(0, 0), false, nil, logger))
 	router.Post("/", successHandler)
 
 	srv := httptest.NewServer(router)
@@ -48,18 +53,21 @@ func TestHashMiddleware(t *testing.T) {
 		key        string
 		wantStatus int
 		wantBody   string
+		wantResult string
 	}{
 		{name: "request_with_hash",
 			hash:       sign.Hash([]byte(requestBody), key),
 			key:        key,
 			wantStatus: http.StatusOK,
 			wantBody:   "success",
+			wantResult: HMACLegacy,
 		},
 		{name: "missing_hash",
 			hash:       "",
 			key:        key,
 			wantStatus: http.StatusOK,
 			wantBody:   "success",
+			wantResult: HMACUnsigned,
 		},
 		{name: "invalid_hash",
 			hash:       "1d23d23d231",
@@ -85,6 +93,322 @@ func TestHashMiddleware(t *testing.T) {
 			require.NoError(t, err)
 			require.Equal(t, test.wantStatus, resp.StatusCode())
 			require.Equal(t, test.wantBody, string(resp.Body()))
+			require.Equal(t, test.wantResult, resp.Header().Get("X-HMAC-Result"))
 		})
 	}
+
+	t.Run("disabled", func(t *testing.T) {
+		router := chi.NewRouter()
+		router.Use(HashMiddleware(nil, nil, nil, false, nil, logger))
+		router.Post("/", successHandler)
+		srv := httptest.NewServer(router)
+		defer srv.Close()
+
+		resp, err := client.R().SetBody([]byte(requestBody)).Post(srv.URL + "/")
+		require.NoError(t, err)
+		require.Equal(t, HMACDisabled, resp.Header().Get("X-HMAC-Result"))
+	})
+}
+
+func TestHashMiddleware_KeyRing(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	now := time.Now()
+	keys, err := sign.NewKeyRing(
+		sign.Key{ID: "old", Secret: "old_key", NotAfter: now.Add(-time.Hour)},
+		sign.Key{ID: "current", Secret: "current_key"},
+		sign.Key{ID: "next", Secret: "next_key", NotBefore: now.Add(time.Hour)},
+	)
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Use(HashMiddleware(keys, nil, sign.NewReplayGuard(0, 0), false, nil, logger))
+	router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("success"))
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	body := []byte(`{"id":"LastGC","type":"gauge"}`)
+	tests := []struct {
+		name       string
+		keyID      string
+		secret     string
+		wantStatus int
+		wantKeyID  string
+	}{
+		{name: "current_key_with_id", keyID: "current", secret: "current_key", wantStatus: http.StatusOK, wantKeyID: "current"},
+		{name: "current_key_without_id", secret: "current_key", wantStatus: http.StatusOK, wantKeyID: "current"},
+		{name: "expired_key", keyID: "old", secret: "old_key", wantStatus: http.StatusBadRequest},
+		{name: "expired_key_without_id", secret: "old_key", wantStatus: http.StatusBadRequest},
+		{name: "key_not_yet_valid", keyID: "next", secret: "next_key", wantStatus: http.StatusBadRequest},
+		{name: "unknown_key_id", keyID: "other", secret: "current_key", wantStatus: http.StatusBadRequest},
+		{name: "wrong_key_for_id", keyID: "current", secret: "old_key", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R().
+				SetHeader(sign.HashHeader, sign.Hash(body, tt.secret)).
+				SetBody(body)
+			if tt.keyID != "" {
+				req.SetHeader(sign.KeyIDHeader, tt.keyID)
+			}
+			resp, err := req.Post(srv.URL + "/")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode())
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			// The response is signed with the key of the request.
+			require.Equal(t, tt.wantKeyID, resp.Header().Get(sign.KeyIDHeader))
+			require.Equal(t, sign.Hash(resp.Body(), tt.secret), resp.Header().Get(sign.HashHeader))
+		})
+	}
+}
+
+func TestHashMiddleware_Replay(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	key := "test_key"
+
+	router := chi.NewRouter()
+	router.Use(HashMiddleware(sign.NewSingleKeyRing(key), nil, sign.NewReplayGuard(time.Minute, 100), false, nil, logger))
+	router.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-HMAC-Result", HMACResult(r.Context()))
+		_, _ = w.Write([]byte("success"))
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := func(path, timestamp, nonce string) map[string]string {
+		return map[string]string{
+			sign.HashHeader:      sign.Hash(sign.CanonicalRequest(http.MethodPost, path, timestamp, nonce, body), key),
+			sign.TimestampHeader: timestamp,
+			sign.NonceHeader:     nonce,
+		}
+	}
+	downgraded := signed("/updates/", now, "n-downgrade")
+	delete(downgraded, sign.TimestampHeader)
+	delete(downgraded, sign.NonceHeader)
+
+	// The cases run in order: the replay reuses the nonce of the first request.
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "signed_request", headers: signed("/updates/", now, "n1"), wantStatus: http.StatusOK, wantBody: "success"},
+		{name: "replayed_request", headers: signed("/updates/", now, "n1"), wantStatus: http.StatusBadRequest, wantBody: "Request replay rejected\n"},
+		{
+			name:       "stale_timestamp",
+			headers:    signed("/updates/", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), "n2"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Request replay rejected\n",
+		},
+		{
+			name:       "signed_for_another_path",
+			headers:    signed("/update/", now, "n3"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Hash verification failed\n",
+		},
+		{name: "timestamp_headers_stripped", headers: downgraded, wantStatus: http.StatusBadRequest, wantBody: "Hash verification failed\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().SetHeaders(tt.headers).SetBody(body).Post(srv.URL + "/updates/")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode())
+			require.Equal(t, tt.wantBody, string(resp.Body()))
+			if tt.wantStatus == http.StatusOK {
+				require.Equal(t, HMACVerified, resp.Header().Get("X-HMAC-Result"))
+			}
+		})
+	}
+}
+
+func TestHashMiddleware_Legacy(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	key := "test_key"
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	legacy := map[string]string{sign.HashHeader: sign.Hash(body, key)}
+
+	tests := []struct {
+		name         string
+		required     bool
+		headers      map[string]string
+		wantStatus   int
+		wantLegacy   int64
+		wantUnsigned int64
+	}{
+		{name: "legacy_rejected", required: true, headers: legacy, wantStatus: http.StatusBadRequest},
+		{name: "unsigned_rejected", required: true, wantStatus: http.StatusBadRequest},
+		{name: "legacy_allowed", headers: legacy, wantStatus: http.StatusOK, wantLegacy: 1},
+		{name: "unsigned_allowed", wantStatus: http.StatusOK, wantUnsigned: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := new(SignStats)
+			router := chi.NewRouter()
+			router.Use(HashMiddleware(sign.NewSingleKeyRing(key), nil, sign.NewReplayGuard(0, 0), tt.required, stats, logger))
+			router.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("success"))
+			})
+			srv := httptest.NewServer(router)
+			defer srv.Close()
+
+			resp, err := resty.New().R().SetHeaders(tt.headers).SetBody(body).Post(srv.URL + "/updates/")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode())
+			// The accepted requests without replay protection are counted.
+			require.Equal(t, tt.wantLegacy, stats.legacy.Load())
+			require.Equal(t, tt.wantUnsigned, stats.unsigned.Load())
+		})
+	}
+}
+
+func TestHashMiddleware_AgentSignature(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	key := "test_key"
+	dir := t.TempDir()
+	signer, err := sign.LoadSigner(signtest.WriteAgentKey(t, dir, "agent-1", signtest.NewEd25519(t)))
+	require.NoError(t, err)
+	stranger, err := sign.LoadSigner(signtest.WriteAgentKey(t, t.TempDir(), "agent-1", signtest.NewEd25519(t)))
+	require.NoError(t, err)
+	agents, err := sign.LoadAgentKeys(dir)
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Use(HashMiddleware(sign.NewSingleKeyRing(key), agents, sign.NewReplayGuard(time.Minute, 100), true, nil, logger))
+	router.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-HMAC-Result", HMACResult(r.Context()))
+		w.Header().Set("X-Agent-ID", AgentID(r.Context()))
+		_, _ = w.Write([]byte("success"))
+	})
+	router.Get("/value", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("42"))
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := func(s *sign.Signer, agentID, nonce string) map[string]string {
+		sig, err := s.Sign(sign.CanonicalRequest(http.MethodPost, "/updates/", now, nonce, body))
+		require.NoError(t, err)
+		return map[string]string{
+			sign.SignatureHeader: sig,
+			sign.AgentIDHeader:   agentID,
+			sign.TimestampHeader: now,
+			sign.NonceHeader:     nonce,
+		}
+	}
+	withoutNonce := signed(signer, "agent-1", "n-stripped")
+	delete(withoutNonce, sign.TimestampHeader)
+	delete(withoutNonce, sign.NonceHeader)
+
+	// The cases run in order: the replay reuses the nonce of the first request.
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "signed_by_agent", headers: signed(signer, "agent-1", "n1"), wantStatus: http.StatusOK, wantBody: "success"},
+		{name: "replayed_request", headers: signed(signer, "agent-1", "n1"), wantStatus: http.StatusBadRequest, wantBody: "Request replay rejected\n"},
+		{name: "unknown_agent", headers: signed(signer, "agent-2", "n2"), wantStatus: http.StatusBadRequest, wantBody: "Signature verification failed\n"},
+		{name: "key_of_another_agent", headers: signed(stranger, "agent-1", "n3"), wantStatus: http.StatusBadRequest, wantBody: "Signature verification failed\n"},
+		{name: "without_replay_protection", headers: withoutNonce, wantStatus: http.StatusBadRequest, wantBody: "Signature verification failed\n"},
+		{name: "unsigned_request", wantStatus: http.StatusBadRequest, wantBody: "Request signature required\n"},
+		{
+			name:       "legacy_hmac_request",
+			headers:    map[string]string{sign.HashHeader: sign.Hash(body, key)},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Request signature required\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().SetHeaders(tt.headers).SetBody(body).Post(srv.URL + "/updates/")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode())
+			require.Equal(t, tt.wantBody, string(resp.Body()))
+			if tt.wantStatus == http.StatusOK {
+				require.Equal(t, HMACSignature, resp.Header().Get("X-HMAC-Result"))
+				require.Equal(t, "agent-1", resp.Header().Get("X-Agent-ID"))
+			}
+		})
+	}
+
+	t.Run("unsigned_get_is_allowed", func(t *testing.T) {
+		resp, err := resty.New().R().Get(srv.URL + "/value")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+		require.Equal(t, sign.Hash(resp.Body(), key), resp.Header().Get(sign.HashHeader))
+	})
+}
+
+func TestHashMiddleware_SignsResponses(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	keys, err := sign.NewKeyRing(
+		sign.Key{ID: "k1", Secret: "k1_key"},
+		sign.Key{ID: "k2", Secret: "k2_key"},
+	)
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Use(HashMiddleware(keys, nil, sign.NewReplayGuard(0, 0), false, nil, logger))
+	router.Get("/value", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("42"))
+	})
+	router.Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("data: 2\n\n"))
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		headers    map[string]string
+		wantStatus int
+		wantKey    sign.Key
+	}{
+		{name: "unsigned_request", path: "/value", wantStatus: http.StatusOK, wantKey: sign.Key{ID: "k1", Secret: "k1_key"}},
+		{
+			name:       "unsigned_request_naming_a_key",
+			path:       "/value",
+			headers:    map[string]string{sign.KeyIDHeader: "k2"},
+			wantStatus: http.StatusOK,
+			wantKey:    sign.Key{ID: "k2", Secret: "k2_key"},
+		},
+		{
+			name:       "rejected_request",
+			path:       "/value",
+			headers:    map[string]string{sign.KeyIDHeader: "k2", sign.HashHeader: "00"},
+			wantStatus: http.StatusBadRequest,
+			wantKey:    sign.Key{ID: "k2", Secret: "k2_key"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().SetHeaders(tt.headers).Get(srv.URL + tt.path)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode())
+			require.Equal(t, tt.wantKey.ID, resp.Header().Get(sign.KeyIDHeader))
+			require.Equal(t, sign.Hash(resp.Body(), tt.wantKey.Secret), resp.Header().Get(sign.HashHeader))
+		})
+	}
+
+	t.Run("streamed_response_is_not_signed", func(t *testing.T) {
+		resp, err := resty.New().R().Get(srv.URL + "/stream")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+		require.Equal(t, "data: 1\n\ndata: 2\n\n", string(resp.Body()))
+		require.Equal(t, "text/event-stream", resp.Header().Get("Content-Type"))
+		require.Empty(t, resp.Header().Get(sign.HashHeader))
+	})
 }
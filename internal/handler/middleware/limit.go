@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/limit"
+	"go.uber.org/zap"
+)
+
+// RateLimitMiddleware is a middleware that limits the requests of every client, the client is named by key.
+// A request over the limit is answered with 429 and the seconds until the next allowed request in Retry-After.
+// The requests without a client key, and all requests with a nil limiter, are passed through.
+// It runs before HashMiddleware, so that a rejected request does not use up its nonce and can be retried.
+func RateLimitMiddleware(limiter *limit.RateLimiter, key func(*http.Request) string, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := key(r)
+			if client == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := limiter.Allow(client); !ok {
+				requestLogger(r, logger).Debugf("rate limit of %s exceeded, retry in %s", r.RemoteAddr, wait)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIP returns the IP address of the client of the request, the key of the per-IP rate limit.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientToken returns the hash of the bearer API token of the request, the key of the per-token rate limit.
+// The token is not authenticated yet: an unknown token gets its own bucket and is rejected by AuthMiddleware.
+func ClientToken(r *http.Request) string {
+	token, ok := bearerToken(r)
+	if !ok {
+		return ""
+	}
+	return auth.HashToken(token)
+}
+
+// BodyLimitMiddleware is a middleware that rejects the request bodies larger than maxSize as received.
+// A body announced larger by Content-Length is answered with 413 at once, a longer body fails to read
+// with *http.MaxBytesError, which the readers answer with 413.
+func BodyLimitMiddleware(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxSize {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BodyTooLarge reports whether reading the request body failed because of a size limit.
+func BodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// ConcurrencyMiddleware is a middleware that limits the requests served at once by the semaphore.
+// The other requests wait for a free slot, a request whose client leaves while waiting is answered with 503.
+func ConcurrencyMiddleware(sem limit.Semaphore, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if sem == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			if err := sem.Acquire(r.Context()); err != nil {
+				requestLogger(r, logger).Debugf("request of %s gave up waiting for the storage after %s", r.RemoteAddr, time.Since(start))
+				http.Error(w, "Server is busy", http.StatusServiceUnavailable)
+				return
+			}
+			defer sem.Release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
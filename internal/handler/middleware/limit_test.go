@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/limit"
+	"github.com/go-chi/chi"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	router := chi.NewRouter()
+	router.Use(RateLimitMiddleware(limit.NewRateLimiter(1, 2), ClientToken, logger))
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	get := func(token string) *resty.Response {
+		req := resty.New().R()
+		if token != "" {
+			req.SetAuthToken(token)
+		}
+		resp, err := req.Get(srv.URL)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The burst is allowed, then the token is rejected with the time to wait.
+	assert.Equal(t, http.StatusOK, get("mt_agent").StatusCode())
+	assert.Equal(t, http.StatusOK, get("mt_agent").StatusCode())
+	resp := get("mt_agent")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+	assert.Equal(t, "Too many requests\n", string(resp.Body()))
+
+	// Other tokens, and the requests without a token, are not limited by the bucket of the token.
+	assert.Equal(t, http.StatusOK, get("mt_grafana").StatusCode())
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, get("").StatusCode())
+	}
+}
+
+func TestClientKeys(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.10:51234"
+	assert.Equal(t, "192.0.2.10", ClientIP(r))
+	r.RemoteAddr = "[2001:db8::1]:51234"
+	assert.Equal(t, "2001:db8::1", ClientIP(r))
+
+	assert.Empty(t, ClientToken(r))
+	r.Header.Set("Authorization", "Bearer mt_agent")
+	assert.Equal(t, auth.HashToken("mt_agent"), ClientToken(r))
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	router := chi.NewRouter()
+	router.Use(BodyLimitMiddleware(64), MiddlewareGzip(256, logger))
+	router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if BodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	gzipped := func(data string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(data))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	// Four kilobytes of zeros compress below the limit of the received body.
+	bomb := gzipped(strings.Repeat("0", 4096))
+	require.LessOrEqual(t, len(bomb), 64, "the bomb must pass the limit of the received body")
+
+	tests := []struct {
+		name       string
+		body       io.Reader
+		gzip       bool
+		wantStatus int
+	}{
+		{name: "small_body", body: strings.NewReader("metrics"), wantStatus: http.StatusOK},
+		{name: "content_length_too_large", body: strings.NewReader(strings.Repeat("x", 65)), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked_body_too_large", body: io.MultiReader(strings.NewReader(strings.Repeat("x", 65))), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "small_gzip_body", body: bytes.NewReader(gzipped("metrics")), gzip: true, wantStatus: http.StatusOK},
+		{name: "gzip_bomb", body: bytes.NewReader(bomb), gzip: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL, tt.body)
+			require.NoError(t, err)
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	router := chi.NewRouter()
+	router.Use(ConcurrencyMiddleware(limit.NewSemaphore(1), logger))
+	router.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	router.Get("/fast", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(srv.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// The second request waits for the slot, and gives up with its client.
+	resp, err := resty.New().SetTimeout(50 * time.Millisecond).R().Get(srv.URL + "/fast")
+	assert.Error(t, err, "the request must wait while the slot is taken")
+	_ = resp
+
+	// Once the slot is free the next request is served.
+	close(release)
+	<-done
+	fast, err := resty.New().R().Get(srv.URL + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, fast.StatusCode())
+}
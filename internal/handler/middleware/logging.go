@@ -2,68 +2,158 @@ package handler
 
 import (
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/pool"
+	"github.com/go-chi/chi"
 	"go.uber.org/zap"
 )
 
-type (
-	// Hold the status code and size of the response.
-	responseData struct {
-		status int
-		size   int
-	}
+// responseWriter captures the status code and the size of the response for the middlewares reporting them.
+// The writers are pooled: the outermost of these middlewares takes one for the request, the inner ones share it.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
 
-	// Custom ResponseWriter with capture of response data.
-	loggingResponseWriter struct {
-		http.ResponseWriter
-		responseData *responseData
+// responseWriters is the pool of the capturing writers.
+var responseWriters = pool.NewPool(func() *responseWriter { return &responseWriter{} })
+
+// captureResponse returns the capturing writer of the response: w itself if an outer middleware already captures it,
+// or a writer of the pool, owned by the caller, which puts it back once the request is served.
+func captureResponse(w http.ResponseWriter) (rw *responseWriter, owned bool) {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw, false
 	}
-)
+	rw = responseWriters.Get()
+	rw.ResponseWriter = w
+	return rw, true
+}
+
+// Reset clears the writer before it goes back to the pool.
+func (rw *responseWriter) Reset() {
+	*rw = responseWriter{}
+}
 
 // Redefine the Write and WriteHeader methods to capture response data.
-func (r *loggingResponseWriter) Write(b []byte) (int, error) {
-	size, err := r.ResponseWriter.Write(b)
-	r.responseData.size += size
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	// A body written without a status is sent with 200.
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	size, err := rw.ResponseWriter.Write(b)
+	rw.size += size
 	return size, err
 }
 
-func (r *loggingResponseWriter) WriteHeader(statusCode int) {
-	r.ResponseWriter.WriteHeader(statusCode)
-	r.responseData.status = statusCode
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.ResponseWriter.WriteHeader(statusCode)
+	// Only the first status is sent, the next calls are superfluous.
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
 }
 
-// MiddlewareLogging is a middleware for logging HTTP requests (URI, method, processing time, response status, size)
-func MiddlewareLogging(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
-	return func(h http.Handler) http.Handler {
-		logFn := func(w http.ResponseWriter, r *http.Request) {
-			start := time.Now()
+// Flush sends the buffered data to the client, required by streaming handlers.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
 
-			responseData := &responseData{
-				status: 0,
-				size:   0,
-			}
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
 
-			lw := loggingResponseWriter{
-				ResponseWriter: w,
-				responseData:   responseData,
-			}
-			h.ServeHTTP(&lw, r)
+// Status returns the status code of the response, 200 if the handler wrote none.
+func (rw *responseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
 
-			duration := time.Since(start)
+// routeKey identifies the route of a request by its method and pattern, the requests matching no route share the zero key.
+type routeKey struct {
+	method  string
+	pattern string
+}
 
-			logger.Infow("Request info:",
-				"uri", r.RequestURI,
-				"method", r.Method,
-				"duration", duration,
-			)
+// AccessLogSampler samples the access log per route: every request answered with an error is logged, and one of every n others,
+// so that a busy route neither floods the log nor crowds the entries of the quiet routes out.
+type AccessLogSampler struct {
+	every  uint64
+	mu     sync.RWMutex
+	counts map[routeKey]*atomic.Uint64
+}
 
-			logger.Infow("Response info:",
-				"status", responseData.status,
-				"size", responseData.size,
-			)
+// NewAccessLogSampler returns a sampler logging the first successful request of every route and then one of every n,
+// all of them if n is below 2.
+func NewAccessLogSampler(n int) *AccessLogSampler {
+	if n < 1 {
+		n = 1
+	}
+	return &AccessLogSampler{every: uint64(n), counts: make(map[routeKey]*atomic.Uint64)}
+}
 
+// Sample reports whether the request of the route answered with the status is logged. A nil sampler logs every request.
+func (s *AccessLogSampler) Sample(method, pattern string, status int) bool {
+	if s == nil || s.every == 1 || status >= http.StatusBadRequest {
+		return true
+	}
+	key := routeKey{}
+	if pattern != "" {
+		key = routeKey{method: method, pattern: pattern}
+	}
+	s.mu.RLock()
+	count, ok := s.counts[key]
+	s.mu.RUnlock()
+	if !ok {
+		s.mu.Lock()
+		if count, ok = s.counts[key]; !ok {
+			count = new(atomic.Uint64)
+			s.counts[key] = count
 		}
-		return http.HandlerFunc(logFn)
+		s.mu.Unlock()
+	}
+	return count.Add(1)%s.every == 1
+}
+
+// MiddlewareLogging logs an access log entry for the requests kept by the sampler: method, URI, route, response status,
+// size and processing time, as typed fields of the logger of the request. The entries are not built when the info level is disabled.
+func MiddlewareLogging(log *zap.Logger, sampler *AccessLogSampler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw, owned := captureResponse(w)
+			if owned {
+				defer responseWriters.Put(rw)
+			}
+			next.ServeHTTP(rw, r)
+
+			var pattern string
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				pattern = rctx.RoutePattern()
+			}
+			status := rw.Status()
+			if !log.Core().Enabled(zap.InfoLevel) || !sampler.Sample(r.Method, pattern, status) {
+				return
+			}
+			if ce := logger.PlainFromContext(r.Context(), log).Check(zap.InfoLevel, "HTTP request"); ce != nil {
+				ce.Write(
+					zap.String("method", r.Method),
+					zap.String("uri", r.RequestURI),
+					zap.String("route", pattern),
+					zap.Int("status", status),
+					zap.Int("size", rw.size),
+					zap.Duration("duration", time.Since(start)),
+				)
+			}
+		})
 	}
 }
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// legacyResponseWriter is the writer of the previous access log, allocated per request.
+type legacyResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *legacyResponseWriter) Write(b []byte) (int, error) {
+	size, err := r.ResponseWriter.Write(b)
+	r.size += size
+	return size, err
+}
+
+func (r *legacyResponseWriter) WriteHeader(statusCode int) {
+	r.ResponseWriter.WriteHeader(statusCode)
+	r.status = statusCode
+}
+
+// legacyMiddlewareLogging is the previous access log, kept as the baseline of the benchmarks: the sugared logger
+// of the request, built eagerly with the request ID, writes two entries with loosely typed fields for every request.
+func legacyMiddlewareLogging(log *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := log.With("request_id", logger.RequestID(r.Context()))
+			start := time.Now()
+			lw := &legacyResponseWriter{ResponseWriter: w}
+			h.ServeHTTP(lw, r)
+			duration := time.Since(start)
+
+			log.Infow("Request info:",
+				"uri", r.RequestURI,
+				"method", r.Method,
+				"duration", duration,
+			)
+			log.Infow("Response info:",
+				"status", lw.status,
+				"size", lw.size,
+			)
+		})
+	}
+}
+
+// BenchmarkMiddlewareLogging compares the access log with the previous one, behind the request ID middleware,
+// at the info level of the server with the output discarded.
+func BenchmarkMiddlewareLogging(b *testing.B) {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), zap.InfoLevel)
+	log := zap.New(core, zap.AddCaller())
+
+	tests := []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+	}{
+		{"legacy", legacyMiddlewareLogging(log.Sugar())},
+		{"typed/every_request", MiddlewareLogging(log, NewAccessLogSampler(1))},
+		{"typed/sampled_100", MiddlewareLogging(log, NewAccessLogSampler(100))},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			r := chi.NewRouter()
+			r.Use(RequestIDMiddleware(log.Sugar()), tt.middleware)
+			r.Post("/update/{metricType}/{metricName}/{metricValue}", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			})
+			req := httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
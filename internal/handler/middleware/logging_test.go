@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLogSampler_Sample(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		method  string
+		pattern string
+		status  int
+		want    int // logged requests of 10
+	}{
+		{name: "every_request", n: 1, method: http.MethodPost, pattern: "/updates", status: http.StatusOK, want: 10},
+		{name: "zero_logs_every_request", n: 0, method: http.MethodPost, pattern: "/updates", status: http.StatusOK, want: 10},
+		{name: "one_of_four", n: 4, method: http.MethodPost, pattern: "/updates", status: http.StatusOK, want: 3},
+		{name: "errors_always", n: 4, method: http.MethodPost, pattern: "/updates", status: http.StatusBadRequest, want: 10},
+		{name: "unmatched", n: 4, method: "BREW", status: http.StatusOK, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewAccessLogSampler(tt.n)
+			var logged int
+			for i := 0; i < 10; i++ {
+				if s.Sample(tt.method, tt.pattern, tt.status) {
+					logged++
+				}
+			}
+			assert.Equal(t, tt.want, logged)
+		})
+	}
+
+	// Every route has its own count, a busy route does not use up the entries of the other ones.
+	s := NewAccessLogSampler(100)
+	for i := 0; i < 10; i++ {
+		s.Sample(http.MethodPost, "/updates", http.StatusOK)
+	}
+	assert.True(t, s.Sample(http.MethodGet, "/value/{metricType}/{metricName}", http.StatusOK))
+	assert.True(t, s.Sample(http.MethodPost, "/update", http.StatusOK))
+	assert.False(t, s.Sample(http.MethodPost, "/updates", http.StatusOK))
+	// A nil sampler logs every request.
+	assert.True(t, (*AccessLogSampler)(nil).Sample(http.MethodPost, "/updates", http.StatusOK))
+}
+
+func TestMiddlewareLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	log := zap.New(core)
+	r := chi.NewRouter()
+	r.Use(RequestIDMiddleware(log.Sugar()), MiddlewareLogging(log, NewAccessLogSampler(2)))
+	r.Post("/update/{metricType}/{metricName}/{metricValue}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	r.Get("/value/{metricType}/{metricName}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "metric not found", http.StatusNotFound)
+	})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	first := serve(http.MethodPost, "/update/counter/PollCount/1")
+	serve(http.MethodPost, "/update/counter/PollCount/2")
+	serve(http.MethodPost, "/update/counter/PollCount/3")
+	serve(http.MethodGet, "/value/counter/Unknown")
+
+	// The first and third updates are sampled, the failed request is always logged.
+	entries := logs.FilterMessage("HTTP request").All()
+	require.Len(t, entries, 3)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, first.Header().Get(logger.RequestIDHeader), fields["request_id"])
+	assert.Equal(t, http.MethodPost, fields["method"])
+	assert.Equal(t, "/update/counter/PollCount/1", fields["uri"])
+	assert.Equal(t, "/update/{metricType}/{metricName}/{metricValue}", fields["route"])
+	assert.Equal(t, int64(http.StatusOK), fields["status"])
+	assert.Equal(t, int64(2), fields["size"])
+	assert.Contains(t, fields, "duration")
+	assert.Equal(t, "/update/counter/PollCount/3", entries[1].ContextMap()["uri"])
+	assert.Equal(t, int64(http.StatusNotFound), entries[2].ContextMap()["status"])
+}
+
+func TestCaptureResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw, owned := captureResponse(rec)
+	require.True(t, owned)
+	assert.Equal(t, http.StatusOK, rw.Status())
+
+	// The inner middlewares share the writer of the outermost one.
+	inner, owned := captureResponse(rw)
+	assert.False(t, owned)
+	assert.Same(t, rw, inner)
+
+	// Only the first status is kept, the next ones are not sent.
+	inner.WriteHeader(http.StatusAccepted)
+	inner.WriteHeader(http.StatusInternalServerError)
+	_, err := inner.Write([]byte("accepted"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, rw.Status())
+	assert.Equal(t, len("accepted"), rw.size)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	// The writer is reset before it goes back to the pool.
+	responseWriters.Put(rw)
+	assert.Nil(t, rw.ResponseWriter)
+	assert.Equal(t, http.StatusOK, rw.Status())
+	assert.Zero(t, rw.size)
+}
@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"github.com/go-chi/chi"
+)
+
+// MetricsMiddleware counts the requests in the self-metrics of the server, per route and status class, with their latency.
+// The requests matching no route are counted together, so that unknown paths do not add metrics.
+func MetricsMiddleware(reg *selfmetrics.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw, owned := captureResponse(w)
+			if owned {
+				defer responseWriters.Put(rw)
+			}
+			next.ServeHTTP(rw, r)
+
+			route := selfmetrics.UnmatchedRoute
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = selfmetrics.RouteName(r.Method, rctx.RoutePattern())
+			}
+			reg.ObserveRequest(route, rw.Status(), time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// RequestIDMiddleware keeps the X-Request-ID of the client, or generates one if it is missing or malformed,
+// and echoes it in the response. The request context carries the ID and a logger adding it, and the trace ID
+// of the request if it is traced, to every entry.
+func RequestIDMiddleware(log *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(logger.RequestIDHeader)
+			if !logger.ValidRequestID(id) {
+				id = logger.NewRequestID()
+			}
+			w.Header().Set(logger.RequestIDHeader, id)
+
+			var fields []zap.Field
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				fields = append(fields, zap.String("trace_id", sc.TraceID().String()))
+				trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request.id", id))
+			}
+			next.ServeHTTP(w, r.WithContext(logger.WithRequest(r.Context(), log, id, fields...)))
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantKept bool
+	}{
+		{name: "client_id", header: "agent-7f3a", wantKept: true},
+		{name: "missing"},
+		{name: "with_spaces", header: "id with spaces"},
+		{name: "with_newline", header: "id\nforged=entry"},
+		{name: "too_long", header: strings.Repeat("a", 129)},
+		{name: "max_length", header: strings.Repeat("a", 128), wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			var ctxID string
+			handler := RequestIDMiddleware(zap.New(core).Sugar())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxID = logger.RequestID(r.Context())
+				logger.FromContext(r.Context(), zap.NewNop().Sugar()).Info("handled")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(logger.RequestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			// The ID is echoed in the response, carried by the context and added to the entries of the request.
+			id := rec.Header().Get(logger.RequestIDHeader)
+			if tt.wantKept {
+				assert.Equal(t, tt.header, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+			assert.Equal(t, id, ctxID)
+			if assert.Equal(t, 1, logs.Len()) {
+				assert.Equal(t, id, logs.All()[0].ContextMap()["request_id"])
+			}
+		})
+	}
+}
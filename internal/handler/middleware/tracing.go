@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware starts the server span of the request, a child of the trace context sent by the client.
+// The span is named after the route once the router has matched it.
+func TracingMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracing.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+					attribute.String("client.address", ClientIP(r)),
+				))
+			defer span.End()
+
+			rw, owned := captureResponse(w)
+			if owned {
+				defer responseWriters.Put(rw)
+			}
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+				span.SetAttributes(attribute.String("http.route", rctx.RoutePattern()))
+			}
+			status := rw.Status()
+			span.SetAttributes(attribute.Int("http.response.status_code", status), attribute.Int("http.response.body.size", rw.size))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+	}
+}
+
+// stage is the span of a middleware stage. It is ended once: before the next handler, or with the rejection of the request.
+type stage struct {
+	span trace.Span
+	done bool
+}
+
+func startStage(r *http.Request, name string) *stage {
+	_, span := tracing.Start(r.Context(), name)
+	return &stage{span: span}
+}
+
+// end ends the span, with an error if the stage rejected the request with the status.
+func (s *stage) end(status int) {
+	if s.done {
+		return
+	}
+	if status >= http.StatusBadRequest {
+		s.span.SetAttributes(attribute.Int("http.response.status_code", status))
+		s.span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	s.span.End()
+	s.done = true
+}
@@ -10,13 +10,13 @@ import (
 func (h *Handler) PingHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ping the database.
-		h.logger.Debug("Pinging the database")
+		h.log(r).Debug("Pinging the database")
 		if err := h.storage.Ping(r.Context()); err != nil {
-			h.logger.Error("Failed to ping the database: %w", err)
+			h.log(r).Error("Failed to ping the database: %w", err)
 			http.Error(w, "Failed to ping the database", http.StatusInternalServerError)
 			return
 		}
-		h.logger.Debug("Database is connected")
+		h.log(r).Debug("Database is connected")
 		w.WriteHeader(http.StatusOK)
 	}
 }
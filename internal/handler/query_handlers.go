@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/query"
+	"go.uber.org/zap"
+)
+
+// Run runs the background tasks of the handler (counter snapshots, from the first rate query) until ctx is done.
+func (h *Handler) Run(ctx context.Context) {
+	h.query.Run(ctx)
+}
+
+// QueryHandler handles aggregation queries.
+// GET takes the query from the URL parameters (pattern, regex, type, func), POST takes it from the JSON body.
+func (h *Handler) QueryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var q models.Query
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+				if bodyTooLarge(w, err) {
+					return
+				}
+				h.log(r).Debug("Cannot decode query JSON body", zap.Error(err))
+				http.Error(w, "invalid query body", http.StatusBadRequest)
+				return
+			}
+		} else {
+			params := r.URL.Query()
+			q.Pattern = params.Get("pattern")
+			q.MType = params.Get("type")
+			q.Func = params.Get("func")
+			if regex := params.Get("regex"); regex != "" {
+				var err error
+				if q.Regex, err = strconv.ParseBool(regex); err != nil {
+					http.Error(w, "invalid regex flag", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		h.log(r).Debugf("query: pattern = %s, regex = %t, type = %s, func = %s", q.Pattern, q.Regex, q.MType, q.Func)
+
+		result, err := h.query.Evaluate(r.Context(), q)
+		switch {
+		case errors.Is(err, query.ErrInvalidQuery):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, query.ErrNoMatch):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, query.ErrNoRateData):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			h.log(r).Error("failed to evaluate query", zap.Error(err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		// Write response.
+		resp, err := json.Marshal(result)
+		if err != nil {
+			h.log(r).Debug("Cannot encode response JSON:", err)
+			http.Error(w, "Cannot encode response JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(resp); err != nil {
+			h.log(r).Debug("Failed to write response body:", err)
+		}
+	}
+}
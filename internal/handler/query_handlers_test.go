@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestQueryHandler(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	ms := mstorage.NewMemStorage()
+	for id, v := range map[string]float64{`Alloc{agent="a"}`: 10, `Alloc{agent="b"}`: 30, "HeapAlloc": 5} {
+		v := v
+		require.NoError(t, ms.SetGauge(context.Background(), id, &v))
+	}
+	h := NewHandler(ms, "", audit.NewAuditor(logger, "", ""), logger)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		params     map[string]string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "get_sum_glob",
+			method:     http.MethodGet,
+			params:     map[string]string{"pattern": "Alloc*", "func": "sum"},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"func":"sum","value":40,"count":2}`,
+		},
+		{
+			name:       "post_avg_regex",
+			method:     http.MethodPost,
+			body:       `{"pattern":".*Alloc.*","regex":true,"type":"gauge","func":"avg"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"func":"avg","value":15,"count":3}`,
+		},
+		{
+			name:       "no_match",
+			method:     http.MethodGet,
+			params:     map[string]string{"pattern": "Missing", "func": "max"},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "rate_without_snapshot",
+			method:     http.MethodGet,
+			params:     map[string]string{"pattern": "*", "func": "rate"},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "invalid_function",
+			method:     http.MethodGet,
+			params:     map[string]string{"pattern": "*", "func": "median"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid_regex_flag",
+			method:     http.MethodGet,
+			params:     map[string]string{"pattern": "*", "func": "sum", "regex": "maybe"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid_body",
+			method:     http.MethodPost,
+			body:       `{"pattern":`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R().SetQueryParams(tt.params)
+			if tt.body != "" {
+				req.SetHeader("Content-Type", "application/json").SetBody(tt.body)
+			}
+			resp, err := req.Execute(tt.method, srv.URL+"/query")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, resp.String())
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ package handler
 import (
 	"net/http"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
 	mw "github.com/devize-ed/yapracproj-metrics.git/internal/handler/middleware"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 )
@@ -11,13 +13,74 @@ import (
 func (h *Handler) NewRouter() http.Handler {
 	// Initialize and configure the router, adding the route paths.
 	r := chi.NewRouter()
-	r.Use(mw.MiddlewareLogging(h.logger), mw.HashMiddleware(h.hashKey, h.logger), middleware.StripSlashes, mw.MiddlewareGzip(h.logger))
-	r.Post("/update/{metricType}/{metricName}/{metricValue}", h.UpdateMetricHandler())
-	r.Post("/update", h.UpdateMetricJSONHandler())
-	r.Post("/updates", h.UpdateBatchHandler())
-	r.Post("/value", h.GetMetricJSONHandler())
-	r.Get("/value/{metricType}/{metricName}", h.GetMetricHandler())
-	r.Get("/", h.ListMetricsHandler())
-	r.Get("/ping", h.PingHandler())
+	// The server span comes first, so that the spans of the other middlewares and of the handlers are its children.
+	// The request ID is set next, the entries of the request are logged with it from then on.
+	// The self-metrics count every request, the ones rejected by the limits and the authentication too.
+	r.Use(mw.TracingMiddleware(),
+		mw.RequestIDMiddleware(h.logger),
+		mw.MetricsMiddleware(h.self),
+		mw.MiddlewareLogging(h.plain, h.access),
+		mw.RateLimitMiddleware(h.limits.perIP, mw.ClientIP, h.logger),
+		mw.RateLimitMiddleware(h.limits.perToken, mw.ClientToken, h.logger),
+		mw.BodyLimitMiddleware(h.limits.maxBody),
+		middleware.StripSlashes)
+	// The routes are grouped by the scope of the API token they require, /ping and the dashboard page stay open.
+	// The storage-bound handlers share the concurrency limit, /stream holds its connection open and is left out.
+	// The limits and the authentication run before HashMiddleware: the requests they reject do not use up their
+	// nonces, and the agents retry them as they are.
+	r.Group(func(r chi.Router) {
+		r.Use(mw.AuthMiddleware(h.auth, auth.ScopeWrite, h.logger), mw.ConcurrencyMiddleware(h.limits.storage, h.logger))
+		r.Use(h.verified()...)
+		r.Post("/update/{metricType}/{metricName}/{metricValue}", traced("UpdateMetric", h.UpdateMetricHandler()))
+		r.Post("/update", traced("UpdateMetricJSON", h.UpdateMetricJSONHandler()))
+		r.Post("/updates", traced("UpdateBatch", h.UpdateBatchHandler()))
+		r.Post("/api/v1/write", traced("RemoteWrite", h.RemoteWriteHandler()))
+		r.Post("/v1/metrics", traced("OTLPMetrics", h.OTLPMetricsHandler()))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(mw.AuthMiddleware(h.auth, auth.ScopeRead, h.logger))
+		r.Group(func(r chi.Router) {
+			r.Use(mw.ConcurrencyMiddleware(h.limits.storage, h.logger))
+			r.Use(h.verified()...)
+			r.Post("/value", traced("GetMetricJSON", h.GetMetricJSONHandler()))
+			r.Get("/value/{metricType}/{metricName}", traced("GetMetric", h.GetMetricHandler()))
+			r.Get("/query", traced("Query", h.QueryHandler()))
+			r.Post("/query", traced("Query", h.QueryHandler()))
+			r.Get("/", traced("ListMetrics", h.ListMetricsHandler()))
+		})
+		r.With(h.verified()...).Get("/stream", traced("Stream", h.StreamHandler()))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(mw.AuthMiddleware(h.auth, auth.ScopeAdmin, h.logger))
+		r.Use(h.verified()...)
+		r.Get("/audit/stats", traced("AuditStats", h.AuditStatsHandler()))
+		r.Get("/debug/metrics", traced("SelfMetrics", h.SelfMetricsHandler()))
+		if h.debug != nil {
+			r.Handle("/debug/pprof", h.debug)
+			r.Handle("/debug/pprof/*", h.debug)
+			r.Get("/debug/vars", h.debug.ServeHTTP)
+			r.Get("/debug/profile", h.debug.ServeHTTP)
+		}
+	})
+	r.With(h.verified()...).Get("/ping", traced("Ping", h.PingHandler()))
+	r.With(h.verified()...).Get("/dashboard", traced("Dashboard", h.DashboardHandler()))
 	return r
 }
+
+// verified returns the middlewares verifying the signature of the request and signing the response,
+// then decompressing the request and compressing the response.
+func (h *Handler) verified() []func(http.Handler) http.Handler {
+	return []func(http.Handler) http.Handler{
+		mw.HashMiddleware(h.keys, h.agents, h.replay, h.signReq, h.signs, h.logger),
+		mw.MiddlewareGzip(h.limits.maxDecompressed, h.logger),
+	}
+}
+
+// traced runs the handler in a span named after it, a child of the server span of the request.
+func traced(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "handler."+name)
+		defer span.End()
+		h(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// accessLogSamplings are the access log samplings the router benchmarks run with.
+var accessLogSamplings = []struct {
+	name     string
+	sampling int
+}{
+	{"every_request", 1},
+	{"sampled_100", 100},
+}
+
+// benchLogger logs at the info level of the server to io.Discard, so that the cost of the entries is measured without the output.
+func benchLogger() *zap.SugaredLogger {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), zap.InfoLevel)
+	return zap.New(core, zap.AddCaller()).Sugar()
+}
+
+// benchRouter returns the router of a handler over the memory storage, without hashing and authentication.
+func benchRouter(b *testing.B, sampling int) http.Handler {
+	logger := benchLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	auditor := audit.NewAuditor(logger, "", "")
+	go auditor.Run(ctx)
+	return NewHandler(mstorage.NewMemStorage(), "", auditor, logger).WithAccessLogSampling(sampling).NewRouter()
+}
+
+// benchServe sends the requests of newReq to the router and checks that they succeed.
+func benchServe(b *testing.B, router http.Handler, newReq func() *http.Request) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newReq())
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
+
+// BenchmarkRouter_Update measures a request to the update routes through all the middlewares of the router.
+func BenchmarkRouter_Update(b *testing.B) {
+	body := []byte(`{"id":"Alloc","type":"gauge","value":123.45}`)
+	for _, s := range accessLogSamplings {
+		b.Run("URL/"+s.name, func(b *testing.B) {
+			benchServe(b, benchRouter(b, s.sampling), func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil)
+			})
+		})
+		b.Run("JSON/"+s.name, func(b *testing.B) {
+			benchServe(b, benchRouter(b, s.sampling), func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			})
+		})
+	}
+}
+
+// BenchmarkRouter_Updates measures a batch of 10 metrics sent to /updates through all the middlewares of the router.
+func BenchmarkRouter_Updates(b *testing.B) {
+	metrics := make([]models.Metrics, 10)
+	for i := range metrics {
+		if i%2 == 0 {
+			value := float64(i)
+			metrics[i] = models.Metrics{ID: "gauge_" + strconv.Itoa(i), MType: models.Gauge, Value: &value}
+		} else {
+			delta := int64(i)
+			metrics[i] = models.Metrics{ID: "counter_" + strconv.Itoa(i), MType: models.Counter, Delta: &delta}
+		}
+	}
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, s := range accessLogSamplings {
+		b.Run(s.name, func(b *testing.B) {
+			benchServe(b, benchRouter(b, s.sampling), func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			})
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/auth"
+	authcfg "github.com/devize-ed/yapracproj-metrics.git/internal/auth/config"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/diagnostics"
+	limitcfg "github.com/devize-ed/yapracproj-metrics.git/internal/limit/config"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+)
+
+func TestRouter_Auth(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auditor := audit.NewAuditor(logger, "", "")
+	go auditor.Run(ctx)
+	records, unsubscribe, err := auditor.Subscribe(ctx, 8)
+	require.NoError(t, err)
+	defer unsubscribe()
+
+	store, err := auth.NewStaticStore([]authcfg.TokenConfig{
+		{ID: "agent", Hash: auth.HashToken("write-token"), Scopes: []string{auth.ScopeWrite}},
+		{ID: "grafana", Hash: auth.HashToken("read-token"), Scopes: []string{auth.ScopeRead}},
+		{ID: "ops", Hash: auth.HashToken("admin-token"), Scopes: []string{auth.ScopeAdmin}},
+	})
+	require.NoError(t, err)
+	h := NewHandler(mstorage.NewMemStorage(), "", auditor, logger).
+		WithAuthenticator(auth.NewAuthenticator(store)).
+		WithDiagnostics(diagnostics.NewHandler("metrics-test"))
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{name: "ping_is_open", method: http.MethodGet, path: "/ping", wantStatus: http.StatusOK},
+		{name: "update_without_token", method: http.MethodPost, path: "/update/counter/PollCount/1", wantStatus: http.StatusUnauthorized},
+		{name: "update_with_read_token", method: http.MethodPost, path: "/update/counter/PollCount/1", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "update_with_write_token", method: http.MethodPost, path: "/update/counter/PollCount/1", token: "write-token", wantStatus: http.StatusOK},
+		{name: "value_without_token", method: http.MethodGet, path: "/value/counter/PollCount", wantStatus: http.StatusUnauthorized},
+		{name: "value_with_write_token", method: http.MethodGet, path: "/value/counter/PollCount", token: "write-token", wantStatus: http.StatusForbidden},
+		{name: "value_with_read_token", method: http.MethodGet, path: "/value/counter/PollCount", token: "read-token", wantStatus: http.StatusOK},
+		{name: "stats_with_read_token", method: http.MethodGet, path: "/audit/stats", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "stats_with_admin_token", method: http.MethodGet, path: "/audit/stats", token: "admin-token", wantStatus: http.StatusOK},
+		{name: "value_with_admin_token", method: http.MethodGet, path: "/value/counter/PollCount", token: "admin-token", wantStatus: http.StatusOK},
+		{name: "vars_without_token", method: http.MethodGet, path: "/debug/vars", wantStatus: http.StatusUnauthorized},
+		{name: "vars_with_read_token", method: http.MethodGet, path: "/debug/vars", token: "read-token", wantStatus: http.StatusForbidden},
+		{name: "vars_with_admin_token", method: http.MethodGet, path: "/debug/vars", token: "admin-token", wantStatus: http.StatusOK},
+		{name: "pprof_with_write_token", method: http.MethodGet, path: "/debug/pprof/", token: "write-token", wantStatus: http.StatusForbidden},
+		{name: "pprof_with_admin_token", method: http.MethodGet, path: "/debug/pprof/", token: "admin-token", wantStatus: http.StatusOK},
+		{name: "goroutines_with_admin_token", method: http.MethodGet, path: "/debug/pprof/goroutine?debug=1", token: "admin-token", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := resty.New().R()
+			if tt.token != "" {
+				req.SetAuthToken(tt.token)
+			}
+			resp, err := req.Execute(tt.method, srv.URL+tt.path)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+		})
+	}
+
+	// Only the authorized update is audited, with the ID of its token.
+	select {
+	case msg := <-records:
+		assert.Equal(t, "agent", msg.TokenID)
+	case <-time.After(time.Second):
+		t.Fatal("no audit record received")
+	}
+	select {
+	case msg := <-records:
+		t.Fatalf("unexpected audit record %+v", msg)
+	default:
+	}
+}
+
+func TestRouter_DashboardWithAuth(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	store, err := auth.NewStaticStore([]authcfg.TokenConfig{
+		{ID: "grafana", Hash: auth.HashToken("read-token"), Scopes: []string{auth.ScopeRead}},
+	})
+	require.NoError(t, err)
+	ms := mstorage.NewMemStorage()
+	delta := int64(3)
+	require.NoError(t, ms.AddCounter(context.Background(), "PollCount", &delta))
+	h := NewHandler(ms, "", audit.NewAuditor(logger, "", ""), logger).WithAuthenticator(auth.NewAuthenticator(store))
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	// The page is served without a token and without the metrics, it asks for the token.
+	resp, err := resty.New().R().SetHeader("Accept", "text/html").Get(srv.URL + "/dashboard")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.String(), `id="token"`)
+	assert.NotContains(t, resp.String(), "PollCount")
+
+	// The refresh of the page needs the token.
+	resp, err = resty.New().R().SetHeader("Accept", "application/json").Get(srv.URL + "/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	resp, err = resty.New().R().SetHeader("Accept", "application/json").SetAuthToken("read-token").Get(srv.URL + "/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `[{"id":"PollCount","type":"counter","delta":3}]`, resp.String())
+
+	// Without auth the page does not ask for a token.
+	open := httptest.NewServer(NewHandler(ms, "", audit.NewAuditor(logger, "", ""), logger).NewRouter())
+	defer open.Close()
+	resp, err = resty.New().R().Get(open.URL + "/dashboard")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotContains(t, resp.String(), `id="token"`)
+}
+
+func TestRouter_Limits(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	h := NewHandler(mstorage.NewMemStorage(), "", audit.NewAuditor(logger, "", ""), logger).
+		WithLimits(limitcfg.LimitConfig{MaxBodySize: 64, IPRate: 1, IPBurst: 3})
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	// The body above the limit is rejected before it is read.
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(`[{"id":"` + strings.Repeat("x", 64) + `","type":"counter","delta":1}]`).
+		Post(srv.URL + "/updates/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode())
+
+	// The rejected request counted, the burst of the client IP address is left with two requests.
+	for i := 0; i < 2; i++ {
+		resp, err = resty.New().R().Get(srv.URL + "/ping")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode(), "request %d", i)
+	}
+	resp, err = resty.New().R().Get(srv.URL + "/ping")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+}
+
+func TestRouter_SelfMetrics(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	auditor := audit.NewAuditor(logger, "", "")
+	h := NewHandler(mstorage.NewMemStorage(), "", auditor, logger).
+		WithSelfMetrics(selfmetrics.NewRegistry(auditor))
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	for _, path := range []string{"/ping", "/ping", "/value/counter/missing", "/unknown/path"} {
+		_, err := resty.New().R().Get(srv.URL + path)
+		require.NoError(t, err)
+	}
+
+	// The requests are counted per route and status class, with the metrics of the auditor.
+	var metrics []models.Metrics
+	resp, err := resty.New().R().SetResult(&metrics).Get(srv.URL + "/debug/metrics")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	counters := map[string]int64{}
+	for _, m := range metrics {
+		assert.True(t, strings.HasPrefix(m.ID, selfmetrics.Namespace), m.ID)
+		if m.MType == models.Counter {
+			counters[m.ID] = *m.Delta
+		}
+	}
+	assert.Equal(t, int64(2), counters["_server.http.requests.get.ping.2xx"])
+	assert.Equal(t, int64(1), counters["_server.http.requests.get.value.metricType.metricName.4xx"])
+	assert.Equal(t, int64(1), counters["_server.http.requests.unmatched.4xx"])
+	assert.Contains(t, counters, "_server.audit.dropped")
+
+	// The diagnostics endpoints are not served unless they are enabled.
+	resp, err = resty.New().R().Get(srv.URL + "/debug/vars")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
+
+func TestRouter_ReservedNames(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	ms := mstorage.NewMemStorage()
+	reg := selfmetrics.NewRegistry()
+	h := NewHandler(ms, "", audit.NewAuditor(logger, "", ""), logger).WithSelfMetrics(reg)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	// The user metrics cannot be written under the namespace of the self-metrics.
+	requests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "text", path: "/update/counter/_server.http.requests.get.ping.2xx/100", wantStatus: http.StatusBadRequest},
+		{name: "json", path: "/update", contentType: "application/json", body: `{"id":"_server.audit.dropped","type":"counter","delta":1}`, wantStatus: http.StatusBadRequest},
+		{
+			name:        "batch",
+			path:        "/updates",
+			contentType: "application/json",
+			body:        `[{"id":"Alloc","type":"gauge","value":1},{"id":"_server.audit.spooled","type":"gauge","value":1}]`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "otlp",
+			path:        "/v1/metrics",
+			contentType: "application/json",
+			body:        `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"_server.audit.spooled","gauge":{"dataPoints":[{"asInt":"7"}]}}]}]}]}`,
+			wantStatus:  http.StatusOK,
+		},
+	}
+	for _, tt := range requests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().SetHeader("Content-Type", tt.contentType).SetBody(tt.body).Post(srv.URL + tt.path)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+			if tt.wantStatus == http.StatusOK {
+				assert.Contains(t, resp.String(), `"rejectedDataPoints":"1"`)
+			}
+		})
+	}
+	metrics, err := ms.ListMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, metrics, "no metric of a rejected request is saved")
+
+	// The ingested self-metrics are named after the routes and can be read back.
+	_, err = resty.New().R().Get(srv.URL + "/ping")
+	require.NoError(t, err)
+	require.NoError(t, selfmetrics.NewIngester(reg, ms, time.Minute, logger).Ingest(context.Background()))
+	resp, err := resty.New().R().Get(srv.URL + "/value/counter/_server.http.requests.get.ping.2xx")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "1", resp.String())
+	resp, err = resty.New().R().Get(srv.URL + "/value/counter/_server.http.requests.post.update.metricType.metricName.metricValue.4xx")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "1", resp.String())
+}
+
+func TestRouter_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	logger := zap.NewNop().Sugar()
+	h := NewHandler(repository.WithTracing(mstorage.NewMemStorage()), "secret", audit.NewAuditor(logger, "", ""), logger)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	// The request continues the trace of the client.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	resp, err := resty.New().R().
+		SetHeader("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01").
+		SetHeader(sign.HashHeader, sign.Hash(body, "secret")).
+		SetBody(body).
+		Post(srv.URL + "/updates/")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		assert.Equal(t, traceID, s.SpanContext.TraceID().String(), s.Name)
+		spans[s.Name] = s
+	}
+	require.Contains(t, spans, "POST /updates")
+	server := spans["POST /updates"]
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+
+	// The stages, the handler and the repository call are nested in the server span.
+	parents := map[string]string{
+		"middleware.hash":        "POST /updates",
+		"middleware.gzip":        "POST /updates",
+		"handler.UpdateBatch":    "middleware.gzip",
+		"repository.UpdateBatch": "handler.UpdateBatch",
+	}
+	for name, parent := range parents {
+		require.Contains(t, spans, name)
+		assert.Equal(t, spans[parent].SpanContext.SpanID(), spans[name].Parent.SpanID(), name)
+	}
+}
+
+func TestRouter_SignDefault(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	key := "secret"
+	jsonBody := `{"id":"Alloc","type":"gauge","value":1}`
+	otlpBody := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"queue.size","gauge":{"dataPoints":[{"asInt":"7"}]}}]}]}]}`
+
+	tests := []struct {
+		name         string
+		required     bool
+		wantStatus   int
+		wantUnsigned int64
+		wantLegacy   int64
+	}{
+		// By default the text API, the older agents and the ingest senders keep working and are counted.
+		{name: "legacy_accepted_by_default", wantStatus: http.StatusOK, wantUnsigned: 2, wantLegacy: 1},
+		{name: "required", required: true, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(mstorage.NewMemStorage(), key, audit.NewAuditor(logger, "", ""), logger).WithSignRequired(tt.required)
+			srv := httptest.NewServer(h.NewRouter())
+			defer srv.Close()
+
+			// Unsigned text update.
+			resp, err := resty.New().R().Post(srv.URL + "/update/counter/PollCount/1")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+
+			// HMAC over the body only, as by the older agents.
+			resp, err = resty.New().R().
+				SetHeader("Content-Type", "application/json").
+				SetHeader(sign.HashHeader, sign.Hash([]byte(jsonBody), key)).
+				SetBody(jsonBody).
+				Post(srv.URL + "/update")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+
+			// Unsigned OTLP export, the OTLP senders cannot sign with replay protection.
+			resp, err = resty.New().R().SetHeader("Content-Type", "application/json").SetBody(otlpBody).Post(srv.URL + "/v1/metrics")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode())
+
+			stats := map[string]int64{}
+			for _, m := range h.signs.Collect() {
+				stats[m.ID] = *m.Delta
+			}
+			assert.Equal(t, tt.wantUnsigned, stats["sign.unsigned_posts"])
+			assert.Equal(t, tt.wantLegacy, stats["sign.legacy_posts"])
+		})
+	}
+}
+
+// flakyStore is a token store failing while down is set.
+type flakyStore struct {
+	auth.Store
+	down atomic.Bool
+}
+
+func (s *flakyStore) Lookup(ctx context.Context, hash string) (auth.Token, error) {
+	if s.down.Load() {
+		return auth.Token{}, errors.New("token database is down")
+	}
+	return s.Store.Lookup(ctx, hash)
+}
+
+func TestRouter_RetryKeepsNonce(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	key := "secret"
+	static, err := auth.NewStaticStore([]authcfg.TokenConfig{
+		{ID: "agent", Hash: auth.HashToken("write-token"), Scopes: []string{auth.ScopeWrite}},
+	})
+	require.NoError(t, err)
+	store := &flakyStore{Store: static}
+	store.down.Store(true)
+	h := NewHandler(mstorage.NewMemStorage(), key, audit.NewAuditor(logger, "", ""), logger).
+		WithAuthenticator(auth.NewAuthenticator(store)).
+		WithReplayGuard(sign.NewReplayGuard(time.Minute, 100))
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	// The retry of a request refused with 503 carries the same nonce, as sent by the agent.
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	nonce, err := sign.NewNonce()
+	require.NoError(t, err)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	send := func() *resty.Response {
+		resp, err := resty.New().R().
+			SetAuthToken("write-token").
+			SetHeader("Content-Type", "application/json").
+			SetHeader(sign.TimestampHeader, timestamp).
+			SetHeader(sign.NonceHeader, nonce).
+			SetHeader(sign.HashHeader, sign.Hash(sign.CanonicalRequest(http.MethodPost, "/updates", timestamp, nonce, body), key)).
+			SetBody(body).
+			Post(srv.URL + "/updates")
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, send().StatusCode())
+	store.down.Store(false)
+	assert.Equal(t, http.StatusOK, send().StatusCode(), "the refused request must not use up its nonce")
+	assert.Equal(t, http.StatusBadRequest, send().StatusCode(), "the processed request is a replay")
+}
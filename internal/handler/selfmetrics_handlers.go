@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SelfMetricsHandler returns the self-metrics of the server as a JSON array of metrics, the counters as totals.
+func (h *Handler) SelfMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := json.Marshal(h.self.Snapshot())
+		if err != nil {
+			h.log(r).Debug("Cannot encode response JSON:", err)
+			http.Error(w, "Cannot encode response JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(resp); err != nil {
+			h.log(r).Debug("Failed to write response body:", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/query"
+	"go.uber.org/zap"
+)
+
+// streamBufferSize is the number of updates buffered for a stream client, a client falling further behind is dropped.
+const streamBufferSize = 64
+
+// streamKeepAlive is the interval of the keep-alive comments keeping idle connections open through proxies.
+const streamKeepAlive = 15 * time.Second
+
+// streamEvent is the data of an update event.
+type streamEvent struct {
+	TimeStamp time.Time        `json:"ts"`
+	Metrics   []models.Metrics `json:"metrics"`
+}
+
+// StreamHandler streams the metric updates as Server-Sent Events.
+// The updates come from the auditor with the new values of the metrics, the optional URL parameters filter them
+// by name (name, regex) and type (type).
+func (h *Handler) StreamHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// Parse the filters.
+		params := r.URL.Query()
+		metricType := params.Get("type")
+		switch metricType {
+		case "", models.Gauge, models.Counter:
+		default:
+			http.Error(w, "Invalid metric type", http.StatusBadRequest)
+			return
+		}
+		var match *regexp.Regexp
+		if name := params.Get("name"); name != "" {
+			regex, _ := strconv.ParseBool(params.Get("regex"))
+			pattern, err := query.Pattern(models.Query{Pattern: name, Regex: regex})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			match = regexp.MustCompile(pattern)
+		}
+
+		// Subscribe to the updates.
+		updates, cancel, err := h.auditor.Subscribe(r.Context(), streamBufferSize)
+		if err != nil {
+			h.log(r).Debug("Cannot subscribe to the updates", zap.Error(err))
+			http.Error(w, "stream is not available", http.StatusServiceUnavailable)
+			return
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := time.NewTicker(streamKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case msg, ok := <-updates:
+				// The subscription is closed when the client is too slow or the server stops.
+				if !ok {
+					h.log(r).Debugf("stream of %s is closed", r.RemoteAddr)
+					return
+				}
+				metrics := streamMetrics(msg.Changes, metricType, match)
+				if len(metrics) == 0 {
+					continue
+				}
+				data, err := json.Marshal(streamEvent{TimeStamp: msg.TimeStamp, Metrics: metrics})
+				if err != nil {
+					h.log(r).Debug("Cannot encode stream event:", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: update\ndata: %s\n\n", data); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// streamMetrics returns the new values of the changed metrics matching the filters.
+func streamMetrics(changes []models.MetricChange, metricType string, match *regexp.Regexp) []models.Metrics {
+	var metrics []models.Metrics
+	for _, c := range changes {
+		if metricType != "" && c.MType != metricType {
+			continue
+		}
+		if match != nil && !match.MatchString(c.ID) {
+			continue
+		}
+		switch {
+		case c.MType == models.Gauge && c.NewValue != nil:
+			metrics = append(metrics, models.Metrics{ID: c.ID, MType: models.Gauge, Value: c.NewValue})
+		case c.MType == models.Counter && c.NewDelta != nil:
+			metrics = append(metrics, models.Metrics{ID: c.ID, MType: models.Counter, Delta: c.NewDelta})
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// readEvents sends the data of the SSE update events of the gzipped stream to the channel.
+func readEvents(resp *http.Response, events chan<- streamEvent) {
+	defer close(events)
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e streamEvent
+		if err := json.Unmarshal([]byte(data), &e); err == nil {
+			events <- e
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	auditor := audit.NewAuditor(logger, "", "")
+	go auditor.Run(ctx)
+	h := NewHandler(mstorage.NewMemStorage(), "", auditor, logger)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	// The gzip middleware wraps the response, the events must still be flushed one by one.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/stream?name=Alloc*&type=gauge", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	events := make(chan streamEvent, 8)
+	go readEvents(resp, events)
+
+	// Filtered out updates are not streamed, the subscription may be registered after the first update.
+	batch := `[{"id":"PollCount","type":"counter","delta":1},{"id":"HeapAlloc","type":"gauge","value":1},` +
+		`{"id":"AllocBytes","type":"gauge","value":2.5},{"id":"AllocBytes","type":"counter","delta":3}]`
+	var got streamEvent
+	require.Eventually(t, func() bool {
+		_, err := resty.New().R().SetHeader("Content-Type", "application/json").SetBody(batch).Post(srv.URL + "/updates")
+		require.NoError(t, err)
+		select {
+		case got = <-events:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Len(t, got.Metrics, 1)
+	assert.Equal(t, "AllocBytes", got.Metrics[0].ID)
+	assert.Equal(t, models.Gauge, got.Metrics[0].MType)
+	require.NotNil(t, got.Metrics[0].Value)
+	assert.Equal(t, 2.5, *got.Metrics[0].Value)
+}
+
+func TestStreamHandler_InvalidFilters(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	h := NewHandler(mstorage.NewMemStorage(), "", audit.NewAuditor(logger, "", ""), logger)
+	srv := httptest.NewServer(h.NewRouter())
+	defer srv.Close()
+
+	for _, params := range []string{"type=histogram", "name=(&regex=true"} {
+		resp, err := resty.New().R().Get(srv.URL + "/stream?" + params)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode(), params)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	delta, value := int64(5), 2.5
+	changes := []models.MetricChange{
+		{ID: "PollCount", MType: models.Counter, NewDelta: &delta},
+		{ID: "Alloc", MType: models.Gauge, NewValue: &value},
+		{ID: "Broken", MType: models.Gauge},
+	}
+	tests := []struct {
+		name       string
+		metricType string
+		match      *regexp.Regexp
+		want       []string
+	}{
+		{name: "all", want: []string{"PollCount", "Alloc"}},
+		{name: "type", metricType: models.Counter, want: []string{"PollCount"}},
+		{name: "name", match: regexp.MustCompile(`^Al`), want: []string{"Alloc"}},
+		{name: "none", metricType: models.Gauge, match: regexp.MustCompile(`^Poll`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range streamMetrics(changes, tt.metricType, tt.match) {
+				got = append(got, m.ID)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	metrics := streamMetrics(changes, "", nil)
+	assert.Equal(t, delta, *metrics[0].Delta)
+	assert.Equal(t, value, *metrics[1].Value)
+}
@@ -0,0 +1,41 @@
+// Package ingest provides decoders for third-party metric protocols.
+// It converts Prometheus remote-write and OTLP payloads into the metrics model.
+package ingest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label is a name-value pair attached to a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// SeriesName builds a metric ID from the name and labels in the Prometheus text format,
+// e.g. `http_requests_total{code="200",method="GET"}`. Labels are sorted by name, so the
+// same series always maps to the same ID. A series without labels keeps the plain name.
+func SeriesName(name string, labels []Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,548 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Aggregation temporality of OTLP sums.
+const (
+	TemporalityUnspecified = 0
+	TemporalityDelta       = 1
+	TemporalityCumulative  = 2
+)
+
+// Kinds of supported OTLP metrics.
+const (
+	otlpKindGauge = "gauge"
+	otlpKindSum   = "sum"
+)
+
+// otlpTemporalityPrefix is the prefix of the temporality enum names in the JSON encoding.
+const otlpTemporalityPrefix = "AGGREGATION_TEMPORALITY_"
+
+// otlpIdleTimeout is the time after which the state of a cumulative sum that received no point is forgotten,
+// the next point of the series is then compared with the stored counter.
+const otlpIdleTimeout = time.Hour
+
+// otlpSweepInterval is the minimal interval between the removals of the idle cumulative states.
+const otlpSweepInterval = 10 * time.Minute
+
+// Field numbers of the OTLP ExportMetricsServiceRequest message and its children.
+const (
+	exportResourceMetrics protowire.Number = 1
+	resourceScopeMetrics  protowire.Number = 2
+	scopeMetrics          protowire.Number = 2
+
+	metricName  protowire.Number = 1
+	metricGauge protowire.Number = 5
+	metricSum   protowire.Number = 7
+
+	gaugeDataPoints protowire.Number = 1
+	sumDataPoints   protowire.Number = 1
+	sumTemporality  protowire.Number = 2
+	sumMonotonic    protowire.Number = 3
+
+	pointStartTime  protowire.Number = 2
+	pointTime       protowire.Number = 3
+	pointAsDouble   protowire.Number = 4
+	pointAsInt      protowire.Number = 6
+	pointAttributes protowire.Number = 7
+
+	responsePartialSuccess protowire.Number = 1
+	partialRejectedPoints  protowire.Number = 1
+	partialErrorMessage    protowire.Number = 2
+
+	keyValueKey   protowire.Number = 1
+	keyValueValue protowire.Number = 2
+
+	anyValueString protowire.Number = 1
+	anyValueBool   protowire.Number = 2
+	anyValueInt    protowire.Number = 3
+	anyValueDouble protowire.Number = 4
+)
+
+// OTLPMetric is a decoded OTLP gauge or sum with its number data points.
+// Histograms, summaries and other kinds are not supported and are skipped on decoding.
+type OTLPMetric struct {
+	Name        string
+	Kind        string // "gauge" or "sum"
+	Monotonic   bool   // the sum only grows
+	Temporality int    // aggregation temporality of the sum
+	Points      []OTLPPoint
+}
+
+// OTLPPoint is a single number data point.
+type OTLPPoint struct {
+	Labels    []Label // data point attributes
+	StartTime uint64  // start of the cumulative series, ns since epoch
+	Time      uint64  // timestamp of the point, ns since epoch
+	Value     float64
+}
+
+// cumulativeState is the last seen value of a cumulative sum.
+type cumulativeState struct {
+	start uint64
+	value float64
+	seen  time.Time // time of the export of the value
+}
+
+// OTLPReceiver converts OTLP metric exports into counters and gauges.
+// Monotonic sums are stored as counters: delta points are added as is, cumulative points are
+// converted into increments against the last value seen for the series (the first point and
+// the first point after a reset are added in full). A series without a last value, forgotten after
+// otlpIdleTimeout or lost with a restart of the server, continues from its stored counter.
+// Monotonic sums without a temporality and the metrics named under the namespace of the self-metrics are rejected.
+// Non-monotonic sums and gauges are stored as gauges.
+type OTLPReceiver struct {
+	mu         sync.Mutex
+	cumulative map[string]cumulativeState // last value of cumulative sums by metric ID
+	swept      time.Time                  // time of the last removal of the idle states
+	now        func() time.Time
+}
+
+// NewOTLPReceiver creates a new OTLP receiver.
+func NewOTLPReceiver() *OTLPReceiver {
+	return &OTLPReceiver{
+		cumulative: make(map[string]cumulativeState),
+		now:        time.Now,
+	}
+}
+
+// Store converts the metrics and saves them with SaveBatch, it returns the saved metrics and the number of
+// rejected data points.
+// The cumulative state is updated only when the batch is saved, so a retried export is not lost.
+func (o *OTLPReceiver) Store(ctx context.Context, storage repository.Repository, metrics []OTLPMetric) ([]models.Metrics, int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	counters := make(map[string]float64)
+	gauges := make(map[string]OTLPPoint)
+	updates := make(map[string]cumulativeState)
+	var rejected int64
+
+	for _, m := range metrics {
+		for _, p := range m.Points {
+			if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+				continue
+			}
+			id := SeriesName(m.Name, p.Labels)
+			if selfmetrics.CheckName(id) != nil {
+				// The namespace of the self-metrics is reserved for the server.
+				rejected++
+				continue
+			}
+			if m.Kind == otlpKindGauge || !m.Monotonic {
+				// Keep the latest point of the gauge.
+				if prev, ok := gauges[id]; !ok || prev.Time <= p.Time {
+					gauges[id] = p
+				}
+				continue
+			}
+			switch m.Temporality {
+			case TemporalityCumulative:
+				prev, ok := updates[id]
+				if !ok {
+					prev, ok = o.cumulative[id]
+					ok = ok && now.Sub(prev.seen) < otlpIdleTimeout
+				}
+				if !ok {
+					// The stored counter holds the last value of a series seen before.
+					stored, err := storage.GetCounter(ctx, id)
+					switch {
+					case err == nil:
+						prev, ok = cumulativeState{start: p.StartTime, value: float64(*stored)}, true
+					case !errors.Is(err, models.ErrNotFound):
+						return nil, rejected, fmt.Errorf("failed to read OTLP counter %s: %w", id, err)
+					}
+				}
+				delta := p.Value
+				// The same series continues, otherwise it was reset and starts over from zero.
+				if ok && prev.start == p.StartTime && p.Value >= prev.value {
+					delta = p.Value - prev.value
+				}
+				counters[id] += delta
+				updates[id] = cumulativeState{start: p.StartTime, value: p.Value, seen: now}
+			case TemporalityDelta:
+				counters[id] += p.Value
+			default:
+				// Without a temporality the value can be neither added nor converted.
+				rejected++
+			}
+		}
+	}
+
+	batch := make([]models.Metrics, 0, len(counters)+len(gauges))
+	for id, v := range counters {
+		delta := int64(math.Round(v))
+		batch = append(batch, models.Metrics{ID: id, MType: models.Counter, Delta: &delta})
+	}
+	for id, p := range gauges {
+		value := p.Value
+		batch = append(batch, models.Metrics{ID: id, MType: models.Gauge, Value: &value})
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+	if len(batch) == 0 {
+		return batch, rejected, nil
+	}
+
+	if err := storage.SaveBatch(ctx, batch); err != nil {
+		return nil, rejected, fmt.Errorf("failed to save OTLP batch: %w", err)
+	}
+	for id, s := range updates {
+		o.cumulative[id] = s
+	}
+	o.sweep(now)
+	return batch, rejected, nil
+}
+
+// sweep removes the states of the cumulative sums idle for otlpIdleTimeout, at most once per otlpSweepInterval.
+func (o *OTLPReceiver) sweep(now time.Time) {
+	if now.Sub(o.swept) < otlpSweepInterval {
+		return
+	}
+	o.swept = now
+	for id, s := range o.cumulative {
+		if now.Sub(s.seen) >= otlpIdleTimeout {
+			delete(o.cumulative, id)
+		}
+	}
+}
+
+// EncodeOTLPResponseProto encodes the protobuf ExportMetricsServiceResponse, with a partial success
+// when data points were rejected.
+func EncodeOTLPResponseProto(rejected int64, message string) []byte {
+	if rejected == 0 {
+		return nil
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, partialRejectedPoints, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, partialErrorMessage, protowire.BytesType)
+	partial = protowire.AppendString(partial, message)
+
+	var b []byte
+	b = protowire.AppendTag(b, responsePartialSuccess, protowire.BytesType)
+	return protowire.AppendBytes(b, partial)
+}
+
+// EncodeOTLPResponseJSON encodes the JSON ExportMetricsServiceResponse, with a partial success
+// when data points were rejected.
+func EncodeOTLPResponseJSON(rejected int64, message string) []byte {
+	if rejected == 0 {
+		return []byte(`{}`)
+	}
+	// The 64-bit integers are strings in the protobuf JSON mapping.
+	b, _ := json.Marshal(map[string]any{
+		"partialSuccess": map[string]string{
+			"rejectedDataPoints": strconv.FormatInt(rejected, 10),
+			"errorMessage":       message,
+		},
+	})
+	return b
+}
+
+// DecodeOTLPProto decodes a protobuf-encoded ExportMetricsServiceRequest.
+func DecodeOTLPProto(b []byte) ([]OTLPMetric, error) {
+	var metrics []OTLPMetric
+	err := walkMessage(b, func(rm field) error {
+		if rm.num != exportResourceMetrics || rm.typ != protowire.BytesType {
+			return nil
+		}
+		return walkMessage(rm.bytes, func(sm field) error {
+			if sm.num != resourceScopeMetrics || sm.typ != protowire.BytesType {
+				return nil
+			}
+			return walkMessage(sm.bytes, func(mf field) error {
+				if mf.num != scopeMetrics || mf.typ != protowire.BytesType {
+					return nil
+				}
+				m, err := decodeOTLPMetric(mf.bytes)
+				if err != nil {
+					return err
+				}
+				if m.Kind != "" {
+					metrics = append(metrics, m)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode OTLP request: %w", err)
+	}
+	return metrics, nil
+}
+
+// decodeOTLPMetric decodes an OTLP Metric message, unsupported kinds are left with an empty Kind.
+func decodeOTLPMetric(b []byte) (OTLPMetric, error) {
+	var m OTLPMetric
+	err := walkMessage(b, func(f field) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case metricName:
+			m.Name = string(f.bytes)
+		case metricGauge:
+			m.Kind = otlpKindGauge
+			return walkMessage(f.bytes, func(pf field) error {
+				if pf.num != gaugeDataPoints || pf.typ != protowire.BytesType {
+					return nil
+				}
+				p, err := decodeOTLPPoint(pf.bytes)
+				m.Points = append(m.Points, p)
+				return err
+			})
+		case metricSum:
+			m.Kind = otlpKindSum
+			return walkMessage(f.bytes, func(pf field) error {
+				switch {
+				case pf.num == sumDataPoints && pf.typ == protowire.BytesType:
+					p, err := decodeOTLPPoint(pf.bytes)
+					m.Points = append(m.Points, p)
+					return err
+				case pf.num == sumTemporality && pf.typ == protowire.VarintType:
+					m.Temporality = int(pf.value)
+				case pf.num == sumMonotonic && pf.typ == protowire.VarintType:
+					m.Monotonic = protowire.DecodeBool(pf.value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return m, err
+}
+
+// decodeOTLPPoint decodes an OTLP NumberDataPoint message.
+func decodeOTLPPoint(b []byte) (OTLPPoint, error) {
+	var p OTLPPoint
+	err := walkMessage(b, func(f field) error {
+		switch {
+		case f.num == pointStartTime && f.typ == protowire.Fixed64Type:
+			p.StartTime = f.value
+		case f.num == pointTime && f.typ == protowire.Fixed64Type:
+			p.Time = f.value
+		case f.num == pointAsDouble && f.typ == protowire.Fixed64Type:
+			p.Value = math.Float64frombits(f.value)
+		case f.num == pointAsInt && f.typ == protowire.Fixed64Type:
+			p.Value = float64(int64(f.value))
+		case f.num == pointAttributes && f.typ == protowire.BytesType:
+			l, err := decodeOTLPAttribute(f.bytes)
+			if err != nil {
+				return err
+			}
+			p.Labels = append(p.Labels, l)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// decodeOTLPAttribute decodes an OTLP KeyValue message with a scalar value.
+func decodeOTLPAttribute(b []byte) (Label, error) {
+	var l Label
+	err := walkMessage(b, func(f field) error {
+		switch {
+		case f.num == keyValueKey && f.typ == protowire.BytesType:
+			l.Name = string(f.bytes)
+		case f.num == keyValueValue && f.typ == protowire.BytesType:
+			return walkMessage(f.bytes, func(vf field) error {
+				switch {
+				case vf.num == anyValueString && vf.typ == protowire.BytesType:
+					l.Value = string(vf.bytes)
+				case vf.num == anyValueBool && vf.typ == protowire.VarintType:
+					l.Value = strconv.FormatBool(protowire.DecodeBool(vf.value))
+				case vf.num == anyValueInt && vf.typ == protowire.VarintType:
+					l.Value = strconv.FormatInt(int64(vf.value), 10)
+				case vf.num == anyValueDouble && vf.typ == protowire.Fixed64Type:
+					l.Value = strconv.FormatFloat(math.Float64frombits(vf.value), 'f', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return l, err
+}
+
+// OTLP JSON encoding (protobuf JSON mapping with lowerCamelCase names).
+type (
+	otlpJSONRequest struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []otlpJSONMetric `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+
+	otlpJSONMetric struct {
+		Name  string `json:"name"`
+		Gauge *struct {
+			DataPoints []otlpJSONPoint `json:"dataPoints"`
+		} `json:"gauge"`
+		Sum *struct {
+			DataPoints             []otlpJSONPoint `json:"dataPoints"`
+			AggregationTemporality otlpJSONEnum    `json:"aggregationTemporality"`
+			IsMonotonic            bool            `json:"isMonotonic"`
+		} `json:"sum"`
+	}
+
+	otlpJSONPoint struct {
+		Attributes []struct {
+			Key   string `json:"key"`
+			Value struct {
+				StringValue *string         `json:"stringValue"`
+				BoolValue   *bool           `json:"boolValue"`
+				IntValue    *otlpJSONNumber `json:"intValue"`
+				DoubleValue *float64        `json:"doubleValue"`
+			} `json:"value"`
+		} `json:"attributes"`
+		StartTimeUnixNano otlpJSONNumber  `json:"startTimeUnixNano"`
+		TimeUnixNano      otlpJSONNumber  `json:"timeUnixNano"`
+		AsDouble          *float64        `json:"asDouble"`
+		AsInt             *otlpJSONNumber `json:"asInt"`
+	}
+)
+
+// otlpJSONNumber is a 64-bit integer encoded either as a JSON number or a string.
+type otlpJSONNumber string
+
+// UnmarshalJSON accepts both quoted and plain numbers.
+func (n *otlpJSONNumber) UnmarshalJSON(b []byte) error {
+	*n = otlpJSONNumber(bytes.Trim(b, `"`))
+	return nil
+}
+
+func (n otlpJSONNumber) toInt64() (int64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+func (n otlpJSONNumber) toUint64() (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+// otlpJSONEnum is the aggregation temporality encoded either as an integer or as an enum name.
+type otlpJSONEnum int
+
+// UnmarshalJSON accepts both the integer value and the enum name.
+func (e *otlpJSONEnum) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		var v int
+		if err := json.Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("invalid aggregation temporality %s", b)
+		}
+		*e = otlpJSONEnum(v)
+		return nil
+	}
+	switch strings.TrimPrefix(name, otlpTemporalityPrefix) {
+	case "DELTA":
+		*e = TemporalityDelta
+	case "CUMULATIVE":
+		*e = TemporalityCumulative
+	default:
+		*e = TemporalityUnspecified
+	}
+	return nil
+}
+
+// DecodeOTLPJSON decodes a JSON-encoded ExportMetricsServiceRequest.
+func DecodeOTLPJSON(b []byte) ([]OTLPMetric, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("failed to decode OTLP request: %w", err)
+	}
+
+	var metrics []OTLPMetric
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, jm := range sm.Metrics {
+				m := OTLPMetric{Name: jm.Name}
+				var points []otlpJSONPoint
+				switch {
+				case jm.Gauge != nil:
+					m.Kind = otlpKindGauge
+					points = jm.Gauge.DataPoints
+				case jm.Sum != nil:
+					m.Kind = otlpKindSum
+					m.Monotonic = jm.Sum.IsMonotonic
+					m.Temporality = int(jm.Sum.AggregationTemporality)
+					points = jm.Sum.DataPoints
+				default:
+					continue
+				}
+				for _, jp := range points {
+					p, err := jp.point()
+					if err != nil {
+						return nil, fmt.Errorf("failed to decode OTLP data point of %s: %w", jm.Name, err)
+					}
+					m.Points = append(m.Points, p)
+				}
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// point converts the JSON data point into an OTLPPoint.
+func (jp otlpJSONPoint) point() (OTLPPoint, error) {
+	var (
+		p   OTLPPoint
+		err error
+	)
+	if p.StartTime, err = jp.StartTimeUnixNano.toUint64(); err != nil {
+		return p, err
+	}
+	if p.Time, err = jp.TimeUnixNano.toUint64(); err != nil {
+		return p, err
+	}
+	switch {
+	case jp.AsDouble != nil:
+		p.Value = *jp.AsDouble
+	case jp.AsInt != nil:
+		v, err := jp.AsInt.toInt64()
+		if err != nil {
+			return p, err
+		}
+		p.Value = float64(v)
+	}
+	for _, a := range jp.Attributes {
+		l := Label{Name: a.Key}
+		switch v := a.Value; {
+		case v.StringValue != nil:
+			l.Value = *v.StringValue
+		case v.BoolValue != nil:
+			l.Value = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != nil:
+			l.Value = string(*v.IntValue)
+		case v.DoubleValue != nil:
+			l.Value = strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+		}
+		p.Labels = append(p.Labels, l)
+	}
+	return p, nil
+}
@@ -0,0 +1,317 @@
+package ingest
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// appendMessage appends a length-delimited field to b.
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// encodeOTLPPoint encodes a NumberDataPoint with a double value and string attributes.
+func encodeOTLPPoint(p OTLPPoint) []byte {
+	var b []byte
+	for _, l := range p.Labels {
+		var v []byte
+		v = protowire.AppendTag(v, anyValueString, protowire.BytesType)
+		v = protowire.AppendString(v, l.Value)
+		var kv []byte
+		kv = protowire.AppendTag(kv, keyValueKey, protowire.BytesType)
+		kv = protowire.AppendString(kv, l.Name)
+		kv = appendMessage(kv, keyValueValue, v)
+		b = appendMessage(b, pointAttributes, kv)
+	}
+	b = protowire.AppendTag(b, pointStartTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, p.StartTime)
+	b = protowire.AppendTag(b, pointTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, p.Time)
+	b = protowire.AppendTag(b, pointAsDouble, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(p.Value))
+	return b
+}
+
+// encodeOTLPRequest encodes an ExportMetricsServiceRequest with a single resource and scope.
+func encodeOTLPRequest(metrics ...OTLPMetric) []byte {
+	var scope []byte
+	for _, m := range metrics {
+		var points []byte
+		for _, p := range m.Points {
+			points = appendMessage(points, gaugeDataPoints, encodeOTLPPoint(p))
+		}
+		var mb []byte
+		mb = protowire.AppendTag(mb, metricName, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.Name)
+		switch m.Kind {
+		case otlpKindGauge:
+			mb = appendMessage(mb, metricGauge, points)
+		case otlpKindSum:
+			points = protowire.AppendTag(points, sumTemporality, protowire.VarintType)
+			points = protowire.AppendVarint(points, uint64(m.Temporality))
+			points = protowire.AppendTag(points, sumMonotonic, protowire.VarintType)
+			points = protowire.AppendVarint(points, protowire.EncodeBool(m.Monotonic))
+			mb = appendMessage(mb, metricSum, points)
+		default:
+			// Histogram (field 9) without points.
+			mb = appendMessage(mb, 9, nil)
+		}
+		scope = appendMessage(scope, scopeMetrics, mb)
+	}
+	resource := appendMessage(nil, resourceScopeMetrics, scope)
+	return appendMessage(nil, exportResourceMetrics, resource)
+}
+
+func TestDecodeOTLPProto(t *testing.T) {
+	want := []OTLPMetric{
+		{
+			Name: "memory.free",
+			Kind: otlpKindGauge,
+			Points: []OTLPPoint{
+				{Labels: []Label{{"host", "a"}}, Time: 20, Value: 512},
+			},
+		},
+		{
+			Name:        "requests",
+			Kind:        otlpKindSum,
+			Monotonic:   true,
+			Temporality: TemporalityCumulative,
+			Points:      []OTLPPoint{{StartTime: 1, Time: 20, Value: 7}},
+		},
+	}
+	payload := encodeOTLPRequest(append(want, OTLPMetric{Name: "latency", Kind: "histogram"})...)
+
+	got, err := DecodeOTLPProto(payload)
+	require.NoError(t, err)
+	assert.Equal(t, want, got, "histograms should be skipped")
+
+	_, err = DecodeOTLPProto([]byte{0x0a, 0xff})
+	assert.Error(t, err)
+}
+
+func TestDecodeOTLPJSON(t *testing.T) {
+	payload := `{
+		"resourceMetrics": [{
+			"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+			"scopeMetrics": [{
+				"scope": {"name": "otel"},
+				"metrics": [
+					{
+						"name": "requests",
+						"sum": {
+							"aggregationTemporality": 2,
+							"isMonotonic": true,
+							"dataPoints": [{
+								"attributes": [
+									{"key": "code", "value": {"intValue": "200"}},
+									{"key": "tls", "value": {"boolValue": true}}
+								],
+								"startTimeUnixNano": "1760800000000000000",
+								"timeUnixNano": "1760800015000000000",
+								"asInt": "42"
+							}]
+						}
+					},
+					{
+						"name": "queue",
+						"sum": {
+							"aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA",
+							"dataPoints": [{"timeUnixNano": "1760800015000000000", "asDouble": 1.5}]
+						}
+					},
+					{
+						"name": "latency",
+						"histogram": {"dataPoints": [{"count": "3"}]}
+					}
+				]
+			}]
+		}]
+	}`
+
+	got, err := DecodeOTLPJSON([]byte(payload))
+	require.NoError(t, err)
+	assert.Equal(t, []OTLPMetric{
+		{
+			Name:        "requests",
+			Kind:        otlpKindSum,
+			Monotonic:   true,
+			Temporality: TemporalityCumulative,
+			Points: []OTLPPoint{{
+				Labels:    []Label{{"code", "200"}, {"tls", "true"}},
+				StartTime: 1760800000000000000,
+				Time:      1760800015000000000,
+				Value:     42,
+			}},
+		},
+		{
+			Name:        "queue",
+			Kind:        otlpKindSum,
+			Temporality: TemporalityDelta,
+			Points:      []OTLPPoint{{Time: 1760800015000000000, Value: 1.5}},
+		},
+	}, got)
+
+	_, err = DecodeOTLPJSON([]byte(`{"resourceMetrics": [`))
+	assert.Error(t, err)
+}
+
+func TestOTLPReceiver_Store(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	receiver := NewOTLPReceiver()
+
+	cumulative := func(start uint64, value float64) OTLPMetric {
+		return OTLPMetric{
+			Name:        "requests",
+			Kind:        otlpKindSum,
+			Monotonic:   true,
+			Temporality: TemporalityCumulative,
+			Points:      []OTLPPoint{{StartTime: start, Time: start + 1, Value: value}},
+		}
+	}
+
+	steps := []struct {
+		name        string
+		metrics     []OTLPMetric
+		wantCounter int64
+	}{
+		{name: "first_cumulative_point_is_added_in_full", metrics: []OTLPMetric{cumulative(1, 10)}, wantCounter: 10},
+		{name: "cumulative_point_adds_the_increase", metrics: []OTLPMetric{cumulative(1, 15)}, wantCounter: 15},
+		{name: "value_decrease_is_a_reset", metrics: []OTLPMetric{cumulative(1, 3)}, wantCounter: 18},
+		{name: "new_start_time_is_a_reset", metrics: []OTLPMetric{cumulative(100, 4)}, wantCounter: 22},
+		{
+			name: "delta_points_are_added",
+			metrics: []OTLPMetric{{
+				Name:        "requests",
+				Kind:        otlpKindSum,
+				Monotonic:   true,
+				Temporality: TemporalityDelta,
+				Points:      []OTLPPoint{{Value: 2}, {Value: 3}},
+			}},
+			wantCounter: 27,
+		},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			_, rejected, err := receiver.Store(ctx, ms, step.metrics)
+			require.NoError(t, err)
+			assert.Zero(t, rejected)
+			got, err := ms.GetCounter(ctx, "requests")
+			require.NoError(t, err)
+			assert.Equal(t, step.wantCounter, *got)
+		})
+	}
+
+	t.Run("gauges_and_non_monotonic_sums", func(t *testing.T) {
+		saved, _, err := receiver.Store(ctx, ms, []OTLPMetric{
+			{Name: "temp", Kind: otlpKindGauge, Points: []OTLPPoint{{Time: 2, Value: 20}, {Time: 1, Value: 10}}},
+			{Name: "queue", Kind: otlpKindSum, Temporality: TemporalityCumulative, Points: []OTLPPoint{{Value: -4}}},
+			{Name: "nan", Kind: otlpKindGauge, Points: []OTLPPoint{{Value: math.NaN()}}},
+		})
+		require.NoError(t, err)
+		assert.Len(t, saved, 2)
+
+		temp, err := ms.GetGauge(ctx, "temp")
+		require.NoError(t, err)
+		assert.Equal(t, 20.0, *temp, "the latest gauge point wins")
+		queue, err := ms.GetGauge(ctx, "queue")
+		require.NoError(t, err)
+		assert.Equal(t, -4.0, *queue)
+	})
+}
+
+func TestOTLPReceiver_StoreUnspecifiedTemporality(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	receiver := NewOTLPReceiver()
+
+	saved, rejected, err := receiver.Store(ctx, ms, []OTLPMetric{
+		{Name: "requests", Kind: otlpKindSum, Monotonic: true, Points: []OTLPPoint{{Value: 5}, {Value: 6}}},
+		{Name: "queue", Kind: otlpKindSum, Points: []OTLPPoint{{Value: 2}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rejected)
+	require.Len(t, saved, 1)
+	assert.Equal(t, "queue", saved[0].ID, "a non-monotonic sum is a gauge whatever its temporality")
+	_, err = ms.GetCounter(ctx, "requests")
+	assert.Error(t, err)
+}
+
+func TestOTLPReceiver_IdleState(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	receiver := NewOTLPReceiver()
+	now := time.Unix(1000, 0)
+	receiver.now = func() time.Time { return now }
+
+	store := func(name string, value float64) {
+		_, _, err := receiver.Store(ctx, ms, []OTLPMetric{{
+			Name:        name,
+			Kind:        otlpKindSum,
+			Monotonic:   true,
+			Temporality: TemporalityCumulative,
+			Points:      []OTLPPoint{{StartTime: 1, Value: value}},
+		}})
+		require.NoError(t, err)
+	}
+	store("idle", 10)
+	store("busy", 10)
+
+	// The state of a series without points for the idle timeout is removed by the next sweep.
+	now = now.Add(otlpIdleTimeout / 2)
+	store("busy", 20)
+	now = now.Add(otlpIdleTimeout / 2)
+	store("busy", 30)
+	receiver.mu.Lock()
+	assert.NotContains(t, receiver.cumulative, "idle")
+	assert.Contains(t, receiver.cumulative, "busy")
+	receiver.mu.Unlock()
+
+	// The next point of the forgotten series continues from the stored counter.
+	store("idle", 12)
+	idle, err := ms.GetCounter(ctx, "idle")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), *idle)
+
+	// A lower point after forgetting is a reset of the series, it is added in full.
+	now = now.Add(otlpIdleTimeout)
+	store("idle", 5)
+	idle, err = ms.GetCounter(ctx, "idle")
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), *idle)
+	busy, err := ms.GetCounter(ctx, "busy")
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), *busy)
+}
+
+func TestEncodeOTLPResponseProto(t *testing.T) {
+	assert.Empty(t, EncodeOTLPResponseProto(0, ""))
+
+	var (
+		rejected uint64
+		message  string
+	)
+	err := walkMessage(EncodeOTLPResponseProto(3, "rejected"), func(f field) error {
+		require.Equal(t, responsePartialSuccess, f.num)
+		return walkMessage(f.bytes, func(pf field) error {
+			switch pf.num {
+			case partialRejectedPoints:
+				rejected = pf.value
+			case partialErrorMessage:
+				message = string(pf.bytes)
+			}
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), rejected)
+	assert.Equal(t, "rejected", message)
+}
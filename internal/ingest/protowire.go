@@ -0,0 +1,50 @@
+package ingest
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field is a single decoded protobuf field.
+type field struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte // payload of length-delimited fields
+	value uint64 // payload of varint and fixed-size fields
+}
+
+// walkMessage walks the wire-encoded protobuf message and calls fn for every field.
+// Unknown fields are passed to fn as well, so the callers just skip the numbers they don't need.
+func walkMessage(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.value = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metricNameLabel is the label holding the series name in Prometheus.
+const metricNameLabel = "__name__"
+
+// ErrNoMetricName is returned when a series has no __name__ label.
+var ErrNoMetricName = errors.New("series has no metric name")
+
+// Field numbers of the prometheus.WriteRequest message and its children.
+const (
+	writeRequestTimeseries protowire.Number = 1
+
+	timeSeriesLabels  protowire.Number = 1
+	timeSeriesSamples protowire.Number = 2
+
+	labelName  protowire.Number = 1
+	labelValue protowire.Number = 2
+
+	sampleValue     protowire.Number = 1
+	sampleTimestamp protowire.Number = 2
+)
+
+// series is a decoded prometheus.TimeSeries with its latest sample.
+type series struct {
+	name      string
+	labels    []Label
+	value     float64
+	timestamp int64
+	hasSample bool
+}
+
+// DecodeRemoteWrite decodes a snappy-compressed Prometheus remote-write request.
+// Every series is converted into a gauge holding its latest sample, labels are folded into the metric ID.
+// Counters are cumulative in Prometheus, so they are also stored as gauges to keep the reported total.
+// Samples that are not finite (including staleness markers) are skipped.
+func DecodeRemoteWrite(compressed []byte) ([]models.Metrics, error) {
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snappy payload: %w", err)
+	}
+
+	// Keep the latest sample per series ID, the same series may be sent several times in one request.
+	latest := make(map[string]series)
+	err = walkMessage(data, func(f field) error {
+		if f.num != writeRequestTimeseries || f.typ != protowire.BytesType {
+			return nil
+		}
+		s, err := decodeTimeSeries(f.bytes)
+		if err != nil {
+			return err
+		}
+		if !s.hasSample {
+			return nil
+		}
+		id := SeriesName(s.name, s.labels)
+		if prev, ok := latest[id]; ok && prev.timestamp > s.timestamp {
+			return nil
+		}
+		latest[id] = s
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode write request: %w", err)
+	}
+
+	ids := make([]string, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	metrics := make([]models.Metrics, 0, len(ids))
+	for _, id := range ids {
+		value := latest[id].value
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &value})
+	}
+	return metrics, nil
+}
+
+// decodeTimeSeries decodes a prometheus.TimeSeries message keeping only the latest finite sample.
+func decodeTimeSeries(b []byte) (series, error) {
+	var s series
+	err := walkMessage(b, func(f field) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case timeSeriesLabels:
+			l, err := decodeLabel(f.bytes)
+			if err != nil {
+				return err
+			}
+			if l.Name == metricNameLabel {
+				s.name = l.Value
+				return nil
+			}
+			s.labels = append(s.labels, l)
+		case timeSeriesSamples:
+			value, ts, err := decodeSample(f.bytes)
+			if err != nil {
+				return err
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil
+			}
+			if !s.hasSample || ts >= s.timestamp {
+				s.value, s.timestamp, s.hasSample = value, ts, true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	if s.name == "" {
+		return s, ErrNoMetricName
+	}
+	return s, nil
+}
+
+// decodeLabel decodes a prometheus.Label message.
+func decodeLabel(b []byte) (Label, error) {
+	var l Label
+	err := walkMessage(b, func(f field) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case labelName:
+			l.Name = string(f.bytes)
+		case labelValue:
+			l.Value = string(f.bytes)
+		}
+		return nil
+	})
+	return l, err
+}
+
+// decodeSample decodes a prometheus.Sample message.
+func decodeSample(b []byte) (float64, int64, error) {
+	var (
+		value float64
+		ts    int64
+	)
+	err := walkMessage(b, func(f field) error {
+		switch {
+		case f.num == sampleValue && f.typ == protowire.Fixed64Type:
+			value = math.Float64frombits(f.value)
+		case f.num == sampleTimestamp && f.typ == protowire.VarintType:
+			ts = int64(f.value)
+		}
+		return nil
+	})
+	return value, ts, err
+}
@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"math"
+	"testing"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testSample struct {
+	value float64
+	ts    int64
+}
+
+// encodeTimeSeries encodes a prometheus.TimeSeries message.
+func encodeTimeSeries(labels []Label, samples []testSample) []byte {
+	var b []byte
+	for _, l := range labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Value)
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, sampleValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, sampleTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.ts))
+		b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// encodeWriteRequest encodes and compresses a prometheus.WriteRequest message.
+func encodeWriteRequest(series ...[]byte) []byte {
+	var b []byte
+	for _, s := range series {
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+	return snappy.Encode(nil, b)
+}
+
+func TestSeriesName(t *testing.T) {
+	assert.Equal(t, "up", SeriesName("up", nil))
+	assert.Equal(t, `up{instance="a:1",job="node"}`, SeriesName("up", []Label{{"job", "node"}, {"instance", "a:1"}}))
+	assert.Equal(t, `m{l="quo\"te"}`, SeriesName("m", []Label{{"l", `quo"te`}}))
+}
+
+func TestDecodeRemoteWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name: "latest_sample_wins",
+			payload: encodeWriteRequest(
+				encodeTimeSeries([]Label{{"__name__", "temp"}, {"room", "a"}}, []testSample{{2, 20}, {1, 10}}),
+				encodeTimeSeries([]Label{{"__name__", "temp"}, {"room", "a"}}, []testSample{{0, 5}}),
+			),
+			want: map[string]float64{`temp{room="a"}`: 2},
+		},
+		{
+			name: "non_finite_samples_are_skipped",
+			payload: encodeWriteRequest(
+				encodeTimeSeries([]Label{{"__name__", "stale"}}, []testSample{{math.NaN(), 10}}),
+				encodeTimeSeries([]Label{{"__name__", "inf"}}, []testSample{{math.Inf(1), 10}}),
+				encodeTimeSeries([]Label{{"__name__", "ok"}}, []testSample{{1, 10}, {math.NaN(), 20}}),
+			),
+			want: map[string]float64{"ok": 1},
+		},
+		{
+			name: "missing_metric_name",
+			payload: encodeWriteRequest(
+				encodeTimeSeries([]Label{{"job", "node"}}, []testSample{{1, 10}}),
+			),
+			wantErr: true,
+		},
+		{
+			name:    "corrupted_protobuf",
+			payload: snappy.Encode(nil, []byte{0x0a, 0xff}),
+			wantErr: true,
+		},
+		{
+			name:    "empty_request",
+			payload: encodeWriteRequest(),
+			want:    map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := DecodeRemoteWrite(tt.payload)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got := make(map[string]float64, len(metrics))
+			for _, m := range metrics {
+				assert.Equal(t, models.Gauge, m.MType)
+				require.NotNil(t, m.Value)
+				got[m.ID] = *m.Value
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,13 @@
+// Package config provides configuration structures for the request limits of the server.
+package config
+
+// LimitConfig holds the request limits of the server. The zero sizes take the defaults, the zero rates and concurrency disable the limit.
+type LimitConfig struct {
+	MaxBodySize         int `env:"LIMIT_BODY_SIZE" json:"max_body_size"`                 // Bytes of the request body as received, 8 MiB if zero.
+	MaxDecompressedSize int `env:"LIMIT_DECOMPRESSED_SIZE" json:"max_decompressed_size"` // Bytes of the request body after the decompression, 32 MiB if zero.
+	IPRate              int `env:"LIMIT_IP_RATE" json:"ip_rate"`                         // Requests per second of a client IP address.
+	IPBurst             int `env:"LIMIT_IP_BURST" json:"ip_burst"`                       // Requests of a client IP address above the rate, the rate if zero.
+	TokenRate           int `env:"LIMIT_TOKEN_RATE" json:"token_rate"`                   // Requests per second of an API token.
+	TokenBurst          int `env:"LIMIT_TOKEN_BURST" json:"token_burst"`                 // Requests of an API token above the rate, the rate if zero.
+	Concurrency         int `env:"LIMIT_CONCURRENCY" json:"concurrency"`                 // Requests served at once by the storage-bound handlers.
+}
@@ -0,0 +1,120 @@
+// Package limit protects the server from misbehaving clients with token bucket rate limits and a concurrency limit.
+package limit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Defaults of the request size limits.
+const (
+	DefaultMaxBodySize         = 8 << 20  // bytes of the request body as received
+	DefaultMaxDecompressedSize = 32 << 20 // bytes of the request body after the decompression
+)
+
+// sweepInterval is the period of the removal of the idle buckets.
+const sweepInterval = time.Minute
+
+// RateLimiter keeps a token bucket per client: every client may send burst requests at once,
+// then rate requests per second. A nil limiter allows every request.
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens added per second
+	burst     float64 // capacity of a bucket
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time // time the tokens were counted
+}
+
+// NewRateLimiter creates a limiter of rate requests per second with the burst, the rate if it is zero.
+// It returns nil if the rate is zero, that is without limit.
+func NewRateLimiter(rate, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token of the client. If the bucket is empty it returns false and the time until the next token.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets refilled to the burst, they are the same as new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Semaphore limits the requests served at once, the others wait for a free slot. A nil semaphore does not limit them.
+type Semaphore chan struct{}
+
+// NewSemaphore creates a semaphore of n slots, nil if n is zero.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire waits for a free slot, it fails when the context is done first.
+func (s Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot taken by Acquire.
+func (s Semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,95 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	// The burst is allowed at once, then the bucket is empty.
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("10.0.0.1")
+		require.True(t, ok, "request %d", i)
+	}
+	ok, wait := l.Allow("10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other clients have their own buckets.
+	ok, _ = l.Allow("10.0.0.2")
+	assert.True(t, ok)
+
+	// The bucket refills at the rate.
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("10.0.0.1")
+	assert.True(t, ok)
+	ok, _ = l.Allow("10.0.0.1")
+	assert.False(t, ok)
+
+	// The refill stops at the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = l.Allow("10.0.0.1")
+		require.True(t, ok, "request %d", i)
+	}
+	ok, _ = l.Allow("10.0.0.1")
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(1, 1)
+	l.now = func() time.Time { return now }
+
+	l.Allow("idle")
+	now = now.Add(2 * sweepInterval)
+	l.Allow("active")
+	assert.Len(t, l.buckets, 1, "the refilled bucket is removed")
+	assert.Contains(t, l.buckets, "active")
+}
+
+func TestRateLimiter_Disabled(t *testing.T) {
+	l := NewRateLimiter(0, 10)
+	assert.Nil(t, l)
+	for i := 0; i < 100; i++ {
+		ok, _ := l.Allow("10.0.0.1")
+		require.True(t, ok)
+	}
+	// The burst is the rate if it is not set.
+	assert.Equal(t, 5.0, NewRateLimiter(5, 0).burst)
+}
+
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(1)
+	require.NoError(t, sem.Acquire(context.Background()))
+
+	// The second request waits until its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sem.Acquire(ctx), context.DeadlineExceeded)
+
+	// A released slot is taken by the waiting request.
+	acquired := make(chan error)
+	go func() { acquired <- sem.Acquire(context.Background()) }()
+	sem.Release()
+	select {
+	case err := <-acquired:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the waiting request did not get the released slot")
+	}
+
+	// A nil semaphore does not limit.
+	var unlimited Semaphore = NewSemaphore(0)
+	assert.Nil(t, unlimited)
+	assert.NoError(t, unlimited.Acquire(context.Background()))
+	unlimited.Release()
+}
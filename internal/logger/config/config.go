@@ -0,0 +1,7 @@
+// Package config provides configuration structures for the logging of the server.
+package config
+
+// AccessLogConfig holds the sampling of the access log of the server.
+type AccessLogConfig struct {
+	Sampling int `env:"ACCESS_LOG_SAMPLING" json:"sampling"` // Log one of every N successful requests per route, the errors always; every request if 0 or 1.
+}
@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader is the header carrying the ID of a request, sent by the agent and echoed by the server.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of the accepted request IDs.
+const maxRequestIDLength = 128
+
+// ctxKey is the type of the context keys of the package.
+type ctxKey int
+
+const requestKey ctxKey = 0
+
+// requestLog is the context value of a request: its ID and its loggers, built on their first use,
+// so that the requests logging nothing do not pay for the loggers adding their fields.
+type requestLog struct {
+	id        string
+	base      *zap.SugaredLogger
+	fields    []zap.Field
+	plainOnce sync.Once
+	plain     *zap.Logger
+	sugarOnce sync.Once
+	sugar     *zap.SugaredLogger
+}
+
+// plainLogger returns the non-sugared logger of the request, building it on the first call.
+func (rl *requestLog) plainLogger() *zap.Logger {
+	rl.plainOnce.Do(func() {
+		rl.plain = rl.base.Desugar().With(append(rl.fields, zap.String("request_id", rl.id))...)
+	})
+	return rl.plain
+}
+
+// sugaredLogger returns the sugared logger of the request, building it on the first call.
+func (rl *requestLog) sugaredLogger() *zap.SugaredLogger {
+	rl.sugarOnce.Do(func() {
+		rl.sugar = rl.plainLogger().Sugar()
+	})
+	return rl.sugar
+}
+
+// NewRequestID returns a random request ID, 16 bytes in hex.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether the request ID sent by a client can be kept: a printable ASCII string
+// without spaces of at most 128 characters, so that it cannot break the log lines.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequest returns a copy of ctx carrying the request ID and the loggers of the request,
+// which add the fields and the request ID to every entry.
+func WithRequest(ctx context.Context, l *zap.SugaredLogger, requestID string, fields ...zap.Field) context.Context {
+	return context.WithValue(ctx, requestKey, &requestLog{id: requestID, base: l, fields: fields})
+}
+
+// FromContext returns the logger of the request of ctx, or fallback outside of a request.
+func FromContext(ctx context.Context, fallback *zap.SugaredLogger) *zap.SugaredLogger {
+	if rl, ok := ctx.Value(requestKey).(*requestLog); ok {
+		return rl.sugaredLogger()
+	}
+	return fallback
+}
+
+// PlainFromContext returns the non-sugared logger of the request of ctx, or fallback outside of a request.
+// It is the logger of the hot paths, its typed fields are not boxed into interfaces like the arguments of the sugared one.
+func PlainFromContext(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if rl, ok := ctx.Value(requestKey).(*requestLog); ok {
+		return rl.plainLogger()
+	}
+	return fallback
+}
+
+// RequestID returns the request ID of ctx, empty outside of a request.
+func RequestID(ctx context.Context) string {
+	if rl, ok := ctx.Value(requestKey).(*requestLog); ok {
+		return rl.id
+	}
+	return ""
+}
@@ -2,6 +2,11 @@
 // It provides types for counter and gauge metrics with JSON serialization support.
 package models
 
+import "errors"
+
+// ErrNotFound is returned by the repositories when the requested metric is not stored.
+var ErrNotFound = errors.New("not found")
+
 // Metric type constants.
 const (
 	Counter = "counter" // Counter metric type.
@@ -17,3 +22,15 @@ type Metrics struct {
 	Value *float64 `json:"value,omitempty"` // Value for gauge metrics.
 	Hash  string   `json:"hash,omitempty"` // Optional hash for integrity verification.
 }
+
+// MetricChange describes the update of a single metric, as reported by the repository that made it.
+// As in Metrics, the counter totals are in the delta fields and the gauge values in the value fields.
+// The old value is nil when the metric did not exist before the update.
+type MetricChange struct {
+	ID       string   `json:"id"`                  // name of the metric
+	MType    string   `json:"type"`                // type of the metric
+	OldDelta *int64   `json:"old_delta,omitempty"` // counter total before the update
+	NewDelta *int64   `json:"new_delta,omitempty"` // counter total after the update
+	OldValue *float64 `json:"old_value,omitempty"` // gauge value before the update
+	NewValue *float64 `json:"new_value,omitempty"` // gauge value after the update
+}
@@ -0,0 +1,26 @@
+package models
+
+// Aggregation functions of the query API.
+const (
+	AggSum   = "sum"   // Sum of the matched values.
+	AggAvg   = "avg"   // Average of the matched values.
+	AggMin   = "min"   // Minimum of the matched values.
+	AggMax   = "max"   // Maximum of the matched values.
+	AggCount = "count" // Number of the matched metrics.
+	AggRate  = "rate"  // Per-second increase of the matched counters.
+)
+
+// Query selects metrics by name and aggregates their values.
+type Query struct {
+	Pattern string `json:"pattern"`         // Name glob (e.g. "Alloc*"), or a regular expression when Regex is set.
+	Regex   bool   `json:"regex,omitempty"` // Pattern is a regular expression.
+	MType   string `json:"type,omitempty"`  // Metric type to match, both types when empty.
+	Func    string `json:"func"`            // Aggregation function.
+}
+
+// QueryResult is the result of an aggregation query.
+type QueryResult struct {
+	Func  string  `json:"func"`
+	Value float64 `json:"value"`
+	Count int64   `json:"count"` // Number of metrics matched by the query.
+}
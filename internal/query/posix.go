@@ -0,0 +1,179 @@
+package query
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// posixMaxRepeat is the largest repetition count accepted by the regular expressions of Postgres.
+const posixMaxRepeat = 255
+
+// posixPattern rewrites the pattern for the POSIX regular expression operator of Postgres (~).
+// The pattern is parsed with the Go syntax and written back with the constructs both engines read the same way:
+// literals and classes as character escapes, '.' not matching a newline as an explicit class, groups without captures.
+// It reports false for the constructs without an equivalent (case folding, word and line boundaries, empty branches,
+// large repetitions), these queries are evaluated in memory.
+func posixPattern(pattern string) (string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	var sb strings.Builder
+	if !writePosix(&sb, re) {
+		return "", false
+	}
+	return sb.String(), true
+}
+
+// writePosix writes the node in the POSIX syntax and reports false if it has no equivalent.
+func writePosix(sb *strings.Builder, re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return false
+		}
+		for _, r := range re.Rune {
+			if !writePosixRune(sb, r) {
+				return false
+			}
+		}
+	case syntax.OpCharClass:
+		return writePosixClass(sb, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		return writePosixClass(sb, []rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune})
+	case syntax.OpAnyChar:
+		// Outside of the newline-sensitive mode the dot of Postgres matches a newline too.
+		sb.WriteString(".")
+	case syntax.OpBeginText:
+		sb.WriteString("^")
+	case syntax.OpEndText:
+		sb.WriteString("$")
+	case syntax.OpCapture:
+		return writePosixGroup(sb, re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !writePosix(sb, sub) {
+				return false
+			}
+		}
+	case syntax.OpAlternate:
+		sb.WriteString("(?:")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				sb.WriteString("|")
+			}
+			if !writePosix(sb, sub) {
+				return false
+			}
+		}
+		sb.WriteString(")")
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		// The greediness changes the extent of a match only, not whether the string matches.
+		if !writePosixGroup(sb, re.Sub[0]) {
+			return false
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			sb.WriteString("*")
+		case syntax.OpPlus:
+			sb.WriteString("+")
+		case syntax.OpQuest:
+			sb.WriteString("?")
+		default:
+			if re.Min > posixMaxRepeat || re.Max > posixMaxRepeat {
+				return false
+			}
+			switch {
+			case re.Max == -1:
+				fmt.Fprintf(sb, "{%d,}", re.Min)
+			case re.Max == re.Min:
+				fmt.Fprintf(sb, "{%d}", re.Min)
+			default:
+				fmt.Fprintf(sb, "{%d,%d}", re.Min, re.Max)
+			}
+		}
+	default:
+		// Empty matches, line and word boundaries.
+		return false
+	}
+	return true
+}
+
+// writePosixGroup writes the node as a non-capturing group.
+func writePosixGroup(sb *strings.Builder, re *syntax.Regexp) bool {
+	sb.WriteString("(?:")
+	if !writePosix(sb, re) {
+		return false
+	}
+	sb.WriteString(")")
+	return true
+}
+
+// writePosixRune writes a literal character: letters, digits and '_' as they are, other ASCII characters escaped
+// with a backslash and the rest as a character code.
+func writePosixRune(sb *strings.Builder, r rune) bool {
+	switch {
+	case r == 0 || r > unicode.MaxRune:
+		// The text of Postgres cannot hold a NUL character.
+		return false
+	case r < 0x80 && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)):
+		sb.WriteRune(r)
+	case r < 0x80 && unicode.IsPrint(r):
+		sb.WriteByte('\\')
+		sb.WriteRune(r)
+	default:
+		writePosixCode(sb, r)
+	}
+	return true
+}
+
+// writePosixCode writes the character entry escape of the character.
+func writePosixCode(sb *strings.Builder, r rune) {
+	if r <= 0xFFFF {
+		fmt.Fprintf(sb, `\u%04X`, r)
+	} else {
+		fmt.Fprintf(sb, `\U%08X`, r)
+	}
+}
+
+// writePosixClass writes the character class given as pairs of range bounds.
+// NUL and the surrogate halves, which cannot appear in the text, are left out of the ranges.
+func writePosixClass(sb *strings.Builder, ranges []rune) bool {
+	var class strings.Builder
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := max(ranges[i], 1), ranges[i+1]
+		if lo <= 0xD7FF && hi >= 0xE000 {
+			writePosixRange(&class, lo, 0xD7FF)
+			writePosixRange(&class, 0xE000, hi)
+			continue
+		}
+		if lo >= 0xD800 && lo <= 0xDFFF {
+			lo = 0xE000
+		}
+		if hi >= 0xD800 && hi <= 0xDFFF {
+			hi = 0xD7FF
+		}
+		writePosixRange(&class, lo, hi)
+	}
+	if class.Len() == 0 {
+		return false
+	}
+	sb.WriteString("[")
+	sb.WriteString(class.String())
+	sb.WriteString("]")
+	return true
+}
+
+// writePosixRange writes a range of a class, nothing if it is empty.
+func writePosixRange(sb *strings.Builder, lo, hi rune) {
+	if lo > hi {
+		return
+	}
+	writePosixCode(sb, lo)
+	if hi > lo {
+		sb.WriteString("-")
+		writePosixCode(sb, hi)
+	}
+}
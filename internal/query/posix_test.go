@@ -0,0 +1,39 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPosixPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    string
+		wantOK  bool
+	}{
+		{name: "literal", pattern: `^Alloc_1$`, want: `^Alloc_1$`, wantOK: true},
+		{name: "punctuation", pattern: `^a\.b\{x="\?"\}$`, want: `^a\.b\{x\=\"\?\"\}$`, wantOK: true},
+		{name: "non_ascii", pattern: `^é$`, want: `^\u00E9$`, wantOK: true},
+		{name: "dot_excludes_newline", pattern: `^a.*$`, want: `^a(?:[\u0001-\u0009\u000B-\uD7FF\uE000-\U0010FFFF])*$`, wantOK: true},
+		{name: "dot_all", pattern: `(?s)^.$`, want: `^.$`, wantOK: true},
+		{name: "perl_class", pattern: `^\d+$`, want: `^(?:[\u0030-\u0039])+$`, wantOK: true},
+		{name: "alternation_and_groups", pattern: `^(?:(Alloc)|Frees)$`, want: `^(?:(?:Alloc)|Frees)$`, wantOK: true},
+		{name: "repeat", pattern: `^a{2,3}b{4,}c{5}$`, want: `^(?:a){2,3}(?:b){4,}(?:c){5}$`, wantOK: true},
+		{name: "lazy", pattern: `^a+?$`, want: `^(?:a)+$`, wantOK: true},
+		{name: "fold_case", pattern: `(?i)^alloc$`},
+		{name: "word_boundary", pattern: `\bAlloc`},
+		{name: "multi_line", pattern: `(?m)^Alloc$`},
+		{name: "empty_branch", pattern: `^(?:a|)$`},
+		{name: "large_repeat", pattern: `^a{300}$`},
+		{name: "invalid", pattern: `(`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := posixPattern(tt.pattern)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,292 @@
+// Package query evaluates aggregation queries over the stored metrics.
+// Metrics are selected by a name glob or a regular expression and aggregated with sum, avg, min, max, count or rate.
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// defaultRateInterval is the interval between counter snapshots used for the rate.
+const defaultRateInterval = 10 * time.Second
+
+var (
+	// ErrInvalidQuery is returned when the query cannot be evaluated.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrNoMatch is returned when avg, min or max is requested and no metric matches the query.
+	ErrNoMatch = errors.New("no metrics match the query")
+	// ErrNoRateData is returned when no counter snapshot has been taken yet.
+	ErrNoRateData = errors.New("not enough counter snapshots to compute the rate")
+)
+
+// snapshot holds the counter values at a moment of time.
+type snapshot struct {
+	at       time.Time
+	counters map[string]int64
+}
+
+// Engine evaluates the queries against the repository.
+// Repositories implementing repository.Aggregator evaluate the aggregations natively,
+// other repositories are listed and aggregated in memory.
+type Engine struct {
+	storage   repository.Repository
+	interval  time.Duration
+	logger    *zap.SugaredLogger
+	mu        sync.Mutex
+	snapshots []snapshot // the two latest counter snapshots, the oldest first
+	rateOnce  sync.Once
+	rateUsed  chan struct{} // closed by the first rate query
+	now       func() time.Time
+}
+
+// NewEngine creates a query engine, counter snapshots for the rate are taken every interval (10s if not positive).
+func NewEngine(storage repository.Repository, interval time.Duration, logger *zap.SugaredLogger) *Engine {
+	if interval <= 0 {
+		interval = defaultRateInterval
+	}
+	return &Engine{
+		storage:  storage,
+		interval: interval,
+		logger:   logger,
+		rateUsed: make(chan struct{}),
+		now:      time.Now,
+	}
+}
+
+// Run takes the counter snapshots until ctx is done.
+// The snapshots start with the first rate query, the metrics are not listed for a server that is never asked for a rate.
+func (e *Engine) Run(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-e.rateUsed:
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		if err := e.Sample(ctx); err != nil {
+			e.logger.Errorf("failed to take a counter snapshot: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample takes a snapshot of the counters, the two latest snapshots are kept.
+func (e *Engine) Sample(ctx context.Context) error {
+	metrics, err := e.storage.ListMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list metrics: %w", err)
+	}
+	s := snapshot{at: e.now(), counters: make(map[string]int64)}
+	for _, m := range metrics {
+		if m.MType == models.Counter && m.Delta != nil {
+			s.counters[m.ID] = *m.Delta
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.snapshots = append(e.snapshots, s)
+	if len(e.snapshots) > 2 {
+		e.snapshots = e.snapshots[len(e.snapshots)-2:]
+	}
+	return nil
+}
+
+// Pattern converts the query pattern into an anchored regular expression.
+// Globs support '*' for any sequence of characters and '?' for a single character.
+func Pattern(q models.Query) (string, error) {
+	if q.Pattern == "" {
+		return "", fmt.Errorf("%w: empty pattern", ErrInvalidQuery)
+	}
+	var pattern string
+	if q.Regex {
+		pattern = "^(?:" + q.Pattern + ")$"
+	} else {
+		var sb strings.Builder
+		sb.WriteString("^")
+		for _, r := range q.Pattern {
+			switch r {
+			case '*':
+				sb.WriteString(".*")
+			case '?':
+				sb.WriteString(".")
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		sb.WriteString("$")
+		pattern = sb.String()
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return pattern, nil
+}
+
+// validate checks the function and the metric type of the query.
+func validate(q models.Query) error {
+	switch q.MType {
+	case "", models.Gauge, models.Counter:
+	default:
+		return fmt.Errorf("%w: unknown metric type %q", ErrInvalidQuery, q.MType)
+	}
+	switch q.Func {
+	case models.AggSum, models.AggAvg, models.AggMin, models.AggMax, models.AggCount:
+	case models.AggRate:
+		if q.MType == models.Gauge {
+			return fmt.Errorf("%w: rate is defined for counters only", ErrInvalidQuery)
+		}
+	default:
+		return fmt.Errorf("%w: unknown function %q", ErrInvalidQuery, q.Func)
+	}
+	return nil
+}
+
+// Evaluate evaluates the query.
+func (e *Engine) Evaluate(ctx context.Context, q models.Query) (models.QueryResult, error) {
+	if err := validate(q); err != nil {
+		return models.QueryResult{}, err
+	}
+	pattern, err := Pattern(q)
+	if err != nil {
+		return models.QueryResult{}, err
+	}
+
+	// The pattern is pushed down when the repository reads it like the regexp package.
+	aggregator, ok := e.storage.(repository.Aggregator)
+	var posix string
+	if ok && q.Func != models.AggRate {
+		if posix, ok = posixPattern(pattern); !ok {
+			e.logger.Debugf("pattern %q has no POSIX equivalent, aggregating in memory", pattern)
+		}
+	}
+
+	var result models.QueryResult
+	switch {
+	case q.Func == models.AggRate:
+		result, err = e.rate(ctx, pattern)
+	case ok:
+		result, err = aggregator.Aggregate(ctx, posix, q)
+	default:
+		result, err = e.aggregate(ctx, pattern, q)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// Sum and count of nothing are zero, other aggregations are undefined.
+	if result.Count == 0 && (q.Func == models.AggAvg || q.Func == models.AggMin || q.Func == models.AggMax) {
+		return result, ErrNoMatch
+	}
+	return result, nil
+}
+
+// aggregate lists the metrics and aggregates the matching values in memory.
+func (e *Engine) aggregate(ctx context.Context, pattern string, q models.Query) (models.QueryResult, error) {
+	re := regexp.MustCompile(pattern)
+	metrics, err := e.storage.ListMetrics(ctx)
+	if err != nil {
+		return models.QueryResult{}, fmt.Errorf("failed to list metrics: %w", err)
+	}
+
+	result := models.QueryResult{Func: q.Func}
+	var (
+		sum    float64
+		lo, hi = math.Inf(1), math.Inf(-1)
+	)
+	for _, m := range metrics {
+		if (q.MType != "" && m.MType != q.MType) || !re.MatchString(m.ID) {
+			continue
+		}
+		var v float64
+		switch {
+		case m.MType == models.Gauge && m.Value != nil:
+			v = *m.Value
+		case m.MType == models.Counter && m.Delta != nil:
+			v = float64(*m.Delta)
+		default:
+			continue
+		}
+		result.Count++
+		sum += v
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	if result.Count == 0 {
+		return result, nil
+	}
+
+	switch q.Func {
+	case models.AggSum:
+		result.Value = sum
+	case models.AggAvg:
+		result.Value = sum / float64(result.Count)
+	case models.AggMin:
+		result.Value = lo
+	case models.AggMax:
+		result.Value = hi
+	case models.AggCount:
+		result.Value = float64(result.Count)
+	}
+	return result, nil
+}
+
+// rate computes the per-second increase of the matching counters since the oldest snapshot.
+// Counters that are missing in the snapshot are not counted until the next one. A counter lower than in the snapshot
+// was reset, as in Prometheus its whole value is the increase.
+func (e *Engine) rate(ctx context.Context, pattern string) (models.QueryResult, error) {
+	e.rateOnce.Do(func() { close(e.rateUsed) })
+	re := regexp.MustCompile(pattern)
+	result := models.QueryResult{Func: models.AggRate}
+
+	e.mu.Lock()
+	if len(e.snapshots) == 0 {
+		e.mu.Unlock()
+		return result, ErrNoRateData
+	}
+	base := e.snapshots[0]
+	e.mu.Unlock()
+
+	metrics, err := e.storage.ListMetrics(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list metrics: %w", err)
+	}
+	elapsed := e.now().Sub(base.at).Seconds()
+	if elapsed <= 0 {
+		return result, ErrNoRateData
+	}
+
+	var increase int64
+	for _, m := range metrics {
+		if m.MType != models.Counter || m.Delta == nil || !re.MatchString(m.ID) {
+			continue
+		}
+		prev, ok := base.counters[m.ID]
+		if !ok {
+			continue
+		}
+		if *m.Delta < prev {
+			increase += *m.Delta
+		} else {
+			increase += *m.Delta - prev
+		}
+		result.Count++
+	}
+	result.Value = float64(increase) / elapsed
+	return result, nil
+}
@@ -0,0 +1,200 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// aggregatingStorage records the pushed down queries.
+type aggregatingStorage struct {
+	repository.Repository
+	pattern string
+	query   models.Query
+}
+
+func (s *aggregatingStorage) Aggregate(ctx context.Context, pattern string, q models.Query) (models.QueryResult, error) {
+	s.pattern, s.query = pattern, q
+	return models.QueryResult{Func: q.Func, Value: 42, Count: 2}, nil
+}
+
+func newTestStorage(t *testing.T) *mstorage.MemStorage {
+	ms := mstorage.NewMemStorage()
+	gauges := map[string]float64{"Alloc{agent=\"a\"}": 10, "Alloc{agent=\"b\"}": 30, "HeapAlloc": 5, "Frees": 1}
+	for id, v := range gauges {
+		v := v
+		require.NoError(t, ms.SetGauge(context.Background(), id, &v))
+	}
+	poll := int64(7)
+	require.NoError(t, ms.AddCounter(context.Background(), "PollCount", &poll))
+	return ms
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   models.Query
+		want    string
+		wantErr bool
+	}{
+		{name: "glob", query: models.Query{Pattern: "Alloc*"}, want: `^Alloc.*$`},
+		{name: "glob_quotes_meta", query: models.Query{Pattern: `a.b{x="?"}`}, want: `^a\.b\{x="."\}$`},
+		{name: "regex", query: models.Query{Pattern: "Alloc|Frees", Regex: true}, want: `^(?:Alloc|Frees)$`},
+		{name: "invalid_regex", query: models.Query{Pattern: "(", Regex: true}, wantErr: true},
+		{name: "empty", query: models.Query{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Pattern(tt.query)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidQuery)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	engine := NewEngine(newTestStorage(t), 0, zap.NewNop().Sugar())
+
+	tests := []struct {
+		name      string
+		query     models.Query
+		wantValue float64
+		wantCount int64
+		wantErr   error
+	}{
+		{name: "sum_glob", query: models.Query{Pattern: "Alloc*", Func: models.AggSum}, wantValue: 40, wantCount: 2},
+		{name: "avg_glob", query: models.Query{Pattern: "Alloc*", Func: models.AggAvg}, wantValue: 20, wantCount: 2},
+		{name: "min_regex", query: models.Query{Pattern: ".*Alloc.*", Regex: true, Func: models.AggMin}, wantValue: 5, wantCount: 3},
+		{name: "max_all", query: models.Query{Pattern: "*", Func: models.AggMax}, wantValue: 30, wantCount: 5},
+		{name: "count_by_type", query: models.Query{Pattern: "*", MType: models.Counter, Func: models.AggCount}, wantValue: 1, wantCount: 1},
+		{name: "sum_of_nothing", query: models.Query{Pattern: "Missing*", Func: models.AggSum}},
+		{name: "avg_of_nothing", query: models.Query{Pattern: "Missing*", Func: models.AggAvg}, wantErr: ErrNoMatch},
+		{name: "unknown_function", query: models.Query{Pattern: "*", Func: "median"}, wantErr: ErrInvalidQuery},
+		{name: "unknown_type", query: models.Query{Pattern: "*", MType: "histogram", Func: models.AggSum}, wantErr: ErrInvalidQuery},
+		{name: "rate_of_gauges", query: models.Query{Pattern: "*", MType: models.Gauge, Func: models.AggRate}, wantErr: ErrInvalidQuery},
+		{name: "rate_without_snapshot", query: models.Query{Pattern: "*", Func: models.AggRate}, wantErr: ErrNoRateData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.Evaluate(context.Background(), tt.query)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.query.Func, got.Func)
+			assert.InDelta(t, tt.wantValue, got.Value, 1e-9)
+			assert.Equal(t, tt.wantCount, got.Count)
+		})
+	}
+}
+
+func TestEngine_Rate(t *testing.T) {
+	ctx := context.Background()
+	ms := newTestStorage(t)
+	engine := NewEngine(ms, time.Second, zap.NewNop().Sugar())
+
+	now := time.Unix(1000, 0)
+	engine.now = func() time.Time { return now }
+	require.NoError(t, engine.Sample(ctx))
+
+	// A counter added after the snapshot is not counted until the next one.
+	now = now.Add(10 * time.Second)
+	delta := int64(50)
+	require.NoError(t, ms.AddCounter(ctx, "PollCount", &delta))
+	require.NoError(t, ms.AddCounter(ctx, "NewCount", &delta))
+
+	got, err := engine.Evaluate(ctx, models.Query{Pattern: "*Count", Func: models.AggRate})
+	require.NoError(t, err)
+	assert.InDelta(t, 5.0, got.Value, 1e-9)
+	assert.Equal(t, int64(1), got.Count)
+
+	// Only the two latest snapshots are kept, the rate is computed since the oldest of them.
+	require.NoError(t, engine.Sample(ctx))
+	now = now.Add(10 * time.Second)
+	require.NoError(t, engine.Sample(ctx))
+	require.NoError(t, ms.AddCounter(ctx, "NewCount", &delta))
+	got, err = engine.Evaluate(ctx, models.Query{Pattern: "NewCount", Func: models.AggRate})
+	require.NoError(t, err)
+	assert.InDelta(t, 5.0, got.Value, 1e-9)
+}
+
+func TestEngine_Pushdown(t *testing.T) {
+	storage := &aggregatingStorage{Repository: newTestStorage(t)}
+	engine := NewEngine(storage, 0, zap.NewNop().Sugar())
+
+	q := models.Query{Pattern: "Alloc*", MType: models.Gauge, Func: models.AggSum}
+	got, err := engine.Evaluate(context.Background(), q)
+	require.NoError(t, err)
+	assert.Equal(t, models.QueryResult{Func: models.AggSum, Value: 42, Count: 2}, got)
+	assert.Equal(t, `^Alloc(?:[\u0001-\u0009\u000B-\uD7FF\uE000-\U0010FFFF])*$`, storage.pattern)
+	assert.Equal(t, q, storage.query)
+
+	// A pattern without a POSIX equivalent is aggregated in memory.
+	storage.pattern = ""
+	got, err = engine.Evaluate(context.Background(), models.Query{Pattern: `(?i)alloc.*`, Regex: true, Func: models.AggSum})
+	require.NoError(t, err)
+	assert.Equal(t, models.QueryResult{Func: models.AggSum, Value: 40, Count: 2}, got)
+	assert.Empty(t, storage.pattern)
+}
+
+func TestEngine_RateCounterReset(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	engine := NewEngine(ms, time.Second, zap.NewNop().Sugar())
+	now := time.Unix(1000, 0)
+	engine.now = func() time.Time { return now }
+
+	high, low := int64(100), int64(30)
+	require.NoError(t, ms.AddCounter(ctx, "Requests", &high))
+	require.NoError(t, ms.AddCounter(ctx, "Errors", &high))
+	require.NoError(t, engine.Sample(ctx))
+
+	// The storage lost the counters, e.g. an in-memory server restarted: Requests counted 30 since,
+	// Errors was restored at 100 and counted 30 more.
+	now = now.Add(10 * time.Second)
+	restarted := mstorage.NewMemStorage()
+	require.NoError(t, restarted.AddCounter(ctx, "Requests", &low))
+	require.NoError(t, restarted.AddCounter(ctx, "Errors", &high))
+	require.NoError(t, restarted.AddCounter(ctx, "Errors", &low))
+	engine.storage = restarted
+
+	got, err := engine.Evaluate(ctx, models.Query{Pattern: "*", Func: models.AggRate})
+	require.NoError(t, err)
+	assert.InDelta(t, 6.0, got.Value, 1e-9)
+	assert.Equal(t, int64(2), got.Count)
+}
+
+func TestEngine_RunStartsWithRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine := NewEngine(newTestStorage(t), time.Hour, zap.NewNop().Sugar())
+	go engine.Run(ctx)
+
+	// No snapshot is taken until the rate is queried.
+	_, err := engine.Evaluate(ctx, models.Query{Pattern: "*", Func: models.AggSum})
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	engine.mu.Lock()
+	assert.Empty(t, engine.snapshots)
+	engine.mu.Unlock()
+
+	_, err = engine.Evaluate(ctx, models.Query{Pattern: "*", Func: models.AggRate})
+	assert.ErrorIs(t, err, ErrNoRateData)
+	assert.Eventually(t, func() bool {
+		engine.mu.Lock()
+		defer engine.mu.Unlock()
+		return len(engine.snapshots) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
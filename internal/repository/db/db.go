@@ -5,15 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
 	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/repository/db/config"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/db/migrations"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -68,7 +74,7 @@ func initPool(ctx context.Context, dsn string, logger *zap.SugaredLogger) (*pgxp
 
 // AddCounter adds the counter to the database.
 func (db *DB) AddCounter(ctx context.Context, id string, delta *int64) error {
-	db.logger.Debug("Saving counter to the database")
+	db.log(ctx).Debug("Saving counter to the database")
 	// Begin a transaction
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
@@ -77,7 +83,7 @@ func (db *DB) AddCounter(ctx context.Context, id string, delta *int64) error {
 	defer func() {
 		if err != nil {
 			if rbErr := tx.Rollback(ctx); rbErr != nil {
-				db.logger.Errorf("failed to rollback transaction: %v", rbErr)
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
 			}
 		}
 	}()
@@ -93,7 +99,7 @@ func (db *DB) AddCounter(ctx context.Context, id string, delta *int64) error {
 	}
 
 	// Commit the transaction
-	if err := commitWithRetries(ctx, tx, db.logger); err != nil {
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
 		return fmt.Errorf("commit error: %w", err)
 	}
 	return nil
@@ -101,7 +107,7 @@ func (db *DB) AddCounter(ctx context.Context, id string, delta *int64) error {
 
 // GetCounter gets the counter from the database.
 func (db *DB) GetCounter(ctx context.Context, id string) (*int64, error) {
-	db.logger.Debug("Get counter from the database")
+	db.log(ctx).Debug("Get counter from the database")
 	// Begin a transaction
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
@@ -110,7 +116,7 @@ func (db *DB) GetCounter(ctx context.Context, id string) (*int64, error) {
 	defer func() {
 		if err != nil {
 			if rbErr := tx.Rollback(ctx); rbErr != nil {
-				db.logger.Errorf("failed to rollback transaction: %v", rbErr)
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
 			}
 		}
 	}()
@@ -120,13 +126,13 @@ func (db *DB) GetCounter(ctx context.Context, id string) (*int64, error) {
 	var delta int64
 	if err = row.Scan(&delta); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, fmt.Errorf("counter %s not found: %w", id, err)
+			return nil, fmt.Errorf("counter %s %w: %w", id, models.ErrNotFound, err)
 		}
 		return nil, fmt.Errorf("failed to query counter %s: %w", id, err)
 	}
 
 	// Commit the transaction
-	if err := commitWithRetries(ctx, tx, db.logger); err != nil {
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
 		return nil, fmt.Errorf("commit error: %w", err)
 	}
 	return &delta, nil
@@ -134,7 +140,7 @@ func (db *DB) GetCounter(ctx context.Context, id string) (*int64, error) {
 
 // SetGauge sets the gauge to the database.
 func (db *DB) SetGauge(ctx context.Context, id string, value *float64) error {
-	db.logger.Debug("Saving gauge to the database")
+	db.log(ctx).Debug("Saving gauge to the database")
 	// Begin a transaction
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
@@ -144,7 +150,7 @@ func (db *DB) SetGauge(ctx context.Context, id string, value *float64) error {
 	defer func() {
 		if err != nil {
 			if rbErr := tx.Rollback(ctx); rbErr != nil {
-				db.logger.Errorf("failed to rollback transaction: %v", rbErr)
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
 			}
 		}
 	}()
@@ -160,7 +166,7 @@ func (db *DB) SetGauge(ctx context.Context, id string, value *float64) error {
 
 	}
 	// Commit the transaction
-	if err := commitWithRetries(ctx, tx, db.logger); err != nil {
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
 		return fmt.Errorf("commit error: %w", err)
 	}
 	return nil
@@ -168,7 +174,7 @@ func (db *DB) SetGauge(ctx context.Context, id string, value *float64) error {
 
 // GetGauge gets the gauge from the database.
 func (db *DB) GetGauge(ctx context.Context, id string) (*float64, error) {
-	db.logger.Debug("Getting gauge from the database")
+	db.log(ctx).Debug("Getting gauge from the database")
 	// Begin a transaction
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
@@ -177,7 +183,7 @@ func (db *DB) GetGauge(ctx context.Context, id string) (*float64, error) {
 	defer func() {
 		if err != nil {
 			if rbErr := tx.Rollback(ctx); rbErr != nil {
-				db.logger.Errorf("failed to rollback transaction: %v", rbErr)
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
 			}
 		}
 	}()
@@ -187,13 +193,13 @@ func (db *DB) GetGauge(ctx context.Context, id string) (*float64, error) {
 	var value float64
 	if err = row.Scan(&value); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, fmt.Errorf("gauge %s not found: %w", id, err)
+			return nil, fmt.Errorf("gauge %s %w: %w", id, models.ErrNotFound, err)
 		}
 		return nil, fmt.Errorf("failed to query gauge %s: %w", id, err)
 	}
 
 	// Commit the transaction
-	if err := commitWithRetries(ctx, tx, db.logger); err != nil {
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
 		return nil, fmt.Errorf("commit error: %w", err)
 	}
 	return &value, nil
@@ -201,7 +207,7 @@ func (db *DB) GetGauge(ctx context.Context, id string) (*float64, error) {
 
 // SaveBatch saves a batch of metrics to the database.
 func (db *DB) SaveBatch(ctx context.Context, metrics []models.Metrics) error {
-	db.logger.Debug("Saving batch to the database")
+	db.log(ctx).Debug("Saving batch to the database")
 	// Check if the batch is empty
 	if len(metrics) == 0 {
 		return fmt.Errorf("failed to save batch: empty slice")
@@ -214,7 +220,7 @@ func (db *DB) SaveBatch(ctx context.Context, metrics []models.Metrics) error {
 	defer func() {
 		if err != nil {
 			if rbErr := tx.Rollback(ctx); rbErr != nil {
-				db.logger.Errorf("failed to rollback transaction: %v", rbErr)
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
 			}
 		}
 	}()
@@ -251,15 +257,90 @@ func (db *DB) SaveBatch(ctx context.Context, metrics []models.Metrics) error {
 	}
 
 	// Commit the transaction
-	if err := commitWithRetries(ctx, tx, db.logger); err != nil {
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
 		return fmt.Errorf("commit error: %w", err)
 	}
 	return nil
 }
 
+// UpdateBatch saves a batch of metrics to the database and returns the values of its metrics before and after the update.
+// Every statement returns the old value of its row, locked by the statement, and the new one, so no extra queries are made.
+func (db *DB) UpdateBatch(ctx context.Context, metrics []models.Metrics) ([]models.MetricChange, error) {
+	db.log(ctx).Debug("Updating batch in the database")
+	// Check if the batch is empty
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("failed to update batch: empty slice")
+	}
+	// Begin a transaction
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(ctx); rbErr != nil {
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	// Prepare a batch of SQL statements to insert or update metrics and return their values
+	batch := &pgx.Batch{}
+	changes := make([]models.MetricChange, 0, len(metrics))
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Gauge:
+			batch.Queue(`
+               WITH old AS (SELECT value FROM gauges WHERE id = $1 FOR UPDATE)
+               INSERT INTO gauges(id,value)
+               VALUES ($1,$2)
+               ON CONFLICT(id) DO UPDATE
+               SET value = EXCLUDED.value
+               RETURNING (SELECT value FROM old), value
+           `, m.ID, m.Value)
+		case models.Counter:
+			batch.Queue(`
+               WITH old AS (SELECT delta FROM counters WHERE id = $1 FOR UPDATE)
+               INSERT INTO counters(id,delta)
+               VALUES ($1,$2)
+               ON CONFLICT(id) DO UPDATE
+               SET delta = counters.delta + EXCLUDED.delta
+               RETURNING (SELECT delta FROM old), delta
+           `, m.ID, m.Delta)
+		default:
+			continue
+		}
+		changes = append(changes, models.MetricChange{ID: m.ID, MType: m.MType})
+	}
+
+	// Send the batch to the database and read the values in the order of the statements
+	br := tx.SendBatch(ctx, batch)
+	for i := range changes {
+		c := &changes[i]
+		if c.MType == models.Gauge {
+			err = br.QueryRow().Scan(&c.OldValue, &c.NewValue)
+		} else {
+			err = br.QueryRow().Scan(&c.OldDelta, &c.NewDelta)
+		}
+		if err != nil {
+			_ = br.Close()
+			return nil, fmt.Errorf("update %s %s: %w", c.MType, c.ID, err)
+		}
+	}
+	if err = br.Close(); err != nil {
+		return nil, fmt.Errorf("batch close: %w", err)
+	}
+
+	// Commit the transaction
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
+		return nil, fmt.Errorf("commit error: %w", err)
+	}
+	return changes, nil
+}
+
 // GetAll reads the metrics from the database.
 func (db *DB) GetAll(ctx context.Context) (map[string]string, error) {
-	db.logger.Debug("Loading metrics from the database")
+	db.log(ctx).Debug("Loading metrics from the database")
 	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
@@ -267,7 +348,7 @@ func (db *DB) GetAll(ctx context.Context) (map[string]string, error) {
 	defer func() {
 		if err != nil {
 			if rbErr := tx.Rollback(ctx); rbErr != nil {
-				db.logger.Errorf("failed to rollback transaction: %v", rbErr)
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
 			}
 		}
 	}()
@@ -310,10 +391,10 @@ func (db *DB) GetAll(ctx context.Context) (map[string]string, error) {
 	}
 
 	// Commit the transaction
-	if err := commitWithRetries(ctx, tx, db.logger); err != nil {
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
 		return nil, fmt.Errorf("commit error: %w", err)
 	}
-	db.logger.Debugf("metrics restored from the database: %d gauges, %d counters", len(gauge), len(counter))
+	db.log(ctx).Debugf("metrics restored from the database: %d gauges, %d counters", len(gauge), len(counter))
 	result := make(map[string]string)
 	for k, v := range gauge {
 		result[k] = strconv.FormatFloat(v, 'f', -1, 64)
@@ -324,28 +405,152 @@ func (db *DB) GetAll(ctx context.Context) (map[string]string, error) {
 	return result, nil
 }
 
+// ListMetrics reads the metrics with their types from the database.
+func (db *DB) ListMetrics(ctx context.Context) ([]models.Metrics, error) {
+	db.log(ctx).Debug("Listing metrics from the database")
+	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(ctx); rbErr != nil {
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	// Query both tables at once, the gauge column is NULL for counters and vice versa
+	rows, err := tx.Query(ctx, `
+               SELECT id, 'gauge', value, NULL::bigint FROM gauges
+               UNION ALL
+               SELECT id, 'counter', NULL::double precision, delta FROM counters
+               ORDER BY 1, 2
+       `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	defer rows.Close()
+	var result []models.Metrics
+	for rows.Next() {
+		var m models.Metrics
+		if err = rows.Scan(&m.ID, &m.MType, &m.Value, &m.Delta); err != nil {
+			return nil, fmt.Errorf("failed to scan metric row: %w", err)
+		}
+		result = append(result, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read metric rows: %w", err)
+	}
+
+	// Commit the transaction
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
+		return nil, fmt.Errorf("commit error: %w", err)
+	}
+	return result, nil
+}
+
+// Aggregate evaluates the aggregation query in the database.
+// The pattern is matched with the POSIX regular expression operator, the query engine rewrites its patterns for it.
+func (db *DB) Aggregate(ctx context.Context, pattern string, q models.Query) (models.QueryResult, error) {
+	db.log(ctx).Debugf("Aggregating %s of %q in the database", q.Func, pattern)
+	result := models.QueryResult{Func: q.Func}
+
+	// Build the source of the values from the tables of the requested types
+	var sources []string
+	if q.MType == "" || q.MType == models.Gauge {
+		sources = append(sources, `SELECT value AS v FROM gauges WHERE id ~ $1`)
+	}
+	if q.MType == "" || q.MType == models.Counter {
+		sources = append(sources, `SELECT delta::double precision AS v FROM counters WHERE id ~ $1`)
+	}
+	if len(sources) == 0 {
+		return result, fmt.Errorf("unknown metric type %q", q.MType)
+	}
+
+	var aggregate string
+	switch q.Func {
+	case models.AggSum:
+		aggregate = "sum(v)"
+	case models.AggAvg:
+		aggregate = "avg(v)"
+	case models.AggMin:
+		aggregate = "min(v)"
+	case models.AggMax:
+		aggregate = "max(v)"
+	case models.AggCount:
+		aggregate = "count(*)::double precision"
+	default:
+		return result, fmt.Errorf("aggregation %q is not supported by the database", q.Func)
+	}
+
+	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(ctx); rbErr != nil {
+				db.log(ctx).Errorf("failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	// The aggregate is NULL when nothing matches, the count tells the caller about it
+	query := fmt.Sprintf(`SELECT count(*), coalesce(%s, 0) FROM (%s) m`, aggregate, strings.Join(sources, " UNION ALL "))
+	if err = tx.QueryRow(ctx, query, pattern).Scan(&result.Count, &result.Value); err != nil {
+		return result, fmt.Errorf("failed to aggregate metrics: %w", err)
+	}
+
+	// Commit the transaction
+	if err := commitWithRetries(ctx, tx, db.log(ctx)); err != nil {
+		return result, fmt.Errorf("commit error: %w", err)
+	}
+	return result, nil
+}
+
 func (db *DB) Ping(ctx context.Context) error {
-	db.logger.Debug("Pinging the database")
+	db.log(ctx).Debug("Pinging the database")
 	if err := db.pool.Ping(ctx); err != nil {
 		return fmt.Errorf("failed to ping the database: %w", err)
 	}
-	db.logger.Debug("Database is connected")
+	db.log(ctx).Debug("Database is connected")
 	return nil
 }
 
+// Collect returns the statistics of the connection pool, for the self-metrics of the server.
+func (db *DB) Collect() []models.Metrics {
+	stat := db.pool.Stat()
+	return []models.Metrics{
+		selfmetrics.Gauge("db.pool.total_conns", float64(stat.TotalConns())),
+		selfmetrics.Gauge("db.pool.acquired_conns", float64(stat.AcquiredConns())),
+		selfmetrics.Gauge("db.pool.idle_conns", float64(stat.IdleConns())),
+		selfmetrics.Gauge("db.pool.max_conns", float64(stat.MaxConns())),
+		selfmetrics.Counter("db.pool.acquires", stat.AcquireCount()),
+		selfmetrics.Counter("db.pool.empty_acquires", stat.EmptyAcquireCount()),
+		selfmetrics.Counter("db.pool.canceled_acquires", stat.CanceledAcquireCount()),
+		selfmetrics.Counter("db.pool.acquire_duration_us", stat.AcquireDuration().Microseconds()),
+	}
+}
+
 // Close closes the database connection pool.
 func (db *DB) Close() error {
 	db.pool.Close()
 	return nil
 }
 
+// log returns the logger of the request of ctx, or the logger of the storage outside of a request.
+func (db *DB) log(ctx context.Context) *zap.SugaredLogger {
+	return logger.FromContext(ctx, db.logger)
+}
+
 func commitWithRetries(ctx context.Context, tx pgx.Tx, logger *zap.SugaredLogger) error {
 	// Define backoff durations for retries
 	backoffs := []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
 
 	for attempt := 1; attempt <= len(backoffs)+1; attempt++ {
 		// attempt to commit the transaction
-		if err := tx.Commit(ctx); err != nil {
+		if err := commit(ctx, tx, attempt); err != nil {
 			// if the error is not retriable or we have exhausted all retries, return the error
 			if !isErrorRetriable(err) || attempt == len(backoffs)+1 {
 				return fmt.Errorf("commit (attempt %d): %w", attempt, err)
@@ -365,6 +570,14 @@ func commitWithRetries(ctx context.Context, tx pgx.Tx, logger *zap.SugaredLogger
 	return nil
 }
 
+// commit commits the transaction in the span of the attempt, so that the retries show in the trace of the request.
+func commit(ctx context.Context, tx pgx.Tx, attempt int) error {
+	ctx, span := tracing.Start(ctx, "db.commit", trace.WithAttributes(attribute.Int("db.commit.attempt", attempt)))
+	err := tx.Commit(ctx)
+	tracing.End(span, err)
+	return err
+}
+
 // isErrorRetriable checks for specific PostgreSQL error codes that indicate retriable errors (connection issues).
 func isErrorRetriable(err error) bool {
 	var pgErr *pgconn.PgError
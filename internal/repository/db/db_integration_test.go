@@ -18,6 +18,7 @@ import (
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestMain(m *testing.M) {
@@ -461,3 +462,88 @@ func TestSaveBatchAndGetAll(t *testing.T) {
 		})
 	}
 }
+
+func TestListMetricsAndAggregate(t *testing.T) {
+	db, err := NewDB(context.Background(), &cfg.DBConfig{
+		DatabaseDSN: getDSN(),
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create a DB: %v", err)
+	}
+	defer db.Close()
+
+	alloc1, alloc2 := float64(10), float64(30)
+	polls := int64(7)
+	err = db.SaveBatch(context.Background(), []models.Metrics{
+		{ID: `Alloc{agent="a"}`, MType: models.Gauge, Value: &alloc1},
+		{ID: `Alloc{agent="b"}`, MType: models.Gauge, Value: &alloc2},
+		{ID: "AllocCount", MType: models.Counter, Delta: &polls},
+	})
+	assert.NoError(t, err)
+
+	t.Run("list_metrics", func(t *testing.T) {
+		metrics, err := db.ListMetrics(context.Background())
+		assert.NoError(t, err)
+		got := map[string]string{}
+		for _, m := range metrics {
+			got[m.ID] = m.MType
+		}
+		assert.Equal(t, models.Gauge, got[`Alloc{agent="a"}`])
+		assert.Equal(t, models.Counter, got["AllocCount"])
+	})
+
+	cases := []struct {
+		Name      string
+		Query     models.Query
+		WantValue float64
+		WantCount int64
+	}{
+		{Name: "sum_gauges", Query: models.Query{MType: models.Gauge, Func: models.AggSum}, WantValue: 40, WantCount: 2},
+		{Name: "avg_gauges", Query: models.Query{MType: models.Gauge, Func: models.AggAvg}, WantValue: 20, WantCount: 2},
+		{Name: "min_all", Query: models.Query{Func: models.AggMin}, WantValue: 7, WantCount: 3},
+		{Name: "max_all", Query: models.Query{Func: models.AggMax}, WantValue: 30, WantCount: 3},
+		{Name: "count_counters", Query: models.Query{MType: models.Counter, Func: models.AggCount}, WantValue: 1, WantCount: 1},
+	}
+	for i, tc := range cases {
+		i, tc := i, tc
+
+		t.Run(fmt.Sprintf("test #%d: %s", i, tc.Name), func(t *testing.T) {
+			got, err := db.Aggregate(context.Background(), `^Alloc.*$`, tc.Query)
+			assert.NoError(t, err)
+			assert.InDelta(t, tc.WantValue, got.Value, 1e-9)
+			assert.Equal(t, tc.WantCount, got.Count)
+		})
+	}
+}
+
+func TestUpdateBatch(t *testing.T) {
+	db, err := NewDB(context.Background(), &cfg.DBConfig{
+		DatabaseDSN: getDSN(),
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create a DB: %v", err)
+	}
+	defer db.Close()
+
+	gauge, newGauge := float64(1.5), float64(2.5)
+	delta := int64(3)
+	err = db.SaveBatch(context.Background(), []models.Metrics{{ID: "updateGauge", MType: models.Gauge, Value: &gauge}})
+	assert.NoError(t, err)
+
+	// The old values are returned by the same statements as the new ones, a new metric has none.
+	changes, err := db.UpdateBatch(context.Background(), []models.Metrics{
+		{ID: "updateGauge", MType: models.Gauge, Value: &newGauge},
+		{ID: "updateCounter", MType: models.Counter, Delta: &delta},
+		{ID: "updateCounter", MType: models.Counter, Delta: &delta},
+	})
+	assert.NoError(t, err)
+	total1, total2 := int64(3), int64(6)
+	assert.Equal(t, []models.MetricChange{
+		{ID: "updateGauge", MType: models.Gauge, OldValue: &gauge, NewValue: &newGauge},
+		{ID: "updateCounter", MType: models.Counter, NewDelta: &total1},
+		{ID: "updateCounter", MType: models.Counter, OldDelta: &total1, NewDelta: &total2},
+	}, changes)
+
+	_, err = db.UpdateBatch(context.Background(), []models.Metrics{})
+	assert.ErrorContains(t, err, "empty slice")
+}
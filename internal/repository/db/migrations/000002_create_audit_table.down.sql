@@ -0,0 +1,4 @@
+-- migrations/000002_create_audit_table.down.sql
+-- Drop table and index created in the up migration
+DROP INDEX IF EXISTS idx_audit_ts;
+DROP TABLE IF EXISTS audit;
@@ -0,0 +1,15 @@
+-- migrations/000002_create_audit_table.up.sql
+
+-- Create table for store audit records
+CREATE TABLE IF NOT EXISTS audit (
+ id BIGSERIAL PRIMARY KEY,
+ ts TIMESTAMPTZ NOT NULL,
+ ip_address TEXT NOT NULL,
+ endpoint TEXT NOT NULL DEFAULT '',
+ request_id TEXT NOT NULL DEFAULT '',
+ metrics TEXT[] NOT NULL,
+ record JSONB NOT NULL
+);
+
+-- Create index for audit records by time
+CREATE INDEX IF NOT EXISTS idx_audit_ts ON audit(ts);
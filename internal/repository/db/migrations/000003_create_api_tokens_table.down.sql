@@ -0,0 +1,3 @@
+-- migrations/000003_create_api_tokens_table.down.sql
+-- Drop table created in the up migration
+DROP TABLE IF EXISTS api_tokens;
@@ -0,0 +1,10 @@
+-- migrations/000003_create_api_tokens_table.up.sql
+
+-- Create table for store API tokens, only the SHA-256 hashes of the tokens are kept
+CREATE TABLE IF NOT EXISTS api_tokens (
+ id TEXT PRIMARY KEY NOT NULL,
+ hash TEXT NOT NULL UNIQUE,
+ scopes TEXT[] NOT NULL,
+ created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+ revoked_at TIMESTAMPTZ
+);
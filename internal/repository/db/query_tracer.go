@@ -3,26 +3,36 @@ package db
 import (
 	"context"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
 	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 // queryTracer implements the pgx.Tracer interface to log query execution details.
+// Every query also runs in a span, a child of the span of the repository call.
 type queryTracer struct {
 	logger *zap.SugaredLogger
 }
 
-// TraceQueryStart logs the start of a query execution.
+// TraceQueryStart logs the start of a query execution and starts its span.
 func (t *queryTracer) TraceQueryStart(
 	ctx context.Context,
 	_ *pgx.Conn,
 	data pgx.TraceQueryStartData,
 ) context.Context {
-	t.logger.Debugf("Running query %s (%v)", data.SQL, data.Args)
+	logger.FromContext(ctx, t.logger).Debugf("Running query %s (%v)", data.SQL, data.Args)
+	ctx, _ = tracing.Start(ctx, "db.query", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql"), attribute.String("db.query.text", data.SQL)))
 	return ctx
 }
 
-// TraceQueryEnd logs the end of a query execution.
-func (t *queryTracer) TraceQueryEnd(_ context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
-	t.logger.Debugf("%v", data.CommandTag)
+// TraceQueryEnd logs the end of a query execution and ends its span.
+func (t *queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	logger.FromContext(ctx, t.logger).Debugf("%v", data.CommandTag)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	tracing.End(span, data.Err)
 }
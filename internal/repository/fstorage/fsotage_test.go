@@ -219,3 +219,27 @@ func TestFileSaver_SaveBatch(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, counterVal2, *val4)
 }
+
+func TestFileSaver_Collect(t *testing.T) {
+	config := &cfg.FStorageConfig{FPath: tmpFilePath(t)}
+	fs := NewFileSaver(context.Background(), config, mstorage.NewMemStorage(), zap.NewNop().Sugar())
+	defer func() {
+		require.NoError(t, fs.Close(), "failed to close file saver")
+	}()
+
+	// Every synchronous save writes the file once.
+	value := 1.5
+	delta := int64(2)
+	require.NoError(t, fs.SetGauge(context.Background(), "gauge", &value))
+	require.NoError(t, fs.AddCounter(context.Background(), "counter", &delta))
+
+	collected := map[string]models.Metrics{}
+	for _, m := range fs.Collect() {
+		collected[m.ID] = m
+	}
+	require.Contains(t, collected, "fstorage.saves")
+	assert.Equal(t, int64(2), *collected["fstorage.saves"].Delta)
+	assert.Equal(t, int64(0), *collected["fstorage.save_failures"].Delta)
+	assert.Contains(t, collected, "fstorage.save_duration_us")
+	assert.Contains(t, collected, "fstorage.last_save_ms")
+}
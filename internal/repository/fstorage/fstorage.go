@@ -9,11 +9,14 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/logger"
 	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
 	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/repository/fstorage/config"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
 	"go.uber.org/zap"
 )
 
@@ -26,6 +29,15 @@ type FileSaver struct {
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
 	logger   *zap.SugaredLogger
+	saves    saveStats
+}
+
+// saveStats count the writes of the file, for the self-metrics of the server.
+type saveStats struct {
+	count    atomic.Int64 // writes of the file
+	failures atomic.Int64 // writes failed after the retries
+	duration atomic.Int64 // total duration of the writes, µs
+	last     atomic.Int64 // duration of the last write, µs
 }
 
 // NewFileSaver constructs a new FileSaver with the provided file name.
@@ -125,9 +137,22 @@ func (f *FileSaver) GetCounter(ctx context.Context, name string) (*int64, error)
 	return delta, nil
 }
 
+// ListMetrics returns all the saved metrics with their types.
+func (f *FileSaver) ListMetrics(ctx context.Context) ([]models.Metrics, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Call the embedded MemStorage method
+	metrics, err := f.MemStorage.ListMetrics(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metrics: %w", err)
+	}
+	return metrics, nil
+}
+
 // SaveBatch saves a batch of metrics to the repository.
 func (f *FileSaver) SaveBatch(ctx context.Context, metrics []models.Metrics) error {
-	f.logger.Debugf("saving metrics to %s", f.fname)
+	f.log(ctx).Debugf("saving metrics to %s", f.fname)
 	// Check if the file name is empty -> not saving (used in tests).
 	if f.fname == "" {
 		return nil
@@ -161,7 +186,7 @@ func (f *FileSaver) SaveBatch(ctx context.Context, metrics []models.Metrics) err
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 	// Write the data to the file.
-	if err := writeFileWithRetries(ctx, f.fname, data, f.logger); err != nil {
+	if err := f.writeFile(ctx, data); err != nil {
 		return fmt.Errorf("failed to save metrics to file: %w", err)
 	}
 
@@ -173,10 +198,54 @@ func (f *FileSaver) SaveBatch(ctx context.Context, metrics []models.Metrics) err
 	}
 	f.mu.Unlock()
 
-	f.logger.Debugf("metrics saved (%d bytes) to %s", len(data), f.fname)
+	f.log(ctx).Debugf("metrics saved (%d bytes) to %s", len(data), f.fname)
 	return nil
 }
 
+// UpdateBatch saves a batch of metrics to the storage, and to the file if the sync save is set,
+// and returns the values of its metrics before and after the update.
+func (f *FileSaver) UpdateBatch(ctx context.Context, metrics []models.Metrics) ([]models.MetricChange, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Call the embedded MemStorage method
+	changes, err := f.MemStorage.UpdateBatch(ctx, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update metrics: %w", err)
+	}
+
+	// If the sync save is set, save the metrics to the file.
+	if f.syncSave {
+		if err := f.saveToFile(ctx); err != nil {
+			return nil, fmt.Errorf("failed to save metrics to file: %w", err)
+		}
+	}
+	return changes, nil
+}
+
+// writeFile writes the data to the file with retries and counts the write.
+func (f *FileSaver) writeFile(ctx context.Context, data []byte) error {
+	start := time.Now()
+	err := writeFileWithRetries(ctx, f.fname, data, f.log(ctx))
+	d := time.Since(start).Microseconds()
+	f.saves.count.Add(1)
+	if err != nil {
+		f.saves.failures.Add(1)
+	}
+	f.saves.duration.Add(d)
+	f.saves.last.Store(d)
+	return err
+}
+
+// Collect returns the statistics of the writes of the file, for the self-metrics of the server.
+func (f *FileSaver) Collect() []models.Metrics {
+	return []models.Metrics{
+		selfmetrics.Counter("fstorage.saves", f.saves.count.Load()),
+		selfmetrics.Counter("fstorage.save_failures", f.saves.failures.Load()),
+		selfmetrics.Counter("fstorage.save_duration_us", f.saves.duration.Load()),
+		selfmetrics.Gauge("fstorage.last_save_ms", float64(f.saves.last.Load())/1000),
+	}
+}
+
 func writeFileWithRetries(ctx context.Context, fname string, data []byte, logger *zap.SugaredLogger) error {
 	backoffs := []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
 
@@ -200,7 +269,7 @@ func writeFileWithRetries(ctx context.Context, fname string, data []byte, logger
 
 // Load reads the metrics from the specified file and restores them to the storage.
 func (f *FileSaver) restoreFromFile(ctx context.Context) error {
-	f.logger.Debugf("loading metrics from %s", f.fname)
+	f.log(ctx).Debugf("loading metrics from %s", f.fname)
 	// Check if the file name is empty -> not saving (used in tests).
 	if f.fname == "" {
 		return nil
@@ -214,7 +283,7 @@ func (f *FileSaver) restoreFromFile(ctx context.Context) error {
 
 	// Check if the data is empty.
 	if len(data) == 0 {
-		f.logger.Warn("storage empty")
+		f.log(ctx).Warn("storage empty")
 		return nil
 	}
 
@@ -226,7 +295,7 @@ func (f *FileSaver) restoreFromFile(ctx context.Context) error {
 
 	if err := json.Unmarshal(data, &tmp); err != nil {
 		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-			f.logger.Warnf("data storage error: %w", err)
+			f.log(ctx).Warnf("data storage error: %w", err)
 			return nil
 		}
 		return fmt.Errorf("error unmarshal metrics: %w", err)
@@ -237,12 +306,12 @@ func (f *FileSaver) restoreFromFile(ctx context.Context) error {
 	f.Counter = tmp.Counter
 	f.mu.Unlock()
 
-	f.logger.Debugf("metrics restored from %s", f.fname)
+	f.log(ctx).Debugf("metrics restored from %s", f.fname)
 	return nil
 }
 
 func (f *FileSaver) saveToFile(ctx context.Context) error {
-	f.logger.Debugf("saving metrics to %s", f.fname)
+	f.log(ctx).Debugf("saving metrics to %s", f.fname)
 	// Check if the file name is empty -> not saving (used in tests).
 	if f.fname == "" {
 		return nil
@@ -262,13 +331,18 @@ func (f *FileSaver) saveToFile(ctx context.Context) error {
 		return err
 	}
 	// Write the data to the file.
-	if err := writeFileWithRetries(ctx, f.fname, data, f.logger); err != nil {
+	if err := f.writeFile(ctx, data); err != nil {
 		return err
 	}
-	f.logger.Debugf("metrics saved (%d bytes) to %s", len(data), f.fname)
+	f.log(ctx).Debugf("metrics saved (%d bytes) to %s", len(data), f.fname)
 	return nil
 }
 
+// log returns the logger of the request of ctx, or the logger of the storage outside of a request.
+func (f *FileSaver) log(ctx context.Context) *zap.SugaredLogger {
+	return logger.FromContext(ctx, f.logger)
+}
+
 func (f *FileSaver) intervalSaver(ctx context.Context, interval int) {
 	defer f.wg.Done()
 
@@ -3,6 +3,7 @@ package mstorage
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
 
 	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
@@ -32,7 +33,7 @@ func (ms *MemStorage) SetGauge(ctx context.Context, name string, value *float64)
 func (ms *MemStorage) GetGauge(ctx context.Context, name string) (*float64, error) {
 	val, ok := ms.Gauge[name]
 	if !ok {
-		return nil, fmt.Errorf("gauge %s not found", name)
+		return nil, fmt.Errorf("gauge %s %w", name, models.ErrNotFound)
 	}
 	return &val, nil
 }
@@ -48,7 +49,7 @@ func (ms *MemStorage) AddCounter(ctx context.Context, name string, delta *int64)
 func (ms *MemStorage) GetCounter(ctx context.Context, name string) (*int64, error) {
 	val, ok := ms.Counter[name]
 	if !ok {
-		return nil, fmt.Errorf("counter %s not found", name)
+		return nil, fmt.Errorf("counter %s %w", name, models.ErrNotFound)
 	}
 	return &val, nil
 }
@@ -66,6 +67,35 @@ func (ms *MemStorage) SaveBatch(ctx context.Context, batch []models.Metrics) err
 	return nil
 }
 
+// UpdateBatch saves a batch of metrics to the storage and returns the values of its metrics before and after the update.
+func (ms *MemStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) ([]models.MetricChange, error) {
+	changes := make([]models.MetricChange, 0, len(batch))
+	for _, m := range batch {
+		change := models.MetricChange{ID: m.ID, MType: m.MType}
+		switch m.MType {
+		case models.Gauge:
+			if old, ok := ms.Gauge[m.ID]; ok {
+				change.OldValue = &old
+			}
+			value := *m.Value
+			ms.Gauge[m.ID] = value
+			change.NewValue = &value
+		case models.Counter:
+			old, ok := ms.Counter[m.ID]
+			if ok {
+				change.OldDelta = &old
+			}
+			total := old + *m.Delta
+			ms.Counter[m.ID] = total
+			change.NewDelta = &total
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
 // Get all the saved metrics from the storage and return them and values as strings.
 func (ms *MemStorage) GetAll(ctx context.Context) (map[string]string, error) {
 	result := make(map[string]string)
@@ -78,6 +108,26 @@ func (ms *MemStorage) GetAll(ctx context.Context) (map[string]string, error) {
 	return result, nil
 }
 
+// ListMetrics returns all the saved metrics sorted by name.
+func (ms *MemStorage) ListMetrics(ctx context.Context) ([]models.Metrics, error) {
+	result := make([]models.Metrics, 0, len(ms.Gauge)+len(ms.Counter))
+	for k, v := range ms.Gauge {
+		value := v
+		result = append(result, models.Metrics{ID: k, MType: models.Gauge, Value: &value})
+	}
+	for k, v := range ms.Counter {
+		delta := v
+		result = append(result, models.Metrics{ID: k, MType: models.Counter, Delta: &delta})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID == result[j].ID {
+			return result[i].MType < result[j].MType
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
 // Ping is a no-op for the in-memory storage.
 func (ms *MemStorage) Ping(ctx context.Context) error {
 	return nil
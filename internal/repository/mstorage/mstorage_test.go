@@ -161,7 +161,7 @@ func TestMemStorage_GetCounter(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := ms.GetCounter(context.Background(), tt.metricName)
 			if tt.wantErr {
-				require.Error(t, err)
+				require.ErrorIs(t, err, models.ErrNotFound)
 			} else {
 				require.NoError(t, err)
 				assert.Equal(t, tt.wantValue, *got)
@@ -202,3 +202,53 @@ func TestMemStorage_SaveBatchAndGetAll(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, expected, all)
 }
+
+// TestMemStorage_UpdateBatch verifies that the batch update reports the values before and after the update.
+func TestMemStorage_UpdateBatch(t *testing.T) {
+	ms := newTestStorage()
+	ctx := context.Background()
+
+	gauge, delta := 1.5, int64(2)
+	require.NoError(t, ms.SaveBatch(ctx, []models.Metrics{{ID: "old", MType: models.Gauge, Value: &gauge}}))
+
+	newGauge, newDelta := 2.5, int64(3)
+	changes, err := ms.UpdateBatch(ctx, []models.Metrics{
+		{ID: "old", MType: models.Gauge, Value: &newGauge},
+		{ID: "new", MType: models.Counter, Delta: &delta},
+		{ID: "new", MType: models.Counter, Delta: &newDelta},
+		{ID: "unknown", MType: "histogram"},
+	})
+	require.NoError(t, err)
+
+	total1, total2 := int64(2), int64(5)
+	assert.Equal(t, []models.MetricChange{
+		{ID: "old", MType: models.Gauge, OldValue: &gauge, NewValue: &newGauge},
+		{ID: "new", MType: models.Counter, NewDelta: &total1},
+		{ID: "new", MType: models.Counter, OldDelta: &total1, NewDelta: &total2},
+	}, changes)
+
+	c, err := ms.GetCounter(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, total2, *c)
+}
+
+// TestMemStorage_ListMetrics verifies listing of the typed metrics sorted by name.
+func TestMemStorage_ListMetrics(t *testing.T) {
+	ms := newTestStorage()
+
+	gauge := 1.5
+	counter := int64(3)
+	require.NoError(t, ms.SaveBatch(context.Background(), []models.Metrics{
+		{ID: "b", MType: models.Gauge, Value: &gauge},
+		{ID: "a", MType: models.Counter, Delta: &counter},
+		{ID: "a", MType: models.Gauge, Value: &gauge},
+	}))
+
+	got, err := ms.ListMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{
+		{ID: "a", MType: models.Counter, Delta: &counter},
+		{ID: "a", MType: models.Gauge, Value: &gauge},
+		{ID: "b", MType: models.Gauge, Value: &gauge},
+	}, got)
+}
@@ -17,23 +17,35 @@ import (
 type Repository interface {
 	// SetGauge sets a gauge metric with the given name and value.
 	SetGauge(ctx context.Context, name string, value *float64) error
-	// GetGauge retrieves the value of a gauge metric by its name.
+	// GetGauge retrieves the value of a gauge metric by its name, the error wraps models.ErrNotFound if it is not stored.
 	GetGauge(ctx context.Context, name string) (*float64, error)
 	// AddCounter increments a counter metric by the given delta.
 	AddCounter(ctx context.Context, name string, delta *int64) error
-	// GetCounter retrieves the value of a counter metric by its name.
+	// GetCounter retrieves the value of a counter metric by its name, the error wraps models.ErrNotFound if it is not stored.
 	GetCounter(ctx context.Context, name string) (*int64, error)
 	// GetAll returns all available metrics
 	GetAll(ctx context.Context) (map[string]string, error)
+	// ListMetrics returns all available metrics with their types and values.
+	ListMetrics(ctx context.Context) ([]models.Metrics, error)
 	// SaveBatch saves a batch of metrics to the repository.
 	SaveBatch(ctx context.Context, batch []models.Metrics) error
+	// UpdateBatch saves a batch of metrics like SaveBatch and returns the values of every gauge and counter
+	// of the batch before and after its update, in the batch order. The values are read by the update itself.
+	UpdateBatch(ctx context.Context, batch []models.Metrics) ([]models.MetricChange, error)
 	// Ping checks the connection to the repository.
 	Ping(ctx context.Context) error
 	// Close closes the repository.
 	Close() error
 }
 
-// NewRepository creates a new repository based on the configuration.
+// Aggregator is implemented by repositories that evaluate aggregation queries natively.
+// The pattern is an anchored POSIX regular expression built from the query, written to match the same IDs as its Go form.
+type Aggregator interface {
+	// Aggregate evaluates the sum, avg, min, max or count of the metrics matching the pattern.
+	Aggregate(ctx context.Context, pattern string, q models.Query) (models.QueryResult, error)
+}
+
+// NewRepository creates a new repository based on the configuration. Its calls are traced.
 func NewRepository(ctx context.Context, config RepositoryConfig, logger *zap.SugaredLogger) (Repository, error) {
 	if config.DBConfig.DatabaseDSN != "" {
 		logger.Info("Using database storage")
@@ -41,12 +53,12 @@ func NewRepository(ctx context.Context, config RepositoryConfig, logger *zap.Sug
 		if err != nil {
 			return nil, fmt.Errorf("failed to create repository: %w", err)
 		}
-		return db, nil
+		return WithTracing(db), nil
 	} else if config.FSConfig.FPath != "" {
 		logger.Info("Using file storage")
-		return fstorage.NewFileSaver(ctx, &config.FSConfig, mstorage.NewMemStorage(), logger), nil
+		return WithTracing(fstorage.NewFileSaver(ctx, &config.FSConfig, mstorage.NewMemStorage(), logger)), nil
 	} else {
 		logger.Info("Using in-memory storage")
-		return mstorage.NewMemStorage(), nil
+		return WithTracing(mstorage.NewMemStorage()), nil
 	}
 }
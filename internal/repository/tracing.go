@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedRepository runs every call of the repository in a span, a child of the span of the request.
+type tracedRepository struct {
+	repo Repository
+}
+
+// tracedAggregator is a traced repository that keeps the native aggregation of the wrapped one.
+type tracedAggregator struct {
+	tracedRepository
+	agg Aggregator
+}
+
+// WithTracing wraps the repository so that its calls are traced. An Aggregator stays an Aggregator.
+func WithTracing(r Repository) Repository {
+	if agg, ok := r.(Aggregator); ok {
+		return &tracedAggregator{tracedRepository: tracedRepository{repo: r}, agg: agg}
+	}
+	return &tracedRepository{repo: r}
+}
+
+func (t *tracedRepository) SetGauge(ctx context.Context, name string, value *float64) (err error) {
+	ctx, span := tracing.Start(ctx, "repository.SetGauge", metricName(name))
+	defer func() { tracing.End(span, err) }()
+	return t.repo.SetGauge(ctx, name, value)
+}
+
+func (t *tracedRepository) GetGauge(ctx context.Context, name string) (_ *float64, err error) {
+	ctx, span := tracing.Start(ctx, "repository.GetGauge", metricName(name))
+	defer func() { tracing.End(span, err) }()
+	return t.repo.GetGauge(ctx, name)
+}
+
+func (t *tracedRepository) AddCounter(ctx context.Context, name string, delta *int64) (err error) {
+	ctx, span := tracing.Start(ctx, "repository.AddCounter", metricName(name))
+	defer func() { tracing.End(span, err) }()
+	return t.repo.AddCounter(ctx, name, delta)
+}
+
+func (t *tracedRepository) GetCounter(ctx context.Context, name string) (_ *int64, err error) {
+	ctx, span := tracing.Start(ctx, "repository.GetCounter", metricName(name))
+	defer func() { tracing.End(span, err) }()
+	return t.repo.GetCounter(ctx, name)
+}
+
+func (t *tracedRepository) GetAll(ctx context.Context) (_ map[string]string, err error) {
+	ctx, span := tracing.Start(ctx, "repository.GetAll")
+	defer func() { tracing.End(span, err) }()
+	return t.repo.GetAll(ctx)
+}
+
+func (t *tracedRepository) ListMetrics(ctx context.Context) (_ []models.Metrics, err error) {
+	ctx, span := tracing.Start(ctx, "repository.ListMetrics")
+	defer func() { tracing.End(span, err) }()
+	return t.repo.ListMetrics(ctx)
+}
+
+func (t *tracedRepository) SaveBatch(ctx context.Context, batch []models.Metrics) (err error) {
+	ctx, span := tracing.Start(ctx, "repository.SaveBatch", trace.WithAttributes(attribute.Int("metrics.count", len(batch))))
+	defer func() { tracing.End(span, err) }()
+	return t.repo.SaveBatch(ctx, batch)
+}
+
+func (t *tracedRepository) UpdateBatch(ctx context.Context, batch []models.Metrics) (_ []models.MetricChange, err error) {
+	ctx, span := tracing.Start(ctx, "repository.UpdateBatch", trace.WithAttributes(attribute.Int("metrics.count", len(batch))))
+	defer func() { tracing.End(span, err) }()
+	return t.repo.UpdateBatch(ctx, batch)
+}
+
+func (t *tracedRepository) Ping(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "repository.Ping")
+	defer func() { tracing.End(span, err) }()
+	return t.repo.Ping(ctx)
+}
+
+// Collect returns the self-metrics of the wrapped repository, if it reports any.
+func (t *tracedRepository) Collect() []models.Metrics {
+	if c, ok := t.repo.(selfmetrics.Collector); ok {
+		return c.Collect()
+	}
+	return nil
+}
+
+func (t *tracedRepository) Close() error {
+	return t.repo.Close()
+}
+
+func (t *tracedAggregator) Aggregate(ctx context.Context, pattern string, q models.Query) (_ models.QueryResult, err error) {
+	ctx, span := tracing.Start(ctx, "repository.Aggregate", trace.WithAttributes(attribute.String("metrics.pattern", pattern)))
+	defer func() { tracing.End(span, err) }()
+	return t.agg.Aggregate(ctx, pattern, q)
+}
+
+// metricName is the span attribute of the metric name.
+func metricName(name string) trace.SpanStartEventOption {
+	return trace.WithAttributes(attribute.String("metrics.name", name))
+}
@@ -0,0 +1,7 @@
+// Package config provides configuration structures for the self-metrics of the server.
+package config
+
+// SelfMetricsConfig holds the ingestion of the self-metrics into the repository of the server.
+type SelfMetricsConfig struct {
+	IngestInterval int `env:"SELF_METRICS_INTERVAL" json:"ingest_interval"` // Interval for saving the self-metrics to the repository, s; disabled if zero.
+}
@@ -0,0 +1,89 @@
+package selfmetrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"go.uber.org/zap"
+)
+
+// Saver is the repository the self-metrics are saved to.
+type Saver interface {
+	SaveBatch(ctx context.Context, batch []models.Metrics) error
+}
+
+// Ingester saves the self-metrics to the repository periodically, so that they can be queried and charted like the user metrics.
+type Ingester struct {
+	registry *Registry
+	storage  Saver
+	interval time.Duration
+	logger   *zap.SugaredLogger
+	saved    map[string]int64 // counter totals already added to the repository
+}
+
+// NewIngester creates an ingester saving the metrics of the registry every interval.
+func NewIngester(registry *Registry, storage Saver, interval time.Duration, logger *zap.SugaredLogger) *Ingester {
+	return &Ingester{
+		registry: registry,
+		storage:  storage,
+		interval: interval,
+		logger:   logger,
+		saved:    make(map[string]int64),
+	}
+}
+
+// Run saves the self-metrics every interval until ctx is cancelled, then saves them a last time.
+func (i *Ingester) Run(ctx context.Context) error {
+	ticker := time.NewTicker(i.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := i.Ingest(ctx); err != nil {
+				i.logger.Errorf("self-metrics ingestion failed: %v", err)
+			}
+		case <-ctx.Done():
+			// Use a fresh context, the parent one is already cancelled.
+			if err := i.Ingest(context.Background()); err != nil {
+				return fmt.Errorf("final self-metrics ingestion failed: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// Ingest saves the current self-metrics. The repository adds the counter deltas, so the counters are saved
+// as their increase since the last ingestion.
+func (i *Ingester) Ingest(ctx context.Context) error {
+	metrics := i.registry.Snapshot()
+	batch := make([]models.Metrics, 0, len(metrics))
+	totals := make(map[string]int64)
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			last, ok := i.saved[m.ID]
+			delta := *m.Delta - last
+			totals[m.ID] = *m.Delta
+			// The unchanged counters are left out once they exist.
+			if ok && delta == 0 {
+				continue
+			}
+			m.Delta = &delta
+		}
+		batch = append(batch, m)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := i.storage.SaveBatch(ctx, batch); err != nil {
+		return fmt.Errorf("failed to save self-metrics: %w", err)
+	}
+	for id, total := range totals {
+		i.saved[id] = total
+	}
+	i.logger.Debugf("saved %d self-metrics", len(batch))
+	return nil
+}
@@ -0,0 +1,160 @@
+// Package selfmetrics collects the metrics of the server about itself: its requests, its storage and its audit pipeline.
+// They are named under a reserved namespace, so that they can be saved to the repository next to the user metrics.
+package selfmetrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+)
+
+// Namespace prefixes the names of the self-metrics. The write paths of the user metrics reject it, see CheckName.
+const Namespace = "_server."
+
+// ErrReservedName is returned for the user metrics named under the namespace of the self-metrics.
+var ErrReservedName = errors.New("metric names starting with " + Namespace + " are reserved for the server")
+
+// CheckName returns ErrReservedName if the name of a user metric is under the namespace,
+// so that the metrics written by the clients cannot be mixed with the self-metrics.
+func CheckName(id string) error {
+	if strings.HasPrefix(id, Namespace) {
+		return fmt.Errorf("metric %q: %w", id, ErrReservedName)
+	}
+	return nil
+}
+
+// UnmatchedRoute is the route of the requests matching no route, so that unknown paths do not add metrics.
+const UnmatchedRoute = "unmatched"
+
+// Collector is implemented by the components reporting metrics about themselves.
+type Collector interface {
+	// Collect returns the metrics of the component named without the namespace, the counters as totals since the start.
+	Collect() []models.Metrics
+}
+
+// Registry counts the requests of the server per route and collects the metrics of the registered components.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+	routes     map[string]*routeStats
+}
+
+// routeStats are the request counters of a route.
+type routeStats struct {
+	requests map[string]int64 // requests per status class
+	count    int64            // requests of all the status classes
+	latency  time.Duration    // total time spent serving the requests
+}
+
+// NewRegistry creates a registry collecting the metrics of the components.
+func NewRegistry(collectors ...Collector) *Registry {
+	return &Registry{
+		collectors: collectors,
+		routes:     make(map[string]*routeStats),
+	}
+}
+
+// Register adds a collector to the registry.
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// RouteName returns the name of the route in the metric names: the lowercase method and the segments of the
+// pattern joined with dots, e.g. "post.update.metricType.metricName.metricValue" for
+// "POST /update/{metricType}/{metricName}/{metricValue}".
+// The parameters lose their braces and regular expressions, a wildcard is named "any" and the root "root";
+// the other characters are replaced with '_', so that the metrics can be read with GET /value/{type}/{name}.
+func RouteName(method, pattern string) string {
+	parts := []string{strings.ToLower(method)}
+	for _, segment := range strings.Split(pattern, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			segment, _, _ = strings.Cut(segment[1:len(segment)-1], ":")
+		}
+		switch segment {
+		case "":
+			continue
+		case "*":
+			segment = "any"
+		}
+		parts = append(parts, strings.Map(routeRune, segment))
+	}
+	if len(parts) == 1 {
+		parts = append(parts, "root")
+	}
+	return strings.Join(parts, ".")
+}
+
+// routeRune keeps the ASCII letters, digits, '_' and '-' of a route segment and replaces the other characters with '_'.
+func routeRune(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+		return r
+	}
+	return '_'
+}
+
+// ObserveRequest counts a request of the route, named by RouteName, answered with the status after the duration.
+func (r *Registry) ObserveRequest(route string, status int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.routes[route]
+	if !ok {
+		s = &routeStats{requests: make(map[string]int64)}
+		r.routes[route] = s
+	}
+	s.requests[statusClass(status)]++
+	s.count++
+	s.latency += d
+}
+
+// Snapshot returns the current self-metrics sorted by name.
+func (r *Registry) Snapshot() []models.Metrics {
+	var metrics []models.Metrics
+	r.mu.Lock()
+	for route, s := range r.routes {
+		for class, n := range s.requests {
+			metrics = append(metrics, Counter("http.requests."+route+"."+class, n))
+		}
+		metrics = append(metrics,
+			Counter("http.latency_us."+route, s.latency.Microseconds()),
+			Gauge("http.latency_avg_ms."+route, float64(s.latency.Microseconds())/float64(s.count)/1000))
+	}
+	collectors := r.collectors
+	r.mu.Unlock()
+	for _, c := range collectors {
+		metrics = append(metrics, c.Collect()...)
+	}
+
+	for i := range metrics {
+		metrics[i].ID = Namespace + metrics[i].ID
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+	return metrics
+}
+
+// Counter returns the counter metric with the total.
+func Counter(name string, total int64) models.Metrics {
+	return models.Metrics{ID: name, MType: models.Counter, Delta: &total}
+}
+
+// Gauge returns the gauge metric with the value.
+func Gauge(name string, value float64) models.Metrics {
+	return models.Metrics{ID: name, MType: models.Gauge, Value: &value}
+}
+
+// statusClass returns the class of the status code, such as "2xx".
+func statusClass(status int) string {
+	if status < http.StatusContinue || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,125 @@
+package selfmetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// collectorFunc adapts a function to the Collector interface.
+type collectorFunc func() []models.Metrics
+
+func (f collectorFunc) Collect() []models.Metrics { return f() }
+
+// failingSaver rejects every batch.
+type failingSaver struct{}
+
+func (failingSaver) SaveBatch(context.Context, []models.Metrics) error {
+	return errors.New("disk full")
+}
+
+// values returns the values of the metrics by name, the counters as float64.
+func values(metrics []models.Metrics) map[string]float64 {
+	v := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			v[m.ID] = float64(*m.Delta)
+		} else {
+			v[m.ID] = *m.Value
+		}
+	}
+	return v
+}
+
+func TestRegistry_Snapshot(t *testing.T) {
+	var dropped int64
+	reg := NewRegistry(collectorFunc(func() []models.Metrics {
+		return []models.Metrics{Counter("audit.dropped", dropped), Gauge("audit.spooled", 2)}
+	}))
+	route := RouteName(http.MethodPost, "/updates")
+	reg.ObserveRequest(route, http.StatusOK, 2*time.Millisecond)
+	reg.ObserveRequest(route, http.StatusOK, 4*time.Millisecond)
+	reg.ObserveRequest(route, http.StatusTooManyRequests, 0)
+	reg.ObserveRequest(UnmatchedRoute, http.StatusNotFound, time.Millisecond)
+	dropped = 5
+
+	metrics := reg.Snapshot()
+	assert.IsIncreasing(t, func() []string {
+		ids := make([]string, len(metrics))
+		for i, m := range metrics {
+			ids[i] = m.ID
+		}
+		return ids
+	}())
+	assert.Equal(t, map[string]float64{
+		"_server.audit.dropped":                    5,
+		"_server.audit.spooled":                    2,
+		"_server.http.requests.post.updates.2xx":   2,
+		"_server.http.requests.post.updates.4xx":   1,
+		"_server.http.latency_us.post.updates":     6000,
+		"_server.http.latency_avg_ms.post.updates": 2,
+		"_server.http.requests.unmatched.4xx":      1,
+		"_server.http.latency_us.unmatched":        1000,
+		"_server.http.latency_avg_ms.unmatched":    1,
+	}, values(metrics))
+}
+
+func TestRouteName(t *testing.T) {
+	tests := []struct {
+		method  string
+		pattern string
+		want    string
+	}{
+		{method: http.MethodPost, pattern: "/update/{metricType}/{metricName}/{metricValue}", want: "post.update.metricType.metricName.metricValue"},
+		{method: http.MethodGet, pattern: "/", want: "get.root"},
+		{method: http.MethodGet, pattern: "/debug/pprof/*", want: "get.debug.pprof.any"},
+		{method: http.MethodGet, pattern: "/api/{id:[0-9]+}", want: "get.api.id"},
+		{method: http.MethodPost, pattern: "/v1/metrics.json", want: "post.v1.metrics_json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, RouteName(tt.method, tt.pattern))
+		})
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	assert.NoError(t, CheckName("PollCount"))
+	assert.NoError(t, CheckName("server.requests"))
+	assert.ErrorIs(t, CheckName("_server.http.requests.get.ping.2xx"), ErrReservedName)
+}
+
+func TestIngester_Ingest(t *testing.T) {
+	var saves int64
+	reg := NewRegistry(collectorFunc(func() []models.Metrics {
+		return []models.Metrics{Counter("fstorage.saves", saves), Gauge("fstorage.last_save_ms", float64(saves))}
+	}))
+	storage := mstorage.NewMemStorage()
+	ingester := NewIngester(reg, storage, time.Second, zap.NewNop().Sugar())
+
+	// The counters are added as their increase since the last ingestion, the gauges are set.
+	saves = 3
+	require.NoError(t, ingester.Ingest(context.Background()))
+	saves = 5
+	require.NoError(t, ingester.Ingest(context.Background()))
+	require.NoError(t, ingester.Ingest(context.Background()))
+	assert.Equal(t, int64(5), storage.Counter["_server.fstorage.saves"])
+	assert.Equal(t, float64(5), storage.Gauge["_server.fstorage.last_save_ms"])
+
+	// A failed batch is added again with the next one.
+	ingester.storage = failingSaver{}
+	saves = 7
+	assert.Error(t, ingester.Ingest(context.Background()))
+	ingester.storage = storage
+	saves = 8
+	require.NoError(t, ingester.Ingest(context.Background()))
+	assert.Equal(t, int64(8), storage.Counter["_server.fstorage.saves"])
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/devize-ed/yapracproj-metrics.git/internal/certs"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/config"
 	"github.com/devize-ed/yapracproj-metrics.git/internal/handler"
 	"go.uber.org/zap"
@@ -40,12 +41,29 @@ func (s *Server) shutdown(ctx context.Context) error {
 }
 
 // Serve starts the HTTP server, blocks until ctx is cancelled, provide shutdown and save metrics.
+// The server serves HTTPS if a certificate is configured and verifies the client certificates if a client CA is set.
 func (s *Server) Serve(ctx context.Context) error {
+	// Load the TLS certificates before listening, so that a bad config fails the start.
+	tlsConfig, err := certs.ServerTLS(s.cfg.TLS)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %w", err)
+	}
+	s.TLSConfig = tlsConfig
+
 	// Start the HTTP server in a goroutine.
 	go func() {
 		// Setart the server and listen for incoming requests.
-		s.logger.Infof("HTTP server listening on %s", s.cfg.Connection.Host)
-		if err := s.ListenAndServe(); err != nil &&
+		var err error
+		if tlsConfig != nil {
+			s.logger.Infof("HTTPS server listening on %s, client certificates required: %t",
+				s.cfg.Connection.Host, tlsConfig.ClientCAs != nil)
+			// the certificates are already in TLSConfig
+			err = s.ListenAndServeTLS("", "")
+		} else {
+			s.logger.Infof("HTTP server listening on %s", s.cfg.Connection.Host)
+			err = s.ListenAndServe()
+		}
+		if err != nil &&
 			!errors.Is(err, http.ErrServerClosed) {
 			s.logger.Errorf("listen error: %w", err)
 		} else {
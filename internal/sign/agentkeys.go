@@ -0,0 +1,200 @@
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Headers of the requests signed with the private key of the agent.
+const (
+	SignatureHeader = "Signature" // base64 signature of the canonical request
+	AgentIDHeader   = "AgentID"   // ID of the agent, the name of its public key
+)
+
+var (
+	// ErrUnknownAgent is returned when the agent has no registered public key.
+	ErrUnknownAgent = errors.New("unknown agent")
+	// ErrBadSignature is returned when the signature does not match the public key of the agent.
+	ErrBadSignature = errors.New("signature verification failed")
+)
+
+// Signer signs the requests of an agent with its Ed25519 or ECDSA private key.
+type Signer struct {
+	key crypto.Signer
+}
+
+// LoadSigner reads the PEM PKCS#8 private key of the agent.
+func LoadSigner(path string) (*Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS8 private key: %w", err)
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &Signer{key: k}, nil
+	case *ecdsa.PrivateKey:
+		return &Signer{key: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T, use Ed25519 or ECDSA", key)
+	}
+}
+
+// Sign returns the base64 signature of the data: Ed25519, or ECDSA of its SHA-256 in ASN.1.
+func (s *Signer) Sign(data []byte) (string, error) {
+	var (
+		sig []byte
+		err error
+	)
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, data)
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		sig, err = ecdsa.SignASN1(rand.Reader, k, sum[:])
+	}
+	if err != nil {
+		return "", fmt.Errorf("sign request: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// AgentKeys holds the public keys of the registered agents, read from the <agent ID>.pem files of a directory.
+// An agent is revoked by removing its file and reloading the keys.
+type AgentKeys struct {
+	dir  string
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+// LoadAgentKeys reads the public keys of the directory.
+func LoadAgentKeys(dir string) (*AgentKeys, error) {
+	a := &AgentKeys{dir: dir}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload rereads the public keys of the directory, the loaded keys are kept if it fails.
+func (a *AgentKeys) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(a.dir, "*.pem"))
+	if err != nil {
+		return fmt.Errorf("failed to list agent keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(paths))
+	for _, path := range paths {
+		key, err := readPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("agent key %s: %w", filepath.Base(path), err)
+		}
+		keys[strings.TrimSuffix(filepath.Base(path), ".pem")] = key
+	}
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of registered agents.
+func (a *AgentKeys) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.keys)
+}
+
+// Verify checks the base64 signature of the data with the public key of the agent.
+func (a *AgentKeys) Verify(agentID string, data []byte, signature string) error {
+	a.mu.RLock()
+	key, ok := a.keys[agentID]
+	a.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownAgent, agentID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	var valid bool
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, data, sig)
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(k, sum[:], sig)
+	}
+	if !valid {
+		return fmt.Errorf("%w: agent %s", ErrBadSignature, agentID)
+	}
+	return nil
+}
+
+// GenerateAgentKey generates an Ed25519 key pair of an agent in the formats read by LoadSigner and LoadAgentKeys:
+// the PEM PKCS#8 private key and the PEM PKIX public key.
+func GenerateAgentKey() (privatePEM, publicPEM []byte, err error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate Ed25519 key: %w", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal private key: %w", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), nil
+}
+
+// LoadAgentKey reads the public key of an agent as LoadAgentKeys does, to check a key before registering it.
+func LoadAgentKey(path string) (crypto.PublicKey, error) {
+	return readPublicKey(path)
+}
+
+// readPublicKey reads a PEM PKIX Ed25519 or ECDSA public key.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKIX public key: %w", err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T, use Ed25519 or ECDSA", key)
+	}
+}
+
+// readPEM reads the file and returns its first PEM block.
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block in key")
+	}
+	return block, nil
+}
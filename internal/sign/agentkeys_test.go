@@ -0,0 +1,140 @@
+package sign
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/sign/signtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentKeys_Verify(t *testing.T) {
+	dir := t.TempDir()
+	edKey := signtest.WriteAgentKey(t, dir, "agent-ed", signtest.NewEd25519(t))
+	ecKey := signtest.WriteAgentKey(t, dir, "agent-ec", signtest.NewECDSA(t))
+	strangerKey := signtest.WriteAgentKey(t, t.TempDir(), "stranger", signtest.NewEd25519(t))
+
+	agents, err := LoadAgentKeys(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, agents.Len())
+
+	data := CanonicalRequest("POST", "/updates/", "1760788800", "abc", []byte("body"))
+	signWith := func(path string) string {
+		signer, err := LoadSigner(path)
+		require.NoError(t, err)
+		sig, err := signer.Sign(data)
+		require.NoError(t, err)
+		return sig
+	}
+
+	tests := []struct {
+		name      string
+		agentID   string
+		data      []byte
+		signature string
+		wantErr   error
+	}{
+		{name: "ed25519", agentID: "agent-ed", data: data, signature: signWith(edKey)},
+		{name: "ecdsa", agentID: "agent-ec", data: data, signature: signWith(ecKey)},
+		{name: "unknown_agent", agentID: "stranger", data: data, signature: signWith(strangerKey), wantErr: ErrUnknownAgent},
+		{name: "key_of_another_agent", agentID: "agent-ed", data: data, signature: signWith(ecKey), wantErr: ErrBadSignature},
+		{name: "tampered_data", agentID: "agent-ed", data: []byte("forged"), signature: signWith(edKey), wantErr: ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := agents.Verify(tt.agentID, tt.data, tt.signature)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("malformed_signature", func(t *testing.T) {
+		assert.Error(t, agents.Verify("agent-ed", data, "not base64!"))
+	})
+}
+
+func TestAgentKeys_Reload(t *testing.T) {
+	dir := t.TempDir()
+	key := signtest.WriteAgentKey(t, dir, "agent-1", signtest.NewEd25519(t))
+	signtest.WriteAgentKey(t, dir, "agent-2", signtest.NewEd25519(t))
+	agents, err := LoadAgentKeys(dir)
+	require.NoError(t, err)
+
+	signer, err := LoadSigner(key)
+	require.NoError(t, err)
+	sig, err := signer.Sign([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, agents.Verify("agent-1", []byte("data"), sig))
+
+	// Revoke the agent by removing its public key.
+	require.NoError(t, os.Remove(filepath.Join(dir, "agent-1.pem")))
+	require.NoError(t, agents.Reload())
+	assert.Equal(t, 1, agents.Len())
+	assert.True(t, errors.Is(agents.Verify("agent-1", []byte("data"), sig), ErrUnknownAgent))
+
+	// A broken key file fails the reload and the loaded keys are kept.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("not a key"), 0600))
+	assert.Error(t, agents.Reload())
+	assert.Equal(t, 1, agents.Len())
+}
+
+func TestLoadAgentKeys_Errors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	rsaDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rsaDir, "agent.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	garbageDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(garbageDir, "agent.pem"), []byte("not a key"), 0600))
+
+	_, err = LoadAgentKeys(rsaDir)
+	assert.ErrorContains(t, err, "unsupported public key type")
+	_, err = LoadAgentKeys(garbageDir)
+	assert.ErrorContains(t, err, "no PEM block")
+}
+
+func TestLoadSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+	rsaPath := filepath.Join(t.TempDir(), "rsa.key")
+	require.NoError(t, os.WriteFile(rsaPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	_, err = LoadSigner(rsaPath)
+	assert.ErrorContains(t, err, "unsupported private key type")
+	_, err = LoadSigner(filepath.Join(t.TempDir(), "missing.key"))
+	assert.Error(t, err)
+}
+
+func TestGenerateAgentKey(t *testing.T) {
+	priv, pub, err := GenerateAgentKey()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "agent-1.pem"), pub, 0644))
+	keyFile := filepath.Join(t.TempDir(), "agent-1.key")
+	require.NoError(t, os.WriteFile(keyFile, priv, 0600))
+
+	signer, err := LoadSigner(keyFile)
+	require.NoError(t, err)
+	agents, err := LoadAgentKeys(dir)
+	require.NoError(t, err)
+	sig, err := signer.Sign([]byte("data"))
+	require.NoError(t, err)
+	assert.NoError(t, agents.Verify("agent-1", []byte("data"), sig))
+	_, err = LoadAgentKey(filepath.Join(dir, "agent-1.pem"))
+	assert.NoError(t, err)
+}
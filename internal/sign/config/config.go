@@ -2,5 +2,21 @@
 package config
 
 type SignConfig struct {
-	Key string `env:"KEY" json:"key"` // Secret key for the Hash.
+	Key            string      `env:"KEY" json:"key"`                                // Secret key for the Hash.
+	KeyID          string      `env:"KEY_ID" json:"key_id"`                          // ID of the key, sent in the HashKeyID header.
+	Keys           []KeyConfig `json:"keys"`                                         // More keys accepted by the server, for the key rotation.
+	ReplayWindow   int         `env:"SIGN_REPLAY_WINDOW" json:"replay_window"`       // Accepted clock skew of the signed requests, s; 300 if zero.
+	NonceCacheSize int         `env:"SIGN_NONCE_CACHE_SIZE" json:"nonce_cache_size"` // Nonces of the signed requests remembered by the server; 100000 if zero.
+	Required       bool        `env:"SIGN_REQUIRED" json:"required"`                 // Reject the POST requests not signed with replay protection.
+	AgentKeysDir   string      `env:"SIGN_AGENT_KEYS_DIR" json:"agent_keys_dir"`     // Directory of the <agent ID>.pem public keys of the agents.
+	PrivateKey     string      `env:"SIGN_PRIVATE_KEY" json:"private_key"`           // PEM Ed25519 or ECDSA private key of the agent.
+	AgentID        string      `env:"AGENT_ID" json:"agent_id"`                      // ID of the agent, the name of its public key on the server.
+}
+
+// KeyConfig is a key of the key ring of the server.
+type KeyConfig struct {
+	ID        string `json:"id"`                   // ID of the key, sent by the agents in the HashKeyID header.
+	Key       string `json:"key"`                  // Secret key for the Hash.
+	NotBefore string `json:"not_before,omitempty"` // RFC 3339 time the key becomes valid, valid from the start if empty.
+	NotAfter  string `json:"not_after,omitempty"`  // RFC 3339 time the key expires, never if empty.
 }
@@ -0,0 +1,179 @@
+package sign
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/sign/config"
+)
+
+// KeyIDHeader is the HTTP header name for the ID of the key of the hash.
+const KeyIDHeader = "HashKeyID"
+
+var (
+	// ErrUnknownKey is returned when the key ID of the request is not in the key ring.
+	ErrUnknownKey = errors.New("unknown sign key")
+	// ErrKeyNotValid is returned when the key of the request is not yet or no longer valid.
+	ErrKeyNotValid = errors.New("sign key is not valid at this time")
+)
+
+// Key is a key of the key ring.
+type Key struct {
+	ID        string    // ID of the key, empty for the key of the KEY setting without KEY_ID
+	Secret    string    // secret key for the Hash
+	NotBefore time.Time // time the key becomes valid, zero if it is valid from the start
+	NotAfter  time.Time // time the key expires, zero if it never expires
+}
+
+// ValidAt reports whether the key is valid at the time.
+func (k Key) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// KeyRing holds the keys accepted by the server, so that the keys can be rotated without downtime:
+// a new key is added to the ring, the agents are moved to it one by one, then the old key is removed or expires.
+type KeyRing struct {
+	keys []Key
+	now  func() time.Time
+}
+
+// NewKeyRing creates a key ring of the keys, the key IDs must be unique.
+func NewKeyRing(keys ...Key) (*KeyRing, error) {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k.Secret == "" {
+			return nil, fmt.Errorf("sign key %q: secret is required", k.ID)
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("sign key %q: duplicate key ID", k.ID)
+		}
+		if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotBefore.Before(k.NotAfter) {
+			return nil, fmt.Errorf("sign key %q: not_before must be before not_after", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return &KeyRing{keys: keys, now: time.Now}, nil
+}
+
+// NewSingleKeyRing creates a key ring of one key without ID, nil if the key is empty.
+func NewSingleKeyRing(secret string) *KeyRing {
+	if secret == "" {
+		return nil
+	}
+	return &KeyRing{keys: []Key{{Secret: secret}}, now: time.Now}
+}
+
+// KeyRingFromConfig creates the key ring of the key and the keys of the config, nil if there are none.
+func KeyRingFromConfig(c cfg.SignConfig) (*KeyRing, error) {
+	var keys []Key
+	if c.Key != "" {
+		keys = append(keys, Key{ID: c.KeyID, Secret: c.Key})
+	}
+	for _, kc := range c.Keys {
+		if kc.ID == "" {
+			return nil, errors.New("sign key: id is required")
+		}
+		k := Key{ID: kc.ID, Secret: kc.Key}
+		var err error
+		if k.NotBefore, err = parseKeyTime(kc.NotBefore); err != nil {
+			return nil, fmt.Errorf("sign key %q: not_before: %w", kc.ID, err)
+		}
+		if k.NotAfter, err = parseKeyTime(kc.NotAfter); err != nil {
+			return nil, fmt.Errorf("sign key %q: not_after: %w", kc.ID, err)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return NewKeyRing(keys...)
+}
+
+// parseKeyTime parses an RFC 3339 time, the zero time if the value is empty.
+func parseKeyTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Empty reports whether the ring has no keys, a nil ring is empty.
+func (r *KeyRing) Empty() bool {
+	return r == nil || len(r.keys) == 0
+}
+
+// Key returns the currently valid key with the ID.
+func (r *KeyRing) Key(id string) (Key, bool) {
+	if r.Empty() || id == "" {
+		return Key{}, false
+	}
+	now := r.now()
+	for _, k := range r.keys {
+		if k.ID == id && k.ValidAt(now) {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// SigningKey returns the key signing the responses to the requests without a valid key:
+// the first currently valid key, that is the key of KEY if it is set.
+func (r *KeyRing) SigningKey() (Key, bool) {
+	if r.Empty() {
+		return Key{}, false
+	}
+	now := r.now()
+	for _, k := range r.keys {
+		if k.ValidAt(now) {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// Verify checks the hash of the data and returns the key that matches it.
+// With a key ID only that key is tried, without one every currently valid key is tried,
+// so that the agents which do not send a key ID keep working during the rotation.
+func (r *KeyRing) Verify(data []byte, keyID, hash string) (Key, error) {
+	if r.Empty() {
+		return Key{}, ErrUnknownKey
+	}
+	now := r.now()
+	if keyID != "" {
+		for _, k := range r.keys {
+			if k.ID != keyID {
+				continue
+			}
+			if !k.ValidAt(now) {
+				return Key{}, fmt.Errorf("%w: %s", ErrKeyNotValid, keyID)
+			}
+			if _, err := Verify(data, k.Secret, hash); err != nil {
+				return Key{}, err
+			}
+			return k, nil
+		}
+		return Key{}, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	valid := 0
+	for _, k := range r.keys {
+		if !k.ValidAt(now) {
+			continue
+		}
+		valid++
+		if ok, _ := Verify(data, k.Secret, hash); ok {
+			return k, nil
+		}
+	}
+	if valid == 0 {
+		return Key{}, ErrKeyNotValid
+	}
+	return Key{}, errors.New("hash verification failed: no valid key matches")
+}
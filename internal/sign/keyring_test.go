@@ -0,0 +1,140 @@
+package sign
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/sign/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRingFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  cfg.SignConfig
+		wantIDs []string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "no_keys", config: cfg.SignConfig{}, wantNil: true},
+		{name: "single_key", config: cfg.SignConfig{Key: "k"}, wantIDs: []string{""}},
+		{
+			name: "key_and_ring",
+			config: cfg.SignConfig{Key: "k", KeyID: "k1", Keys: []cfg.KeyConfig{
+				{ID: "k2", Key: "k2", NotBefore: "2026-10-01T00:00:00Z", NotAfter: "2026-12-01T00:00:00Z"},
+			}},
+			wantIDs: []string{"k1", "k2"},
+		},
+		{name: "ring_key_without_id", config: cfg.SignConfig{Keys: []cfg.KeyConfig{{Key: "k"}}}, wantErr: true},
+		{name: "ring_key_without_secret", config: cfg.SignConfig{Keys: []cfg.KeyConfig{{ID: "k1"}}}, wantErr: true},
+		{
+			name:    "duplicate_id",
+			config:  cfg.SignConfig{Key: "k", KeyID: "k1", Keys: []cfg.KeyConfig{{ID: "k1", Key: "other"}}},
+			wantErr: true,
+		},
+		{name: "bad_time", config: cfg.SignConfig{Keys: []cfg.KeyConfig{{ID: "k1", Key: "k", NotAfter: "tomorrow"}}}, wantErr: true},
+		{
+			name: "empty_validity",
+			config: cfg.SignConfig{Keys: []cfg.KeyConfig{
+				{ID: "k1", Key: "k", NotBefore: "2026-12-01T00:00:00Z", NotAfter: "2026-10-01T00:00:00Z"},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring, err := KeyRingFromConfig(tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantNil {
+				assert.Nil(t, ring)
+				assert.True(t, ring.Empty())
+				return
+			}
+			var ids []string
+			for _, k := range ring.keys {
+				ids = append(ids, k.ID)
+			}
+			assert.Equal(t, tt.wantIDs, ids)
+		})
+	}
+}
+
+func TestKeyRing_Verify(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	ring, err := NewKeyRing(
+		Key{ID: "old", Secret: "old_key", NotAfter: now},
+		Key{ID: "current", Secret: "current_key", NotBefore: now.Add(-24 * time.Hour)},
+		Key{ID: "next", Secret: "next_key", NotBefore: now.Add(time.Hour)},
+	)
+	require.NoError(t, err)
+	ring.now = func() time.Time { return now }
+
+	data := []byte("test_data")
+	tests := []struct {
+		name    string
+		keyID   string
+		secret  string
+		wantID  string
+		wantErr error
+	}{
+		{name: "by_id", keyID: "current", secret: "current_key", wantID: "current"},
+		{name: "without_id", secret: "current_key", wantID: "current"},
+		{name: "expired_at_not_after", keyID: "old", secret: "old_key", wantErr: ErrKeyNotValid},
+		{name: "before_not_before", keyID: "next", secret: "next_key", wantErr: ErrKeyNotValid},
+		{name: "unknown_id", keyID: "other", secret: "current_key", wantErr: ErrUnknownKey},
+		{name: "expired_without_id", secret: "old_key"},
+		{name: "wrong_secret", keyID: "current", secret: "old_key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ring.Verify(data, tt.keyID, Hash(data, tt.secret))
+			if tt.wantID == "" {
+				require.Error(t, err)
+				if tt.wantErr != nil {
+					assert.True(t, errors.Is(err, tt.wantErr), "got %v", err)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantID, key.ID)
+		})
+	}
+
+	// After the rotation window the next key takes over.
+	ring.now = func() time.Time { return now.Add(2 * time.Hour) }
+	key, err := ring.Verify(data, "", Hash(data, "next_key"))
+	require.NoError(t, err)
+	assert.Equal(t, "next", key.ID)
+}
+
+func TestKeyRing_SigningKey(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	ring, err := NewKeyRing(
+		Key{ID: "old", Secret: "old_key", NotAfter: now},
+		Key{ID: "current", Secret: "current_key"},
+	)
+	require.NoError(t, err)
+	ring.now = func() time.Time { return now }
+
+	key, ok := ring.SigningKey()
+	require.True(t, ok)
+	assert.Equal(t, "current", key.ID, "the expired key does not sign")
+
+	key, ok = ring.Key("current")
+	require.True(t, ok)
+	assert.Equal(t, "current_key", key.Secret)
+	_, ok = ring.Key("old")
+	assert.False(t, ok)
+	_, ok = ring.Key("")
+	assert.False(t, ok)
+
+	var empty *KeyRing
+	_, ok = empty.SigningKey()
+	assert.False(t, ok)
+}
@@ -0,0 +1,139 @@
+package sign
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of the signed requests with replay protection.
+const (
+	TimestampHeader = "HashTimestamp" // Unix time of the request, in seconds
+	NonceHeader     = "HashNonce"     // random value used once
+)
+
+// Defaults of the replay protection.
+const (
+	DefaultReplayWindow   = 5 * time.Minute // accepted clock skew between the agent and the server
+	DefaultNonceCacheSize = 100000          // nonces remembered by the server
+)
+
+var (
+	// ErrStaleRequest is returned for a timestamp outside of the clock skew window.
+	ErrStaleRequest = errors.New("request timestamp is outside of the replay window")
+	// ErrReplayedRequest is returned for a nonce that was already seen.
+	ErrReplayedRequest = errors.New("request nonce was already used")
+)
+
+// CanonicalRequest returns the signed material of a request with replay protection:
+// the method, the path, the timestamp, the nonce and the hex SHA-256 of the body, one per line.
+func CanonicalRequest(method, path, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n"))
+}
+
+// NewNonce returns a random nonce.
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ReplayGuard rejects the requests outside of the clock skew window and the nonces it has already seen.
+// The nonces are kept until they leave the window. When the cache is full the oldest nonce is evicted,
+// and the requests not newer than it are rejected from then on, so that the evicted nonce cannot be replayed.
+type ReplayGuard struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	seen   map[string]bool
+	byTime nonceHeap
+	floor  time.Time // requests at or before it are rejected
+	now    func() time.Time
+}
+
+// NewReplayGuard creates a guard with the window and the nonce cache size, the defaults if they are zero.
+func NewReplayGuard(window time.Duration, size int) *ReplayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	if size <= 0 {
+		size = DefaultNonceCacheSize
+	}
+	return &ReplayGuard{
+		window: window,
+		size:   size,
+		seen:   make(map[string]bool),
+		now:    time.Now,
+	}
+}
+
+// Check validates the timestamp and records the nonce of a request whose signature is verified.
+func (g *ReplayGuard) Check(timestamp, nonce string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp %q", timestamp)
+	}
+	if nonce == "" {
+		return errors.New("request nonce is empty")
+	}
+	ts := time.Unix(sec, 0)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) || !ts.After(g.floor) {
+		return ErrStaleRequest
+	}
+	if g.seen[nonce] {
+		return ErrReplayedRequest
+	}
+
+	// Forget the nonces that left the window, they are rejected as stale anyway.
+	for len(g.byTime) > 0 && g.byTime[0].ts.Before(now.Add(-g.window)) {
+		delete(g.seen, heap.Pop(&g.byTime).(nonceEntry).nonce)
+	}
+	// Evict the oldest nonces if the cache is still full.
+	for len(g.byTime) >= g.size {
+		oldest := heap.Pop(&g.byTime).(nonceEntry)
+		delete(g.seen, oldest.nonce)
+		if oldest.ts.After(g.floor) {
+			g.floor = oldest.ts
+		}
+	}
+	if !ts.After(g.floor) {
+		return ErrStaleRequest
+	}
+	g.seen[nonce] = true
+	heap.Push(&g.byTime, nonceEntry{nonce: nonce, ts: ts})
+	return nil
+}
+
+// nonceEntry is a nonce with the timestamp of its request.
+type nonceEntry struct {
+	nonce string
+	ts    time.Time
+}
+
+// nonceHeap orders the nonces by their timestamps, the oldest first.
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].ts.Before(h[j].ts) }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x any)        { *h = append(*h, x.(nonceEntry)) }
+func (h *nonceHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
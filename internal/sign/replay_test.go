@@ -0,0 +1,87 @@
+package sign
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalRequest(t *testing.T) {
+	got := CanonicalRequest("POST", "/updates/", "1760788800", "abc", []byte("body"))
+	assert.Equal(t,
+		"POST\n/updates/\n1760788800\nabc\n230d8358dc8e8890b4c58deeb62912ee2f20357ae92a5cc861b98e68fe31acb5",
+		string(got))
+
+	nonce, err := NewNonce()
+	require.NoError(t, err)
+	other, err := NewNonce()
+	require.NoError(t, err)
+	assert.Len(t, nonce, 32)
+	assert.NotEqual(t, nonce, other)
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	ts := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+
+	tests := []struct {
+		name      string
+		timestamp string
+		nonce     string
+		wantErr   error
+	}{
+		{name: "fresh", timestamp: ts(0), nonce: "n1"},
+		{name: "replay", timestamp: ts(0), nonce: "n1", wantErr: ErrReplayedRequest},
+		{name: "skewed_within_window", timestamp: ts(-4 * time.Minute), nonce: "n2"},
+		{name: "from_the_future_within_window", timestamp: ts(4 * time.Minute), nonce: "n3"},
+		{name: "too_old", timestamp: ts(-6 * time.Minute), nonce: "n4", wantErr: ErrStaleRequest},
+		{name: "too_new", timestamp: ts(6 * time.Minute), nonce: "n5", wantErr: ErrStaleRequest},
+	}
+	g := NewReplayGuard(0, 0)
+	g.now = func() time.Time { return now }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := g.Check(tt.timestamp, tt.nonce)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		assert.Error(t, g.Check("yesterday", "n6"))
+		assert.Error(t, g.Check(ts(0), ""))
+	})
+
+	t.Run("expired_nonces_are_forgotten", func(t *testing.T) {
+		g.now = func() time.Time { return now.Add(10 * time.Minute) }
+		require.NoError(t, g.Check(ts(10*time.Minute), "n7"))
+		assert.Len(t, g.seen, 1)
+	})
+}
+
+func TestReplayGuard_Bounded(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	ts := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+	g := NewReplayGuard(time.Minute, 2)
+	g.now = func() time.Time { return now }
+
+	require.NoError(t, g.Check(ts(-30*time.Second), "n1"))
+	require.NoError(t, g.Check(ts(-20*time.Second), "n2"))
+	// The cache is full, the oldest nonce is evicted.
+	require.NoError(t, g.Check(ts(-10*time.Second), "n3"))
+	assert.Len(t, g.seen, 2)
+
+	// The evicted nonce cannot be replayed: requests not newer than it are rejected.
+	assert.True(t, errors.Is(g.Check(ts(-30*time.Second), "n1"), ErrStaleRequest))
+	assert.True(t, errors.Is(g.Check(ts(-40*time.Second), "n4"), ErrStaleRequest))
+	assert.True(t, errors.Is(g.Check(ts(-20*time.Second), "n2"), ErrReplayedRequest))
+	assert.NoError(t, g.Check(ts(0), "n5"))
+	assert.Len(t, g.seen, 2)
+}
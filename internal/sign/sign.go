@@ -4,6 +4,7 @@ package sign
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -12,6 +13,18 @@ import (
 // HashHeader is the HTTP header name for the HMAC-SHA256 hash.
 const HashHeader = "HashSHA256"
 
+// NewSecret returns a random HMAC key of the size in bytes, hex encoded.
+func NewSecret(size int) (string, error) {
+	if size < 16 {
+		return "", fmt.Errorf("secret must be at least 16 bytes (got %d)", size)
+	}
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // Hash calculates the HMAC-SHA256 hash of the given data using the provided key.
 func Hash(data []byte, key string) string {
 	// Create a new HMAC-SHA256 hash.
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHash(t *testing.T) {
@@ -91,3 +92,15 @@ func TestVerify(t *testing.T) {
 		})
 	}
 }
+
+func TestNewSecret(t *testing.T) {
+	_, err := NewSecret(8)
+	assert.Error(t, err)
+
+	secret, err := NewSecret(32)
+	require.NoError(t, err)
+	other, err := NewSecret(32)
+	require.NoError(t, err)
+	assert.Len(t, secret, 64)
+	assert.NotEqual(t, secret, other)
+}
@@ -0,0 +1,62 @@
+// Package signtest generates throwaway agent key pairs for the tests of the asymmetric request signing.
+package signtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// NewEd25519 generates an Ed25519 private key.
+func NewEd25519(t testing.TB) crypto.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate Ed25519 key: %v", err)
+	}
+	return key
+}
+
+// NewECDSA generates an ECDSA P-256 private key.
+func NewECDSA(t testing.TB) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECDSA key: %v", err)
+	}
+	return key
+}
+
+// WriteAgentKey registers the agent in the keys directory by writing its public key to <dir>/<agentID>.pem.
+// It returns the path of the PEM PKCS#8 private key, written to a temporary directory of the test.
+func WriteAgentKey(t testing.TB, dir, agentID string, key crypto.Signer) string {
+	t.Helper()
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	writePEM(t, filepath.Join(dir, agentID+".pem"), "PUBLIC KEY", pub)
+
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), agentID+".key")
+	writePEM(t, path, "PRIVATE KEY", priv)
+	return path
+}
+
+// writePEM writes the PEM block to the file.
+func writePEM(t testing.TB, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,8 @@
+// Package config provides configuration structures for the StatsD listener.
+package config
+
+// StatsDConfig holds the StatsD listener of the server. The listener is disabled without an address.
+type StatsDConfig struct {
+	Address       string `env:"STATSD_ADDRESS" json:"address"`               // UDP address to listen on, the listener is disabled when empty.
+	FlushInterval int    `env:"STATSD_FLUSH_INTERVAL" json:"flush_interval"` // Interval for flushing aggregated values to the repository, s.
+}
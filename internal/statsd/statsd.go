@@ -0,0 +1,392 @@
+// Package statsd provides a UDP listener for the StatsD line protocol.
+// It aggregates received counters and gauges and flushes them to the repository periodically.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/selfmetrics"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/statsd/config"
+	"go.uber.org/zap"
+)
+
+// defaultFlushInterval is used when the flush interval is not configured.
+const defaultFlushInterval = 10 * time.Second
+
+// maxCounter is 2^63, the first float64 above the int64 range; -maxCounter is math.MinInt64.
+const maxCounter = float64(1 << 63)
+
+// maxPacketSize is the maximum size of a single UDP datagram.
+const maxPacketSize = 65535
+
+// StatsD metric types supported by the listener.
+const (
+	typeCounter = "c"
+	typeGauge   = "g"
+)
+
+// Sample is a single parsed StatsD value.
+type Sample struct {
+	Name     string  // metric name
+	Type     string  // StatsD type: "c" or "g"
+	Value    float64 // parsed value
+	Rate     float64 // sample rate in (0, 1]
+	Relative bool    // gauge value is a signed delta (e.g. "+3" or "-3")
+}
+
+// gaugeState holds the aggregated gauge value between flushes.
+type gaugeState struct {
+	value    float64
+	relative bool // value is a delta relative to the stored gauge
+}
+
+// Listener receives StatsD packets over UDP and flushes aggregated values to the repository.
+type Listener struct {
+	addr          string
+	flushInterval time.Duration
+	storage       repository.Repository
+	auditor       *audit.Auditor
+	logger        *zap.SugaredLogger
+
+	mu         sync.Mutex
+	counters   map[string]float64             // accumulated counter increments
+	remainders map[string]float64             // fractions of the counters left from the previous flushes
+	gauges     map[string]*gaugeState         // last gauge values or accumulated deltas
+	sources    map[string]map[string]struct{} // metric names per source address, for the auditor
+}
+
+// NewListener creates a new StatsD listener.
+func NewListener(config cfg.StatsDConfig, storage repository.Repository, auditor *audit.Auditor, logger *zap.SugaredLogger) *Listener {
+	interval := time.Duration(config.FlushInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	return &Listener{
+		addr:          config.Address,
+		flushInterval: interval,
+		storage:       storage,
+		auditor:       auditor,
+		logger:        logger,
+		counters:      make(map[string]float64),
+		remainders:    make(map[string]float64),
+		gauges:        make(map[string]*gaugeState),
+		sources:       make(map[string]map[string]struct{}),
+	}
+}
+
+// Run listens for StatsD packets until ctx is cancelled, then performs a final flush.
+func (l *Listener) Run(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", l.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", l.addr, err)
+	}
+	l.logger.Infof("StatsD listener on %s", conn.LocalAddr())
+	return l.serve(ctx, conn)
+}
+
+// serve reads packets from the connection and flushes aggregated values at the flush interval.
+func (l *Listener) serve(ctx context.Context, conn net.PacketConn) error {
+	// Close the connection on shutdown to unblock the reader.
+	go func() {
+		<-ctx.Done()
+		if err := conn.Close(); err != nil {
+			l.logger.Debugf("close StatsD connection: %v", err)
+		}
+	}()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		l.readLoop(conn)
+	}()
+
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Flush(ctx); err != nil {
+				l.logger.Errorf("StatsD flush failed: %v", err)
+			}
+		case <-ctx.Done():
+			<-readDone
+			// Use a fresh context, the parent one is already cancelled.
+			if err := l.Flush(context.Background()); err != nil {
+				return fmt.Errorf("final StatsD flush failed: %w", err)
+			}
+			l.logger.Debug("StatsD listener stopped")
+			return nil
+		}
+	}
+}
+
+// readLoop reads packets from the connection until it is closed.
+func (l *Listener) readLoop(conn net.PacketConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.logger.Debugf("read StatsD packet: %v", err)
+			continue
+		}
+		samples, err := ParsePacket(buf[:n])
+		if err != nil {
+			l.logger.Debugf("StatsD packet from %s: %v", addr, err)
+		}
+		l.add(addrHost(addr), samples)
+	}
+}
+
+// add aggregates the samples into the pending counters and gauges.
+func (l *Listener) add(source string, samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	names, ok := l.sources[source]
+	if !ok {
+		names = make(map[string]struct{})
+		l.sources[source] = names
+	}
+	for _, s := range samples {
+		switch s.Type {
+		case typeCounter:
+			l.counters[s.Name] += s.Value / s.Rate
+		case typeGauge:
+			g, ok := l.gauges[s.Name]
+			switch {
+			case !s.Relative:
+				l.gauges[s.Name] = &gaugeState{value: s.Value}
+			case ok:
+				g.value += s.Value
+			default:
+				l.gauges[s.Name] = &gaugeState{value: s.Value, relative: true}
+			}
+		}
+		names[s.Name] = struct{}{}
+	}
+}
+
+// Flush saves the aggregated values to the repository and resets the aggregation state.
+// The counters are saved as whole increments, the fractions of the sampled counters are carried into the next flush.
+// When the save fails the values are merged back into the state and saved by the next flush.
+func (l *Listener) Flush(ctx context.Context) error {
+	l.mu.Lock()
+	counters, remainders, gauges, sources := l.counters, l.remainders, l.gauges, l.sources
+	l.counters = make(map[string]float64)
+	l.remainders = make(map[string]float64)
+	l.gauges = make(map[string]*gaugeState)
+	l.sources = make(map[string]map[string]struct{})
+	l.mu.Unlock()
+
+	batch := make([]models.Metrics, 0, len(counters)+len(gauges))
+	// The remainders of the counters without samples wait for the next ones.
+	carry := maps.Clone(remainders)
+	for name, v := range counters {
+		whole, frac := math.Modf(v + remainders[name])
+		delete(carry, name)
+		if frac != 0 {
+			carry[name] = frac
+		}
+		delta, ok := counterDelta(whole)
+		if !ok {
+			l.logger.Warnf("StatsD counter %s increment %g is out of the int64 range, saved as %d", name, whole, delta)
+		}
+		batch = append(batch, models.Metrics{ID: name, MType: models.Counter, Delta: &delta})
+	}
+	for name, g := range gauges {
+		value := g.value
+		if g.relative {
+			// Relative gauges are applied on top of the stored value, a missing gauge starts from 0.
+			cur, err := l.storage.GetGauge(ctx, name)
+			switch {
+			case err == nil:
+				value += *cur
+			case !errors.Is(err, models.ErrNotFound):
+				l.restore(counters, remainders, gauges, sources)
+				return fmt.Errorf("failed to read StatsD gauge %s: %w", name, err)
+			}
+		}
+		batch = append(batch, models.Metrics{ID: name, MType: models.Gauge, Value: &value})
+	}
+	if len(batch) == 0 {
+		l.restore(nil, remainders, nil, nil)
+		return nil
+	}
+
+	changes, err := l.storage.UpdateBatch(ctx, batch)
+	if err != nil {
+		l.restore(counters, remainders, gauges, sources)
+		return fmt.Errorf("failed to save StatsD batch: %w", err)
+	}
+	l.restore(nil, carry, nil, nil)
+	l.logger.Debugf("StatsD flushed %d metrics", len(batch))
+
+	// Send the changes of the metrics to the auditor per source address.
+	byName := make(map[string][]models.MetricChange, len(changes))
+	for _, c := range changes {
+		byName[c.ID] = append(byName[c.ID], c)
+	}
+	for source, names := range sources {
+		list := make([]string, 0, len(names))
+		for name := range names {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		var sourceChanges []models.MetricChange
+		for _, name := range list {
+			sourceChanges = append(sourceChanges, byName[name]...)
+		}
+		l.auditor.Record(audit.AuditMsg{Addr: source, Metrics: list, Changes: sourceChanges})
+	}
+	return nil
+}
+
+// restore merges the values of a failed flush back into the aggregation state, before the values received since.
+// It also keeps the counter remainders for the next flush.
+func (l *Listener) restore(counters, remainders map[string]float64, gauges map[string]*gaugeState, sources map[string]map[string]struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for name, v := range counters {
+		l.counters[name] += v
+	}
+	for name, v := range remainders {
+		l.remainders[name] += v
+	}
+	for name, g := range gauges {
+		cur, ok := l.gauges[name]
+		switch {
+		case !ok:
+			l.gauges[name] = g
+		case cur.relative:
+			// The deltas received since apply on top of the restored value.
+			l.gauges[name] = &gaugeState{value: g.value + cur.value, relative: g.relative}
+		}
+		// An absolute value received since replaces the restored one.
+	}
+	for source, names := range sources {
+		cur, ok := l.sources[source]
+		if !ok {
+			l.sources[source] = names
+			continue
+		}
+		for name := range names {
+			cur[name] = struct{}{}
+		}
+	}
+}
+
+// counterDelta converts the whole counter increment to an int64, clamping it to the int64 range.
+// It reports false if the increment was clamped.
+func counterDelta(whole float64) (int64, bool) {
+	switch {
+	case whole >= maxCounter:
+		return math.MaxInt64, false
+	case whole < -maxCounter:
+		return math.MinInt64, false
+	}
+	return int64(whole), true
+}
+
+// ParsePacket parses a StatsD packet that may contain several newline separated metrics.
+// Valid lines are returned even if some of the lines fail to parse.
+func ParsePacket(packet []byte) ([]Sample, error) {
+	var (
+		samples []Sample
+		errs    error
+	)
+	for _, line := range bytes.Split(packet, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		s, err := ParseLine(string(line))
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, errs
+}
+
+// ParseLine parses a single StatsD line in the "name:value|type[|@rate]" format.
+func ParseLine(line string) (Sample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Sample{}, fmt.Errorf("invalid line %q: missing name", line)
+	}
+	if err := selfmetrics.CheckName(name); err != nil {
+		return Sample{}, fmt.Errorf("invalid line %q: %w", line, err)
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return Sample{}, fmt.Errorf("invalid line %q: missing type", line)
+	}
+
+	s := Sample{Name: name, Type: parts[1], Rate: 1}
+	if s.Type != typeCounter && s.Type != typeGauge {
+		return Sample{}, fmt.Errorf("invalid line %q: unsupported type %q", line, s.Type)
+	}
+
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Sample{}, fmt.Errorf("invalid line %q: %w", line, err)
+	}
+	// NaN and Inf cannot be stored: a counter cannot be rounded to an integer and a gauge cannot be encoded to JSON.
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Sample{}, fmt.Errorf("invalid line %q: value is not finite", line)
+	}
+	s.Value = value
+	s.Relative = s.Type == typeGauge && (strings.HasPrefix(parts[0], "+") || strings.HasPrefix(parts[0], "-"))
+
+	// Parse the optional sample rate, other extensions (e.g. tags) are ignored.
+	for _, ext := range parts[2:] {
+		if !strings.HasPrefix(ext, "@") {
+			continue
+		}
+		rate, err := strconv.ParseFloat(ext[1:], 64)
+		if err != nil || !(rate > 0 && rate <= 1) {
+			return Sample{}, fmt.Errorf("invalid line %q: bad sample rate %q", line, ext)
+		}
+		s.Rate = rate
+	}
+	// A counter increment must fit the int64 counters of the repository once scaled by the sample rate.
+	if s.Type == typeCounter && math.Abs(s.Value/s.Rate) >= maxCounter {
+		return Sample{}, fmt.Errorf("invalid line %q: counter value is out of the int64 range", line)
+	}
+	return s, nil
+}
+
+// addrHost returns the host part of the packet source address.
+func addrHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,371 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/devize-ed/yapracproj-metrics.git/internal/audit"
+	models "github.com/devize-ed/yapracproj-metrics.git/internal/model"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository"
+	"github.com/devize-ed/yapracproj-metrics.git/internal/repository/mstorage"
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/statsd/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestListener(ms *mstorage.MemStorage) *Listener {
+	logger := zap.NewNop().Sugar()
+	auditor := audit.NewAuditor(logger, "", "")
+	return NewListener(cfg.StatsDConfig{FlushInterval: 1}, ms, auditor, logger)
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Sample
+		wantErr bool
+	}{
+		{
+			name: "counter",
+			line: "requests:1|c",
+			want: Sample{Name: "requests", Type: "c", Value: 1, Rate: 1},
+		},
+		{
+			name: "counter_with_sample_rate",
+			line: "requests:2|c|@0.5",
+			want: Sample{Name: "requests", Type: "c", Value: 2, Rate: 0.5},
+		},
+		{
+			name: "gauge",
+			line: "temperature:3.2|g",
+			want: Sample{Name: "temperature", Type: "g", Value: 3.2, Rate: 1},
+		},
+		{
+			name: "relative_gauge",
+			line: "temperature:-1.5|g",
+			want: Sample{Name: "temperature", Type: "g", Value: -1.5, Rate: 1, Relative: true},
+		},
+		{
+			name: "tags_are_ignored",
+			line: "requests:1|c|#env:prod",
+			want: Sample{Name: "requests", Type: "c", Value: 1, Rate: 1},
+		},
+		{
+			name:    "missing_name",
+			line:    ":1|c",
+			wantErr: true,
+		},
+		{
+			name:    "missing_type",
+			line:    "requests:1",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported_type",
+			line:    "latency:320|ms",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_value",
+			line:    "requests:abc|c",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_sample_rate",
+			line:    "requests:1|c|@2",
+			wantErr: true,
+		},
+		{
+			name:    "nan_sample_rate",
+			line:    "requests:1|c|@NaN",
+			wantErr: true,
+		},
+		{
+			name:    "counter_out_of_range",
+			line:    "bytes:1e19|c",
+			wantErr: true,
+		},
+		{
+			name:    "scaled_counter_out_of_range",
+			line:    "bytes:1e17|c|@0.01",
+			wantErr: true,
+		},
+		{
+			name:    "reserved_name",
+			line:    "_server.audit.dropped:1|c",
+			wantErr: true,
+		},
+		{
+			name:    "nan_value",
+			line:    "temperature:NaN|g",
+			wantErr: true,
+		},
+		{
+			name:    "infinite_value",
+			line:    "requests:+Inf|c",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	samples, err := ParsePacket([]byte("a:1|c\nb:2|g\n\nbroken\nc:3|c|@0.1\n"))
+	assert.Error(t, err, "invalid line should be reported")
+	require.Len(t, samples, 3)
+	assert.Equal(t, "a", samples[0].Name)
+	assert.Equal(t, "b", samples[1].Name)
+	assert.Equal(t, "c", samples[2].Name)
+}
+
+func TestListener_Flush(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	stored := 10.0
+	require.NoError(t, ms.SetGauge(ctx, "relative", &stored))
+
+	l := newTestListener(ms)
+	samples, err := ParsePacket([]byte("hits:1|c\nhits:1|c|@0.5\ntemp:1|g\ntemp:2.5|g\nrelative:+2|g\nrelative:-0.5|g\nfresh:+3|g"))
+	require.NoError(t, err)
+	l.add("127.0.0.1", samples)
+	require.NoError(t, l.Flush(ctx))
+
+	hits, err := ms.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *hits, "sampled counter should be scaled by the rate")
+
+	temp, err := ms.GetGauge(ctx, "temp")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, *temp, "last gauge value wins")
+
+	relative, err := ms.GetGauge(ctx, "relative")
+	require.NoError(t, err)
+	assert.Equal(t, 11.5, *relative, "relative gauge should be applied to the stored value")
+
+	fresh, err := ms.GetGauge(ctx, "fresh")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *fresh, "relative gauge without stored value starts from zero")
+
+	// The second flush has nothing to save, counters are not added twice.
+	require.NoError(t, l.Flush(ctx))
+	hits, err = ms.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *hits)
+}
+
+func TestListener_FlushAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := zap.NewNop().Sugar()
+	auditor := audit.NewAuditor(logger, "", "")
+	go auditor.Run(ctx)
+	updates, unsubscribe, err := auditor.Subscribe(ctx, 4)
+	require.NoError(t, err)
+	defer unsubscribe()
+
+	l := NewListener(cfg.StatsDConfig{FlushInterval: 1}, mstorage.NewMemStorage(), auditor, logger)
+	samples, err := ParsePacket([]byte("hits:2|c\ntemp:1.5|g"))
+	require.NoError(t, err)
+	l.add("127.0.0.1", samples)
+	require.NoError(t, l.Flush(ctx))
+
+	// The record carries the new values of the metrics, for the subscribers of the stream.
+	select {
+	case msg := <-updates:
+		assert.Equal(t, "127.0.0.1", msg.Addr)
+		assert.Equal(t, []string{"hits", "temp"}, msg.Metrics)
+		require.Len(t, msg.Changes, 2)
+		assert.Equal(t, models.Counter, msg.Changes[0].MType)
+		require.NotNil(t, msg.Changes[0].NewDelta)
+		assert.Equal(t, int64(2), *msg.Changes[0].NewDelta)
+		assert.Equal(t, models.Gauge, msg.Changes[1].MType)
+		require.NotNil(t, msg.Changes[1].NewValue)
+		assert.Equal(t, 1.5, *msg.Changes[1].NewValue)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit record")
+	}
+}
+
+// failingStorage fails the batch updates while fail is set and the gauge reads while failReads is set.
+type failingStorage struct {
+	repository.Repository
+	fail      bool
+	failReads bool
+}
+
+func (s *failingStorage) GetGauge(ctx context.Context, name string) (*float64, error) {
+	if s.failReads {
+		return nil, errors.New("database is down")
+	}
+	return s.Repository.GetGauge(ctx, name)
+}
+
+func (s *failingStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) ([]models.MetricChange, error) {
+	if s.fail {
+		return nil, errors.New("database is down")
+	}
+	return s.Repository.UpdateBatch(ctx, batch)
+}
+
+func TestListener_FlushFailed(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	storage := &failingStorage{Repository: ms, fail: true}
+	logger := zap.NewNop().Sugar()
+	l := NewListener(cfg.StatsDConfig{FlushInterval: 1}, storage, audit.NewAuditor(logger, "", ""), logger)
+
+	samples, err := ParsePacket([]byte("hits:2|c\ntemp:1|g\nlevel:+2|g\nreplaced:+1|g"))
+	require.NoError(t, err)
+	l.add("127.0.0.1", samples)
+	assert.Error(t, l.Flush(ctx))
+
+	// The values of the failed flush are kept and merged with the ones received since.
+	samples, err = ParsePacket([]byte("hits:3|c\nlevel:+1|g\nreplaced:5|g"))
+	require.NoError(t, err)
+	l.add("127.0.0.2", samples)
+	storage.fail = false
+	require.NoError(t, l.Flush(ctx))
+
+	hits, err := ms.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *hits)
+	for name, want := range map[string]float64{"temp": 1, "level": 3, "replaced": 5} {
+		value, err := ms.GetGauge(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, want, *value, name)
+	}
+}
+
+func TestListener_FlushRemainder(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	l := newTestListener(ms)
+	add := func(packet string) {
+		samples, err := ParsePacket([]byte(packet))
+		require.NoError(t, err)
+		l.add("127.0.0.1", samples)
+	}
+
+	// 1 sampled at 0.4 counts 2.5: 2 is saved and the half waits for the next samples.
+	add("hits:1|c|@0.4")
+	require.NoError(t, l.Flush(ctx))
+	hits, err := ms.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *hits)
+
+	// A flush without samples does not save the remainder alone.
+	require.NoError(t, l.Flush(ctx))
+	add("hits:1|c|@0.4")
+	require.NoError(t, l.Flush(ctx))
+	hits, err = ms.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *hits, "the remainders add up to whole increments")
+}
+
+func TestListener_FlushClamp(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	l := newTestListener(ms)
+
+	// Each sample fits the int64 range, their sum does not.
+	samples, err := ParsePacket([]byte("bytes:9e18|c\nbytes:9e18|c"))
+	require.NoError(t, err)
+	l.add("127.0.0.1", samples)
+	require.NoError(t, l.Flush(ctx))
+	total, err := ms.GetCounter(ctx, "bytes")
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), *total)
+}
+
+func TestListener_FlushGaugeReadFailed(t *testing.T) {
+	ctx := context.Background()
+	ms := mstorage.NewMemStorage()
+	stored := 10.0
+	require.NoError(t, ms.SetGauge(ctx, "level", &stored))
+	storage := &failingStorage{Repository: ms, failReads: true}
+	logger := zap.NewNop().Sugar()
+	l := NewListener(cfg.StatsDConfig{FlushInterval: 1}, storage, audit.NewAuditor(logger, "", ""), logger)
+
+	samples, err := ParsePacket([]byte("hits:2|c\nlevel:+2|g"))
+	require.NoError(t, err)
+	l.add("127.0.0.1", samples)
+
+	// A read error is not taken for a missing gauge, which would reset it to the delta.
+	assert.Error(t, l.Flush(ctx))
+	level, err := ms.GetGauge(ctx, "level")
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, *level)
+	_, err = ms.GetCounter(ctx, "hits")
+	assert.ErrorIs(t, err, models.ErrNotFound, "nothing is saved by the failed flush")
+
+	storage.failReads = false
+	require.NoError(t, l.Flush(ctx))
+	level, err = ms.GetGauge(ctx, "level")
+	require.NoError(t, err)
+	assert.Equal(t, 12.0, *level)
+	hits, err := ms.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *hits)
+}
+
+func TestListener_Serve(t *testing.T) {
+	ms := mstorage.NewMemStorage()
+	l := newTestListener(ms)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.serve(ctx, conn)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	_, err = client.Write([]byte("PollCount:5|c\nAlloc:42|g"))
+	require.NoError(t, err)
+
+	// Wait until the packet is read by the listener.
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.counters) == 1 && len(l.gauges) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The final flush on shutdown saves the pending values.
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("listener did not stop after context cancellation")
+	}
+
+	count, err := ms.GetCounter(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *count)
+	alloc, err := ms.GetGauge(context.Background(), "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 42.0, *alloc)
+}
@@ -0,0 +1,15 @@
+// Package config provides configuration structures for the tracing of the server and the agent.
+package config
+
+// Span exporters.
+const (
+	ExporterNone   = "none"   // Spans are not recorded, the trace context is still propagated.
+	ExporterStdout = "stdout" // Spans are written to the standard output as indented JSON.
+	ExporterFile   = "file"   // Spans are appended to a file, one JSON object per line.
+)
+
+// TraceConfig holds the span exporter settings. Tracing is disabled without an exporter.
+type TraceConfig struct {
+	Exporter string `env:"TRACE_EXPORTER" json:"exporter"` // Span exporter: none, stdout or file.
+	File     string `env:"TRACE_FILE" json:"file"`         // File the spans are appended to, required by the file exporter.
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cfg "github.com/devize-ed/yapracproj-metrics.git/internal/tracing/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSetup_File(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(cfg.TraceConfig{Exporter: cfg.ExporterFile, File: path}, "metrics-test")
+	require.NoError(t, err)
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("commit failed"))
+	End(parent, nil)
+	require.NoError(t, shutdown(context.Background()))
+
+	// The spans are written one per line, the child in the trace of its parent.
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	type span struct {
+		Name        string
+		SpanContext struct{ TraceID, SpanID string }
+		Parent      struct{ SpanID string }
+		Status      struct{ Code string }
+		Resource    []struct {
+			Key   string
+			Value struct{ Value any }
+		}
+	}
+	spans := map[string]span{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s span
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		spans[s.Name] = s
+	}
+	require.Len(t, spans, 2)
+	assert.Equal(t, spans["parent"].SpanContext.TraceID, spans["child"].SpanContext.TraceID)
+	assert.Equal(t, spans["parent"].SpanContext.SpanID, spans["child"].Parent.SpanID)
+	assert.Equal(t, "Error", spans["child"].Status.Code)
+	var service any
+	for _, kv := range spans["parent"].Resource {
+		if kv.Key == "service.name" {
+			service = kv.Value.Value
+		}
+	}
+	assert.Equal(t, "metrics-test", service)
+}
+
+func TestSetup_Errors(t *testing.T) {
+	shutdown, err := Setup(cfg.TraceConfig{}, "metrics-test")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(cfg.TraceConfig{Exporter: "otlp"}, "metrics-test")
+	assert.ErrorIs(t, err, ErrUnknownExporter)
+	_, err = Setup(cfg.TraceConfig{Exporter: cfg.ExporterFile, File: filepath.Join(t.TempDir(), "missing", "spans.json")}, "metrics-test")
+	assert.Error(t, err)
+}